@@ -0,0 +1,442 @@
+// Package adf renders Markdown to the Atlassian Document Format, the JSON
+// page body of the Confluence Cloud v2 API.
+//
+// It parses with the storage package, so the same shorthands (alerts, task
+// lists, status lozenges, mentions and so on) become their ADF nodes:
+//
+//	doc := adf.Convert(source, storage.Mentions(resolve))
+//	body, err := json.Marshal(doc)
+package adf
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wmorley/scribe-cli/storage"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+// Node is one ADF node. Only the doc node has a version and only text
+// nodes have text; paragraphs and headings may carry an alignment mark.
+type Node struct {
+	Type    string                 `json:"type"`
+	Version int                    `json:"version,omitempty"`
+	Attrs   map[string]interface{} `json:"attrs,omitempty"`
+	Content []*Node                `json:"content,omitempty"`
+	Text    string                 `json:"text,omitempty"`
+	Marks   []*Mark                `json:"marks,omitempty"`
+}
+
+// Mark is a text formatting mark: strong, em, strike, code, link and so on
+type Mark struct {
+	Type  string                 `json:"type"`
+	Attrs map[string]interface{} `json:"attrs,omitempty"`
+}
+
+// Language is the code fence language of a block kept as ADF. Nodes that
+// Markdown cannot express are pulled into such a fence, holding the node's
+// JSON, and pushed back unchanged.
+const Language = "adf"
+
+// PanelTypes maps the storage admonition macros to ADF panel types
+var PanelTypes = map[string]string{
+	"info":    "info",
+	"tip":     "success",
+	"note":    "note",
+	"warning": "warning",
+	"panel":   "info",
+}
+
+// StatusColours maps the storage status colours to ADF lozenge colours
+var StatusColours = map[string]string{
+	"Grey": "neutral", "Red": "red", "Yellow": "yellow", "Green": "green", "Blue": "blue", "Purple": "purple",
+}
+
+// Convert parses Markdown source and returns it as an ADF document. Extra
+// extenders are applied to the parser as they are by storage.New; only
+// their parsing takes effect.
+func Convert(source []byte, extenders ...goldmark.Extender) *Node {
+	doc := storage.New(extenders...).Parser().Parse(text.NewReader(source))
+	c := &converter{source: source}
+	return &Node{Type: "doc", Version: 1, Content: c.blocks(doc)}
+}
+
+type converter struct {
+	source []byte
+	ids    int
+}
+
+// localID numbers the nodes ADF wants a localId on
+func (c *converter) localID() string {
+	c.ids++
+	return strconv.Itoa(c.ids)
+}
+
+func (c *converter) blocks(parent ast.Node) []*Node {
+	var nodes []*Node
+	for n := parent.FirstChild(); n != nil; n = n.NextSibling() {
+		nodes = append(nodes, c.block(n)...)
+	}
+	return nodes
+}
+
+func (c *converter) block(n ast.Node) []*Node {
+	switch n := n.(type) {
+	case *ast.Paragraph:
+		if media := c.mediaSingle(n); media != nil {
+			return []*Node{media}
+		}
+		return []*Node{{Type: "paragraph", Content: c.inlines(n, nil)}}
+	case *ast.TextBlock:
+		return []*Node{{Type: "paragraph", Content: c.inlines(n, nil)}}
+	case *ast.Heading:
+		return []*Node{{Type: "heading", Attrs: map[string]interface{}{"level": n.Level}, Content: c.inlines(n, nil)}}
+	case *ast.ThematicBreak:
+		return []*Node{{Type: "rule"}}
+	case *ast.FencedCodeBlock:
+		language := string(n.Language(c.source))
+		if language == Language {
+			var node Node
+			if err := json.Unmarshal([]byte(c.lines(n)), &node); err == nil && node.Type != "" {
+				return []*Node{&node}
+			}
+		}
+		// ADF code blocks take no parameters beyond the language
+		var info string
+		if n.Info != nil {
+			info = string(n.Info.Segment.Value(c.source))
+		}
+		language, _ = storage.ParseCodeInfo(info)
+		return []*Node{codeBlock(language, c.lines(n))}
+	case *ast.CodeBlock:
+		return []*Node{codeBlock("", c.lines(n))}
+	case *ast.Blockquote:
+		return []*Node{{Type: "blockquote", Content: c.blocks(n)}}
+	case *ast.List:
+		list := &Node{Type: "bulletList"}
+		if n.IsOrdered() {
+			list.Type = "orderedList"
+			if n.Start != 1 {
+				list.Attrs = map[string]interface{}{"order": n.Start}
+			}
+		}
+		for item := n.FirstChild(); item != nil; item = item.NextSibling() {
+			content := c.blocks(item)
+			if len(content) == 0 {
+				content = []*Node{{Type: "paragraph"}}
+			}
+			list.Content = append(list.Content, &Node{Type: "listItem", Content: content})
+		}
+		return []*Node{list}
+	case *storage.TaskList:
+		return []*Node{c.taskList(n)}
+	case *storage.Admonition:
+		panel := &Node{Type: "panel", Attrs: map[string]interface{}{"panelType": PanelTypes[n.Macro]}}
+		// Panels have no title, so it leads the body in bold
+		if n.Title != "" {
+			panel.Content = append(panel.Content, &Node{Type: "paragraph", Content: []*Node{
+				{Type: "text", Text: n.Title, Marks: []*Mark{{Type: "strong"}}},
+			}})
+		}
+		panel.Content = append(panel.Content, c.blocks(n)...)
+		return []*Node{panel}
+	case *storage.Expand:
+		return []*Node{{Type: "expand", Attrs: map[string]interface{}{"title": n.Title}, Content: c.blocks(n)}}
+	case *storage.TOC:
+		return []*Node{TOC(n.Params)}
+	case *east.Table:
+		return []*Node{c.table(n)}
+	case *storage.MathBlock:
+		return []*Node{codeBlock(storage.MathLanguage, n.Source)}
+	case *east.FootnoteList:
+		// ADF has no anchors: the footnotes are a numbered list after a rule
+		list := &Node{Type: "orderedList"}
+		for note := n.FirstChild(); note != nil; note = note.NextSibling() {
+			list.Content = append(list.Content, &Node{Type: "listItem", Content: c.blocks(note)})
+		}
+		return []*Node{{Type: "rule"}, list}
+	case *ast.HTMLBlock:
+		// ADF has no raw HTML; keep the markup readable as text
+		raw := strings.TrimSpace(c.lines(n))
+		if raw == "" {
+			return nil
+		}
+		return []*Node{{Type: "paragraph", Content: []*Node{{Type: "text", Text: raw}}}}
+	default:
+		return c.blocks(n)
+	}
+}
+
+// FootnoteHref is where a footnote reference links to
+func FootnoteHref(n int) string {
+	return "#" + storage.FootnoteAnchor(n)
+}
+
+// TOC returns the toc macro as an ADF extension node
+func TOC(params []storage.MacroParam) *Node {
+	macroParams := map[string]interface{}{}
+	for _, param := range params {
+		macroParams[param.Name] = map[string]interface{}{"value": param.Value}
+	}
+	return &Node{Type: "extension", Attrs: map[string]interface{}{
+		"extensionType": "com.atlassian.confluence.macro.core",
+		"extensionKey":  "toc",
+		"parameters":    map[string]interface{}{"macroParams": macroParams},
+		"layout":        "default",
+	}}
+}
+
+func codeBlock(language, code string) *Node {
+	node := &Node{Type: "codeBlock"}
+	if language != "" {
+		node.Attrs = map[string]interface{}{"language": language}
+	}
+	if code != "" {
+		node.Content = []*Node{{Type: "text", Text: code}}
+	}
+	return node
+}
+
+// mediaSingle returns a paragraph holding nothing but a remote image as an
+// external media node. Local images have no URL to point at and stay links.
+func (c *converter) mediaSingle(p *ast.Paragraph) *Node {
+	img, ok := p.FirstChild().(*ast.Image)
+	if !ok || p.ChildCount() != 1 {
+		return nil
+	}
+	url := string(img.Destination)
+	if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		return nil
+	}
+	attrs := map[string]interface{}{"type": "external", "url": url}
+	if alt := c.plainText(img); alt != "" {
+		attrs["alt"] = alt
+	}
+	return &Node{Type: "mediaSingle", Attrs: map[string]interface{}{"layout": "center"}, Content: []*Node{
+		{Type: "media", Attrs: attrs},
+	}}
+}
+
+// taskList turns a TaskList into taskItems. A nested task list follows the
+// item it belongs to, which is how ADF nests them.
+func (c *converter) taskList(list ast.Node) *Node {
+	node := &Node{Type: "taskList", Attrs: map[string]interface{}{"localId": c.localID()}}
+	for t := list.FirstChild(); t != nil; t = t.NextSibling() {
+		task, ok := t.(*storage.Task)
+		if !ok {
+			continue
+		}
+		state := "TODO"
+		if task.Done {
+			state = "DONE"
+		}
+		item := &Node{Type: "taskItem", Attrs: map[string]interface{}{"localId": c.localID(), "state": state}}
+		node.Content = append(node.Content, item)
+		for b := task.FirstChild(); b != nil; b = b.NextSibling() {
+			switch b := b.(type) {
+			case *storage.TaskList:
+				node.Content = append(node.Content, c.taskList(b))
+			case *ast.TextBlock, *ast.Paragraph:
+				// Task bodies are inline, so later paragraphs join with line breaks
+				if len(item.Content) > 0 {
+					item.Content = append(item.Content, &Node{Type: "hardBreak"})
+				}
+				item.Content = append(item.Content, c.inlines(b, nil)...)
+			}
+		}
+	}
+	return node
+}
+
+func (c *converter) table(table *east.Table) *Node {
+	node := &Node{Type: "table", Attrs: map[string]interface{}{"isNumberColumnEnabled": false, "layout": "default"}}
+	for row := table.FirstChild(); row != nil; row = row.NextSibling() {
+		cellType := "tableCell"
+		if _, ok := row.(*east.TableHeader); ok {
+			cellType = "tableHeader"
+		}
+		r := &Node{Type: "tableRow"}
+		for cell := row.FirstChild(); cell != nil; cell = cell.NextSibling() {
+			para := &Node{Type: "paragraph", Content: c.inlines(cell, nil)}
+			switch cell.(*east.TableCell).Alignment {
+			case east.AlignCenter:
+				para.Marks = []*Mark{{Type: "alignment", Attrs: map[string]interface{}{"align": "center"}}}
+			case east.AlignRight:
+				para.Marks = []*Mark{{Type: "alignment", Attrs: map[string]interface{}{"align": "end"}}}
+			}
+			r.Content = append(r.Content, &Node{Type: cellType, Content: []*Node{para}})
+		}
+		node.Content = append(node.Content, r)
+	}
+	return node
+}
+
+func (c *converter) inlines(parent ast.Node, marks []*Mark) []*Node {
+	var nodes []*Node
+	for n := parent.FirstChild(); n != nil; n = n.NextSibling() {
+		switch n := n.(type) {
+		case *ast.Text:
+			value := string(n.Segment.Value(c.source))
+			if n.SoftLineBreak() {
+				value += " "
+			}
+			nodes = appendText(nodes, value, marks)
+			if n.HardLineBreak() {
+				nodes = append(nodes, &Node{Type: "hardBreak"})
+			}
+		case *ast.String:
+			nodes = appendText(nodes, string(n.Value), marks)
+		case *ast.CodeSpan:
+			// Code only combines with links
+			var code []*Mark
+			for _, m := range marks {
+				if m.Type == "link" {
+					code = append(code, m)
+				}
+			}
+			nodes = appendText(nodes, c.plainText(n), append(code, &Mark{Type: "code"}))
+		case *ast.Emphasis:
+			mark := &Mark{Type: "em"}
+			if n.Level == 2 {
+				mark.Type = "strong"
+			}
+			nodes = append(nodes, c.inlines(n, withMark(marks, mark))...)
+		case *east.Strikethrough:
+			nodes = append(nodes, c.inlines(n, withMark(marks, &Mark{Type: "strike"}))...)
+		case *ast.Link:
+			nodes = append(nodes, c.inlines(n, withMark(marks, link(string(n.Destination), string(n.Title))))...)
+		case *ast.AutoLink:
+			url := string(n.URL(c.source))
+			if n.AutoLinkType == ast.AutoLinkEmail && !strings.HasPrefix(url, "mailto:") {
+				url = "mailto:" + url
+			}
+			nodes = appendText(nodes, string(n.Label(c.source)), withMark(marks, link(url, "")))
+		case *ast.Image:
+			// Inline media is not a thing in ADF; link to the image instead
+			nodes = appendText(nodes, c.plainText(n), withMark(marks, link(string(n.Destination), string(n.Title))))
+		case *ast.RawHTML:
+			var raw strings.Builder
+			for i := 0; i < n.Segments.Len(); i++ {
+				segment := n.Segments.At(i)
+				raw.Write(segment.Value(c.source))
+			}
+			nodes = appendText(nodes, raw.String(), marks)
+		case *east.TaskCheckBox:
+			box := "[ ] "
+			if n.IsChecked {
+				box = "[x] "
+			}
+			nodes = appendText(nodes, box, marks)
+		case *storage.Mention:
+			nodes = append(nodes, mention(n.User))
+		case *storage.TaskAssignee:
+			nodes = appendText(nodes, "@"+n.User, marks)
+		case *storage.Status:
+			attrs := map[string]interface{}{"text": n.Title, "color": StatusColours[n.Colour], "localId": c.localID()}
+			if n.Subtle {
+				attrs["style"] = "subtle"
+			}
+			nodes = append(nodes, &Node{Type: "status", Attrs: attrs})
+		case *storage.Date:
+			nodes = append(nodes, date(n.Date))
+		case *storage.TaskDue:
+			nodes = append(nodes, date(n.Date))
+		case *storage.Math:
+			// Formulas stay LaTeX, in code so they are not reformatted
+			nodes = appendText(nodes, storage.MathFormula(n.Source, false), []*Mark{{Type: "code"}})
+		case *east.FootnoteLink:
+			index := strconv.Itoa(n.Index)
+			nodes = appendText(nodes, index, []*Mark{
+				link(FootnoteHref(n.Index), ""),
+				{Type: "subsup", Attrs: map[string]interface{}{"type": "sup"}},
+			})
+		case *east.FootnoteBacklink:
+			// No anchors to link back to
+		default:
+			nodes = append(nodes, c.inlines(n, marks)...)
+		}
+	}
+	return nodes
+}
+
+// mention returns a mention node. ADF only knows Cloud account IDs, so a
+// Data Center user stays text.
+func mention(user storage.UserRef) *Node {
+	if user.AccountID == "" {
+		return &Node{Type: "text", Text: "@" + user.Username + user.UserKey}
+	}
+	return &Node{Type: "mention", Attrs: map[string]interface{}{"id": user.AccountID}}
+}
+
+// date returns a date node, which holds midnight UTC in milliseconds
+func date(day string) *Node {
+	t, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		return &Node{Type: "text", Text: day}
+	}
+	return &Node{Type: "date", Attrs: map[string]interface{}{"timestamp": strconv.FormatInt(t.UnixMilli(), 10)}}
+}
+
+func link(href, title string) *Mark {
+	attrs := map[string]interface{}{"href": href}
+	if title != "" {
+		attrs["title"] = title
+	}
+	return &Mark{Type: "link", Attrs: attrs}
+}
+
+func withMark(marks []*Mark, mark *Mark) []*Mark {
+	return append(append([]*Mark{}, marks...), mark)
+}
+
+// appendText adds a text node, merging it into the previous one when the
+// marks match (the parser splits text at every delimiter it considers)
+func appendText(nodes []*Node, value string, marks []*Mark) []*Node {
+	if value == "" {
+		return nodes
+	}
+	if len(nodes) > 0 {
+		last := nodes[len(nodes)-1]
+		if last.Type == "text" && reflect.DeepEqual(last.Marks, marks) {
+			last.Text += value
+			return nodes
+		}
+	}
+	return append(nodes, &Node{Type: "text", Text: value, Marks: marks})
+}
+
+// lines returns the raw text of a block, without the final newline
+func (c *converter) lines(n ast.Node) string {
+	var buf bytes.Buffer
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		buf.Write(line.Value(c.source))
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// plainText collects the text under n, e.g. an image's alt text
+func (c *converter) plainText(n ast.Node) string {
+	var buf bytes.Buffer
+	_ = ast.Walk(n, func(child ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch child := child.(type) {
+		case *ast.Text:
+			buf.Write(child.Segment.Value(c.source))
+		case *ast.String:
+			buf.Write(child.Value)
+		}
+		return ast.WalkContinue, nil
+	})
+	return buf.String()
+}
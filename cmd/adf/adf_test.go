@@ -0,0 +1,58 @@
+package adf
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/wmorley/scribe-cli/storage"
+)
+
+func TestConvert(t *testing.T) {
+	for _, tt := range []struct{ markdown, adf string }{
+		{"# Title\n\nSome **bold**, `code` and [link](https://x.y).",
+			`[{"type":"heading","attrs":{"level":1},"content":[{"type":"text","text":"Title"}]},{"type":"paragraph","content":[{"type":"text","text":"Some "},{"type":"text","text":"bold","marks":[{"type":"strong"}]},{"type":"text","text":", "},{"type":"text","text":"code","marks":[{"type":"code"}]},{"type":"text","text":" and "},{"type":"text","text":"link","marks":[{"type":"link","attrs":{"href":"https://x.y"}}]},{"type":"text","text":"."}]}]`},
+		{"1. one\n2. two",
+			`[{"type":"orderedList","content":[{"type":"listItem","content":[{"type":"paragraph","content":[{"type":"text","text":"one"}]}]},{"type":"listItem","content":[{"type":"paragraph","content":[{"type":"text","text":"two"}]}]}]}]`},
+		{"> [!TIP]\n> Tip.",
+			`[{"type":"panel","attrs":{"panelType":"success"},"content":[{"type":"paragraph","content":[{"type":"text","text":"Tip."}]}]}]`},
+		{"- [x] Done\n- [ ] Open",
+			`[{"type":"taskList","attrs":{"localId":"1"},"content":[{"type":"taskItem","attrs":{"localId":"2","state":"DONE"},"content":[{"type":"text","text":"Done"}]},{"type":"taskItem","attrs":{"localId":"3","state":"TODO"},"content":[{"type":"text","text":"Open"}]}]}]`},
+		{"{status:green|OK} {date:2024-05-01}",
+			`[{"type":"paragraph","content":[{"type":"status","attrs":{"color":"green","localId":"1","text":"OK"}},{"type":"text","text":" "},{"type":"date","attrs":{"timestamp":"1714521600000"}}]}]`},
+		{"[[toc maxLevel=2]]",
+			`[{"type":"extension","attrs":{"extensionKey":"toc","extensionType":"com.atlassian.confluence.macro.core","layout":"default","parameters":{"macroParams":{"maxLevel":{"value":"2"}}}}}]`},
+		{"<details>\n<summary>More</summary>\n\nHidden.\n\n</details>",
+			`[{"type":"expand","attrs":{"title":"More"},"content":[{"type":"paragraph","content":[{"type":"text","text":"Hidden."}]}]}]`},
+		{"```go\nx\n```", `[{"type":"codeBlock","attrs":{"language":"go"},"content":[{"type":"text","text":"x"}]}]`},
+		// Nodes Markdown cannot express come back from their fence unchanged
+		{"```adf\n{\"type\":\"rule\"}\n```", `[{"type":"rule"}]`},
+		{"![alt](https://e.com/a.png)",
+			`[{"type":"mediaSingle","attrs":{"layout":"center"},"content":[{"type":"media","attrs":{"alt":"alt","type":"external","url":"https://e.com/a.png"}}]}]`},
+	} {
+		doc := Convert([]byte(tt.markdown))
+		if doc.Type != "doc" || doc.Version != 1 {
+			t.Errorf("%q: document is %s version %d", tt.markdown, doc.Type, doc.Version)
+		}
+		content, err := json.Marshal(doc.Content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != tt.adf {
+			t.Errorf("%q converted to\n%s\nwant\n%s", tt.markdown, content, tt.adf)
+		}
+	}
+}
+
+func TestConvertMentions(t *testing.T) {
+	doc := Convert([]byte("Hi @alice"), storage.Mentions(func(name string) *storage.UserRef {
+		return &storage.UserRef{AccountID: "557058:" + name}
+	}))
+	content, err := json.Marshal(doc.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"type":"paragraph","content":[{"type":"text","text":"Hi "},{"type":"mention","attrs":{"id":"557058:alice"}}]}]`
+	if string(content) != want {
+		t.Errorf("converted to\n%s\nwant\n%s", content, want)
+	}
+}
@@ -2,15 +2,17 @@ module github.com/wmorley/scribe-cli
 
 go 1.22
 
-require github.com/spf13/cobra v1.8.0
+require (
+	github.com/JohannesKaufmann/html-to-markdown v1.6.0
+	github.com/PuerkitoBio/goquery v1.9.2
+	github.com/spf13/cobra v1.8.0
+	github.com/yuin/goldmark v1.7.16
+	golang.org/x/net v0.25.0
+	gopkg.in/yaml.v2 v2.4.0
+)
 
 require (
-	github.com/JohannesKaufmann/html-to-markdown v1.6.0 // indirect
-	github.com/PuerkitoBio/goquery v1.9.2 // indirect
 	github.com/andybalholm/cascadia v1.3.2 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	github.com/yuin/goldmark v1.7.16 // indirect
-	golang.org/x/net v0.25.0 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
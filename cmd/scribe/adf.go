@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JohannesKaufmann/html-to-markdown/escape"
+	"github.com/wmorley/scribe-cli/adf"
+	"github.com/wmorley/scribe-cli/storage"
+)
+
+// Pull side of ADF, for pages from the v2 API. Nodes Markdown cannot
+// express are kept as an ```adf fence holding their JSON, which adf.Convert
+// pushes back unchanged.
+
+// adfPanelKinds is the reverse of adf.PanelTypes
+var adfPanelKinds = map[string]string{
+	"info":    "note",
+	"note":    "important",
+	"success": "tip",
+	"warning": "warning",
+	"error":   "warning",
+}
+
+// ConvertMarkdownFileToADF converts the contents of file to an ADF page
+// body. Mentions are resolved against users, which may be nil. Page links
+// and diagrams are storage-format features and stay plain links and code.
+// The pipeline configured for file runs around the conversion.
+func ConvertMarkdownFileToADF(markdown, file string, users *userDirectory) *ConvertedFile {
+	converted := &ConvertedFile{}
+	pipe, err := loadPipeline(filepath.Dir(file))
+	if err == nil {
+		markdown, err = pipe.run(HookBeforeParse, file, FormatMarkdown, markdown, &converted.Warnings)
+	}
+	if err != nil {
+		converted.Errors = []string{err.Error()}
+		return converted
+	}
+
+	doc := adf.Convert([]byte(stripFrontmatter(markdown)), pipe.extender(), storage.Mentions(users.Resolve), storage.Maths(storage.DefaultMathMacros, nil))
+	body, err := json.Marshal(doc)
+	if err != nil {
+		// Every node is plain data, so this cannot happen in practice
+		body = []byte(`{"type":"doc","version":1}`)
+	}
+	if users != nil {
+		converted.Warnings = append(converted.Warnings, users.Warnings...)
+	}
+	converted.Body, err = pipe.run(HookAfterRender, file, "adf", string(body), &converted.Warnings)
+	if err != nil {
+		converted.Errors = []string{err.Error()}
+	}
+	return converted
+}
+
+// ConvertADFToMarkdown converts an ADF page body, naming mentioned users
+// from users, which may be nil
+func ConvertADFToMarkdown(body string, users *userDirectory) string {
+	var doc adf.Node
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		return fencedBlock(adf.Language, body)
+	}
+	w := &adfMarkdown{users: users}
+	content, notes := doc.Content, ""
+	if n := len(content); n >= 2 && content[n-2].Type == "rule" && content[n-1].Type == "orderedList" && hasFootnoteLinks(&doc) {
+		content, notes = content[:n-2], w.footnotes(content[n-1])
+	}
+	return strings.TrimSpace(w.blocks(content) + "\n\n" + notes)
+}
+
+// hasFootnoteLinks reports whether any text under n links to a footnote
+func hasFootnoteLinks(n *adf.Node) bool {
+	for _, mark := range n.Marks {
+		if href, _ := mark.Attrs["href"].(string); mark.Type == "link" && adfFootnotePattern.MatchString(href) {
+			return true
+		}
+	}
+	for _, c := range n.Content {
+		if hasFootnoteLinks(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// footnotes writes the numbered list push makes of footnotes as `[^1]:` definitions
+func (w *adfMarkdown) footnotes(list *adf.Node) string {
+	var notes []string
+	for i, item := range list.Content {
+		notes = append(notes, footnoteDefinition(i+1, w.blocks(item.Content)))
+	}
+	return strings.Join(notes, "\n")
+}
+
+type adfMarkdown struct {
+	users *userDirectory
+}
+
+func (w *adfMarkdown) blocks(nodes []*adf.Node) string {
+	var blocks []string
+	for _, n := range nodes {
+		if block := w.block(n); block != "" {
+			blocks = append(blocks, block)
+		}
+	}
+	return strings.Join(blocks, "\n\n")
+}
+
+func (w *adfMarkdown) block(n *adf.Node) string {
+	switch n.Type {
+	case "paragraph":
+		return w.inlines(n.Content, false)
+	case "heading":
+		level := intAttr(n, "level")
+		if level < 1 || level > 6 {
+			level = 1
+		}
+		return strings.Repeat("#", level) + " " + w.inlines(n.Content, false)
+	case "rule":
+		return "---"
+	case "codeBlock":
+		language, _ := n.Attrs["language"].(string)
+		if language == storage.MathLanguage {
+			return "$$\n" + plainADFText(n.Content) + "\n$$"
+		}
+		return fencedBlock(language, plainADFText(n.Content))
+	case "blockquote":
+		return prefixLines("> ", w.blocks(n.Content))
+	case "bulletList", "orderedList":
+		return w.list(n)
+	case "taskList":
+		return w.taskList(n)
+	case "panel":
+		panelType, _ := n.Attrs["panelType"].(string)
+		kind, ok := adfPanelKinds[panelType]
+		if !ok {
+			kind = "panel"
+		}
+		return strings.Trim(admonitionToMarkdown(kind, "", w.blocks(n.Content)), "\n")
+	case "expand", "nestedExpand":
+		var b strings.Builder
+		b.WriteString("<details>\n")
+		if title, _ := n.Attrs["title"].(string); title != "" {
+			b.WriteString("<summary>" + html.EscapeString(title) + "</summary>\n")
+		}
+		if body := w.blocks(n.Content); body != "" {
+			b.WriteString("\n" + body + "\n")
+		}
+		b.WriteString("\n</details>")
+		return b.String()
+	case "table":
+		if table, ok := w.table(n); ok {
+			return table
+		}
+	case "mediaSingle":
+		if len(n.Content) == 1 && n.Content[0].Attrs["type"] == "external" {
+			media := n.Content[0]
+			url, _ := media.Attrs["url"].(string)
+			alt, _ := media.Attrs["alt"].(string)
+			return "![" + escape.MarkdownCharacters(alt) + "](" + url + ")"
+		}
+	case "extension":
+		if n.Attrs["extensionKey"] == "toc" {
+			return tocFromADF(n)
+		}
+	}
+	return preservedADF(n)
+}
+
+// preservedADF keeps n as an ```adf fence
+func preservedADF(n *adf.Node) string {
+	raw, err := json.MarshalIndent(n, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return fencedBlock(adf.Language, string(raw))
+}
+
+func (w *adfMarkdown) list(n *adf.Node) string {
+	number := 1
+	if n.Type == "orderedList" {
+		if order := intAttr(n, "order"); order > 0 {
+			number = order
+		}
+	}
+	var items []string
+	for _, item := range n.Content {
+		marker := "- "
+		if n.Type == "orderedList" {
+			marker = strconv.Itoa(number) + ". "
+			number++
+		}
+		items = append(items, listItem(marker, w.itemBlocks(item.Content)))
+	}
+	return strings.Join(items, "\n")
+}
+
+// itemBlocks writes the blocks of a list item, keeping a nested list tight
+// against the paragraph before it
+func (w *adfMarkdown) itemBlocks(nodes []*adf.Node) string {
+	var b strings.Builder
+	for i, n := range nodes {
+		block := w.block(n)
+		if block == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			if nodes[i-1].Type == "paragraph" && (n.Type == "bulletList" || n.Type == "orderedList") {
+				b.WriteString("\n")
+			} else {
+				b.WriteString("\n\n")
+			}
+		}
+		b.WriteString(block)
+	}
+	return b.String()
+}
+
+// taskList writes `- [ ]` items. A nested task list follows the item it
+// belongs to.
+func (w *adfMarkdown) taskList(n *adf.Node) string {
+	var items []string
+	for _, item := range n.Content {
+		if item.Type == "taskList" && len(items) > 0 {
+			items[len(items)-1] += "\n" + prefixLines("  ", w.taskList(item))
+			continue
+		}
+		box := "[ ] "
+		if item.Attrs["state"] == "DONE" {
+			box = "[x] "
+		}
+		items = append(items, listItem("- "+box, w.inlines(item.Content, true)))
+	}
+	return strings.Join(items, "\n")
+}
+
+// table writes a GFM table, or reports false when a cell holds more than
+// paragraphs
+func (w *adfMarkdown) table(n *adf.Node) (string, bool) {
+	var rows [][]string
+	var aligns []string
+	for r, row := range n.Content {
+		var cells []string
+		for _, cell := range row.Content {
+			var lines []string
+			for _, block := range cell.Content {
+				if block.Type != "paragraph" {
+					return "", false
+				}
+				lines = append(lines, w.inlines(block.Content, false))
+			}
+			cells = append(cells, strings.ReplaceAll(strings.Join(lines, "<br />"), "\n", " "))
+			if r == 0 {
+				aligns = append(aligns, adfCellAlignment(cell))
+			}
+		}
+		rows = append(rows, cells)
+	}
+	if len(rows) == 0 {
+		return "", false
+	}
+
+	var b strings.Builder
+	for i, row := range rows {
+		for len(row) < len(aligns) {
+			row = append(row, "")
+		}
+		b.WriteString("| " + strings.Join(row, " | ") + " |\n")
+		if i == 0 {
+			b.WriteString("|")
+			for _, align := range aligns {
+				b.WriteString(" " + align + " |")
+			}
+			b.WriteString("\n")
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n"), true
+}
+
+// adfCellAlignment reads the alignment mark of a cell's paragraph as a GFM delimiter
+func adfCellAlignment(cell *adf.Node) string {
+	if len(cell.Content) > 0 {
+		for _, mark := range cell.Content[0].Marks {
+			if mark.Type != "alignment" {
+				continue
+			}
+			switch mark.Attrs["align"] {
+			case "center":
+				return ":-:"
+			case "end":
+				return "--:"
+			}
+		}
+	}
+	return "---"
+}
+
+// tocFromADF writes `[[toc]]`, with the macro parameters in name order
+func tocFromADF(n *adf.Node) string {
+	parameters, _ := n.Attrs["parameters"].(map[string]interface{})
+	macroParams, _ := parameters["macroParams"].(map[string]interface{})
+	names := make([]string, 0, len(macroParams))
+	for name := range macroParams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("[[toc")
+	for _, name := range names {
+		param, _ := macroParams[name].(map[string]interface{})
+		value, _ := param["value"].(string)
+		if !macroParamName.MatchString(name) || strings.Contains(value, `"`) {
+			return preservedADF(n)
+		}
+		if value == "" || strings.ContainsAny(value, " \t\n]") {
+			value = `"` + value + `"`
+		}
+		b.WriteString(" " + name + "=" + value)
+	}
+	return b.String() + "]]"
+}
+
+// inlines writes inline nodes. Inside a task, dates are due dates.
+func (w *adfMarkdown) inlines(nodes []*adf.Node, task bool) string {
+	var b strings.Builder
+	for _, n := range nodes {
+		switch n.Type {
+		case "text":
+			b.WriteString(markedText(n))
+		case "hardBreak":
+			b.WriteString("\\\n")
+		case "mention":
+			b.WriteString(w.mention(n))
+		case "date":
+			day := adfDate(n)
+			if task {
+				b.WriteString("due:" + day)
+			} else {
+				b.WriteString("{date:" + day + "}")
+			}
+		case "status":
+			b.WriteString(adfStatus(n))
+		case "inlineCard":
+			url, _ := n.Attrs["url"].(string)
+			b.WriteString("<" + url + ">")
+		case "emoji":
+			if text, ok := n.Attrs["text"].(string); ok && text != "" {
+				b.WriteString(text)
+			} else if name, ok := n.Attrs["shortName"].(string); ok {
+				b.WriteString(name)
+			}
+		default:
+			if text, ok := n.Attrs["text"].(string); ok {
+				b.WriteString(escape.MarkdownCharacters(text))
+			}
+		}
+	}
+	return b.String()
+}
+
+var (
+	adfFootnotePattern = regexp.MustCompile(`^#fn-(\d+)$`)
+	adfMathPattern     = regexp.MustCompile(`^\$[^$\s](?:[^$]*[^$\s])?\$$`)
+)
+
+// markedText writes a text node with its marks. Links go outermost.
+func markedText(n *adf.Node) string {
+	var href, title string
+	code := false
+	for _, mark := range n.Marks {
+		switch mark.Type {
+		case "code":
+			code = true
+		case "link":
+			href, _ = mark.Attrs["href"].(string)
+			title, _ = mark.Attrs["title"].(string)
+		}
+	}
+
+	if m := adfFootnotePattern.FindStringSubmatch(href); m != nil {
+		return "[^" + m[1] + "]"
+	}
+	s := escape.MarkdownCharacters(n.Text)
+	switch {
+	case code && adfMathPattern.MatchString(n.Text):
+		// Push keeps formulas as code
+		s = n.Text
+	case code:
+		s = codeSpan(n.Text)
+	}
+	for _, mark := range n.Marks {
+		switch mark.Type {
+		case "em":
+			s = emphasize(s, "_")
+		case "strong":
+			s = emphasize(s, "**")
+		case "strike":
+			s = emphasize(s, "~~")
+		}
+	}
+	if href != "" && len(n.Marks) == 1 && (n.Text == href || "mailto:"+n.Text == href) {
+		return "<" + n.Text + ">"
+	}
+	if href != "" {
+		if title != "" {
+			href += ` "` + strings.ReplaceAll(title, `"`, `\"`) + `"`
+		}
+		s = "[" + s + "](" + href + ")"
+	}
+	return s
+}
+
+// emphasize wraps s in delim, keeping surrounding spaces outside it so the
+// delimiters still count
+func emphasize(s, delim string) string {
+	trimmed := strings.TrimSpace(s)
+	if trimmed == "" {
+		return s
+	}
+	start := strings.Index(s, trimmed)
+	return s[:start] + delim + trimmed + delim + s[start+len(trimmed):]
+}
+
+// codeSpan fences code with more backticks than it contains in a row
+func codeSpan(code string) string {
+	fence := "`"
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	if strings.HasPrefix(code, "`") || strings.HasSuffix(code, "`") {
+		code = " " + code + " "
+	}
+	return fence + code + fence
+}
+
+func (w *adfMarkdown) mention(n *adf.Node) string {
+	id, _ := n.Attrs["id"].(string)
+	if text, _ := n.Attrs["text"].(string); strings.TrimPrefix(text, "@") != "" {
+		name := strings.NewReplacer("[", "\\[", "]", "\\]").Replace(strings.TrimPrefix(text, "@"))
+		return "@[" + name + "](" + id + ")"
+	}
+	return w.users.mentionMarkdown(id, "", "")
+}
+
+// adfDate reads a date node's timestamp, milliseconds since the epoch
+func adfDate(n *adf.Node) string {
+	var ms int64
+	switch ts := n.Attrs["timestamp"].(type) {
+	case string:
+		ms, _ = strconv.ParseInt(ts, 10, 64)
+	case float64:
+		ms = int64(ts)
+	}
+	return time.UnixMilli(ms).UTC().Format("2006-01-02")
+}
+
+func adfStatus(n *adf.Node) string {
+	colour := "grey"
+	if c, _ := n.Attrs["color"].(string); c != "" && c != "neutral" {
+		colour = c
+	}
+	text, _ := n.Attrs["text"].(string)
+	if _, ok := storage.StatusColours[colour]; !ok || strings.ContainsAny(text, "|}\\\n") {
+		return escape.MarkdownCharacters(text)
+	}
+	status := "{status:" + colour
+	if text != "" {
+		status += "|" + text
+	}
+	if n.Attrs["style"] == "subtle" {
+		if text == "" {
+			status += "|"
+		}
+		status += "|subtle"
+	}
+	return status + "}"
+}
+
+// listItem puts marker before the first line of body and indents the rest to match
+func listItem(marker, body string) string {
+	lines := strings.Split(body, "\n")
+	pad := strings.Repeat(" ", len(marker))
+	for i, line := range lines {
+		if i == 0 {
+			lines[i] = marker + line
+		} else if line != "" {
+			lines[i] = pad + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func prefixLines(prefix, body string) string {
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(prefix+line, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func plainADFText(nodes []*adf.Node) string {
+	var b strings.Builder
+	for _, n := range nodes {
+		b.WriteString(n.Text)
+	}
+	return b.String()
+}
+
+// intAttr reads a numeric attribute, which JSON decodes as a float64
+func intAttr(n *adf.Node, name string) int {
+	switch v := n.Attrs[name].(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	case string:
+		i, _ := strconv.Atoi(v)
+		return i
+	}
+	return 0
+}
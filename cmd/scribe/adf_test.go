@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/wmorley/scribe-cli/adf"
+	"github.com/wmorley/scribe-cli/storage"
+)
+
+func TestADFRoundTrip(t *testing.T) {
+	for _, markdown := range []string{
+		"# Title\n\nSome _emphasis_, **strong** and ~~struck~~ text with `code`.",
+		"A [link](https://example.com \"Example\") and <https://example.com>.",
+		"one\\\ntwo",
+		"- one\n- two\n  - nested",
+		"3. three\n4. four",
+		"- [ ] open due:2024-05-01\n- [x] done\n  - [ ] sub-task",
+		"> quoted\n>\n> twice",
+		"> [!WARNING]\n> Careful.",
+		"```go\nfmt.Println(\"hi\")\n```",
+		"| Name | Count |\n| --- | --: |\n| a | 1 |",
+		"![Logo](https://example.com/logo.png)",
+		"[[toc maxLevel=2]]",
+		"{status:green|DONE} and {status:grey|IDLE|subtle} on {date:2024-05-01}",
+		"<details>\n<summary>More</summary>\n\nHidden.\n\n</details>",
+		"---",
+		"Euler: $e^{i\\pi} + 1 = 0$\n\n$$\n\\int_0^1 x\\,dx\n$$",
+		"A note[^1].\n\n[^1]: The note.",
+	} {
+		doc := adf.Convert([]byte(markdown), storage.Maths(storage.DefaultMathMacros, nil))
+		body, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pulled := ConvertADFToMarkdown(string(body), nil); pulled != markdown {
+			t.Errorf("round trip of\n%s\ngave\n%s\nvia %s", markdown, pulled, body)
+		}
+	}
+}
+
+func TestADFKeepsUnknownNodes(t *testing.T) {
+	body := `{"type":"doc","version":1,"content":[` +
+		`{"type":"paragraph","content":[{"type":"text","text":"Hi "},{"type":"mention","attrs":{"id":"5b10ac8d82e05b22cc7d4ef5","text":"@Alice Smith"}}]},` +
+		`{"type":"layoutSection","content":[{"type":"layoutColumn","attrs":{"width":50}}]}]}`
+	pulled := ConvertADFToMarkdown(body, nil)
+	if !strings.HasPrefix(pulled, "Hi @[Alice Smith](5b10ac8d82e05b22cc7d4ef5)\n\n```adf\n") {
+		t.Fatalf("pulled:\n%s", pulled)
+	}
+
+	doc := adf.Convert([]byte(pulled), storage.Mentions(nil))
+	if len(doc.Content) != 2 || doc.Content[1].Type != "layoutSection" || doc.Content[0].Content[1].Type != "mention" {
+		raw, _ := json.Marshal(doc)
+		t.Errorf("pushed back as %s", raw)
+	}
+}
+
+// v2Confluence serves a space with three pages, two to a cursor page, and
+// records the page it is sent
+type v2Confluence struct {
+	*httptest.Server
+	sent V2PageRequest
+}
+
+func newV2Confluence(t *testing.T) *v2Confluence {
+	f := &v2Confluence{}
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/wiki/api/v2/spaces":
+			fmt.Fprint(w, `{"results":[{"id":"7","key":"DEV","name":"Development","type":"global"}]}`)
+		case r.URL.Path == "/wiki/api/v2/spaces/7/pages" && r.URL.Query().Get("cursor") == "":
+			fmt.Fprint(w, `{"results":[{"id":"1","title":"One","spaceId":"7"},{"id":"2","title":"Two","spaceId":"7"}],`+
+				`"_links":{"next":"/wiki/api/v2/spaces/7/pages?limit=2&cursor=abc"}}`)
+		case r.URL.Path == "/wiki/api/v2/spaces/7/pages":
+			fmt.Fprint(w, `{"results":[{"id":"3","title":"Three","spaceId":"7"}],"_links":{}}`)
+		case r.URL.Path == "/wiki/api/v2/pages" && r.Method == http.MethodPost:
+			json.NewDecoder(r.Body).Decode(&f.sent)
+			fmt.Fprint(w, `{"id":"9","title":"New","spaceId":"7","version":{"number":1}}`)
+		case r.URL.Path == "/wiki/api/v2/pages/9":
+			fmt.Fprint(w, `{"id":"9","title":"New","spaceId":"7","version":{"number":1},`+
+				`"body":{"atlas_doc_format":{"representation":"atlas_doc_format","value":"{\"type\":\"doc\",\"version\":1,\"content\":[{\"type\":\"paragraph\",\"content\":[{\"type\":\"text\",\"text\":\"Hello\"}]}]}"}}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func TestConfluenceV2Client(t *testing.T) {
+	server := newV2Confluence(t)
+	client := &ConfluenceV2Client{&ConfluenceClient{BaseURL: server.URL, Client: server.Server.Client()}}
+	ctx := context.Background()
+
+	var titles []string
+	it := client.IterPages(ctx, "DEV", &ListOptions{Limit: 2, Offset: 1})
+	for it.Next() {
+		if it.Value().Space.Key != "DEV" {
+			t.Errorf("page %s has space %q", it.Value().ID, it.Value().Space.Key)
+		}
+		titles = append(titles, it.Value().Title)
+	}
+	if err := it.Err(); err != nil || strings.Join(titles, ",") != "Two,Three" {
+		t.Errorf("got %v, %v; want the cursor followed past the offset", titles, err)
+	}
+
+	converted, err := convertFile(ctx, client, "new.md", "Hello **world**", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CreatePage(ctx, "DEV", "New", converted.Body, ""); err != nil {
+		t.Fatal(err)
+	}
+	if server.sent.SpaceID != "7" || server.sent.Body.Representation != "atlas_doc_format" || !strings.Contains(server.sent.Body.Value, `"strong"`) {
+		t.Errorf("sent %+v", server.sent)
+	}
+
+	pulled, err := getPage(ctx, client, GetPageParams{ID: "9"}, nil)
+	if err != nil || pulled.Content != "Hello" || pulled.Version != 1 {
+		t.Errorf("got %+v, %v", pulled, err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	htmltomarkdown "github.com/JohannesKaufmann/html-to-markdown"
+	"github.com/JohannesKaufmann/html-to-markdown/escape"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/wmorley/scribe-cli/storage"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+)
+
+// headingIDAttr holds the `{#custom-id}` of a heading between the Before
+// hook that finds its anchor macro and the heading rule
+const headingIDAttr = "data-scribe-id"
+
+// headingToMarkdown writes a heading with a `{#custom-id}` attribute, as
+// the stock rule does except for keeping the `#` of the attribute
+func headingToMarkdown(content string, heading *goquery.Selection) string {
+	content = strings.Join(strings.Fields(strings.ReplaceAll(content, "#", `\#`)), " ")
+	level := strings.TrimPrefix(goquery.NodeName(heading), "h")
+	n, _ := strconv.Atoi(level)
+	return "\n\n" + strings.Repeat("#", n) + " " + content + " {#" + heading.AttrOr(headingIDAttr, "") + "}\n\n"
+}
+
+// headingAnchorsToMarkdown turns the anchor macro push writes at the start
+// of a `{#custom-id}` heading back into the attribute, and maps every
+// heading's Confluence anchor to the `#fragment` push will give it
+func headingAnchorsToMarkdown(selec *goquery.Selection) map[string]string {
+	fragments := map[string]string{}
+	ids := parser.NewContext().IDs()
+	headings := selec.Find("h1, h2, h3, h4, h5, h6")
+
+	// Custom ids are taken before any is generated, as they are on push
+	headings.Each(func(_ int, heading *goquery.Selection) {
+		anchor := heading.Children().First()
+		if !anchor.Is("ac\\:structured-macro[ac\\:name='anchor']") {
+			return
+		}
+		name := strings.TrimSpace(anchor.ChildrenFiltered("ac\\:parameter").Text())
+		if name == "" || strings.ContainsAny(name, " {}") {
+			return
+		}
+		anchor.Remove()
+		heading.SetAttr(headingIDAttr, name)
+		ids.Put([]byte(name))
+		fragments[name] = name
+	})
+
+	seen := map[string]int{}
+	headings.Each(func(_ int, heading *goquery.Selection) {
+		if _, custom := heading.Attr(headingIDAttr); custom {
+			return
+		}
+		text := strings.TrimSpace(heading.Text())
+		anchor := storage.HeadingAnchor(text)
+		if count := seen[anchor]; count > 0 {
+			seen[anchor]++
+			anchor += "." + strconv.Itoa(count)
+		} else {
+			seen[anchor] = 1
+		}
+		fragments[anchor] = string(ids.Generate([]byte(text), ast.KindHeading))
+	})
+	return fragments
+}
+
+// anchorLinkToMarkdown writes a link to an anchor on the same page as a
+// `#fragment` link to its heading
+func anchorLinkToMarkdown(converter *htmltomarkdown.Converter, link *goquery.Selection, fragments map[string]string) string {
+	anchor := link.AttrOr("ac:anchor", "")
+	fragment, ok := fragments[anchor]
+	if !ok {
+		fragment = anchor
+	}
+	return "[" + linkText(converter, link, anchor) + "](#" + fragment + ")"
+}
+
+// linkText is the Markdown text of an ac:link: its rich or plain body, or fallback
+func linkText(converter *htmltomarkdown.Converter, link *goquery.Selection, fallback string) string {
+	text := strings.TrimSpace(converter.Convert(link.ChildrenFiltered("ac\\:link-body")))
+	if text == "" {
+		text = escape.MarkdownCharacters(strings.TrimSpace(link.ChildrenFiltered("ac\\:plain-text-link-body").Text()))
+	}
+	if text == "" {
+		text = escape.MarkdownCharacters(fallback)
+	}
+	return text
+}
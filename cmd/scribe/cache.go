@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultCacheTTL = 5 * time.Minute
+
+// errOffline is returned for requests that cannot be answered from the cache in offline mode
+var errOffline = errors.New("offline mode: no cached response")
+
+// cacheTransport keeps space and page listings on disk underneath the
+// providers. Fresh entries are served without touching the network, stale
+// ones are revalidated with If-None-Match, and in offline mode anything
+// cached is served regardless of age.
+type cacheTransport struct {
+	Dir     string
+	TTL     time.Duration
+	Offline bool
+	Next    http.RoundTripper
+}
+
+type noCacheKey struct{}
+
+// withoutCache makes requests carrying ctx bypass the listing cache
+func withoutCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCacheKey{}, true)
+}
+
+type cacheEntry struct {
+	URL         string    `json:"url"`
+	ETag        string    `json:"etag,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        []byte    `json:"body"`
+	StoredAt    time.Time `json:"stored_at"`
+}
+
+// CacheStats summarises the on-disk cache for `cache stats`
+type CacheStats struct {
+	Dir     string     `json:"dir"`
+	Entries int        `json:"entries"`
+	Fresh   int        `json:"fresh"`
+	Stale   int        `json:"stale"`
+	Bytes   int64      `json:"bytes"`
+	TTL     string     `json:"ttl"`
+	Oldest  *time.Time `json:"oldest,omitempty"`
+	Newest  *time.Time `json:"newest,omitempty"`
+}
+
+// newCacheTransport configures the cache from SCRIBE_CACHE_DIR and SCRIBE_CACHE_TTL
+func newCacheTransport(offline bool) *cacheTransport {
+	dir := os.Getenv("SCRIBE_CACHE_DIR")
+	if dir == "" {
+		if base, err := os.UserCacheDir(); err == nil {
+			dir = filepath.Join(base, "scribe")
+		}
+	}
+
+	ttl := defaultCacheTTL
+	if v := os.Getenv("SCRIBE_CACHE_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			ttl = d
+		}
+	}
+
+	return &cacheTransport{
+		Dir:     dir,
+		TTL:     ttl,
+		Offline: offline,
+		Next:    http.DefaultTransport,
+	}
+}
+
+// isListing reports whether u is a space or page listing, or a user lookup,
+// we are allowed to cache. Single pages are never cached: updates need their
+// current version number.
+func isListing(u *url.URL) bool {
+	path := strings.TrimPrefix(u.Path, "/wiki")
+	switch path {
+	case "/rest/api/space", "/rest/api/content/search":
+		return true
+	case "/rest/api/user", "/rest/api/search/user":
+		return true
+	case "/rest/api/content":
+		return u.Query().Get("spaceKey") != ""
+	case "/api/v2/spaces":
+		return true
+	}
+	// The v2 listing of the pages in a space
+	return strings.HasPrefix(path, "/api/v2/spaces/") && strings.HasSuffix(path, "/pages")
+}
+
+// cacheKey ignores the /wiki prefix so the bare and Cloud paths share an entry,
+// and includes the credentials so accounts never see each other's listings
+func cacheKey(req *http.Request) string {
+	u := *req.URL
+	u.Path = strings.TrimPrefix(u.Path, "/wiki")
+	sum := sha256.Sum256([]byte(u.String() + "\n" + req.Header.Get("Authorization")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	bypass := req.Context().Value(noCacheKey{}) != nil
+	if t.Dir == "" || bypass || req.Method != http.MethodGet || !isListing(req.URL) {
+		if t.Offline {
+			return nil, fmt.Errorf("%w for %s %s", errOffline, req.Method, req.URL.Path)
+		}
+		resp, err := t.Next.RoundTrip(req)
+		if err == nil && req.Method != http.MethodGet && resp.StatusCode < 400 {
+			// A page was created or changed, so cached page listings are out of date
+			t.invalidate(func(e *cacheEntry) bool {
+				u, err := url.Parse(e.URL)
+				return err == nil && !strings.HasSuffix(u.Path, "/rest/api/space") && !strings.HasSuffix(u.Path, "/api/v2/spaces") && !strings.HasSuffix(u.Path, "/user")
+			})
+		}
+		return resp, err
+	}
+
+	key := cacheKey(req)
+	entry, _ := t.load(key)
+	if entry != nil && (t.Offline || time.Since(entry.StoredAt) < t.TTL) {
+		return entry.response(req), nil
+	}
+	if t.Offline {
+		return nil, fmt.Errorf("%w for %s", errOffline, req.URL.Path)
+	}
+
+	if entry != nil && entry.ETag != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("If-None-Match", entry.ETag)
+	}
+
+	resp, err := t.Next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && entry != nil:
+		resp.Body.Close()
+		entry.StoredAt = time.Now()
+		t.store(key, entry)
+		return entry.response(req), nil
+	case resp.StatusCode == http.StatusOK:
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		t.store(key, &cacheEntry{
+			URL:         req.URL.String(),
+			ETag:        resp.Header.Get("ETag"),
+			ContentType: resp.Header.Get("Content-Type"),
+			Body:        body,
+			StoredAt:    time.Now(),
+		})
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	return resp, nil
+}
+
+func (e *cacheEntry) response(req *http.Request) *http.Response {
+	header := http.Header{}
+	if e.ContentType != "" {
+		header.Set("Content-Type", e.ContentType)
+	}
+	if e.ETag != "" {
+		header.Set("ETag", e.ETag)
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+func (t *cacheTransport) load(key string) (*cacheEntry, error) {
+	data, err := os.ReadFile(filepath.Join(t.Dir, key+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// store writes through a temp file so concurrent readers never see a partial entry.
+// Failing to cache is never fatal to the request.
+func (t *cacheTransport) store(key string, entry *cacheEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(t.Dir, 0o700); err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(t.Dir, key+".*.tmp")
+	if err != nil {
+		return
+	}
+	_, werr := tmp.Write(data)
+	cerr := tmp.Close()
+	if werr != nil || cerr != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(t.Dir, key+".json")); err != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+// entries lists every cache file with its decoded entry
+func (t *cacheTransport) entries() (map[string]*cacheEntry, error) {
+	files, err := filepath.Glob(filepath.Join(t.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]*cacheEntry, len(files))
+	for _, file := range files {
+		key := strings.TrimSuffix(filepath.Base(file), ".json")
+		entry, err := t.load(key)
+		if err != nil {
+			continue
+		}
+		out[file] = entry
+	}
+	return out, nil
+}
+
+func (t *cacheTransport) invalidate(match func(*cacheEntry) bool) {
+	entries, err := t.entries()
+	if err != nil {
+		return
+	}
+	for file, entry := range entries {
+		if match(entry) {
+			os.Remove(file)
+		}
+	}
+}
+
+// Clear removes every cached entry and returns how many were deleted
+func (t *cacheTransport) Clear() (int, error) {
+	if t.Dir == "" {
+		return 0, nil
+	}
+	files, err := filepath.Glob(filepath.Join(t.Dir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, file := range files {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func (t *cacheTransport) Stats() (*CacheStats, error) {
+	stats := &CacheStats{Dir: t.Dir, TTL: t.TTL.String()}
+	entries, err := t.entries()
+	if err != nil {
+		return nil, err
+	}
+	for file, entry := range entries {
+		stats.Entries++
+		if info, err := os.Stat(file); err == nil {
+			stats.Bytes += info.Size()
+		}
+		if time.Since(entry.StoredAt) < t.TTL {
+			stats.Fresh++
+		} else {
+			stats.Stale++
+		}
+		storedAt := entry.StoredAt
+		if stats.Oldest == nil || storedAt.Before(*stats.Oldest) {
+			stats.Oldest = &storedAt
+		}
+		if stats.Newest == nil || storedAt.After(*stats.Newest) {
+			stats.Newest = &storedAt
+		}
+	}
+	return stats, nil
+}
+
+type CacheParams struct{}
+
+// CacheCleared reports how many cached entries clearCache removed
+type CacheCleared struct {
+	Removed int `json:"removed"`
+}
+
+func clearCache(ctx context.Context, client ScribeProvider, p CacheParams, progress ProgressFunc) (*CacheCleared, error) {
+	removed, err := newCacheTransport(offline).Clear()
+	if err != nil {
+		return nil, fmt.Errorf("failed to clear cache: %w", err)
+	}
+	return &CacheCleared{Removed: removed}, nil
+}
+
+func cacheStats(ctx context.Context, client ScribeProvider, p CacheParams, progress ProgressFunc) (*CacheStats, error) {
+	stats, err := newCacheTransport(offline).Stats()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache: %w", err)
+	}
+	return stats, nil
+}
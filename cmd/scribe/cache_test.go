@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listingServer answers every request with its path, user and the current
+// version, tagged with that version so unchanged listings revalidate
+type listingServer struct {
+	*httptest.Server
+	version  atomic.Int32
+	requests atomic.Int32
+	notMod   atomic.Int32
+}
+
+func newListingServer(t *testing.T) *listingServer {
+	s := &listingServer{}
+	s.version.Store(1)
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		if r.Method != http.MethodGet {
+			if r.URL.Query().Get("fail") != "" {
+				w.WriteHeader(http.StatusConflict)
+			}
+			return
+		}
+		etag := fmt.Sprintf(`"v%d"`, s.version.Load())
+		if r.Header.Get("If-None-Match") == etag {
+			s.notMod.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		user, _, _ := r.BasicAuth()
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "%s %s v%d", r.URL.Path, user, s.version.Load())
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// cacheClient is a client for s behind a cache in its own directory
+func (s *listingServer) cacheClient(t *testing.T, ttl time.Duration) (*cacheTransport, *http.Client) {
+	cache := &cacheTransport{Dir: t.TempDir(), TTL: ttl, Next: s.Client().Transport}
+	return cache, &http.Client{Transport: cache}
+}
+
+func fetch(t *testing.T, client *http.Client, method, path, user string) (string, error) {
+	t.Helper()
+	return fetchContext(context.Background(), t, client, method, path, user)
+}
+
+func fetchContext(ctx context.Context, t *testing.T, client *http.Client, method, path, user string) (string, error) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, method, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(user, "token")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func mustFetch(t *testing.T, client *http.Client, path, want string) {
+	t.Helper()
+	got, err := fetch(t, client, http.MethodGet, path, "me")
+	if err != nil || got != want {
+		t.Errorf("GET %s: got %q (%v), want %q", path, got, err, want)
+	}
+}
+
+func TestCacheServesFreshListings(t *testing.T) {
+	server := newListingServer(t)
+	cache, client := server.cacheClient(t, time.Hour)
+	spaces := server.URL + "/rest/api/space?limit=100"
+
+	mustFetch(t, client, spaces, "/rest/api/space me v1")
+	server.version.Store(2)
+	mustFetch(t, client, spaces, "/rest/api/space me v1")
+	// Cloud's /wiki path shares the entry
+	mustFetch(t, client, server.URL+"/wiki/rest/api/space?limit=100", "/rest/api/space me v1")
+	if got := server.requests.Load(); got != 1 {
+		t.Errorf("%d requests, want the fresh entry served", got)
+	}
+
+	// Single pages are never cached, and a context can skip the cache
+	for i := 0; i < 2; i++ {
+		mustFetch(t, client, server.URL+"/rest/api/content/42", "/rest/api/content/42 me v2")
+	}
+	got, err := fetchContext(withoutCache(context.Background()), t, client, http.MethodGet, spaces, "me")
+	if err != nil || got != "/rest/api/space me v2" {
+		t.Errorf("bypassing the cache: got %q (%v)", got, err)
+	}
+	if got := server.requests.Load(); got != 4 {
+		t.Errorf("%d requests, want pages and the bypass sent", got)
+	}
+
+	stats, err := cache.Stats()
+	if err != nil || stats.Entries != 1 || stats.Fresh != 1 {
+		t.Errorf("stats %+v (%v), want one fresh entry", stats, err)
+	}
+}
+
+func TestCacheRevalidatesStaleListings(t *testing.T) {
+	server := newListingServer(t)
+	cache, client := server.cacheClient(t, time.Hour)
+	spaces := server.URL + "/rest/api/space"
+
+	mustFetch(t, client, spaces, "/rest/api/space me v1")
+	cache.TTL = 0
+	mustFetch(t, client, spaces, "/rest/api/space me v1")
+	if server.requests.Load() != 2 || server.notMod.Load() != 1 {
+		t.Errorf("%d requests and %d 304s, want the stale entry revalidated", server.requests.Load(), server.notMod.Load())
+	}
+
+	// A 304 restarts the entry's TTL
+	cache.TTL = time.Hour
+	mustFetch(t, client, spaces, "/rest/api/space me v1")
+	if server.requests.Load() != 2 {
+		t.Errorf("%d requests, want the revalidated entry fresh", server.requests.Load())
+	}
+
+	cache.TTL = 0
+	server.version.Store(2)
+	mustFetch(t, client, spaces, "/rest/api/space me v2")
+	cache.TTL = time.Hour
+	mustFetch(t, client, spaces, "/rest/api/space me v2")
+	if server.requests.Load() != 3 || server.notMod.Load() != 1 {
+		t.Errorf("%d requests and %d 304s, want the changed listing stored", server.requests.Load(), server.notMod.Load())
+	}
+}
+
+func TestCacheOffline(t *testing.T) {
+	server := newListingServer(t)
+	cache, client := server.cacheClient(t, 0)
+	mustFetch(t, client, server.URL+"/rest/api/space", "/rest/api/space me v1")
+	server.Close()
+
+	// However stale, a cached listing is served; anything else fails as offline
+	cache.Offline = true
+	mustFetch(t, client, server.URL+"/rest/api/space", "/rest/api/space me v1")
+	for _, path := range []string{"/rest/api/content/search?cql=space=DEV", "/rest/api/content/42"} {
+		if _, err := fetch(t, client, http.MethodGet, server.URL+path, "me"); !errors.Is(err, errOffline) {
+			t.Errorf("GET %s: got %v, want errOffline", path, err)
+		}
+	}
+	if _, err := fetch(t, client, http.MethodPut, server.URL+"/rest/api/content/42", "me"); !errors.Is(err, errOffline) {
+		t.Errorf("PUT: got %v, want errOffline", err)
+	}
+}
+
+func TestCacheInvalidatesPageListingsOnWrite(t *testing.T) {
+	server := newListingServer(t)
+	_, client := server.cacheClient(t, time.Hour)
+	listings := []struct {
+		path, body string
+		page       bool
+	}{
+		{"/rest/api/space", "/rest/api/space", false},
+		{"/rest/api/content?spaceKey=DEV", "/rest/api/content", true},
+		{"/rest/api/content/search?cql=space=DEV", "/rest/api/content/search", true},
+		{"/rest/api/search/user?cql=user.fullname~alice", "/rest/api/search/user", false},
+	}
+	for _, l := range listings {
+		mustFetch(t, client, server.URL+l.path, l.body+" me v1")
+	}
+	server.version.Store(2)
+
+	// A failed write changes nothing
+	if _, err := fetch(t, client, http.MethodPut, server.URL+"/rest/api/content/42?fail=1", "me"); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range listings {
+		mustFetch(t, client, server.URL+l.path, l.body+" me v1")
+	}
+
+	// A page update drops the page listings, but not spaces or users
+	if _, err := fetch(t, client, http.MethodPut, server.URL+"/rest/api/content/42", "me"); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range listings {
+		want := l.body + " me v1"
+		if l.page {
+			want = l.body + " me v2"
+		}
+		mustFetch(t, client, server.URL+l.path, want)
+	}
+}
+
+func TestCacheKeysOnCredentials(t *testing.T) {
+	server := newListingServer(t)
+	_, client := server.cacheClient(t, time.Hour)
+	spaces := server.URL + "/rest/api/space"
+
+	for _, user := range []string{"alice", "bob", "alice", "bob"} {
+		got, err := fetch(t, client, http.MethodGet, spaces, user)
+		if want := "/rest/api/space " + user + " v1"; err != nil || got != want {
+			t.Errorf("%s: got %q (%v), want %q", user, got, err, want)
+		}
+	}
+	if got := server.requests.Load(); got != 2 {
+		t.Errorf("%d requests, want one per account", got)
+	}
+}
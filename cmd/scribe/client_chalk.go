@@ -2,12 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync/atomic"
 )
 
 type ChalkClient struct {
@@ -15,6 +18,10 @@ type ChalkClient struct {
 	Username string
 	APIToken string
 	Client   *http.Client
+
+	// useWiki is set once a request only succeeded under the /wiki prefix,
+	// so a long-lived client stops probing the bare path on every call
+	useWiki atomic.Bool
 }
 
 type CreateChalkPageRequest struct {
@@ -56,17 +63,29 @@ func NewChalkClient(baseURL, username, apiToken string) *ChalkClient {
 	}
 }
 
-func (c *ChalkClient) doRequest(method, path string, body interface{}) ([]byte, error) {
+// InstanceURL is the base URL page links are written against
+func (c *ChalkClient) InstanceURL() string {
+	return c.BaseURL
+}
+
+func (c *ChalkClient) doRequest(ctx context.Context, method, path string, body interface{}) ([]byte, error) {
 	// Prepare request body
 	var bodyData []byte
 	var err error
-	if body != nil {
+	contentType := "application/json"
+	if upload, ok := body.(*attachmentUpload); ok {
+		bodyData, contentType = upload.Data, upload.ContentType
+	} else if body != nil {
 		bodyData, err = json.Marshal(body)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	if c.useWiki.Load() && !strings.Contains(path, "/wiki/") {
+		path = strings.Replace(path, "/rest/api/", "/wiki/rest/api/", 1)
+	}
+
 	// Try the requested path first
 	fullURL := c.BaseURL + path
 	var reqBody io.Reader
@@ -79,13 +98,14 @@ func (c *ChalkClient) doRequest(method, path string, body interface{}) ([]byte,
 		return nil, fmt.Errorf("only HTTPS URLs are allowed for security from Chalk [%s]", c.BaseURL)
 	}
 
-	req, err := http.NewRequest(method, fullURL, reqBody)
+	req, err := http.NewRequestWithContext(ctx, method, fullURL, reqBody)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Authorization", "Bearer "+c.APIToken)
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Atlassian-Token", "nocheck")
 	req.Header.Set("Accept", "application/json")
 
 	resp, err := c.Client.Do(req)
@@ -105,10 +125,11 @@ func (c *ChalkClient) doRequest(method, path string, body interface{}) ([]byte,
 		if wikiPath != path {
 			wikiURL := c.BaseURL + wikiPath
 			wikiReqBody := bytes.NewBuffer(bodyData)
-			wikiReq, err := http.NewRequest(method, wikiURL, wikiReqBody)
+			wikiReq, err := http.NewRequestWithContext(ctx, method, wikiURL, wikiReqBody)
 			if err == nil {
 				wikiReq.Header.Set("Authorization", "Bearer "+c.APIToken)
-				wikiReq.Header.Set("Content-Type", "application/json")
+				wikiReq.Header.Set("Content-Type", contentType)
+				wikiReq.Header.Set("X-Atlassian-Token", "nocheck")
 				wikiReq.Header.Set("Accept", "application/json")
 				wikiResp, err := c.Client.Do(wikiReq)
 				if err == nil {
@@ -116,6 +137,7 @@ func (c *ChalkClient) doRequest(method, path string, body interface{}) ([]byte,
 					wikiRespBody, err := io.ReadAll(wikiResp.Body)
 					if err == nil {
 						if wikiResp.StatusCode < 400 {
+							c.useWiki.Store(true)
 							return wikiRespBody, nil
 						}
 						// Wiki path also failed, return original error
@@ -133,29 +155,30 @@ func (c *ChalkClient) doRequest(method, path string, body interface{}) ([]byte,
 			errorMsg = errorMsg[:500] + "..."
 		}
 		// Don't include full URL in error (might contain credentials in some cases)
-		return nil, fmt.Errorf("API error (status %d): %s", resp.StatusCode, errorMsg)
+		return nil, &apiError{StatusCode: resp.StatusCode, Message: errorMsg}
 	}
 
 	return respBody, nil
 }
 
-func (c *ChalkClient) ListSpaces(opts *ListOptions) ([]Space, error) {
+func (c *ChalkClient) spacesEndpoint(opts *ListOptions, start int) string {
 	limit := 100
-	offset := 0
+	filter := ""
 
 	if opts != nil {
 		if opts.Limit > 0 {
 			limit = opts.Limit
 		}
-		if opts.Offset > 0 {
-			offset = opts.Offset
-		}
 		if opts.Query != "" {
-			query = fmt.Sprintf("&spaceKey=%s", url.QueryEscape(opts.Query))
+			filter = fmt.Sprintf("&spaceKey=%s", url.QueryEscape(opts.Query))
 		}
 	}
-	endpoint := fmt.Sprintf("/rest/api/space?limit=%d&start=%d%s", limit, offset, query)
-	respBody, err := c.doRequest("GET", endpoint, nil)
+	return fmt.Sprintf("/rest/api/space?limit=%d&start=%d%s", limit, start, filter)
+}
+
+func (c *ChalkClient) ListSpaces(ctx context.Context, opts *ListOptions) ([]Space, error) {
+	endpoint := c.spacesEndpoint(opts, startOffset(opts))
+	respBody, err := c.doRequest(ctx, "GET", endpoint, nil)
 	if err != nil {
 		return nil, fmt.Errorf("ChalkClient (%s) error: %v", c.BaseURL, err)
 	}
@@ -168,7 +191,7 @@ func (c *ChalkClient) ListSpaces(opts *ListOptions) ([]Space, error) {
 	return spacesResp.Results, nil
 }
 
-func (c *ChalkClient) CreatePage(spaceKey, title, content, parentID string) (*Page, error) {
+func (c *ChalkClient) CreatePage(ctx context.Context, spaceKey, title, content, parentID string) (*Page, error) {
 	req := CreatePageRequest{
 		Type:  "page",
 		Title: title,
@@ -183,7 +206,7 @@ func (c *ChalkClient) CreatePage(spaceKey, title, content, parentID string) (*Pa
 		}{{ID: parentID}}
 	}
 
-	respBody, err := c.doRequest("POST", "/rest/api/content", req)
+	respBody, err := c.doRequest(ctx, "POST", "/rest/api/content", req)
 	if err != nil {
 		return nil, err
 	}
@@ -196,14 +219,14 @@ func (c *ChalkClient) CreatePage(spaceKey, title, content, parentID string) (*Pa
 	return &page, nil
 }
 
-func (c *ChalkClient) GetPage(pageID string) (*Page, error) {
+func (c *ChalkClient) GetPage(ctx context.Context, pageID string) (*Page, error) {
 	// Validate and sanitize pageID to prevent injection
 	if pageID == "" {
 		return nil, fmt.Errorf("page ID cannot be empty")
 	}
 	// URL encode to prevent injection
 	encodedPageID := url.PathEscape(pageID)
-	respBody, err := c.doRequest("GET", "/rest/api/content/"+encodedPageID+"?expand=body.storage,version,space", nil)
+	respBody, err := c.doRequest(ctx, "GET", "/rest/api/content/"+encodedPageID+"?expand=body.storage,version,space", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -216,7 +239,7 @@ func (c *ChalkClient) GetPage(pageID string) (*Page, error) {
 	return &page, nil
 }
 
-func (c *ChalkClient) UpdatePage(pageID, content string) (*Page, error) {
+func (c *ChalkClient) UpdatePage(ctx context.Context, pageID, content string) (*Page, error) {
 	// Validate pageID
 	if pageID == "" {
 		return nil, fmt.Errorf("page ID cannot be empty")
@@ -224,7 +247,7 @@ func (c *ChalkClient) UpdatePage(pageID, content string) (*Page, error) {
 	// URL encode to prevent injection
 	encodedPageID := url.PathEscape(pageID)
 
-	page, err := c.GetPage(pageID)
+	page, err := c.GetPage(ctx, pageID)
 	if err != nil {
 		return nil, err
 	}
@@ -237,7 +260,7 @@ func (c *ChalkClient) UpdatePage(pageID, content string) (*Page, error) {
 	req.Body.Storage.Value = content
 	req.Body.Storage.Representation = "storage"
 
-	respBody, err := c.doRequest("PUT", "/rest/api/content/"+encodedPageID, req)
+	respBody, err := c.doRequest(ctx, "PUT", "/rest/api/content/"+encodedPageID, req)
 	if err != nil {
 		return nil, err
 	}
@@ -250,11 +273,7 @@ func (c *ChalkClient) UpdatePage(pageID, content string) (*Page, error) {
 	return &updatedPage, nil
 }
 
-func (c *ChalkClient) SearchPages(spaceKey string, opts *ListOptions) ([]Page, error) {
-	// Validate and URL encode spaceKey to prevent injection
-	if spaceKey == "" {
-		return nil, fmt.Errorf("space key cannot be empty")
-	}
+func (c *ChalkClient) searchEndpoint(spaceKey string, opts *ListOptions, start int) string {
 	cqlQuery := fmt.Sprintf("space = %q AND type = \"page\"", spaceKey)
 	if opts != nil && opts.Query != "" {
 		// CQL title contains: title ~ "value"; escape \ and " in value
@@ -267,19 +286,21 @@ func (c *ChalkClient) SearchPages(spaceKey string, opts *ListOptions) ([]Page, e
 	params.Add("cql", cqlQuery)
 
 	limit := 100
-	start := 0
-	if opts != nil {
-		if opts.Limit > 0 {
-			limit = opts.Limit
-		}
-		if opts.Offset >= 0 {
-			start = opts.Offset
-		}
+	if opts != nil && opts.Limit > 0 {
+		limit = opts.Limit
 	}
 	params.Add("limit", fmt.Sprintf("%d", limit))
 	params.Add("start", fmt.Sprintf("%d", start))
-	endpoint := "/rest/api/content/search?" + params.Encode()
-	respBody, err := c.doRequest("GET", endpoint, nil)
+	return "/rest/api/content/search?" + params.Encode()
+}
+
+func (c *ChalkClient) SearchPages(ctx context.Context, spaceKey string, opts *ListOptions) ([]Page, error) {
+	// Validate and URL encode spaceKey to prevent injection
+	if spaceKey == "" {
+		return nil, fmt.Errorf("space key cannot be empty")
+	}
+	endpoint := c.searchEndpoint(spaceKey, opts, startOffset(opts))
+	respBody, err := c.doRequest(ctx, "GET", endpoint, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -291,3 +312,60 @@ func (c *ChalkClient) SearchPages(spaceKey string, opts *ListOptions) ([]Page, e
 
 	return pagesResp.Results, nil
 }
+
+// IterSpaces walks every space matching opts, starting at opts.Offset
+func (c *ChalkClient) IterSpaces(ctx context.Context, opts *ListOptions) *Iterator[Space] {
+	return newIterator[Space](ctx, c.doRequest, func(start int) string {
+		return c.spacesEndpoint(opts, start)
+	}, startOffset(opts))
+}
+
+// IterPages walks every page in spaceKey matching opts, starting at opts.Offset
+func (c *ChalkClient) IterPages(ctx context.Context, spaceKey string, opts *ListOptions) *Iterator[Page] {
+	return newIterator[Page](ctx, c.doRequest, func(start int) string {
+		return c.searchEndpoint(spaceKey, opts, start)
+	}, startOffset(opts))
+}
+
+func (c *ChalkClient) UploadAttachment(ctx context.Context, pageID, path string) error {
+	if pageID == "" {
+		return fmt.Errorf("page ID cannot be empty")
+	}
+	upload, err := newAttachmentUpload(path)
+	if err != nil {
+		return err
+	}
+	// PUT creates the attachment or adds a new version of an existing one
+	_, err = c.doRequest(ctx, "PUT", "/rest/api/content/"+url.PathEscape(pageID)+"/child/attachment", upload)
+	return err
+}
+
+// FindUser looks a Data Center user up by username, returning nil when
+// there is no such user
+func (c *ChalkClient) FindUser(ctx context.Context, name string) (*User, error) {
+	respBody, err := c.doRequest(ctx, "GET", "/rest/api/user?username="+url.QueryEscape(name), nil)
+	if err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var user User
+	if err := json.Unmarshal(respBody, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (c *ChalkClient) GetUser(ctx context.Context, id string) (*User, error) {
+	respBody, err := c.doRequest(ctx, "GET", "/rest/api/user?key="+url.QueryEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	var user User
+	if err := json.Unmarshal(respBody, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
@@ -2,19 +2,35 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync/atomic"
 )
 
+// apiError is a response with an error status
+type apiError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("API error (status %d): %s", e.StatusCode, e.Message)
+}
+
 type ConfluenceClient struct {
 	BaseURL  string
 	Username string
 	APIToken string
 	Client   *http.Client
+
+	// useWiki is set once a request only succeeded under the /wiki prefix,
+	// so a long-lived client stops probing the bare path on every call
+	useWiki atomic.Bool
 }
 
 type CreatePageRequest struct {
@@ -57,17 +73,29 @@ func NewConfluenceClient(baseURL, username, apiToken string) *ConfluenceClient {
 	}
 }
 
-func (c *ConfluenceClient) doRequest(method, path string, body interface{}) ([]byte, error) {
+// InstanceURL is the base URL page links are written against
+func (c *ConfluenceClient) InstanceURL() string {
+	return c.BaseURL
+}
+
+func (c *ConfluenceClient) doRequest(ctx context.Context, method, path string, body interface{}) ([]byte, error) {
 	// Prepare request body
 	var bodyData []byte
 	var err error
-	if body != nil {
+	contentType := "application/json"
+	if upload, ok := body.(*attachmentUpload); ok {
+		bodyData, contentType = upload.Data, upload.ContentType
+	} else if body != nil {
 		bodyData, err = json.Marshal(body)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	if c.useWiki.Load() && !strings.Contains(path, "/wiki/") {
+		path = strings.Replace(path, "/rest/api/", "/wiki/rest/api/", 1)
+	}
+
 	// Try the requested path first
 	fullURL := c.BaseURL + path
 	var reqBody io.Reader
@@ -80,13 +108,14 @@ func (c *ConfluenceClient) doRequest(method, path string, body interface{}) ([]b
 		return nil, fmt.Errorf("only HTTPS URLs are allowed for security Confluence %s", c.BaseURL)
 	}
 
-	req, err := http.NewRequest(method, fullURL, reqBody)
+	req, err := http.NewRequestWithContext(ctx, method, fullURL, reqBody)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.SetBasicAuth(c.Username, c.APIToken)
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Atlassian-Token", "nocheck")
 	req.Header.Set("Accept", "application/json")
 
 	resp, err := c.Client.Do(req)
@@ -106,10 +135,11 @@ func (c *ConfluenceClient) doRequest(method, path string, body interface{}) ([]b
 		if wikiPath != path {
 			wikiURL := c.BaseURL + wikiPath
 			wikiReqBody := bytes.NewBuffer(bodyData)
-			wikiReq, err := http.NewRequest(method, wikiURL, wikiReqBody)
+			wikiReq, err := http.NewRequestWithContext(ctx, method, wikiURL, wikiReqBody)
 			if err == nil {
 				wikiReq.SetBasicAuth(c.Username, c.APIToken)
-				wikiReq.Header.Set("Content-Type", "application/json")
+				wikiReq.Header.Set("Content-Type", contentType)
+				wikiReq.Header.Set("X-Atlassian-Token", "nocheck")
 				wikiReq.Header.Set("Accept", "application/json")
 				wikiResp, err := c.Client.Do(wikiReq)
 				if err == nil {
@@ -117,6 +147,7 @@ func (c *ConfluenceClient) doRequest(method, path string, body interface{}) ([]b
 					wikiRespBody, err := io.ReadAll(wikiResp.Body)
 					if err == nil {
 						if wikiResp.StatusCode < 400 {
+							c.useWiki.Store(true)
 							return wikiRespBody, nil
 						}
 						// Wiki path also failed, return original error
@@ -134,30 +165,30 @@ func (c *ConfluenceClient) doRequest(method, path string, body interface{}) ([]b
 			errorMsg = errorMsg[:500] + "..."
 		}
 		// Don't include full URL in error (might contain credentials in some cases)
-		return nil, fmt.Errorf("API error (status %d): %s", resp.StatusCode, errorMsg)
+		return nil, &apiError{StatusCode: resp.StatusCode, Message: errorMsg}
 	}
 
 	return respBody, nil
 }
 
-func (c *ConfluenceClient) ListSpaces(opts *ListOptions) ([]Space, error) {
+func (c *ConfluenceClient) spacesEndpoint(opts *ListOptions, start int) string {
 	limit := 100
-	offset := 0
+	filter := ""
 
 	if opts != nil {
 		if opts.Limit > 0 {
 			limit = opts.Limit
 		}
-		if opts.Offset > 0 {
-			offset = opts.Offset
-		}
 		if opts.Query != "" {
-			query = fmt.Sprintf("&spaceKey=%s", url.QueryEscape(opts.Query))
+			filter = fmt.Sprintf("&spaceKey=%s", url.QueryEscape(opts.Query))
 		}
 	}
-	endpoint := fmt.Sprintf("/rest/api/space?limit=%d&start=%d%s", limit, offset, query)
+	return fmt.Sprintf("/rest/api/space?limit=%d&start=%d%s", limit, start, filter)
+}
 
-	respBody, err := c.doRequest("GET", endpoint, nil)
+func (c *ConfluenceClient) ListSpaces(ctx context.Context, opts *ListOptions) ([]Space, error) {
+	endpoint := c.spacesEndpoint(opts, startOffset(opts))
+	respBody, err := c.doRequest(ctx, "GET", endpoint, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -170,7 +201,7 @@ func (c *ConfluenceClient) ListSpaces(opts *ListOptions) ([]Space, error) {
 	return spacesResp.Results, nil
 }
 
-func (c *ConfluenceClient) CreatePage(spaceKey, title, content, parentID string) (*Page, error) {
+func (c *ConfluenceClient) CreatePage(ctx context.Context, spaceKey, title, content, parentID string) (*Page, error) {
 	req := CreatePageRequest{
 		Type:  "page",
 		Title: title,
@@ -185,7 +216,7 @@ func (c *ConfluenceClient) CreatePage(spaceKey, title, content, parentID string)
 		}{{ID: parentID}}
 	}
 
-	respBody, err := c.doRequest("POST", "/rest/api/content", req)
+	respBody, err := c.doRequest(ctx, "POST", "/rest/api/content", req)
 	if err != nil {
 		return nil, err
 	}
@@ -198,14 +229,14 @@ func (c *ConfluenceClient) CreatePage(spaceKey, title, content, parentID string)
 	return &page, nil
 }
 
-func (c *ConfluenceClient) GetPage(pageID string) (*Page, error) {
+func (c *ConfluenceClient) GetPage(ctx context.Context, pageID string) (*Page, error) {
 	// Validate and sanitize pageID to prevent injection
 	if pageID == "" {
 		return nil, fmt.Errorf("page ID cannot be empty")
 	}
 	// URL encode to prevent injection
 	encodedPageID := url.PathEscape(pageID)
-	respBody, err := c.doRequest("GET", "/rest/api/content/"+encodedPageID+"?expand=body.storage,version,space", nil)
+	respBody, err := c.doRequest(ctx, "GET", "/rest/api/content/"+encodedPageID+"?expand=body.storage,version,space", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -218,7 +249,7 @@ func (c *ConfluenceClient) GetPage(pageID string) (*Page, error) {
 	return &page, nil
 }
 
-func (c *ConfluenceClient) UpdatePage(pageID, content string) (*Page, error) {
+func (c *ConfluenceClient) UpdatePage(ctx context.Context, pageID, content string) (*Page, error) {
 	// Validate pageID
 	if pageID == "" {
 		return nil, fmt.Errorf("page ID cannot be empty")
@@ -226,7 +257,7 @@ func (c *ConfluenceClient) UpdatePage(pageID, content string) (*Page, error) {
 	// URL encode to prevent injection
 	encodedPageID := url.PathEscape(pageID)
 
-	page, err := c.GetPage(pageID)
+	page, err := c.GetPage(ctx, pageID)
 	if err != nil {
 		return nil, err
 	}
@@ -239,7 +270,7 @@ func (c *ConfluenceClient) UpdatePage(pageID, content string) (*Page, error) {
 	req.Body.Storage.Value = content
 	req.Body.Storage.Representation = "storage"
 
-	respBody, err := c.doRequest("PUT", "/rest/api/content/"+encodedPageID, req)
+	respBody, err := c.doRequest(ctx, "PUT", "/rest/api/content/"+encodedPageID, req)
 	if err != nil {
 		return nil, err
 	}
@@ -252,13 +283,21 @@ func (c *ConfluenceClient) UpdatePage(pageID, content string) (*Page, error) {
 	return &updatedPage, nil
 }
 
-func (c *ConfluenceClient) SearchPages(spaceKey string, opts *ListOptions) ([]Page, error) {
+func (c *ConfluenceClient) searchEndpoint(spaceKey string, opts *ListOptions, start int) string {
+	limit := 100
+	if opts != nil && opts.Limit > 0 {
+		limit = opts.Limit
+	}
+	encodedSpaceKey := url.QueryEscape(spaceKey)
+	return fmt.Sprintf("/rest/api/content?spaceKey=%s&limit=%d&start=%d&expand=version,space", encodedSpaceKey, limit, start)
+}
+
+func (c *ConfluenceClient) SearchPages(ctx context.Context, spaceKey string, opts *ListOptions) ([]Page, error) {
 	// Validate and URL encode spaceKey to prevent injection
 	if spaceKey == "" {
 		return nil, fmt.Errorf("space key cannot be empty")
 	}
-	encodedSpaceKey := url.QueryEscape(spaceKey)
-	respBody, err := c.doRequest("GET", fmt.Sprintf("/rest/api/content?spaceKey=%s&limit=100&expand=version,space", encodedSpaceKey), nil)
+	respBody, err := c.doRequest(ctx, "GET", c.searchEndpoint(spaceKey, opts, startOffset(opts)), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -270,3 +309,79 @@ func (c *ConfluenceClient) SearchPages(spaceKey string, opts *ListOptions) ([]Pa
 
 	return pagesResp.Results, nil
 }
+
+// IterSpaces walks every space matching opts, starting at opts.Offset
+func (c *ConfluenceClient) IterSpaces(ctx context.Context, opts *ListOptions) *Iterator[Space] {
+	return newIterator[Space](ctx, c.doRequest, func(start int) string {
+		return c.spacesEndpoint(opts, start)
+	}, startOffset(opts))
+}
+
+// IterPages walks every page in spaceKey matching opts, starting at opts.Offset
+func (c *ConfluenceClient) IterPages(ctx context.Context, spaceKey string, opts *ListOptions) *Iterator[Page] {
+	return newIterator[Page](ctx, c.doRequest, func(start int) string {
+		return c.searchEndpoint(spaceKey, opts, start)
+	}, startOffset(opts))
+}
+
+func (c *ConfluenceClient) UploadAttachment(ctx context.Context, pageID, path string) error {
+	if pageID == "" {
+		return fmt.Errorf("page ID cannot be empty")
+	}
+	upload, err := newAttachmentUpload(path)
+	if err != nil {
+		return err
+	}
+	// PUT creates the attachment or adds a new version of an existing one
+	_, err = c.doRequest(ctx, "PUT", "/rest/api/content/"+url.PathEscape(pageID)+"/child/attachment", upload)
+	return err
+}
+
+// FindUser searches users by name for an @mention. Cloud has no usernames,
+// so the name is matched exactly, ignoring case, against public names,
+// display names and the local part of email addresses; it returns nil
+// unless exactly one user matches. The search itself is fuzzy, so a user
+// it finds but no name of matches is not taken.
+func (c *ConfluenceClient) FindUser(ctx context.Context, name string) (*User, error) {
+	query := strings.NewReplacer(".", " ", "_", " ", "\\", "\\\\", "\"", "\\\"").Replace(name)
+	params := url.Values{}
+	params.Add("cql", fmt.Sprintf("user.fullname ~ \"%s\"", query))
+	params.Add("limit", "25")
+	respBody, err := c.doRequest(ctx, "GET", "/rest/api/search/user?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var search UserSearchResponse
+	if err := json.Unmarshal(respBody, &search); err != nil {
+		return nil, err
+	}
+	var found *User
+	for i, result := range search.Results {
+		user := result.User
+		local, _, _ := strings.Cut(user.Email, "@")
+		for _, candidate := range []string{user.PublicName, user.DisplayName, local} {
+			if candidate == "" || !strings.EqualFold(candidate, name) {
+				continue
+			}
+			if found != nil && found.AccountID != user.AccountID {
+				return nil, nil
+			}
+			found = &search.Results[i].User
+			break
+		}
+	}
+	return found, nil
+}
+
+func (c *ConfluenceClient) GetUser(ctx context.Context, id string) (*User, error) {
+	respBody, err := c.doRequest(ctx, "GET", "/rest/api/user?accountId="+url.QueryEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	var user User
+	if err := json.Unmarshal(respBody, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
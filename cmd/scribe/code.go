@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/wmorley/scribe-cli/storage"
+)
+
+// codeAliases are the fence languages mapped to code macro languages for
+// files in dir: the defaults, then the config files' code_aliases, with
+// SCRIBE_CODE_ALIASES (e.g. "kotlin=java,tsx=js") on top. Config files that
+// fail to load add nothing; the pipeline, read from the same files, reports them.
+func codeAliases(dir string) map[string]string {
+	aliases := map[string]string{}
+	for alias, language := range storage.DefaultCodeAliases {
+		aliases[alias] = language
+	}
+	if config, err := loadConfig(dir); err == nil {
+		for alias, language := range config.CodeAliases {
+			aliases[alias] = language
+		}
+	}
+	for _, pair := range strings.Split(os.Getenv("SCRIBE_CODE_ALIASES"), ",") {
+		if alias, language, ok := strings.Cut(pair, "="); ok {
+			aliases[strings.TrimSpace(strings.ToLower(alias))] = strings.TrimSpace(language)
+		}
+	}
+	return aliases
+}
+
+// codeToMarkdown writes a code macro as a fence, with its parameters other
+// than the language in the info string
+func codeToMarkdown(macro *goquery.Selection) string {
+	info := macro.ChildrenFiltered("ac\\:parameter[ac\\:name='language']").Text()
+	macro.ChildrenFiltered("ac\\:parameter").Each(func(_ int, param *goquery.Selection) {
+		name := param.AttrOr("ac:name", "")
+		if name == "" || name == "language" {
+			return
+		}
+		if info == "" && param.Text() == "true" {
+			// A bare word first would be read back as the language
+			info = name + "=true"
+			return
+		}
+		info += " " + codeInfoParam(name, param.Text())
+	})
+	code := macro.Find("ac\\:plain-text-body").Text()
+
+	fence := "```"
+	if strings.Contains(info, "`") {
+		fence = "~~~"
+	}
+	for strings.Contains(code, fence) {
+		fence += fence[:1]
+	}
+	return fmt.Sprintf("\n%s%s\n%s\n%s\n", fence, strings.TrimSpace(info), code, fence)
+}
+
+// codeInfoParam writes a parameter as ParseCodeInfo reads it back: bare
+// when true, quoted when the value has spaces or quotes
+func codeInfoParam(name, value string) string {
+	switch {
+	case value == "true":
+		return name
+	case value == "" || strings.ContainsAny(value, " \t\"\\"):
+		return name + `="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+	}
+	return name + "=" + value
+}
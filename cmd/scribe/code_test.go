@@ -0,0 +1,91 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wmorley/scribe-cli/storage"
+)
+
+func TestCodeAliasesFromEnvironment(t *testing.T) {
+	t.Setenv("SCRIBE_CODE_ALIASES", "golang=text, Kotlin=java")
+
+	got := ConvertMarkdownToConfluence("```golang\nx\n```\n\n```kotlin\ny\n```\n\n```yaml\nz\n```")
+	for _, want := range []string{
+		`<ac:parameter ac:name="language">text</ac:parameter><ac:plain-text-body><![CDATA[x]]>`,
+		`<ac:parameter ac:name="language">java</ac:parameter><ac:plain-text-body><![CDATA[y]]>`,
+		`<ac:parameter ac:name="language">yml</ac:parameter><ac:plain-text-body><![CDATA[z]]>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("storage lacks %s:\n%s", want, got)
+		}
+	}
+}
+
+func TestCodeAliasesFromConfig(t *testing.T) {
+	dir := writeConfigs(t, "code_aliases: {golang: text, Kotlin: kt}\n", "code_aliases: {kotlin: java, gradle: groovy}\n")
+	t.Setenv("SCRIBE_CODE_ALIASES", "golang=go")
+
+	aliases := codeAliases(dir)
+	for alias, want := range map[string]string{"golang": "go", "kotlin": "java", "gradle": "groovy", "yaml": "yml"} {
+		if aliases[alias] != want {
+			t.Errorf("%s maps to %q, want %q", alias, aliases[alias], want)
+		}
+	}
+	// The repository's aliases only apply to its files
+	if outside := codeAliases("."); outside["kotlin"] != "kt" || outside["gradle"] != "" {
+		t.Errorf("outside the repository kotlin maps to %q and gradle to %q, want kt and nothing", outside["kotlin"], outside["gradle"])
+	}
+
+	converted := ConvertMarkdownFileToConfluence("```kotlin\nx\n```", filepath.Join(dir, "doc.md"), "", nil)
+	if want := `<ac:parameter ac:name="language">java</ac:parameter>`; !strings.Contains(converted.Body, want) {
+		t.Errorf("storage lacks %s:\n%s", want, converted.Body)
+	}
+}
+
+func TestCodeParametersPullAsInfoString(t *testing.T) {
+	for _, c := range []struct{ params, markdown string }{
+		{`<ac:parameter ac:name="title">say "hi"</ac:parameter><ac:parameter ac:name="language">py</ac:parameter><ac:parameter ac:name="linenumbers">true</ac:parameter>`,
+			"```py title=\"say \\\"hi\\\"\" linenumbers\nx\n```"},
+		{`<ac:parameter ac:name="collapse">true</ac:parameter>`, "```collapse=true\nx\n```"},
+		{"<ac:parameter ac:name=\"title\">a`b</ac:parameter>", "~~~title=a`b\nx\n~~~"},
+	} {
+		storage := `<ac:structured-macro ac:name="code">` + c.params + `<ac:plain-text-body><![CDATA[x]]></ac:plain-text-body></ac:structured-macro>`
+		got := ConvertConfluenceToMarkdown(storage)
+		if got != c.markdown {
+			t.Errorf("pulled\n%s\nwant\n%s", got, c.markdown)
+		}
+		if again := ConvertConfluenceToMarkdown(ConvertMarkdownToConfluence(got)); again != got {
+			t.Errorf("%s does not survive a round trip:\n%s", got, again)
+		}
+	}
+}
+
+func TestCodeAliasesNameBrushes(t *testing.T) {
+	for alias, language := range storage.DefaultCodeAliases {
+		if !storage.CodeLanguages[language] {
+			t.Errorf("alias %s maps to %s, which the code macro does not highlight", alias, language)
+		}
+	}
+}
+
+func TestCodeInfoKeepsOnlyMacroParameters(t *testing.T) {
+	markdown := "```ts {1,3} title=app.ts hl_lines=2\nx\n```"
+	got := ConvertMarkdownToConfluence(markdown)
+	want := `<ac:structured-macro ac:name="code"><ac:parameter ac:name="language">js</ac:parameter><ac:parameter ac:name="title">app.ts</ac:parameter><ac:plain-text-body>`
+	if !strings.Contains(got, want) || strings.Contains(got, "{1,3}") || strings.Contains(got, "hl_lines") {
+		t.Errorf("storage\n%s\nwant only the title after the language", got)
+	}
+
+	var issues []string
+	for _, issue := range lintMarkdown("doc.md", markdown) {
+		issues = append(issues, issue.String())
+	}
+	if want := []string{
+		`doc.md:1:4: "{1,3}" is not a code macro parameter, so push drops it [code-parameter]`,
+		`doc.md:1:4: "hl_lines" is not a code macro parameter, so push drops it [code-parameter]`,
+	}; strings.Join(issues, "\n") != strings.Join(want, "\n") {
+		t.Errorf("lint issues\n%s\nwant\n%s", strings.Join(issues, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// RepoConfigFile is the per-repository config file, found by walking up
+// from the directory of the file being converted
+const RepoConfigFile = ".scribe.yaml"
+
+// Config is what the config files set. The user's file
+// ($XDG_CONFIG_HOME/scribe/config.yaml) is read first and the repository's
+// second; pipeline stages from both run, the user's first, and the
+// repository's profile settings override the user's, short of sending a
+// token from the user's file somewhere else.
+type Config struct {
+	DefaultProfile string             `yaml:"default_profile"`
+	Profiles       map[string]Profile `yaml:"profiles"`
+	Pipeline       []StageConfig      `yaml:"pipeline"`
+	// CodeAliases map fence languages to code macro languages, over the
+	// defaults; the repository's win over the user's
+	CodeAliases map[string]string `yaml:"code_aliases"`
+	// CredentialHelper is only read from the user's file: a repository
+	// must not choose the command API tokens are handed to
+	CredentialHelper string `yaml:"credential_helper"`
+	// TrustedRepositories are the directories whose .scribe.yaml may run
+	// exec stages. Only read from the user's file.
+	TrustedRepositories []string `yaml:"trusted_repositories"`
+}
+
+// Profile is a named instance to talk to, in place of the SCRIBE_URL,
+// SCRIBE_USERNAME, SCRIBE_API_TOKEN and SCRIBE_PROVIDER variables
+type Profile struct {
+	URL      string `yaml:"url" json:"url"`
+	Username string `yaml:"username" json:"username,omitempty"`
+	APIToken string `yaml:"api_token" json:"-"`
+	Provider string `yaml:"provider" json:"provider,omitempty"`
+}
+
+// merge sets the fields other sets
+func (p *Profile) merge(other Profile) {
+	if other.URL != "" {
+		p.URL = other.URL
+	}
+	if other.Username != "" {
+		p.Username = other.Username
+	}
+	if other.APIToken != "" {
+		p.APIToken = other.APIToken
+	}
+	if other.Provider != "" {
+		p.Provider = other.Provider
+	}
+}
+
+// userConfigPath is the user's config file, or "" when there is no config directory
+func userConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "scribe", "config.yaml")
+}
+
+// repoConfigPath is the nearest .scribe.yaml in dir or above it, or ""
+func repoConfigPath(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(dir, RepoConfigFile)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// loadConfig reads the user's config file and the repository config file
+// that applies to dir. Missing files are skipped.
+func loadConfig(dir string) (*Config, error) {
+	config := &Config{}
+	for _, path := range []string{userConfigPath(), repoConfigPath(dir)} {
+		if path == "" {
+			continue
+		}
+		file, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if file == nil {
+			continue
+		}
+		user := path == userConfigPath()
+		if !user {
+			if err := config.checkRepoConfig(file); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+		for i := range file.Pipeline {
+			file.Pipeline[i].trusted = user || config.trusts(file.Pipeline[i].dir)
+		}
+		config.add(file)
+	}
+	return config, nil
+}
+
+// checkRepoConfig rejects what a repository's file may not set over the
+// user's: the credential helper, or where a token from the user's file is sent
+func (c *Config) checkRepoConfig(file *Config) error {
+	if file.CredentialHelper != "" {
+		return fmt.Errorf("credential_helper can only be set in %s", userConfigPath())
+	}
+	if len(file.TrustedRepositories) > 0 {
+		return fmt.Errorf("trusted_repositories can only be set in %s", userConfigPath())
+	}
+	for name, profile := range file.Profiles {
+		user, ok := c.Profiles[name]
+		if !ok || user.APIToken == "" {
+			continue
+		}
+		if (profile.URL != "" && profile.URL != user.URL) || (profile.Provider != "" && profile.Provider != user.Provider) {
+			return fmt.Errorf("profile %s has its api_token in %s, so its url and provider can only be set there", name, userConfigPath())
+		}
+	}
+	return nil
+}
+
+// trusts reports whether the repository config in dir may run commands
+func (c *Config) trusts(dir string) bool {
+	for _, trusted := range c.TrustedRepositories {
+		if filepath.IsAbs(trusted) && filepath.Clean(trusted) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// add layers file over the config read so far
+func (c *Config) add(file *Config) {
+	if file.CredentialHelper != "" {
+		c.CredentialHelper = file.CredentialHelper
+	}
+	c.TrustedRepositories = append(c.TrustedRepositories, file.TrustedRepositories...)
+	if file.DefaultProfile != "" {
+		c.DefaultProfile = file.DefaultProfile
+	}
+	for name, profile := range file.Profiles {
+		if c.Profiles == nil {
+			c.Profiles = map[string]Profile{}
+		}
+		merged := c.Profiles[name]
+		merged.merge(profile)
+		c.Profiles[name] = merged
+	}
+	for alias, language := range file.CodeAliases {
+		if c.CodeAliases == nil {
+			c.CodeAliases = map[string]string{}
+		}
+		c.CodeAliases[strings.ToLower(alias)] = language
+	}
+	c.Pipeline = append(c.Pipeline, file.Pipeline...)
+}
+
+// readConfigFile parses the config file at path, or returns nil if there is none
+func readConfigFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range config.Pipeline {
+		config.Pipeline[i].dir = filepath.Dir(path)
+	}
+	return config, nil
+}
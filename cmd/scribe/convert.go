@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// FormatStorage is Confluence storage format, which convert goes through
+// between any two other formats
+const FormatStorage = "storage"
+
+// formatExtensions are the file extensions convert reads --from off and
+// writes --output-dir files with
+var formatExtensions = map[string]string{
+	FormatMarkdown: ".md",
+	FormatWiki:     ".wiki",
+	FormatStorage:  ".xml",
+}
+
+// ConvertOptions configure an offline conversion
+type ConvertOptions struct {
+	From string
+	To   string
+	// Frontmatter is "strip" to drop a leading --- block, or "keep" to copy
+	// it to Markdown and wiki output. Storage output never carries it.
+	Frontmatter string
+	// Macros renames macros between Markdown and Confluence, keyed by the
+	// name Markdown converts to: {"info": "panel"} pushes alerts as panel
+	// macros and pulls panel macros as alerts
+	Macros map[string]string
+	// Pipeline runs around conversions from and to Markdown, for File
+	Pipeline *pipeline
+	File     string
+	// BaseURL is the instance links to other pages point at in Markdown
+	// output; without it they keep only their text
+	BaseURL string
+}
+
+// convertDocument converts content from one of markdown, wiki or storage
+// to another, offline: links, mentions and diagrams are written as they
+// are rather than resolved against Confluence. Raw HTML is sanitized as
+// it is on push, and storage converted from Markdown or wiki markup that
+// Confluence would reject is an error. Warnings go to stderr.
+func convertDocument(content string, opts ConvertOptions) (string, error) {
+	frontmatter := ""
+	switch opts.Frontmatter {
+	case "", "strip":
+	case "keep":
+		if block := strings.TrimSuffix(content, stripFrontmatter(content)); block != "" {
+			frontmatter = block + "\n"
+		}
+	default:
+		return "", fmt.Errorf("unknown --frontmatter %q (want strip or keep)", opts.Frontmatter)
+	}
+
+	var warnings []string
+	defer func() {
+		for _, warning := range warnings {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+		}
+	}()
+
+	var storage string
+	var problems []string
+	switch opts.From {
+	case FormatMarkdown:
+		content, err := opts.Pipeline.run(HookBeforeParse, opts.File, FormatMarkdown, content, &warnings)
+		if err != nil {
+			return "", err
+		}
+		sanitizer := newHTMLSanitizer(opts.File, content)
+		storage = renameMacros(convertMarkdown(content, append(markdownExtenders(content, opts.File), opts.Pipeline.extender(), sanitizer.Extender())...), opts.Macros)
+		sanitizer.report(&warnings, &problems)
+		if storage, err = opts.Pipeline.run(HookAfterRender, opts.File, FormatStorage, storage, &warnings); err != nil {
+			return "", err
+		}
+		if len(problems) == 0 {
+			problems = validateStorage(storage)
+		}
+	case FormatWiki:
+		storage = ConvertWikiToConfluence(content)
+		problems = validateStorage(storage)
+	case FormatStorage:
+		storage = content
+	default:
+		return "", fmt.Errorf("unknown --from format %q (want %s, %s or %s)", opts.From, FormatMarkdown, FormatWiki, FormatStorage)
+	}
+	if len(problems) > 0 {
+		return "", fmt.Errorf("Confluence would reject the converted page:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	switch opts.To {
+	case FormatMarkdown:
+		markdown, err := opts.Pipeline.run(HookAfterPull, opts.File, FormatMarkdown, convertConfluence(renameMacros(storage, invertMacros(opts.Macros)), &pageLinkTargets{baseURL: opts.BaseURL}), &warnings)
+		return frontmatter + markdown, err
+	case FormatWiki:
+		return frontmatter + ConvertConfluenceToWiki(storage), nil
+	case FormatStorage:
+		return storage, nil
+	}
+	return "", fmt.Errorf("unknown --to format %q (want %s, %s or %s)", opts.To, FormatMarkdown, FormatWiki, FormatStorage)
+}
+
+var macroNamePattern = regexp.MustCompile(`(<ac:structured-macro\b[^>]*\bac:name=")([^"]*)"`)
+
+// renameMacros gives the macros in storage the names names maps them to.
+// Only the start tags of macros are rewritten, never text or CDATA that
+// looks like one; storage that cannot be tokenized is returned unchanged.
+func renameMacros(storage string, names map[string]string) string {
+	if len(names) == 0 {
+		return storage
+	}
+	decoder := xml.NewDecoder(strings.NewReader(storage))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	var b strings.Builder
+	copied := 0
+	for {
+		offset := int(decoder.InputOffset())
+		tok, err := decoder.RawToken()
+		if err == io.EOF {
+			return b.String() + storage[copied:]
+		}
+		if err != nil {
+			return storage
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || xmlName(start.Name) != "ac:structured-macro" {
+			continue
+		}
+		name, ok := names[xmlAttr(start, "ac:name")]
+		if !ok {
+			continue
+		}
+		tag := storage[offset:decoder.InputOffset()]
+		m := macroNamePattern.FindStringSubmatchIndex(tag)
+		if m == nil {
+			continue
+		}
+		b.WriteString(storage[copied:offset])
+		b.WriteString(tag[:m[3]])
+		_ = xml.EscapeText(&b, []byte(name))
+		b.WriteString(tag[m[1]-1:])
+		copied = offset + len(tag)
+	}
+}
+
+func invertMacros(names map[string]string) map[string]string {
+	inverted := make(map[string]string, len(names))
+	for from, to := range names {
+		inverted[to] = from
+	}
+	return inverted
+}
+
+// parseMacroMappings reads --macro markdown=confluence pairs
+func parseMacroMappings(mappings []string) (map[string]string, error) {
+	names := map[string]string{}
+	for _, mapping := range mappings {
+		from, to, ok := strings.Cut(mapping, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid --macro %q (want markdown-name=confluence-name)", mapping)
+		}
+		names[from] = to
+	}
+	return names, nil
+}
+
+// formatOf is the format a file's extension names, or markdown
+func formatOf(file string) string {
+	ext := strings.ToLower(filepath.Ext(file))
+	for format, formatExt := range formatExtensions {
+		if ext == formatExt {
+			return format
+		}
+	}
+	return FormatMarkdown
+}
+
+// ConvertParams mirror convert's flags for one document: Content, or the
+// contents of File when Content is empty
+type ConvertParams struct {
+	File        string   `json:"file"`
+	Content     string   `json:"content"`
+	From        string   `json:"from"`
+	To          string   `json:"to"`
+	Frontmatter string   `json:"frontmatter"`
+	Macro       []string `json:"macro"`
+}
+
+// ConvertResult is a converted document
+type ConvertResult struct {
+	Content string `json:"content"`
+}
+
+// convertContent converts one document offline, writing links to other
+// pages against client's instance
+func convertContent(ctx context.Context, client ScribeProvider, p ConvertParams, progress ProgressFunc) (*ConvertResult, error) {
+	macros, err := parseMacroMappings(p.Macro)
+	if err != nil {
+		return nil, err
+	}
+	content, dir := p.Content, "."
+	if p.File != "" {
+		dir = filepath.Dir(p.File)
+	}
+	if content == "" && p.File != "" {
+		data, err := os.ReadFile(p.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+		content = string(data)
+	}
+	opts := ConvertOptions{From: p.From, To: p.To, Frontmatter: p.Frontmatter, Macros: macros, File: p.File, BaseURL: instanceURL(client)}
+	if opts.From == "" {
+		opts.From = formatOf(p.File)
+	}
+	if opts.To == "" {
+		opts.To = FormatStorage
+	}
+	if opts.Pipeline, err = loadPipeline(dir); err != nil {
+		return nil, err
+	}
+	output, err := convertDocument(content, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &ConvertResult{Content: output}, nil
+}
+
+func runConvert(cmd *cobra.Command, args []string) error {
+	macros, err := parseMacroMappings(convertMacros)
+	if err != nil {
+		return err
+	}
+	opts := ConvertOptions{To: convertTo, Frontmatter: convertFrontmatter, Macros: macros}
+
+	if len(args) == 0 {
+		if convertOutputDir != "" {
+			return fmt.Errorf("--output-dir needs file arguments")
+		}
+		input, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read stdin: %w", err)
+		}
+		opts.From = convertFrom
+		if opts.From == "" {
+			opts.From = FormatMarkdown
+		}
+		if opts.BaseURL, err = profileURL(profileName, "."); err != nil {
+			return err
+		}
+		if opts.Pipeline, err = loadPipeline("."); err != nil {
+			return err
+		}
+		output, err := convertDocument(string(input), opts)
+		if err != nil {
+			return err
+		}
+		fmt.Println(output)
+		return nil
+	}
+
+	for _, file := range args {
+		input, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		opts.From = convertFrom
+		if opts.From == "" {
+			opts.From = formatOf(file)
+		}
+		opts.File = file
+		if opts.BaseURL, err = profileURL(profileName, filepath.Dir(file)); err != nil {
+			return err
+		}
+		if opts.Pipeline, err = loadPipeline(filepath.Dir(file)); err != nil {
+			return err
+		}
+		output, err := convertDocument(string(input), opts)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		if convertOutputDir == "" {
+			fmt.Println(output)
+			continue
+		}
+		base := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		out := filepath.Join(convertOutputDir, base+formatExtensions[opts.To])
+		if err := os.WriteFile(out, []byte(output+"\n"), 0o644); err != nil {
+			return fmt.Errorf("failed to write file: %w", err)
+		}
+	}
+	return nil
+}
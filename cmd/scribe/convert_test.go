@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConvertDocument(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		content string
+		opts    ConvertOptions
+		want    string
+	}{
+		{
+			name:    "markdown to wiki",
+			content: "# Title\n\nSome **bold** text.",
+			opts:    ConvertOptions{From: FormatMarkdown, To: FormatWiki},
+			want:    "h1. Title\n\nSome *bold* text.",
+		},
+		{
+			name:    "wiki to markdown",
+			content: "h2. Title\n\n* item",
+			opts:    ConvertOptions{From: FormatWiki, To: FormatMarkdown},
+			want:    "## Title\n\n- item",
+		},
+		{
+			name:    "frontmatter stripped",
+			content: "---\nconfluence_title: Guide\n---\n\nText",
+			opts:    ConvertOptions{From: FormatMarkdown, To: FormatMarkdown},
+			want:    "Text",
+		},
+		{
+			name:    "frontmatter kept",
+			content: "---\nconfluence_title: Guide\n---\n\nText",
+			opts:    ConvertOptions{From: FormatMarkdown, To: FormatMarkdown, Frontmatter: "keep"},
+			want:    "---\nconfluence_title: Guide\n---\n\nText",
+		},
+		{
+			name:    "frontmatter never in storage",
+			content: "---\nconfluence_title: Guide\n---\n\nText",
+			opts:    ConvertOptions{From: FormatMarkdown, To: FormatStorage, Frontmatter: "keep"},
+			want:    "<p>Text</p>\n",
+		},
+		{
+			name:    "macro pushed under its mapped name",
+			content: "> [!WARNING]\n> Careful",
+			opts:    ConvertOptions{From: FormatMarkdown, To: FormatStorage, Macros: map[string]string{"warning": "alert"}},
+			want:    "<ac:structured-macro ac:name=\"alert\"><ac:rich-text-body>\n<p>Careful</p>\n</ac:rich-text-body></ac:structured-macro>\n",
+		},
+		{
+			name:    "code that looks like a mapped macro left alone",
+			content: "> [!NOTE]\n> Heads up\n\n```xml\n<ac:structured-macro ac:name=\"info\"/>\n```",
+			opts:    ConvertOptions{From: FormatMarkdown, To: FormatStorage, Macros: map[string]string{"info": "panel"}},
+			want: "<ac:structured-macro ac:name=\"panel\"><ac:rich-text-body>\n<p>Heads up</p>\n</ac:rich-text-body></ac:structured-macro>\n" +
+				"<ac:structured-macro ac:name=\"code\"><ac:parameter ac:name=\"language\">xml</ac:parameter><ac:plain-text-body><![CDATA[<ac:structured-macro ac:name=\"info\"/>]]></ac:plain-text-body></ac:structured-macro>\n",
+		},
+		{
+			name:    "mapped macro pulled as Markdown",
+			content: `<ac:structured-macro ac:name="alert"><ac:rich-text-body><p>Careful</p></ac:rich-text-body></ac:structured-macro>`,
+			opts:    ConvertOptions{From: FormatStorage, To: FormatMarkdown, Macros: map[string]string{"warning": "alert"}},
+			want:    "> [!WARNING]\n> Careful",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := convertDocument(tt.content, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for _, opts := range []ConvertOptions{
+		{From: "rst", To: FormatStorage},
+		{From: FormatWiki, To: "html"},
+		{From: FormatMarkdown, To: FormatMarkdown, Frontmatter: "merge"},
+	} {
+		if _, err := convertDocument("x", opts); err == nil {
+			t.Errorf("%+v accepted", opts)
+		}
+	}
+}
+
+func TestParseMacroMappings(t *testing.T) {
+	names, err := parseMacroMappings([]string{"info=panel", " code = code-pro "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names["info"] != "panel" || names["code"] != "code-pro" {
+		t.Errorf("got %v", names)
+	}
+	for _, bad := range []string{"info", "=panel", "info="} {
+		if _, err := parseMacroMappings([]string{bad}); err == nil || !strings.Contains(err.Error(), bad) {
+			t.Errorf("%q accepted: %v", bad, err)
+		}
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	for file, want := range map[string]string{
+		"doc.md": FormatMarkdown, "legacy.WIKI": FormatWiki, "page.xml": FormatStorage, "notes.txt": FormatMarkdown,
+	} {
+		if got := formatOf(file); got != want {
+			t.Errorf("formatOf(%q) = %q, want %q", file, got, want)
+		}
+	}
+}
@@ -2,71 +2,139 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/xml"
 	"fmt"
 	htmltomarkdown "github.com/JohannesKaufmann/html-to-markdown"
+	"github.com/JohannesKaufmann/html-to-markdown/escape"
 	"github.com/JohannesKaufmann/html-to-markdown/plugin"
 	"github.com/PuerkitoBio/goquery"
+	"github.com/wmorley/scribe-cli/storage"
 	"github.com/yuin/goldmark"
-	"github.com/yuin/goldmark/extension"
-	"github.com/yuin/goldmark/parser"
-	"github.com/yuin/goldmark/renderer/html"
-	"regexp"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+	nethtml "golang.org/x/net/html"
+	"html"
+	"io"
+	"net/url"
+	"path/filepath"
 	"strings"
 )
 
-// ConvertMarkdownToConfluence uses Goldmark to generate strict XHTML
+// ConvertMarkdownToConfluence uses Goldmark with the storage renderer to generate strict XHTML
 func ConvertMarkdownToConfluence(markdown string) string {
-	content := stripFrontmatter(markdown)
+	return convertMarkdown(markdown, markdownExtenders(markdown, "")...)
+}
+
+// markdownExtenders are the extensions ConvertMarkdownToConfluence converts
+// with, which need nothing from Confluence, for markdown read from file.
+// Without a file the code aliases are those configured for the working directory.
+func markdownExtenders(markdown, file string) []goldmark.Extender {
+	return []goldmark.Extender{storage.Mentions(nil), storage.Maths(mathMacros(), nil),
+		storage.HeadingAnchors(parseFrontmatter(markdown)["confluence_title"]), storage.CodeAliases(codeAliases(filepath.Dir(file)))}
+}
+
+// parseMarkdown returns the document ConvertMarkdownToConfluence renders for
+// markdown read from file, and the source its nodes point into: markdown
+// without its frontmatter
+func parseMarkdown(markdown, file string) (ast.Node, []byte) {
+	source := []byte(stripFrontmatter(markdown))
+	return storage.New(markdownExtenders(markdown, file)...).Parser().Parse(text.NewReader(source)), source
+}
+
+// ConvertedFile is a Markdown file converted for upload: the storage body,
+// the rendered diagrams to attach to the page, anything worth a warning and
+// any content Confluence would reject, which stops the upload
+type ConvertedFile struct {
+	Body        string
+	Attachments []string
+	Warnings    []string
+	Errors      []string
+}
+
+// ConvertMarkdownFileToConfluence converts the contents of file, also turning
+// links to other local pages, and to pages of the instance at baseURL, into
+// page links and rendering diagram fences. Mentions are resolved against
+// users, which may be nil. It warns about
+// each local link, diagram or mention that could not be resolved and each
+// piece of raw HTML removed, and reports HTML left invalid as errors. The
+// pipeline configured for file runs around the conversion.
+func ConvertMarkdownFileToConfluence(markdown, file, baseURL string, users *userDirectory) *ConvertedFile {
+	converted := &ConvertedFile{}
+	pipe, err := loadPipeline(filepath.Dir(file))
+	if err == nil {
+		markdown, err = pipe.run(HookBeforeParse, file, FormatMarkdown, markdown, &converted.Warnings)
+	}
+	if err != nil {
+		converted.Errors = []string{err.Error()}
+		return converted
+	}
 
-	// 1. Configure Goldmark for Confluence compatibility
-	md := goldmark.New(
-		goldmark.WithExtensions(extension.GFM), // GitHub Flavored Markdown (tables, strikethrough)
-		goldmark.WithParserOptions(
-			parser.WithAutoHeadingID(),
-		),
-		goldmark.WithRendererOptions(
-			html.WithXHTML(),  // CRITICAL: Generates <br/>, <hr/>, <img ... /> for Data Center validity
-			html.WithUnsafe(), // Allow raw HTML (in case user manually added macros)
-		),
-	)
+	links := newLinkResolver(file, baseURL)
+	diagrams := newDiagramRenderer()
+	sanitizer := newHTMLSanitizer(file, markdown)
+	body := convertMarkdown(markdown, pipe.extender(), sanitizer.Extender(), storage.PageLinks(links.Resolve), storage.Diagrams(diagrams.Render), storage.Mentions(users.Resolve),
+		storage.Maths(mathMacros(), mathRenderer(diagrams)), storage.HeadingAnchors(parseFrontmatter(markdown)["confluence_title"]),
+		storage.CodeAliases(codeAliases(filepath.Dir(file))))
+	converted.Attachments = diagrams.Attachments
+	converted.Warnings = append(converted.Warnings, links.Warnings...)
+	converted.Warnings = append(converted.Warnings, diagrams.Warnings...)
+	if users != nil {
+		converted.Warnings = append(converted.Warnings, users.Warnings...)
+	}
+	sanitizer.report(&converted.Warnings, &converted.Errors)
+	if body, err = pipe.run(HookAfterRender, file, FormatStorage, body, &converted.Warnings); err != nil {
+		converted.Errors = append(converted.Errors, err.Error())
+	}
+	converted.Body = body
+	// Anything else wrong came in verbatim, from a confluence-storage fence
+	// or a pipeline stage
+	if len(converted.Errors) == 0 {
+		converted.Errors = validateStorage(body)
+	}
+	return converted
+}
+
+func convertMarkdown(markdown string, extenders ...goldmark.Extender) string {
+	content := stripFrontmatter(markdown)
 
 	var buf bytes.Buffer
-	if err := md.Convert([]byte(content), &buf); err != nil {
+	if err := storage.New(extenders...).Convert([]byte(content), &buf); err != nil {
 		// Fallback to raw content if conversion fails (rare)
 		return content
 	}
 
-	xhtml := buf.String()
-
-	// Goldmark guarantees the structure is predictable.
-	xhtml = regexp.MustCompile(`(?s)<pre><code class="language-(\w+)">(.+?)</code></pre>`).ReplaceAllStringFunc(xhtml, func(match string) string {
-		parts := regexp.MustCompile(`(?s)<pre><code class="language-(\w+)">(.+?)</code></pre>`).FindStringSubmatch(match)
-		lang := parts[1]
-		code := parts[2]
-		// Unescape HTML entities inside code block so they show up correctly in the macro
-		code = strings.ReplaceAll(code, "&lt;", "<")
-		code = strings.ReplaceAll(code, "&gt;", ">")
-		code = strings.ReplaceAll(code, "&amp;", "&")
-
-		return fmt.Sprintf(`<ac:structured-macro ac:name="code"><ac:parameter ac:name="language">%s</ac:parameter><ac:plain-text-body><![CDATA[%s]]></ac:plain-text-body></ac:structured-macro>`, lang, code)
-	})
+	return buf.String()
+}
 
-	// Handle generic code blocks (no language specified)
-	xhtml = regexp.MustCompile(`(?s)<pre><code>(.+?)</code></pre>`).ReplaceAllStringFunc(xhtml, func(match string) string {
-		parts := regexp.MustCompile(`(?s)<pre><code>(.+?)</code></pre>`).FindStringSubmatch(match)
-		code := parts[1]
-		code = strings.ReplaceAll(code, "&lt;", "<")
-		code = strings.ReplaceAll(code, "&gt;", ">")
-		code = strings.ReplaceAll(code, "&amp;", "&")
+// pageLinkTargets decides where links to other pages point on pull, and
+// whose names user links show
+type pageLinkTargets struct {
+	pages   *localPages
+	space   string // for links without ri:space-key, which stay in the page's space
+	baseURL string
+	users   *userDirectory
+}
 
-		return fmt.Sprintf(`<ac:structured-macro ac:name="code"><ac:plain-text-body><![CDATA[%s]]></ac:plain-text-body></ac:structured-macro>`, code)
-	})
+// ConvertConfluenceToMarkdown uses html-to-markdown for robust parsing.
+// Links to other pages keep only their text.
+func ConvertConfluenceToMarkdown(confluence string) string {
+	return convertConfluence(confluence, &pageLinkTargets{})
+}
 
-	return xhtml
+// ConvertConfluencePageToMarkdown converts page, from the instance at
+// baseURL, for a file in dir, pointing links to pages tracked by Markdown
+// files under dir at those files and naming mentioned users from users,
+// which may be nil
+func ConvertConfluencePageToMarkdown(page *Page, dir, baseURL string, users *userDirectory) string {
+	targets := &pageLinkTargets{space: page.Space.Key, baseURL: baseURL, users: users}
+	if dir != "" {
+		targets.pages = indexLocalPages(dir)
+	}
+	return convertConfluence(page.Body.Storage.Value, targets)
 }
 
-// ConvertConfluenceToMarkdown uses html-to-markdown for robust parsing
-func ConvertConfluenceToMarkdown(confluence string) string {
+func convertConfluence(confluence string, targets *pageLinkTargets) string {
 	converter := htmltomarkdown.NewConverter("", true, nil)
 
 	// Use GFM plugin (tables, strikethrough)
@@ -77,16 +145,45 @@ func ConvertConfluenceToMarkdown(confluence string) string {
 	converter.AddRules(htmltomarkdown.Rule{
 		Filter: []string{"ac:structured-macro"},
 		Replacement: func(content string, selec *goquery.Selection, opt *htmltomarkdown.Options) *string {
-			// Check if it's a code block
-			if selec.AttrOr("ac:name", "") == "code" {
-				// Get language
-				lang := selec.Find("ac\\:parameter[ac\\:name='language']").Text()
+			name := selec.AttrOr("ac:name", "")
 
-				// Get code content (inside CDATA usually, but parsed as text by goquery)
-				code := selec.Find("ac\\:plain-text-body").Text()
+			// Info/note/warning/tip/panel macros go back to GitHub alerts or MkDocs admonitions
+			if kind, ok := storage.AdmonitionTypes[name]; ok {
+				title := selec.ChildrenFiltered("ac\\:parameter[ac\\:name='title']").Text()
+				body := converter.Convert(selec.ChildrenFiltered("ac\\:rich-text-body"))
+				block := admonitionToMarkdown(kind, title, body)
+				return &block
+			}
+
+			if macros := mathMacros(); name == macros.Inline || name == macros.Block {
+				math := mathToMarkdown(selec, macros)
+				return &math
+			}
 
-				// Return standard Markdown code block
-				block := fmt.Sprintf("\n```%s\n%s\n```\n", lang, code)
+			switch name {
+			case "anchor":
+				// Footnote anchors are gone by now; keep any other anchor
+				anchor := preservedMacro(selec)
+				return &anchor
+			case "toc":
+				block := tocToMarkdown(selec)
+				return &block
+			case "status":
+				status := statusToMarkdown(selec)
+				return &status
+			case "expand":
+				if language, source, ok := diagramSource(selec); ok {
+					block := "\n\n" + fencedBlock(language, source) + "\n\n"
+					return &block
+				}
+				block := expandToMarkdown(converter, selec)
+				return &block
+			}
+
+			// Check if it's a code block
+			if name == "code" {
+				// The CDATA body is parsed as text by goquery
+				block := codeToMarkdown(selec)
 				return &block
 			}
 			// If it's not a code block, just return the inner content text (or strip it)
@@ -96,26 +193,436 @@ func ConvertConfluenceToMarkdown(confluence string) string {
 		},
 	})
 
-	// Confluence uses <ri:attachment ri:filename="image.png" /> inside <ac:image>
+	// A lone space between two inline nodes (`<strong>a</strong> <em>b</em>`, or
+	// the mentions and dates below) is a word break, not formatting whitespace
+	converter.AddRules(htmltomarkdown.Rule{
+		Filter: []string{"#text"},
+		Replacement: func(content string, selec *goquery.Selection, opt *htmltomarkdown.Options) *string {
+			node := selec.Nodes[0]
+			if strings.TrimSpace(node.Data) != "" || !isInlineNode(node.PrevSibling) || !isInlineNode(node.NextSibling) {
+				return nil
+			}
+			space := " "
+			return &space
+		},
+	})
+
+	// Macros with no Markdown equivalent come back as their original storage
+	// source, restored verbatim on push: a fenced block where they stand
+	// alone, an HTML comment where they sit inside text, lists or tables
+	converter.AddRules(htmltomarkdown.Rule{
+		Filter: []string{"scribe-storage"},
+		Replacement: func(content string, selec *goquery.Selection, opt *htmltomarkdown.Options) *string {
+			raw, err := base64.StdEncoding.DecodeString(selec.AttrOr("data-raw", ""))
+			if err != nil {
+				return nil
+			}
+			if !isBlockContext(selec.Parent()) {
+				comment := storage.RawComment(string(raw))
+				return &comment
+			}
+			block := "\n\n" + fencedBlock(storage.RawLanguage, string(raw)) + "\n\n"
+			return &block
+		},
+	})
+
+	// The stock rule turns <br> into a paragraph break; keep it a hard line break.
+	// Trailing spaces are trimmed from every line, so use the backslash form.
+	converter.AddRules(htmltomarkdown.Rule{
+		Filter: []string{"br"},
+		Replacement: func(content string, selec *goquery.Selection, opt *htmltomarkdown.Options) *string {
+			if selec.ParentsFiltered("td, th").Length() > 0 {
+				// A table row has to stay on one line
+				cellBreak := "<br />"
+				return &cellBreak
+			}
+			// Drop the newline storage format usually has after a <br />
+			if next := selec.Nodes[0].NextSibling; next != nil && next.Type == nethtml.TextNode {
+				next.Data = strings.TrimLeft(next.Data, " \t\r\n")
+			}
+			lineBreak := "\\\n"
+			return &lineBreak
+		},
+	})
+
+	converter.AddRules(htmltomarkdown.Rule{
+		Filter: []string{"table"},
+		Replacement: func(content string, selec *goquery.Selection, opt *htmltomarkdown.Options) *string {
+			table := tableToMarkdown(converter, selec)
+			return &table
+		},
+	})
+
+	// Tables Markdown cannot express are serialized before the hooks below
+	// rewrite mentions and dates inside them
+	converter.AddRules(htmltomarkdown.Rule{
+		Filter: []string{"scribe-html"},
+		Replacement: func(content string, selec *goquery.Selection, opt *htmltomarkdown.Options) *string {
+			html, err := base64.StdEncoding.DecodeString(selec.AttrOr("data-raw", ""))
+			if err != nil {
+				return nil
+			}
+			block := "\n\n" + string(html) + "\n\n"
+			return &block
+		},
+	})
+	converter.Before(func(selec *goquery.Selection) {
+		selec.Find("table").Each(func(_ int, table *goquery.Selection) {
+			if table.ParentsFiltered("table").Length() == 0 && !isSimpleTable(table) {
+				raw := base64.StdEncoding.EncodeToString([]byte(tableToHTML(table)))
+				table.ReplaceWithHtml(`<scribe-html data-raw="` + raw + `"></scribe-html>`)
+			}
+		})
+	})
+
+	// Task lists go back to GFM checkboxes, nested tasks indented under their
+	// parent. One inside a plain list item is indented under that item, as
+	// the list rules expect of a nested list.
+	converter.AddRules(htmltomarkdown.Rule{
+		Filter: []string{"ac:task-list"},
+		Replacement: func(content string, selec *goquery.Selection, opt *htmltomarkdown.Options) *string {
+			indent, nested := listIndent(selec)
+			var b strings.Builder
+			if !nested {
+				b.WriteString("\n\n")
+			} else if prev := selec.Nodes[0].PrevSibling; prev == nil || prev.Type != nethtml.TextNode || !strings.HasSuffix(strings.TrimRight(prev.Data, " \t"), "\n") {
+				b.WriteString("\n")
+			}
+			selec.ChildrenFiltered("ac\\:task").Each(func(_ int, task *goquery.Selection) {
+				box := "[ ]"
+				if strings.TrimSpace(task.ChildrenFiltered("ac\\:task-status").Text()) == "complete" {
+					box = "[x]"
+				}
+				body := strings.TrimSpace(converter.Convert(task.ChildrenFiltered("ac\\:task-body")))
+				for i, line := range strings.Split(body, "\n") {
+					switch {
+					case i == 0:
+						b.WriteString(indent + "- " + box + " " + line + "\n")
+					case line != "":
+						b.WriteString(indent + "  " + line + "\n")
+					}
+				}
+			})
+			block := b.String()
+			if !nested {
+				block += "\n"
+			} else if selec.Parent().Children().Last().IsSelection(selec) {
+				// The item adds the line break that ends it
+				block = strings.TrimRight(block, "\n")
+			}
+			return &block
+		},
+	})
+
+	// Markdown written by a Before hook, which must not be escaped again
+	converter.AddRules(htmltomarkdown.Rule{
+		Filter: []string{"scribe-markdown"},
+		Replacement: func(content string, selec *goquery.Selection, opt *htmltomarkdown.Options) *string {
+			md := selec.AttrOr("data-md", "")
+			return &md
+		},
+	})
+
+	// Footnotes go back to `[^1]` references and definitions
+	converter.Before(func(selec *goquery.Selection) {
+		footnotesToMarkdown(converter, selec)
+	})
+
+	// Heading anchor macros go back to `{#custom-id}`, and links to anchors
+	// on the page to the `#fragment` of their heading. The fragments are read
+	// from the whole page below, before any hook converts part of it.
+	var fragments map[string]string
+	converter.AddRules(htmltomarkdown.Rule{
+		Filter: []string{"h1", "h2", "h3", "h4", "h5", "h6"},
+		Replacement: func(content string, selec *goquery.Selection, opt *htmltomarkdown.Options) *string {
+			if _, custom := selec.Attr(headingIDAttr); !custom || strings.TrimSpace(content) == "" {
+				return nil
+			}
+			heading := headingToMarkdown(content, selec)
+			return &heading
+		},
+	})
+
+	// User links become @mentions and dates become date lozenges, or due
+	// dates inside tasks. They are swapped for plain text up front so the
+	// spaces around them survive whitespace collapsing.
+	converter.Before(func(selec *goquery.Selection) {
+		selec.Find("ac\\:link").Each(func(_ int, link *goquery.Selection) {
+			user := link.ChildrenFiltered("ri\\:user")
+			if user.Length() == 0 {
+				return
+			}
+			mention := targets.users.mentionMarkdown(user.AttrOr("ri:account-id", ""), user.AttrOr("ri:userkey", ""), user.AttrOr("ri:username", ""))
+			link.ReplaceWithHtml(`<scribe-markdown data-md="` + html.EscapeString(mention) + `"></scribe-markdown>`)
+		})
+		selec.Find("time[datetime]").Each(func(_ int, t *goquery.Selection) {
+			date := "{date:" + t.AttrOr("datetime", "") + "}"
+			if t.ParentsFiltered("ac\\:task-body").Length() > 0 {
+				date = "due:" + t.AttrOr("datetime", "")
+			}
+			t.ReplaceWithHtml(html.EscapeString(date))
+		})
+	})
+
+	// Page links point at the local file tracking the page, or at the page on the server
+	converter.AddRules(htmltomarkdown.Rule{
+		Filter: []string{"ac:link"},
+		Replacement: func(content string, selec *goquery.Selection, opt *htmltomarkdown.Options) *string {
+			page := selec.ChildrenFiltered("ri\\:page")
+			if anchor := selec.AttrOr("ac:anchor", ""); page.Length() == 0 && anchor != "" && selec.Children().Not("ac\\:link-body, ac\\:plain-text-link-body").Length() == 0 {
+				link := anchorLinkToMarkdown(converter, selec, fragments)
+				return &link
+			}
+			if page.Length() == 0 {
+				return nil
+			}
+			title := page.AttrOr("ri:content-title", "")
+			space := page.AttrOr("ri:space-key", targets.space)
+
+			text := linkText(converter, selec, title)
+
+			anchor := selec.AttrOr("ac:anchor", "")
+			dest, ok := targets.pages.link(space, title, anchor)
+			if !ok {
+				if targets.baseURL == "" || space == "" {
+					return &text
+				}
+				dest = displayURL(targets.baseURL, space, title)
+				if anchor != "" {
+					dest += "#" + url.PathEscape(anchor)
+				}
+			}
+			link := "[" + text + "](" + dest + ")"
+			return &link
+		},
+	})
+
+	// Confluence uses <ri:attachment ri:filename="image.png" /> or <ri:url ri:value="..." /> inside <ac:image>
 	converter.AddRules(htmltomarkdown.Rule{
 		Filter: []string{"ac:image"},
 		Replacement: func(content string, selec *goquery.Selection, opt *htmltomarkdown.Options) *string {
-			filename := selec.Find("ri\\:attachment").AttrOr("ri:filename", "")
-			if filename != "" {
-				image := fmt.Sprintf("![%s](%s)", filename, filename)
-				return &image
+			if isDiagramImage(selec) {
+				empty := ""
+				return &empty
+			}
+			if formula, ok := mathImageToMarkdown(selec); ok {
+				return &formula
+			}
+			src := selec.Find("ri\\:url").AttrOr("ri:value", "")
+			alt := src
+			if filename := selec.Find("ri\\:attachment").AttrOr("ri:filename", ""); filename != "" {
+				src, alt = (&url.URL{Path: filename}).String(), filename
+			}
+			if src == "" {
+				return nil
 			}
-			return nil
+			alt = selec.AttrOr("ac:alt", alt)
+			image := fmt.Sprintf("![%s](%s", escape.MarkdownCharacters(alt), src)
+			if title := selec.AttrOr("ac:title", ""); title != "" {
+				image += fmt.Sprintf(" %q", title)
+			}
+			image += ")"
+			return &image
 		},
 	})
 
-	markdown, err := converter.ConvertString(confluence)
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(normalizeStorage(confluence)))
 	if err != nil {
 		// Fallback to simple regex if library fails
 		return confluence
 	}
+	fragments = headingAnchorsToMarkdown(doc.Selection)
+
+	return strings.TrimSpace(converter.Convert(doc.Selection))
+}
+
+// isBlockContext reports whether a block-level Markdown construct can stand in parent
+func isBlockContext(parent *goquery.Selection) bool {
+	switch goquery.NodeName(parent) {
+	case "body", "ac:rich-text-body", "ac:layout-cell", "blockquote":
+		return true
+	}
+	return false
+}
+
+// Storage elements that sit inside text like inline HTML elements
+var inlineStorageElements = map[string]bool{
+	"ac:link": true, "ac:image": true, "ac:emoticon": true, "ac:inline-comment-marker": true, "ac:placeholder": true,
+	"ri:page": true, "ri:user": true, "ri:attachment": true, "ri:url": true, "ri:space": true,
+	"scribe-markdown": true,
+}
+
+// listIndent is the indent of a list nested in plain list items: the
+// width of the markers of each list around it, as the list rules count them
+func listIndent(selec *goquery.Selection) (string, bool) {
+	width, nested := 0, false
+	for n := selec.Parent(); n.Length() > 0; n = n.Parent() {
+		if n.Is("li") {
+			nested = true
+			continue
+		}
+		if !n.Is("ul") && !n.Is("ol") {
+			break
+		}
+		width += len(n.Children().First().AttrOr("data-converter-list-prefix", ""))
+	}
+	return strings.Repeat(" ", width), nested
+}
+
+func isInlineNode(n *nethtml.Node) bool {
+	if n == nil {
+		return false
+	}
+	if n.Type == nethtml.TextNode {
+		return true
+	}
+	if n.Type != nethtml.ElementNode {
+		return false
+	}
+	if n.Data == "ac:structured-macro" {
+		return !isBlockElement(n)
+	}
+	return htmltomarkdown.IsInlineElement(n.Data) || inlineStorageElements[n.Data]
+}
+
+// htmlVoidElements are written self-closing; every other element gets an explicit end tag
+var htmlVoidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true,
+	"img": true, "input": true, "link": true, "meta": true, "source": true, "track": true, "wbr": true,
+}
 
-	return strings.TrimSpace(markdown)
+// normalizeStorage rewrites storage XHTML so an HTML parser reads it the way
+// Confluence means it. HTML has no self-closing syntax for unknown elements,
+// so <ri:page ... /> would swallow its following siblings, and CDATA sections
+// (the bodies of code macros) would be dropped as comments. Elements are
+// given explicit end tags and CDATA is re-emitted as escaped text.
+//
+// Macros the converter has no Markdown for are cut out byte for byte and
+// replaced by a <scribe-storage> placeholder carrying the original source.
+// Input that is not well-formed enough to tokenize is returned unchanged.
+func normalizeStorage(storage string) string {
+	return normalizeStorageFor(storage, isConvertedMacro)
+}
+
+// normalizeStorageFor is normalizeStorage for a writer that converts the
+// macros isConverted accepts
+func normalizeStorageFor(storage string, isConverted func(name string) bool) string {
+	decoder := xml.NewDecoder(strings.NewReader(storage))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	var b strings.Builder
+	preserving, depth := int64(-1), 0
+	for {
+		offset := decoder.InputOffset()
+		tok, err := decoder.RawToken()
+		if err == io.EOF {
+			return b.String()
+		}
+		if err != nil {
+			return storage
+		}
+
+		if preserving >= 0 {
+			switch tok.(type) {
+			case xml.StartElement:
+				depth++
+			case xml.EndElement:
+				depth--
+			}
+			if depth == 0 {
+				raw := storage[preserving:decoder.InputOffset()]
+				b.WriteString(`<scribe-storage data-raw="` + base64.StdEncoding.EncodeToString([]byte(raw)) + `"></scribe-storage>`)
+				preserving = -1
+			}
+			continue
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if xmlName(t.Name) == "ac:structured-macro" && !isConverted(xmlAttr(t, "ac:name")) {
+				preserving, depth = offset, 1
+				continue
+			}
+			b.WriteString("<" + xmlName(t.Name))
+			for _, attr := range t.Attr {
+				b.WriteString(" " + xmlName(attr.Name) + `="`)
+				_ = xml.EscapeText(&b, []byte(attr.Value))
+				b.WriteString(`"`)
+			}
+			if htmlVoidElements[t.Name.Local] && t.Name.Space == "" {
+				b.WriteString(" />")
+			} else {
+				b.WriteString(">")
+			}
+		case xml.EndElement:
+			if !htmlVoidElements[t.Name.Local] || t.Name.Space != "" {
+				b.WriteString("</" + xmlName(t.Name) + ">")
+			}
+		case xml.CharData:
+			_ = xml.EscapeText(&b, t)
+		case xml.Comment:
+			b.WriteString("<!--" + string(t) + "-->")
+		}
+	}
+}
+
+// isConvertedMacro reports whether ConvertConfluenceToMarkdown has Markdown for a macro
+func isConvertedMacro(name string) bool {
+	switch name {
+	case "code", "toc", "status", "expand", "anchor":
+		return true
+	}
+	if macros := mathMacros(); name == macros.Inline || name == macros.Block {
+		return true
+	}
+	_, ok := storage.AdmonitionTypes[name]
+	return ok
+}
+
+func xmlAttr(el xml.StartElement, name string) string {
+	for _, attr := range el.Attr {
+		if xmlName(attr.Name) == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// xmlName keeps namespace prefixes such as ac: and ri: as written
+func xmlName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// admonitionToMarkdown writes untitled callouts as GitHub alerts and titled
+// ones (and panels, which GitHub has no alert for) as MkDocs admonitions
+func admonitionToMarkdown(kind, title, body string) string {
+	var b strings.Builder
+	b.WriteString("\n\n")
+	if title == "" && kind != "panel" {
+		b.WriteString("> [!" + strings.ToUpper(kind) + "]\n")
+		for _, line := range strings.Split(body, "\n") {
+			b.WriteString(strings.TrimRight("> "+line, " ") + "\n")
+		}
+	} else {
+		b.WriteString("!!! " + kind)
+		if title != "" {
+			b.WriteString(` "` + strings.ReplaceAll(title, `"`, "'") + `"`)
+		}
+		b.WriteString("\n")
+		for _, line := range strings.Split(body, "\n") {
+			if line != "" {
+				line = "    " + line
+			}
+			b.WriteString(line + "\n")
+		}
+	}
+	b.WriteString("\n")
+	return b.String()
 }
 
 func stripFrontmatter(content string) string {
@@ -130,3 +637,22 @@ func stripFrontmatter(content string) string {
 	}
 	return content
 }
+
+// parseFrontmatter returns the "key: value" pairs of a leading --- block
+func parseFrontmatter(content string) map[string]string {
+	values := map[string]string{}
+	lines := strings.Split(content, "\n")
+	if len(lines) < 3 || lines[0] != "---" {
+		return values
+	}
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		if line == "---" {
+			return values
+		}
+		if key, value, ok := strings.Cut(line, ":"); ok {
+			values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return map[string]string{}
+}
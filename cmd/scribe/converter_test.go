@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// storageCorpus returns the storage documents under testdata/storage by file name
+func storageCorpus(t *testing.T) map[string]string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join("testdata", "storage", "*.xml"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no storage fixtures found: %v", err)
+	}
+	docs := map[string]string{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs[filepath.Base(file)] = string(data)
+	}
+	return docs
+}
+
+// unknownMacros returns the source of every outermost macro that has no Markdown form
+func unknownMacros(t *testing.T, doc string) []string {
+	t.Helper()
+	decoder := xml.NewDecoder(strings.NewReader(doc))
+	decoder.Strict = false
+
+	var macros []string
+	start, depth := int64(-1), 0
+	for {
+		offset := decoder.InputOffset()
+		tok, err := decoder.RawToken()
+		if err == io.EOF {
+			return macros
+		}
+		if err != nil {
+			t.Fatalf("fixture is not well-formed: %v", err)
+		}
+		switch el := tok.(type) {
+		case xml.StartElement:
+			if start >= 0 {
+				depth++
+			} else if xmlName(el.Name) == "ac:structured-macro" && !isConvertedMacro(xmlAttr(el, "ac:name")) {
+				start, depth = offset, 1
+			}
+		case xml.EndElement:
+			if start >= 0 {
+				if depth--; depth == 0 {
+					macros = append(macros, doc[start:decoder.InputOffset()])
+					start = -1
+				}
+			}
+		}
+	}
+}
+
+func TestUnknownMacrosSurviveRoundTrip(t *testing.T) {
+	for name, doc := range storageCorpus(t) {
+		t.Run(name, func(t *testing.T) {
+			markdown := ConvertConfluenceToMarkdown(doc)
+			pushed := ConvertMarkdownToConfluence(markdown)
+
+			for _, macro := range unknownMacros(t, doc) {
+				if !strings.Contains(pushed, macro) {
+					t.Errorf("macro not restored verbatim:\n%s\n\npushed:\n%s", macro, pushed)
+				}
+			}
+
+			if again := ConvertConfluenceToMarkdown(pushed); again != markdown {
+				t.Errorf("second pull differs:\n--- first\n%s\n--- second\n%s", markdown, again)
+			}
+		})
+	}
+}
+
+func TestUnknownMacroPlacement(t *testing.T) {
+	macro := `<ac:structured-macro ac:name="jira"><ac:parameter ac:name="key">OPS-1</ac:parameter></ac:structured-macro>`
+
+	block := ConvertConfluenceToMarkdown(macro)
+	if !strings.HasPrefix(block, "```confluence-storage\n") {
+		t.Errorf("standalone macro should be a fenced block, got:\n%s", block)
+	}
+
+	inline := ConvertConfluenceToMarkdown("<p>See " + macro + " now</p>")
+	if !strings.HasPrefix(inline, "See <!-- confluence-storage:") || !strings.HasSuffix(inline, " --> now") {
+		t.Errorf("macro inside text should be an HTML comment, got:\n%s", inline)
+	}
+	if pushed := ConvertMarkdownToConfluence(inline); pushed != "<p>See "+macro+" now</p>\n" {
+		t.Errorf("inline macro not restored, got:\n%s", pushed)
+	}
+}
+
+func TestHeadingAnchors(t *testing.T) {
+	dir := t.TempDir()
+	other := "---\nconfluence_title: Setup Guide\nconfluence_space: DEV\n---\n\n# Install it\n"
+	if err := os.WriteFile(filepath.Join(dir, "other.md"), []byte(other), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	markdown := "## Getting started\n\n## Notes {#notes}\n\n## Notes\n\nSee [above](#getting-started), [notes](#notes), [more](#notes-1) and [install](other.md#install-it)."
+
+	converted := ConvertMarkdownFileToConfluence("---\nconfluence_title: My Page\n---\n"+markdown, filepath.Join(dir, "doc.md"), "", nil)
+	for _, want := range []string{
+		`<h2 id="MyPage-Gettingstarted">`,
+		`<h2 id="MyPage-notes"><ac:structured-macro ac:name="anchor"><ac:parameter ac:name="">notes</ac:parameter></ac:structured-macro>Notes</h2>`,
+		`<ac:link ac:anchor="Gettingstarted"><ac:link-body>above</ac:link-body></ac:link>`,
+		`<ac:link ac:anchor="notes">`,
+		`<ac:link ac:anchor="Notes">`,
+		`<ac:link ac:anchor="Installit"><ri:page ri:content-title="Setup Guide" ri:space-key="DEV" />`,
+	} {
+		if !strings.Contains(converted.Body, want) {
+			t.Errorf("storage lacks %s:\n%s", want, converted.Body)
+		}
+	}
+
+	page := &Page{Space: Space{Key: "DEV"}}
+	page.Body.Storage.Value = converted.Body
+	if got := ConvertConfluencePageToMarkdown(page, dir, "", nil); got != markdown {
+		t.Errorf("pull gave:\n%s", got)
+	}
+}
+
+func TestPageLinksUseInstanceURL(t *testing.T) {
+	t.Setenv("SCRIBE_URL", "https://env.example.com")
+	page := &Page{Space: Space{Key: "DEV"}}
+	page.Body.Storage.Value = `<p><ac:link><ri:page ri:content-title="Setup Guide" /></ac:link></p>`
+	pulled := ConvertConfluencePageToMarkdown(page, "", "https://wiki.example.com", nil)
+	if pulled != "[Setup Guide](https://wiki.example.com/display/DEV/Setup+Guide)" {
+		t.Fatalf("pull gave:\n%s", pulled)
+	}
+
+	converted := ConvertMarkdownFileToConfluence(pulled, "doc.md", "https://wiki.example.com", nil)
+	if !strings.Contains(converted.Body, `<ri:page ri:content-title="Setup Guide" ri:space-key="DEV" />`) {
+		t.Errorf("push gave:\n%s", converted.Body)
+	}
+}
+
+func TestSpaceBetweenLinks(t *testing.T) {
+	markdown := "## Intro {#custom}\n\n[a](#custom) [b](#custom)"
+	if got := roundTrip(markdown); got != markdown {
+		t.Errorf("anchor links came back as:\n%s", got)
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"A", "B"} {
+		doc := "---\nconfluence_title: " + name + "\nconfluence_space: DEV\n---\n"
+		if err := os.WriteFile(filepath.Join(dir, strings.ToLower(name)+".md"), []byte(doc), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	page := &Page{Space: Space{Key: "DEV"}}
+	page.Body.Storage.Value = `<p><ac:link><ri:page ri:content-title="A" /></ac:link> <ac:link><ri:page ri:content-title="B" /></ac:link></p>`
+	if got := ConvertConfluencePageToMarkdown(page, dir, "", nil); got != "[A](a.md) [B](b.md)" {
+		t.Errorf("page links came back as:\n%s", got)
+	}
+}
+
+func TestAdmonitions(t *testing.T) {
+	for _, tt := range []struct {
+		markdown string
+		storage  string
+		pulled   string
+	}{
+		{"> [!NOTE]\n> Heads up.", `<ac:structured-macro ac:name="info"><ac:rich-text-body>` + "\n<p>Heads up.</p>\n", "> [!NOTE]\n> Heads up."},
+		{"> [!TIP]\n> One.\n>\n> Two.", `<ac:structured-macro ac:name="tip"><ac:rich-text-body>` + "\n<p>One.</p>\n<p>Two.</p>\n", "> [!TIP]\n> One.\n>\n> Two."},
+		{"> [!WARNING]\n> Careful.", `<ac:structured-macro ac:name="warning">`, "> [!WARNING]\n> Careful."},
+		// Alert types without a macro of their own share one, and pull back as its type
+		{"> [!CAUTION]\n> Hot.", `<ac:structured-macro ac:name="warning">`, "> [!WARNING]\n> Hot."},
+		{"!!! tip \"Title\"\n    Body.", `<ac:structured-macro ac:name="tip"><ac:parameter ac:name="title">Title</ac:parameter><ac:rich-text-body>`, "!!! tip \"Title\"\n    Body."},
+		{"!!! panel\n    Boxed.", `<ac:structured-macro ac:name="panel"><ac:rich-text-body>`, "!!! panel\n    Boxed."},
+		// The macro keeps no record of the syntax, so an untitled block pulls back as an alert
+		{"!!! note\n    Heads up.", `<ac:structured-macro ac:name="info"><ac:rich-text-body>` + "\n<p>Heads up.</p>\n", "> [!NOTE]\n> Heads up."},
+	} {
+		pushed := ConvertMarkdownToConfluence(tt.markdown)
+		if !strings.Contains(pushed, tt.storage) || strings.Count(pushed, "<ac:parameter") != strings.Count(tt.storage, "<ac:parameter") {
+			t.Errorf("%q pushed as:\n%s", tt.markdown, pushed)
+		}
+		if pulled := ConvertConfluenceToMarkdown(pushed); pulled != tt.pulled {
+			t.Errorf("%q pulled back as:\n%s", tt.markdown, pulled)
+		}
+	}
+}
+
+func TestTaskLists(t *testing.T) {
+	for _, tt := range []struct {
+		markdown string
+		storage  []string
+	}{
+		{"- [ ] Open\n- [x] Done", []string{
+			"<ac:task-status>incomplete</ac:task-status>\n<ac:task-body>Open</ac:task-body>",
+			"<ac:task-status>complete</ac:task-status>\n<ac:task-body>Done</ac:task-body>",
+		}},
+		{"- [ ] Ship due:2026-11-02", []string{`<ac:task-body>Ship <time datetime="2026-11-02" /></ac:task-body>`}},
+		// Subtasks are task lists inside the parent task's body
+		{"- [ ] Parent\n  - [x] Child\n  - [ ] Other\n- [x] Last", []string{
+			"<ac:task-body>Parent\n<ac:task-list>",
+			"<ac:task-status>complete</ac:task-status>\n<ac:task-body>Child</ac:task-body>",
+			"</ac:task-list>\n</ac:task-body>",
+		}},
+		{"- [ ] Task\n  - Plain child", []string{"<ac:task-body>Task\n<ul>\n<li>Plain child</li>\n</ul>\n</ac:task-body>"}},
+		// Tasks nested in plain lists keep their place in the list
+		{"- Plain\n  - [ ] Task under plain\n- Item", []string{"<li>Plain\n<ac:task-list>", "</ac:task-list>\n</li>\n<li>Item</li>"}},
+		{"1. First\n   - [x] Done\n   - [ ] Open\n2. Second", []string{"<li>First\n<ac:task-list>", "<li>Second</li>"}},
+		{"- A\n  - B\n    - [ ] Deep\n- C", []string{"<li>B\n<ac:task-list>"}},
+	} {
+		pushed := ConvertMarkdownToConfluence(tt.markdown)
+		for _, want := range tt.storage {
+			if !strings.Contains(pushed, want) {
+				t.Errorf("%q pushed without %q:\n%s", tt.markdown, want, pushed)
+			}
+		}
+		if pulled := ConvertConfluenceToMarkdown(pushed); pulled != tt.markdown {
+			t.Errorf("%q pulled back as:\n%s", tt.markdown, pulled)
+		}
+	}
+}
+
+func TestMacroShorthands(t *testing.T) {
+	for _, tt := range []struct {
+		markdown string
+		storage  string
+		pulled   string // when not the markdown itself
+	}{
+		{"[[toc]]", `<ac:structured-macro ac:name="toc"></ac:structured-macro>`, ""},
+		{"Intro\n\n[[toc maxLevel=3 minLevel=2]]\n\n# Heading", `<ac:structured-macro ac:name="toc"><ac:parameter ac:name="maxLevel">3</ac:parameter><ac:parameter ac:name="minLevel">2</ac:parameter></ac:structured-macro>`, ""},
+		{"<details>\n<summary>More</summary>\n\nHidden **text**.\n\n</details>", `<ac:structured-macro ac:name="expand"><ac:parameter ac:name="title">More</ac:parameter><ac:rich-text-body>` + "\n<p>Hidden <strong>text</strong>.</p>\n</ac:rich-text-body></ac:structured-macro>", ""},
+		{"<details>\n\nNo summary.\n\n</details>", `<ac:structured-macro ac:name="expand"><ac:rich-text-body>`, ""},
+		{"<details>\n<summary>Outer</summary>\n\n<details>\n<summary>Inner</summary>\n\nDeep.\n\n</details>\n\n</details>", `<ac:rich-text-body>` + "\n" + `<ac:structured-macro ac:name="expand"><ac:parameter ac:name="title">Inner</ac:parameter>`, ""},
+		{"{status:green|DONE}", `<ac:structured-macro ac:name="status"><ac:parameter ac:name="colour">Green</ac:parameter><ac:parameter ac:name="title">DONE</ac:parameter></ac:structured-macro>`, ""},
+		{"{status:yellow|WIP}", `<ac:parameter ac:name="colour">Yellow</ac:parameter>`, ""},
+		{"{status:red|BLOCKED}", `<ac:parameter ac:name="colour">Red</ac:parameter>`, ""},
+		{"{status:blue|New}", `<ac:parameter ac:name="colour">Blue</ac:parameter>`, ""},
+		{"{status:purple|Idea}", `<ac:parameter ac:name="colour">Purple</ac:parameter>`, ""},
+		{"{status:grey|Later}", `<ac:parameter ac:name="colour">Grey</ac:parameter>`, ""},
+		{"{status:green}", `<ac:structured-macro ac:name="status"><ac:parameter ac:name="colour">Green</ac:parameter></ac:structured-macro>`, ""},
+		{"{status:red|LATE|subtle}", `<ac:parameter ac:name="subtle">true</ac:parameter>`, ""},
+		// Colours are written as the macro spells them and pulled lower case
+		{"{status:Green|Done}", `<ac:parameter ac:name="colour">Green</ac:parameter>`, "{status:green|Done}"},
+		// Pipes in a table cell are escaped, and stay escaped on pull
+		{"| a |\n| --- |\n| {status:green\\|OK} |", `<td><ac:structured-macro ac:name="status"><ac:parameter ac:name="colour">Green</ac:parameter><ac:parameter ac:name="title">OK</ac:parameter></ac:structured-macro></td>`, ""},
+		// A colour the macro does not have stays text
+		{"{status:pink|Odd}", "<p>{status:pink|Odd}</p>", `{status:pink\|Odd}`},
+	} {
+		pushed := ConvertMarkdownToConfluence(tt.markdown)
+		if !strings.Contains(pushed, tt.storage) {
+			t.Errorf("%q pushed without %s:\n%s", tt.markdown, tt.storage, pushed)
+		}
+		want := tt.pulled
+		if want == "" {
+			want = tt.markdown
+		}
+		if pulled := ConvertConfluenceToMarkdown(pushed); pulled != want {
+			t.Errorf("%q pulled back as:\n%s", tt.markdown, pulled)
+		}
+	}
+}
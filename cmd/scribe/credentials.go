@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The API token of an instance is the first found of:
+//
+//  1. the profile's api_token, or SCRIBE_API_TOKEN when no profile is in use
+//  2. the credential helper: SCRIBE_CREDENTIAL_HELPER, or credential_helper
+//     in the user's config file
+//  3. the Secret Service keyring, through secret-tool
+//  4. the encrypted credentials file
+//
+// `auth login` stores a token in the first of 2-4 that is available.
+
+// Credential names whose token is wanted: an account on an instance
+type Credential struct {
+	URL      string
+	Username string
+}
+
+// credentialStore keeps tokens outside the environment
+type credentialStore interface {
+	// Name is how `auth` commands refer to the store
+	Name() string
+	// Get returns the stored token, or "" when there is none
+	Get(cred Credential) (string, error)
+	Store(cred Credential, token string) error
+	Erase(cred Credential) error
+}
+
+// credentialStores are the stores available, in lookup order
+func credentialStores(config *Config) []credentialStore {
+	var stores []credentialStore
+	if helper := credentialHelper(config); helper != "" {
+		stores = append(stores, &helperStore{args: strings.Fields(helper)})
+	}
+	if keyringAvailable() {
+		stores = append(stores, keyringStore{})
+	}
+	if store := newFileStore(); store != nil {
+		stores = append(stores, store)
+	}
+	return stores
+}
+
+func credentialHelper(config *Config) string {
+	if helper := os.Getenv("SCRIBE_CREDENTIAL_HELPER"); helper != "" {
+		return helper
+	}
+	return config.CredentialHelper
+}
+
+// resolveToken finds the token for profile, which is the profile called
+// name or, for "", the SCRIBE_* variables. It also says where the token came
+// from: "config", "environment" or a store's name. A store that fails is
+// skipped with a warning, so a locked keyring does not hide the file.
+func resolveToken(config *Config, name string, profile Profile) (string, string, error) {
+	if profile.APIToken != "" {
+		if name == "" {
+			return profile.APIToken, "environment", nil
+		}
+		return profile.APIToken, "config", nil
+	}
+	cred := Credential{URL: profile.URL, Username: profile.Username}
+	if cred.URL == "" {
+		return "", "", nil
+	}
+	for _, store := range credentialStores(config) {
+		token, err := store.Get(cred)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: credential %s: %v\n", store.Name(), err)
+			continue
+		}
+		if token != "" {
+			return token, store.Name(), nil
+		}
+	}
+	return "", "", nil
+}
+
+// helperStore asks an external command in the git credential helper
+// protocol: the action (get, store or erase) is its last argument and
+// key=value lines describe the credential on stdin.
+type helperStore struct {
+	args []string
+}
+
+func (h *helperStore) Name() string {
+	return "helper"
+}
+
+func (h *helperStore) Get(cred Credential) (string, error) {
+	values, err := h.run("get", cred, "")
+	return values["password"], err
+}
+
+func (h *helperStore) Store(cred Credential, token string) error {
+	_, err := h.run("store", cred, token)
+	return err
+}
+
+func (h *helperStore) Erase(cred Credential) error {
+	_, err := h.run("erase", cred, "")
+	return err
+}
+
+func (h *helperStore) run(action string, cred Credential, token string) (map[string]string, error) {
+	u, err := url.Parse(cred.URL)
+	if err != nil {
+		return nil, err
+	}
+	var input strings.Builder
+	fmt.Fprintf(&input, "protocol=%s\nhost=%s\n", u.Scheme, u.Host)
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		fmt.Fprintf(&input, "path=%s\n", path)
+	}
+	if cred.Username != "" {
+		fmt.Fprintf(&input, "username=%s\n", cred.Username)
+	}
+	if token != "" {
+		fmt.Fprintf(&input, "password=%s\n", token)
+	}
+	input.WriteString("\n")
+
+	cmd := exec.Command(h.args[0], append(h.args[1:], action)...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = strings.NewReader(input.String()), &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s %s: %w: %s", h.args[0], action, err, msg)
+		}
+		return nil, fmt.Errorf("%s %s: %w", h.args[0], action, err)
+	}
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		if key, value, ok := strings.Cut(scanner.Text(), "="); ok {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+// keyringStore keeps tokens in the Secret Service (GNOME Keyring, KWallet)
+// through libsecret's secret-tool
+type keyringStore struct{}
+
+func keyringAvailable() bool {
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		return false
+	}
+	_, err := exec.LookPath("secret-tool")
+	return err == nil
+}
+
+func (keyringStore) Name() string {
+	return "keyring"
+}
+
+func keyringAttributes(cred Credential) []string {
+	return []string{"service", "scribe-cli", "url", strings.TrimRight(cred.URL, "/"), "username", cred.Username}
+}
+
+func (keyringStore) Get(cred Credential) (string, error) {
+	cmd := exec.Command("secret-tool", append([]string{"lookup"}, keyringAttributes(cred)...)...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		// lookup fails silently when nothing matches
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("secret-tool lookup: %s", msg)
+		}
+		return "", nil
+	}
+	return strings.TrimRight(stdout.String(), "\n"), nil
+}
+
+func (keyringStore) Store(cred Credential, token string) error {
+	args := append([]string{"store", "--label", "scribe-cli " + cred.URL}, keyringAttributes(cred)...)
+	cmd := exec.Command("secret-tool", args...)
+	cmd.Stdin = strings.NewReader(token)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("secret-tool store: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (keyringStore) Erase(cred Credential) error {
+	cmd := exec.Command("secret-tool", append([]string{"clear"}, keyringAttributes(cred)...)...)
+	if out, err := cmd.CombinedOutput(); err != nil && len(bytes.TrimSpace(out)) > 0 {
+		return fmt.Errorf("secret-tool clear: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// fileStore keeps tokens in a file encrypted with AES-GCM. The key is
+// derived from SCRIBE_CREDENTIALS_PASSPHRASE when that is set, and is
+// otherwise a random key in a second file, which keeps tokens out of
+// anything that copies the credentials file alone, such as backups.
+type fileStore struct {
+	path    string
+	keyPath string
+}
+
+// newFileStore keeps the files beside the user's config, or returns nil
+// when there is no config directory
+func newFileStore() *fileStore {
+	path := userConfigPath()
+	if path == "" {
+		return nil
+	}
+	dir := filepath.Dir(path)
+	return &fileStore{path: filepath.Join(dir, "credentials.enc"), keyPath: filepath.Join(dir, "credentials.key")}
+}
+
+// encryptedCredentials is the file's layout; Data decrypts to a JSON
+// object from credentialKey to token
+type encryptedCredentials struct {
+	Salt  []byte `json:"salt,omitempty"` // for the passphrase, when there is one
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// PBKDF2 iterations for the passphrase, as OWASP recommends for SHA-256
+const passphraseIterations = 600000
+
+func (f *fileStore) Name() string {
+	return "file"
+}
+
+func credentialKey(cred Credential) string {
+	return strings.TrimRight(cred.URL, "/") + " " + cred.Username
+}
+
+func (f *fileStore) Get(cred Credential) (string, error) {
+	tokens, err := f.load()
+	return tokens[credentialKey(cred)], err
+}
+
+func (f *fileStore) Store(cred Credential, token string) error {
+	tokens, err := f.load()
+	if err != nil {
+		return err
+	}
+	tokens[credentialKey(cred)] = token
+	return f.save(tokens)
+}
+
+func (f *fileStore) Erase(cred Credential) error {
+	tokens, err := f.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := tokens[credentialKey(cred)]; !ok {
+		return nil
+	}
+	delete(tokens, credentialKey(cred))
+	if len(tokens) == 0 {
+		return os.Remove(f.path)
+	}
+	return f.save(tokens)
+}
+
+func (f *fileStore) load() (map[string]string, error) {
+	tokens := map[string]string{}
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return tokens, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file encryptedCredentials
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.path, err)
+	}
+	gcm, err := f.cipher(file.Salt, false)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, file.Nonce, file.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt %s: wrong SCRIBE_CREDENTIALS_PASSPHRASE or key file", f.path)
+	}
+	if err := json.Unmarshal(plain, &tokens); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.path, err)
+	}
+	return tokens, nil
+}
+
+func (f *fileStore) save(tokens map[string]string) error {
+	plain, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	file := encryptedCredentials{}
+	if os.Getenv("SCRIBE_CREDENTIALS_PASSPHRASE") != "" {
+		file.Salt = make([]byte, 16)
+		if _, err := rand.Read(file.Salt); err != nil {
+			return err
+		}
+	}
+	gcm, err := f.cipher(file.Salt, true)
+	if err != nil {
+		return err
+	}
+	file.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return err
+	}
+	file.Data = gcm.Seal(nil, file.Nonce, plain, nil)
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o700); err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// cipher is the AES-GCM cipher for a file with salt, which is set when the
+// file was written with a passphrase. create makes the key file if needed.
+func (f *fileStore) cipher(salt []byte, create bool) (cipher.AEAD, error) {
+	var key []byte
+	if salt != nil {
+		passphrase := os.Getenv("SCRIBE_CREDENTIALS_PASSPHRASE")
+		if passphrase == "" {
+			return nil, fmt.Errorf("%s is encrypted with a passphrase: set SCRIBE_CREDENTIALS_PASSPHRASE", f.path)
+		}
+		key = pbkdf2SHA256([]byte(passphrase), salt, passphraseIterations)
+	} else {
+		var err error
+		if key, err = f.fileKey(create); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (f *fileStore) fileKey(create bool) ([]byte, error) {
+	key, err := os.ReadFile(f.keyPath)
+	if err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if err == nil {
+		return nil, fmt.Errorf("%s is not a 32-byte key", f.keyPath)
+	}
+	if !errors.Is(err, fs.ErrNotExist) || !create {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.keyPath), 0o700); err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(f.keyPath, key, 0o600)
+}
+
+// pbkdf2SHA256 derives a 32-byte key, the single block of RFC 8018's PBKDF2
+// with HMAC-SHA256
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// AuthStatus is what `auth` commands report for the instance in use. The
+// token itself is never shown.
+type AuthStatus struct {
+	Profile  string   `json:"profile,omitempty"`
+	URL      string   `json:"url"`
+	Username string   `json:"username,omitempty"`
+	Source   string   `json:"source,omitempty"` // where the token comes from; empty when there is none
+	Stores   []string `json:"stores"`           // stores available for `auth login`
+}
+
+// authTarget is the config, profile name and profile `auth` commands act on.
+// They work on no file, so the repository config is the working directory's.
+func authTarget(name string) (*Config, string, Profile, error) {
+	config, err := loadConfig(".")
+	if err != nil {
+		return nil, "", Profile{}, err
+	}
+	name = selectProfile(config, name)
+	profile, err := instanceProfile(config, name)
+	if err != nil {
+		return nil, "", Profile{}, err
+	}
+	if profile.URL == "" {
+		return nil, "", Profile{}, fmt.Errorf("no instance to authenticate with: set SCRIBE_URL or choose a profile")
+	}
+	return config, name, profile, nil
+}
+
+// authStatus reports where the token for the profile called name comes from
+func authStatus(name string) (*AuthStatus, error) {
+	config, name, profile, err := authTarget(name)
+	if err != nil {
+		return nil, err
+	}
+	_, source, err := resolveToken(config, name, profile)
+	if err != nil {
+		return nil, err
+	}
+	status := &AuthStatus{Profile: name, URL: profile.URL, Username: profile.Username, Source: source, Stores: []string{}}
+	for _, store := range credentialStores(config) {
+		status.Stores = append(status.Stores, store.Name())
+	}
+	return status, nil
+}
+
+// authLogin stores token for the profile called name in the store called
+// storeName, or in the first store available when that is ""
+func authLogin(name, storeName, token string) (*AuthStatus, error) {
+	if token == "" {
+		return nil, fmt.Errorf("no token given")
+	}
+	config, name, profile, err := authTarget(name)
+	if err != nil {
+		return nil, err
+	}
+	stores := credentialStores(config)
+	var store credentialStore
+	for _, s := range stores {
+		if storeName == "" || s.Name() == storeName {
+			store = s
+			break
+		}
+	}
+	if store == nil {
+		return nil, fmt.Errorf("credential store %q is not available", storeName)
+	}
+	if err := store.Store(Credential{URL: profile.URL, Username: profile.Username}, token); err != nil {
+		return nil, err
+	}
+	if profile.APIToken != "" {
+		setting := "SCRIBE_API_TOKEN"
+		if name != "" {
+			setting = "the api_token of profile " + name
+		}
+		fmt.Fprintf(os.Stderr, "Warning: %s is used before the stored token\n", setting)
+	}
+	return authStatus(name)
+}
+
+// authLogout removes the token for the profile called name from every store
+func authLogout(name string) (*AuthStatus, error) {
+	config, name, profile, err := authTarget(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, store := range credentialStores(config) {
+		if err := store.Erase(Credential{URL: profile.URL, Username: profile.Username}); err != nil {
+			return nil, fmt.Errorf("credential %s: %w", store.Name(), err)
+		}
+	}
+	return authStatus(name)
+}
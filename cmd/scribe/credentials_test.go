@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeHelper is a git-style credential helper keeping one token per host
+// in its directory, and logging every request it gets
+const fakeHelper = `#!/bin/sh
+dir=$(dirname "$0")
+while IFS='=' read -r key value; do
+	case $key in
+	"") break ;;
+	host) host=$value ;;
+	username) username=$value ;;
+	password) password=$value ;;
+	esac
+done
+echo "$1 $host $username" >> "$dir/log"
+case $1 in
+get) [ -f "$dir/$host" ] && printf 'password=%s\n' "$(cat "$dir/$host")" ;;
+store) printf %s "$password" > "$dir/$host" ;;
+erase) rm -f "$dir/$host" ;;
+esac
+exit 0
+`
+
+// fakeSecretTool stands in for libsecret's secret-tool with a single secret
+const fakeSecretTool = `#!/bin/sh
+dir=$(dirname "$0")
+case $1 in
+lookup) [ -f "$dir/keyring" ] || exit 1; cat "$dir/keyring" ;;
+store) cat > "$dir/keyring" ;;
+clear) rm -f "$dir/keyring" ;;
+esac
+`
+
+func writeScript(t *testing.T, dir, name, script string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTokenResolutionOrder(t *testing.T) {
+	dir := writeConfigs(t, `
+profiles:
+  dc: {url: https://wiki.example.com, username: me}
+`, "")
+	helperDir, bin := t.TempDir(), t.TempDir()
+	t.Setenv("SCRIBE_CREDENTIAL_HELPER", writeScript(t, helperDir, "helper", fakeHelper))
+	writeScript(t, bin, "secret-tool", fakeSecretTool)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path=/dev/null")
+	t.Setenv("SCRIBE_CREDENTIALS_PASSPHRASE", "")
+
+	config, err := loadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := config.Profiles["dc"]
+	cred := Credential{URL: profile.URL, Username: profile.Username}
+	check := func(name string, profile Profile, wantToken, wantSource string) {
+		t.Helper()
+		token, source, err := resolveToken(config, name, profile)
+		if err != nil || token != wantToken || source != wantSource {
+			t.Errorf("got %q from %q (%v), want %q from %q", token, source, err, wantToken, wantSource)
+		}
+	}
+
+	check("dc", profile, "", "")
+	if err := newFileStore().Store(cred, "file-token"); err != nil {
+		t.Fatal(err)
+	}
+	check("dc", profile, "file-token", "file")
+	if err := (keyringStore{}).Store(cred, "keyring-token"); err != nil {
+		t.Fatal(err)
+	}
+	check("dc", profile, "keyring-token", "keyring")
+	if err := (&helperStore{args: []string{os.Getenv("SCRIBE_CREDENTIAL_HELPER")}}).Store(cred, "helper-token"); err != nil {
+		t.Fatal(err)
+	}
+	check("dc", profile, "helper-token", "helper")
+	check("dc", Profile{URL: profile.URL, Username: "me", APIToken: "config-token"}, "config-token", "config")
+	check("", Profile{URL: profile.URL, APIToken: "env-token"}, "env-token", "environment")
+
+	log, err := os.ReadFile(filepath.Join(helperDir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(log), "get wiki.example.com me\n") {
+		t.Errorf("helper log:\n%s", log)
+	}
+}
+
+func TestAuthLoginLogout(t *testing.T) {
+	writeConfigs(t, `
+profiles:
+  dc: {url: https://wiki.example.com, username: me}
+`, "")
+	t.Setenv("SCRIBE_CREDENTIAL_HELPER", "")
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", "")
+	t.Setenv("SCRIBE_CREDENTIALS_PASSPHRASE", "correct horse")
+
+	if _, err := authLogin("dc", "keyring", "s3cret"); err == nil || !strings.Contains(err.Error(), `"keyring" is not available`) {
+		t.Errorf("got %v, want the keyring unavailable", err)
+	}
+	status, err := authLogin("dc", "", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Source != "file" || strings.Join(status.Stores, ",") != "file" {
+		t.Errorf("status %+v, want the token in the file", status)
+	}
+
+	store := newFileStore()
+	data, err := os.ReadFile(store.path)
+	if err != nil || strings.Contains(string(data), "s3cret") {
+		t.Errorf("credentials file holds %s (%v)", data, err)
+	}
+	t.Setenv("SCRIBE_CREDENTIALS_PASSPHRASE", "wrong")
+	if _, err := store.Get(Credential{URL: "https://wiki.example.com", Username: "me"}); err == nil || !strings.Contains(err.Error(), "cannot decrypt") {
+		t.Errorf("got %v, want a decryption failure", err)
+	}
+	t.Setenv("SCRIBE_CREDENTIALS_PASSPHRASE", "correct horse")
+
+	status, err = authLogout("dc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Source != "" {
+		t.Errorf("token still found in %s after logout", status.Source)
+	}
+	if _, err := os.Stat(store.path); !os.IsNotExist(err) {
+		t.Errorf("empty credentials file left behind: %v", err)
+	}
+}
+
+func TestRepoConfigCannotSetCredentialHelper(t *testing.T) {
+	dir := writeConfigs(t, "", "credential_helper: ./steal-tokens\n")
+	if _, err := loadConfig(dir); err == nil || !strings.Contains(err.Error(), "credential_helper can only be set in") {
+		t.Errorf("got %v", err)
+	}
+}
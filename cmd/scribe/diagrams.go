@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/wmorley/scribe-cli/storage"
+)
+
+// Renderer commands for diagram fences. {input} and {output} stand for the
+// source and image files; without them the source goes to stdin and the
+// image is read from stdout. {format} is the image format.
+var defaultDiagramCommands = map[string]string{
+	"mermaid":  "mmdc -i {input} -o {output} -e {format}",
+	"plantuml": "plantuml -t{format} -pipe",
+	// Formulas are only rendered to images when SCRIBE_MATH_CMD is set
+	storage.MathLanguage: "",
+}
+
+// diagramRenderer renders diagram fences with local tools, keeping every
+// image in a cache keyed by a hash of its source so unchanged diagrams are
+// not rendered again. Attachments lists the images the page needs.
+type diagramRenderer struct {
+	Dir         string
+	Format      string
+	Commands    map[string]string
+	Attachments []string
+	Warnings    []string
+}
+
+// newDiagramRenderer reads SCRIBE_MERMAID_CMD, SCRIBE_PLANTUML_CMD,
+// SCRIBE_MATH_CMD and SCRIBE_DIAGRAM_FORMAT (png or svg, default png). Images are cached next to
+// the listing cache.
+func newDiagramRenderer() *diagramRenderer {
+	d := &diagramRenderer{
+		Dir:      filepath.Join(newCacheTransport(false).Dir, "diagrams"),
+		Format:   "png",
+		Commands: map[string]string{},
+	}
+	if format := os.Getenv("SCRIBE_DIAGRAM_FORMAT"); format != "" {
+		d.Format = format
+	}
+	for language, command := range defaultDiagramCommands {
+		if v := os.Getenv("SCRIBE_" + strings.ToUpper(language) + "_CMD"); v != "" {
+			command = v
+		}
+		d.Commands[language] = command
+	}
+	return d
+}
+
+// Render implements storage.DiagramRenderer. A diagram that cannot be
+// rendered is pushed as a code block with a warning.
+func (d *diagramRenderer) Render(language, source string) (string, error) {
+	sum := sha256.Sum256([]byte(language + "\x00" + d.Format + "\x00" + source))
+	filename := language + "-" + hex.EncodeToString(sum[:8]) + "." + d.Format
+	path := filepath.Join(d.Dir, filename)
+
+	if _, err := os.Stat(path); err != nil {
+		if err := d.render(language, source, path); err != nil {
+			if language == storage.MathLanguage {
+				d.Warnings = append(d.Warnings, fmt.Sprintf("formula pushed as a macro: %v", err))
+			} else {
+				d.Warnings = append(d.Warnings, fmt.Sprintf("%s diagram pushed as code: %v", language, err))
+			}
+			return "", err
+		}
+	}
+	for _, attachment := range d.Attachments {
+		if attachment == path {
+			return filename, nil
+		}
+	}
+	d.Attachments = append(d.Attachments, path)
+	return filename, nil
+}
+
+func (d *diagramRenderer) render(language, source, path string) error {
+	args := strings.Fields(d.Commands[language])
+	if len(args) == 0 {
+		return fmt.Errorf("no renderer configured")
+	}
+
+	tmp, err := os.MkdirTemp("", "scribe-diagram-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	input := filepath.Join(tmp, "diagram."+language)
+	output := filepath.Join(tmp, "diagram."+d.Format)
+
+	usesInput, usesOutput := false, false
+	for i, arg := range args {
+		usesInput = usesInput || strings.Contains(arg, "{input}")
+		usesOutput = usesOutput || strings.Contains(arg, "{output}")
+		args[i] = strings.NewReplacer("{input}", input, "{output}", output, "{format}", d.Format).Replace(arg)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if usesInput {
+		if err := os.WriteFile(input, []byte(source), 0o600); err != nil {
+			return err
+		}
+	} else {
+		cmd.Stdin = strings.NewReader(source)
+	}
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s: %w: %s", args[0], err, msg)
+		}
+		return fmt.Errorf("%s: %w", args[0], err)
+	}
+
+	image := stdout.Bytes()
+	if usesOutput {
+		if image, err = os.ReadFile(output); err != nil {
+			return fmt.Errorf("%s wrote no image: %w", args[0], err)
+		}
+	}
+	if len(image) == 0 {
+		return fmt.Errorf("%s wrote no image", args[0])
+	}
+
+	if err := os.MkdirAll(d.Dir, 0o755); err != nil {
+		return err
+	}
+	// Written under a temporary name so an interrupted render never leaves a
+	// truncated image in the cache
+	partial := path + ".tmp"
+	if err := os.WriteFile(partial, image, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(partial, path)
+}
+
+// diagramSource recognizes the collapsed expand push writes under a diagram
+// and returns the source it keeps
+func diagramSource(expand *goquery.Selection) (language, source string, ok bool) {
+	if !expand.Is("ac\\:structured-macro[ac\\:name='expand']") {
+		return "", "", false
+	}
+	code := expand.ChildrenFiltered("ac\\:rich-text-body").Children()
+	if code.Length() != 1 || !code.Is("ac\\:structured-macro[ac\\:name='code']") {
+		return "", "", false
+	}
+	language = code.ChildrenFiltered("ac\\:parameter[ac\\:name='language']").Text()
+	title := expand.ChildrenFiltered("ac\\:parameter[ac\\:name='title']").Text()
+	if !storage.DiagramLanguages[language] || title != storage.DiagramSourceTitle(language) {
+		return "", "", false
+	}
+	return language, code.ChildrenFiltered("ac\\:plain-text-body").Text(), true
+}
+
+// isDiagramImage reports whether image is one push rendered from a fence,
+// which pull drops in favour of the source in the expand that follows it
+func isDiagramImage(image *goquery.Selection) bool {
+	filename := image.Find("ri\\:attachment").AttrOr("ri:filename", "")
+	language, _, _ := strings.Cut(filename, "-")
+	if !storage.DiagramLanguages[language] {
+		return false
+	}
+	paragraph := image.Parent()
+	if !paragraph.Is("p") || paragraph.Children().Length() != 1 || strings.TrimSpace(paragraph.Text()) != "" {
+		return false
+	}
+	sourceLanguage, _, ok := diagramSource(paragraph.Next())
+	return ok && sourceLanguage == language
+}
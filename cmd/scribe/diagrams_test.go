@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDiagramsRenderOnceAndRoundTrip(t *testing.T) {
+	t.Setenv("SCRIBE_CACHE_DIR", t.TempDir())
+	t.Setenv("SCRIBE_MERMAID_CMD", "cat")
+	markdown := "```mermaid\ngraph TD\n  A --> B\n```"
+
+	converted := ConvertMarkdownFileToConfluence(markdown, "doc.md", "", nil)
+	if len(converted.Attachments) != 1 || len(converted.Warnings) != 0 {
+		t.Fatalf("got attachments %v and warnings %v, want one attachment", converted.Attachments, converted.Warnings)
+	}
+	image, err := os.ReadFile(converted.Attachments[0])
+	if err != nil || !strings.HasPrefix(string(image), "graph TD") {
+		t.Fatalf("rendered image: %q, %v", image, err)
+	}
+	if got := ConvertConfluenceToMarkdown(converted.Body); got != markdown {
+		t.Errorf("pull did not restore the fence:\n%s", got)
+	}
+
+	// A cached diagram is not rendered again
+	t.Setenv("SCRIBE_MERMAID_CMD", "false")
+	if again := ConvertMarkdownFileToConfluence(markdown, "doc.md", "", nil); again.Body != converted.Body || len(again.Warnings) != 0 {
+		t.Errorf("second push rendered again: %v", again.Warnings)
+	}
+
+	// A diagram that fails to render is pushed as code
+	failed := ConvertMarkdownFileToConfluence("```mermaid\ngraph LR\n```", "doc.md", "", nil)
+	if len(failed.Attachments) != 0 || len(failed.Warnings) != 1 || !strings.Contains(failed.Body, `ac:name="code"`) {
+		t.Errorf("failed render: attachments %v, warnings %v\n%s", failed.Attachments, failed.Warnings, failed.Body)
+	}
+}
+
+func TestMathRendersToImages(t *testing.T) {
+	t.Setenv("SCRIBE_CACHE_DIR", t.TempDir())
+	t.Setenv("SCRIBE_MATH_CMD", "cat")
+	markdown := "Inline $x^2$ here.\n\n$$\n\\sum_i x_i\n$$"
+
+	converted := ConvertMarkdownFileToConfluence(markdown, "doc.md", "", nil)
+	if len(converted.Attachments) != 2 || len(converted.Warnings) != 0 || !strings.Contains(converted.Body, `ac:alt="$x^2$"`) {
+		t.Fatalf("got attachments %v and warnings %v\n%s", converted.Attachments, converted.Warnings, converted.Body)
+	}
+	if got := ConvertConfluenceToMarkdown(converted.Body); got != markdown {
+		t.Errorf("pull did not restore the formulas:\n%s", got)
+	}
+}
@@ -1,25 +1,88 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 )
 
 // ProviderType identifies which service we are talking to
 type ProviderType string
 
 const (
-	Confluence ProviderType = "cloud"
-	Chalk      ProviderType = "chalk"
+	Confluence   ProviderType = "cloud"
+	ConfluenceV2 ProviderType = "cloud-v2"
+	Chalk        ProviderType = "chalk"
 )
 
-func NewScribeClient() ScribeProvider {
-	// 1. Check for an explicit override (e.g., SCRIBE_PROVIDER=chalk)
-	provider := ProviderType(os.Getenv("SCRIBE_PROVIDER"))
+// NewScribeClient returns the client for the named profile, or with no name
+// for SCRIBE_PROFILE or the config's default_profile. When none of those is
+// set the SCRIBE_* environment variables say what to talk to. The repository
+// config is the one that applies to dir: the directory of the file the
+// command works on, or the working directory for commands without one.
+func NewScribeClient(profile, dir string) (ScribeProvider, error) {
+	config, err := loadConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+	clients := &profileClients{config: config, clients: map[string]*profileClient{}}
+	client, err := clients.get(selectProfile(config, profile))
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// selectProfile is name, or the profile to use when none is named
+func selectProfile(config *Config, name string) string {
+	if name == "" {
+		name = os.Getenv("SCRIBE_PROFILE")
+	}
+	if name == "" {
+		name = config.DefaultProfile
+	}
+	return name
+}
+
+// ProfileInfo describes a configured profile, without its token
+type ProfileInfo struct {
+	Name string `json:"name"`
+	Profile
+	Current bool `json:"current"`
+}
+
+type ProfileListParams struct{}
+
+// profileList lists the profiles, marking the one --profile selects
+func profileList(ctx context.Context, client ScribeProvider, p ProfileListParams, progress ProgressFunc) ([]ProfileInfo, error) {
+	return listProfiles(profileName, ".")
+}
+
+// listProfiles lists the profiles configured for dir, marking the one a
+// command given --profile name would use
+func listProfiles(name, dir string) ([]ProfileInfo, error) {
+	config, err := loadConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+	current := selectProfile(config, name)
+	if _, ok := config.Profiles[current]; current != "" && !ok {
+		return nil, fmt.Errorf("unknown profile %q (%s)", current, describeProfiles(config))
+	}
+	profiles := []ProfileInfo{}
+	for _, n := range profileNames(config) {
+		profiles = append(profiles, ProfileInfo{Name: n, Profile: config.Profiles[n], Current: n == current})
+	}
+	return profiles, nil
+}
 
-	// 2. Logic to "Auto-Detect" if no override is provided
+func newProviderClient(provider ProviderType, baseURL, username, apiToken string) ScribeProvider {
+	// 1. "Auto-Detect" the provider if it is not set
 	if provider == "" {
-		username := os.Getenv("SCRIBE_USERNAME")
 		if username == "" {
 			provider = Chalk
 		} else {
@@ -27,20 +90,177 @@ func NewScribeClient() ScribeProvider {
 		}
 	}
 
-	// 3. Return the correct "Actor"
+	// 2. Return the correct "Actor"
 	switch provider {
+	case ConfluenceV2:
+		return &ConfluenceV2Client{&ConfluenceClient{
+			BaseURL:  baseURL,
+			Username: username,
+			APIToken: apiToken,
+			Client:   newHTTPClient(),
+		}}
 	case Chalk:
 		return &ChalkClient{
-			BaseURL:  os.Getenv("SCRIBE_URL"),
-			APIToken: os.Getenv("SCRIBE_API_TOKEN"),
-			Client:   &http.Client{},
+			BaseURL:  baseURL,
+			APIToken: apiToken,
+			Client:   newHTTPClient(),
 		}
 	default:
 		return &ConfluenceClient{
-			BaseURL:  os.Getenv("SCRIBE_URL"),
+			BaseURL:  baseURL,
+			Username: username,
+			APIToken: apiToken,
+			Client:   newHTTPClient(),
+		}
+	}
+}
+
+// newHTTPClient routes every request through the on-disk listing cache
+func newHTTPClient() *http.Client {
+	return &http.Client{Transport: newCacheTransport(offline)}
+}
+
+// profileClient is the client of one profile. Pages recorded as belonging
+// to another profile are sent through that profile's client instead.
+type profileClient struct {
+	ScribeProvider
+	name    string // "" for the SCRIBE_* variables
+	clients *profileClients
+}
+
+func (c *profileClient) Profile() string {
+	return c.name
+}
+
+func (c *profileClient) ForProfile(name string) (ScribeProvider, error) {
+	if name == "" && os.Getenv("SCRIBE_URL") == "" {
+		return nil, fmt.Errorf("no profile is recorded for it and SCRIBE_URL is not set")
+	}
+	client, err := c.clients.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func (c *profileClient) PageFormat() string {
+	return pageFormat(c.ScribeProvider)
+}
+
+func (c *profileClient) InstanceURL() string {
+	return instanceURL(c.ScribeProvider)
+}
+
+// profileClients creates the client of each profile once, so every page of
+// an instance shares its connection pool
+type profileClients struct {
+	config *Config
+
+	mu      sync.Mutex
+	clients map[string]*profileClient
+}
+
+func (c *profileClients) get(name string) (*profileClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, ok := c.clients[name]; ok {
+		return client, nil
+	}
+
+	profile, err := instanceProfile(c.config, name)
+	if err != nil {
+		return nil, err
+	}
+	token, _, err := resolveToken(c.config, name, profile)
+	if err != nil {
+		return nil, err
+	}
+	provider := newProviderClient(ProviderType(profile.Provider), profile.URL, profile.Username, token)
+	client := &profileClient{ScribeProvider: provider, name: name, clients: c}
+	c.clients[name] = client
+	return client, nil
+}
+
+// instanceProfile is the named profile, or for "" the profile the SCRIBE_*
+// variables describe
+func instanceProfile(config *Config, name string) (Profile, error) {
+	if name == "" {
+		return Profile{
+			URL:      os.Getenv("SCRIBE_URL"),
 			Username: os.Getenv("SCRIBE_USERNAME"),
 			APIToken: os.Getenv("SCRIBE_API_TOKEN"),
-			Client:   &http.Client{},
-		}
+			Provider: os.Getenv("SCRIBE_PROVIDER"),
+		}, nil
+	}
+	profile, ok := config.Profiles[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("unknown profile %q (%s)", name, describeProfiles(config))
+	}
+	if profile.URL == "" {
+		return Profile{}, fmt.Errorf("profile %s has no url", name)
+	}
+	return profile, nil
+}
+
+// profileNames lists the configured profiles in order
+func profileNames(config *Config) []string {
+	names := make([]string, 0, len(config.Profiles))
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func describeProfiles(config *Config) string {
+	if len(config.Profiles) == 0 {
+		return "no profiles are configured"
+	}
+	return "configured: " + strings.Join(profileNames(config), ", ")
+}
+
+// profileURL is the URL of the instance the named profile, or the one used
+// without a name, talks to for files in dir, for commands that need no client
+func profileURL(name, dir string) (string, error) {
+	config, err := loadConfig(dir)
+	if err != nil {
+		return "", err
+	}
+	profile, err := instanceProfile(config, selectProfile(config, name))
+	return profile.URL, err
+}
+
+// instanceURL is the base URL of the instance client talks to, which page
+// links are written against
+func instanceURL(client ScribeProvider) string {
+	if u, ok := client.(interface{ InstanceURL() string }); ok {
+		return u.InstanceURL()
+	}
+	return ""
+}
+
+// profileRouter is implemented by clients that know their profile and can
+// reach the other configured ones
+type profileRouter interface {
+	Profile() string
+	ForProfile(name string) (ScribeProvider, error)
+}
+
+// profileOf names the profile client talks to, or "" for the SCRIBE_*
+// variables
+func profileOf(client ScribeProvider) string {
+	if router, ok := client.(profileRouter); ok {
+		return router.Profile()
+	}
+	return ""
+}
+
+// clientForProfile is the client for the named profile, reached through
+// client. An empty name is the SCRIBE_* variables, as it is when recorded.
+func clientForProfile(client ScribeProvider, name string) (ScribeProvider, error) {
+	router, ok := client.(profileRouter)
+	if !ok || router.Profile() == name {
+		return client, nil
 	}
+	return router.ForProfile(name)
 }
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Golden files for the converter. Run `go test ./scribe -update` after an
+// intended change to the output and review the diff of testdata/.
+var update = flag.Bool("update", false, "rewrite golden files in testdata/")
+
+// checkGolden compares got against the golden file at path, or rewrites it with -update
+func checkGolden(t *testing.T, path, got string, normalize func(string) string) {
+	t.Helper()
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("missing golden file (run with -update): %v", err)
+	}
+	if normalize(got) != normalize(string(want)) {
+		t.Errorf("output differs from %s (run with -update to accept):\n--- got\n%s\n--- want\n%s", path, got, want)
+	}
+}
+
+func identity(s string) string { return s }
+
+// normalizeXHTML puts storage XHTML in a canonical form so golden files
+// compare on meaning: attributes sorted, empty elements self-closed, CDATA
+// written as escaped text and insignificant whitespace dropped. Block
+// elements start on their own line to keep diffs readable.
+func normalizeXHTML(s string) (string, error) {
+	decoder := xml.NewDecoder(strings.NewReader(s))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	var b strings.Builder
+	var pending *xml.StartElement // held back so an empty element can self-close
+	verbatim := 0                 // depth inside elements whose whitespace matters
+
+	writeStart := func(el *xml.StartElement, selfClose bool) {
+		if normalizedBlocks[xmlName(el.Name)] {
+			b.WriteString("\n")
+		}
+		b.WriteString("<" + xmlName(el.Name))
+		attrs := append([]xml.Attr(nil), el.Attr...)
+		sort.Slice(attrs, func(i, j int) bool { return xmlName(attrs[i].Name) < xmlName(attrs[j].Name) })
+		for _, attr := range attrs {
+			b.WriteString(" " + xmlName(attr.Name) + `="`)
+			_ = xml.EscapeText(&b, []byte(attr.Value))
+			b.WriteString(`"`)
+		}
+		if selfClose {
+			b.WriteString("/>")
+		} else {
+			b.WriteString(">")
+		}
+	}
+	flush := func() {
+		if pending != nil {
+			writeStart(pending, false)
+			pending = nil
+		}
+	}
+
+	for {
+		tok, err := decoder.RawToken()
+		if err == io.EOF {
+			flush()
+			return strings.TrimSpace(b.String()), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			flush()
+			el := t.Copy()
+			pending = &el
+			if verbatimElements[xmlName(t.Name)] {
+				verbatim++
+			}
+		case xml.EndElement:
+			if pending != nil {
+				writeStart(pending, true)
+				pending = nil
+			} else {
+				b.WriteString("</" + xmlName(t.Name) + ">")
+			}
+			if verbatimElements[xmlName(t.Name)] {
+				verbatim--
+			}
+		case xml.CharData:
+			text := string(t)
+			if verbatim == 0 {
+				if strings.TrimSpace(text) == "" {
+					continue
+				}
+				text = strings.Join(strings.Fields(text), " ")
+			}
+			flush()
+			_ = xml.EscapeText(&b, []byte(text))
+		case xml.Comment:
+			flush()
+			b.WriteString("<!--" + string(t) + "-->")
+		}
+	}
+}
+
+var normalizedBlocks = map[string]bool{
+	"p": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"ul": true, "ol": true, "li": true, "blockquote": true, "pre": true, "hr": true,
+	"table": true, "thead": true, "tbody": true, "tr": true, "th": true, "td": true,
+	"ac:structured-macro": true, "ac:rich-text-body": true, "ac:task-list": true, "ac:task": true,
+}
+
+var verbatimElements = map[string]bool{"pre": true, "ac:plain-text-body": true}
+
+func mustNormalizeXHTML(s string) string {
+	normalized, err := normalizeXHTML(s)
+	if err != nil {
+		return "normalize failed: " + err.Error() + "\n" + s
+	}
+	return normalized
+}
+
+func TestNormalizeXHTML(t *testing.T) {
+	a := `<p  class="x"   id="y">one
+	two</p><ri:page ri:space-key="S" ri:content-title="T"></ri:page><ac:plain-text-body><![CDATA[ keep  this ]]></ac:plain-text-body>`
+	b := `<p id="y" class="x">one two</p>
+<ri:page ri:content-title="T" ri:space-key="S" /><ac:plain-text-body> keep  this </ac:plain-text-body>`
+	if mustNormalizeXHTML(a) != mustNormalizeXHTML(b) {
+		t.Errorf("equivalent documents normalize differently:\n%s\n%s", mustNormalizeXHTML(a), mustNormalizeXHTML(b))
+	}
+	if mustNormalizeXHTML("<p>a b</p>") == mustNormalizeXHTML("<p>a  c</p>") {
+		t.Error("different text normalized to the same document")
+	}
+}
+
+// TestMarkdownGolden pushes every testdata/markdown/NAME.md and compares
+// the storage with NAME.storage.xml
+func TestMarkdownGolden(t *testing.T) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "markdown", "*.md"))
+	if len(files) == 0 {
+		t.Fatal("no markdown fixtures found")
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".md")
+		t.Run(name, func(t *testing.T) {
+			source, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ConvertMarkdownToConfluence(string(source))
+			checkGolden(t, strings.TrimSuffix(file, ".md")+".storage.xml", got, mustNormalizeXHTML)
+		})
+	}
+}
+
+// TestStorageGolden pulls every testdata/storage/NAME.xml and compares the
+// Markdown with NAME.md
+func TestStorageGolden(t *testing.T) {
+	for name, doc := range storageCorpus(t) {
+		t.Run(name, func(t *testing.T) {
+			got := ConvertConfluenceToMarkdown(doc) + "\n"
+			checkGolden(t, filepath.Join("testdata", "storage", strings.TrimSuffix(name, ".xml")+".md"), got, identity)
+		})
+	}
+}
+
+// construct is one Markdown feature, exercised alone for the lossy report
+// and combined with others by the property test
+type construct struct {
+	name     string
+	markdown string
+}
+
+var constructs = []construct{
+	{"Heading", "## Section title"},
+	{"Heading with custom id", "## Section title {#intro}"},
+	{"Link to heading", "## Getting started\n\nSee [above](#getting-started)."},
+	{"Paragraph", "Plain text that wraps\nacross two lines."},
+	{"Emphasis", "Some *emphasis* here."},
+	{"Strong", "Some **strong** text."},
+	{"Strikethrough", "Some ~~removed~~ text."},
+	{"Inline code", "Run `make build` first."},
+	{"Link", "[Docs](https://example.com/docs)"},
+	{"Link with title", `[Docs](https://example.com/docs "Read me")`},
+	{"Autolink", "<https://example.com>"},
+	{"Local image", "![Diagram](img/diagram.png)"},
+	{"Remote image", "![Logo](https://example.com/logo.png)"},
+	{"Bullet list", "- one\n- two\n- three"},
+	{"Ordered list", "1. one\n2. two\n3. three"},
+	{"Ordered list from 3", "3. three\n4. four"},
+	{"Nested list", "- outer\n  - inner\n- outer again"},
+	{"Loose list", "- one\n\n- two"},
+	{"Task list", "- [ ] todo\n- [x] done"},
+	{"Task with assignee and due date", "- [ ] ship it @alice due:2024-10-04"},
+	{"Mixed task list", "- [ ] task\n- plain"},
+	{"Blockquote", "> Quoted text."},
+	{"GitHub alert", "> [!NOTE]\n> Heads up."},
+	{"Untitled admonition", "!!! note\n    Heads up."},
+	{"Titled admonition", "!!! warning \"Careful\"\n    Mind the gap."},
+	{"Panel", "!!! panel\n    Boxed text."},
+	{"Fenced code", "```go\nfmt.Println(\"hi\")\n```"},
+	{"Fenced code without language", "```\nplain\n```"},
+	{"Fenced code with parameters", "```go title=\"main.go\" linenumbers collapse theme=Midnight\nfunc main() {}\n```"},
+	{"Fenced code language alias", "```language-yaml\nkey: value\n```"},
+	{"Code with CDATA end", "```\na ]]> b\n```"},
+	{"Indented code", "    indented"},
+	{"Horizontal rule", "---"},
+	{"Hard line break", "one  \ntwo"},
+	{"Table", "| a | b |\n| --- | --- |\n| 1 | 2 |"},
+	{"Table alignment", "| a | b |\n| :--- | ---: |\n| 1 | 2 |"},
+	{"Inline HTML", "Press <kbd>Ctrl</kbd>."},
+	{"Preserved macro block", "```confluence-storage\n<ac:structured-macro ac:name=\"jira\"><ac:parameter ac:name=\"key\">OPS-1</ac:parameter></ac:structured-macro>\n```"},
+	{"Table of contents", "[[toc]]"},
+	{"Table of contents with parameters", `[[toc maxLevel=3 exclude="Change log"]]`},
+	{"Status", "Build {status:green|PASSED} today."},
+	{"Subtle status", "{status:grey|DRAFT|subtle}"},
+	{"Expand", "<details>\n<summary>Show more</summary>\n\nHidden *text*.\n\n</details>"},
+	{"Mention", "Thanks @jdoe for the review."},
+	{"Mention by account ID", "cc @[Alice Smith](5b10ac8d82e05b22cc7d4ef5)"},
+	{"Date", "Freeze starts {date:2024-12-20}."},
+	{"Footnote", "Claim.[^1]\n\n[^1]: Source."},
+	{"Named footnote", "Claim.[^source]\n\n[^source]: Source."},
+	{"Footnote under custom heading id", "## Intro {#custom}\n\nClaim.[^1] See [intro](#custom).\n\n[^1]: Source."},
+	{"Inline math", "Energy is $E = mc^2$."},
+	{"Display math", "$$\n\\int_0^1 x\\,dx\n$$"},
+	{"Escaped characters", `Literal \*stars\* and \_underscores\_.`},
+}
+
+func roundTrip(markdown string) string {
+	return ConvertConfluenceToMarkdown(ConvertMarkdownToConfluence(markdown))
+}
+
+// TestRoundTripStability is the property that a document which has been
+// through one push and pull is a fixed point: pushing and pulling it again
+// changes neither the Markdown nor the storage. Documents are random
+// combinations of constructs from a fixed seed so failures reproduce.
+func TestRoundTripStability(t *testing.T) {
+	rng := rand.New(rand.NewSource(34))
+	for i := 0; i < 200; i++ {
+		n := 1 + rng.Intn(6)
+		blocks := make([]string, n)
+		names := make([]string, n)
+		for j := range blocks {
+			c := constructs[rng.Intn(len(constructs))]
+			blocks[j], names[j] = c.markdown, c.name
+		}
+		doc := strings.Join(blocks, "\n\n")
+
+		once := roundTrip(doc)
+		twice := roundTrip(once)
+		if once != twice {
+			t.Errorf("document %d (%s) is not stable:\n--- input\n%s\n--- after one round trip\n%s\n--- after two\n%s",
+				i, strings.Join(names, ", "), doc, once, twice)
+			continue
+		}
+		first := mustNormalizeXHTML(ConvertMarkdownToConfluence(once))
+		second := mustNormalizeXHTML(ConvertMarkdownToConfluence(twice))
+		if first != second {
+			t.Errorf("document %d (%s) pushes differently after a round trip:\n%s\n---\n%s", i, strings.Join(names, ", "), first, second)
+		}
+	}
+}
+
+// TestLossyReport classifies every construct and keeps the result in
+// testdata/lossy-report.md, so a converter change that loses (or stops
+// losing) something shows up in review:
+//
+//   - exact: the Markdown comes back unchanged
+//   - normalized: the Markdown is rewritten but pushes to the same storage
+//   - lossy: pushing the pulled Markdown gives different storage
+func TestLossyReport(t *testing.T) {
+	var exact, normalized, lossy strings.Builder
+	for _, c := range constructs {
+		pulled := roundTrip(c.markdown)
+		pushed := mustNormalizeXHTML(ConvertMarkdownToConfluence(c.markdown))
+		repushed := mustNormalizeXHTML(ConvertMarkdownToConfluence(pulled))
+		switch {
+		case pulled == c.markdown:
+			fmt.Fprintf(&exact, "- %s\n", c.name)
+		case pushed == repushed:
+			fmt.Fprintf(&normalized, "### %s\n\n%s\n\ncomes back as\n\n%s\n\n", c.name, fencedMarkdown(c.markdown), fencedMarkdown(pulled))
+		default:
+			fmt.Fprintf(&lossy, "### %s\n\n%s\n\ncomes back as\n\n%s\n\n", c.name, fencedMarkdown(c.markdown), fencedMarkdown(pulled))
+		}
+	}
+
+	report := "# Round-trip report\n\n" +
+		"Generated by `go test ./scribe -run TestLossyReport -update`. Each construct is\n" +
+		"pushed to storage format and pulled back.\n\n" +
+		"## Lossy\n\nPushing the pulled Markdown changes the page.\n\n" + lossy.String() +
+		"## Normalized\n\nThe Markdown is rewritten but the page is unchanged.\n\n" + normalized.String() +
+		"## Exact\n\n" + exact.String()
+	checkGolden(t, filepath.Join("testdata", "lossy-report.md"), report, identity)
+}
+
+func fencedMarkdown(s string) string {
+	fence := "```"
+	for strings.Contains(s, fence) {
+		fence += "`"
+	}
+	return fence + "markdown\n" + s + "\n" + fence
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/wmorley/scribe-cli/storage"
+)
+
+// Links between local Markdown files become links between Confluence pages.
+// A file is tied to its page by the confluence_title and confluence_space
+// frontmatter that `page get` writes, and pages no local file tracks are
+// linked through their /display/SPACE/Title URL.
+
+// linkResolver resolves the links of one Markdown file on push, collecting
+// a warning for every local link it cannot turn into a page link
+type linkResolver struct {
+	dir      string
+	baseURL  string
+	Warnings []string
+}
+
+// newLinkResolver resolves the links of file, recognising page URLs of the
+// instance at baseURL
+func newLinkResolver(file, baseURL string) *linkResolver {
+	return &linkResolver{
+		dir:     filepath.Dir(file),
+		baseURL: strings.TrimRight(baseURL, "/"),
+	}
+}
+
+func (r *linkResolver) warn(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Resolve implements storage.PageResolver
+func (r *linkResolver) Resolve(dest string) *storage.PageRef {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil
+	}
+	if u.Scheme != "" || u.Host != "" {
+		return r.resolveDisplayURL(dest)
+	}
+	if u.Path == "" || !isMarkdownPath(u.Path) {
+		return nil
+	}
+
+	target := filepath.Join(r.dir, filepath.FromSlash(u.Path))
+	content, err := os.ReadFile(target)
+	if err != nil {
+		r.warn("link to %s: %v", dest, err)
+		return nil
+	}
+	fm := parseFrontmatter(string(content))
+	if fm["confluence_title"] == "" || fm["confluence_space"] == "" {
+		r.warn("link to %s: file has no confluence_title/confluence_space frontmatter (push or pull it first)", dest)
+		return nil
+	}
+	return &storage.PageRef{
+		Title:  fm["confluence_title"],
+		Space:  fm["confluence_space"],
+		Anchor: confluenceAnchor(content, u.Fragment),
+	}
+}
+
+// confluenceAnchor is the Confluence anchor of the heading a `#fragment`
+// of a Markdown file points at. Fragments of no heading are kept as they are.
+func confluenceAnchor(markdown []byte, fragment string) string {
+	if anchor, ok := storage.AnchorsByFragment(markdown)[fragment]; ok && fragment != "" {
+		return anchor
+	}
+	return fragment
+}
+
+// markdownFragment is the `#fragment` of the heading with a Confluence
+// anchor in a Markdown file, the reverse of confluenceAnchor
+func markdownFragment(markdown []byte, anchor string) string {
+	for fragment, a := range storage.AnchorsByFragment(markdown) {
+		if a == anchor {
+			return fragment
+		}
+	}
+	return anchor
+}
+
+// resolveDisplayURL recognises <base URL>/display/SPACE/Title links, as written on pull
+func (r *linkResolver) resolveDisplayURL(dest string) *storage.PageRef {
+	if r.baseURL == "" {
+		return nil
+	}
+	rest, ok := strings.CutPrefix(dest, r.baseURL)
+	if !ok {
+		return nil
+	}
+	rest = strings.TrimPrefix(rest, "/wiki")
+	rest, ok = strings.CutPrefix(rest, "/display/")
+	if !ok {
+		return nil
+	}
+	rest, anchor, _ := strings.Cut(rest, "#")
+	space, title, ok := strings.Cut(rest, "/")
+	if !ok || space == "" || title == "" {
+		return nil
+	}
+	title, err := url.QueryUnescape(title)
+	if err != nil {
+		return nil
+	}
+	return &storage.PageRef{Title: title, Space: space, Anchor: anchor}
+}
+
+func isMarkdownPath(p string) bool {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".md", ".markdown":
+		return true
+	}
+	return false
+}
+
+// localPages indexes the Markdown files under a directory by the page they track
+type localPages struct {
+	dir   string
+	files map[string]string // space + "/" + title -> path
+}
+
+// indexLocalPages walks dir, skipping hidden directories
+func indexLocalPages(dir string) *localPages {
+	pages := &localPages{dir: dir, files: map[string]string{}}
+	_ = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if p != dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isMarkdownPath(p) {
+			return nil
+		}
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return nil
+		}
+		fm := parseFrontmatter(string(content))
+		if fm["confluence_title"] != "" && fm["confluence_space"] != "" {
+			pages.files[fm["confluence_space"]+"/"+fm["confluence_title"]] = p
+		}
+		return nil
+	})
+	return pages
+}
+
+// link returns the relative path to the file tracking the page, if any,
+// with anchor turned into the fragment of the heading it names there.
+// A nil index tracks nothing.
+func (l *localPages) link(space, title, anchor string) (string, bool) {
+	if l == nil {
+		return "", false
+	}
+	p, ok := l.files[space+"/"+title]
+	if !ok {
+		return "", false
+	}
+	rel, err := filepath.Rel(l.dir, p)
+	if err != nil {
+		return "", false
+	}
+	link := &url.URL{Path: filepath.ToSlash(rel)}
+	if anchor != "" {
+		if content, err := os.ReadFile(p); err == nil {
+			link.Fragment = markdownFragment(content, anchor)
+		}
+	}
+	return link.String(), true
+}
+
+// displayURL is the address Confluence serves a page at by space and title
+func displayURL(baseURL, space, title string) string {
+	return strings.TrimRight(baseURL, "/") + "/display/" + url.PathEscape(space) + "/" + url.QueryEscape(title)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wmorley/scribe-cli/storage"
+)
+
+// writeTree writes files, keyed by slash-separated path, under a new directory
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+const setupPage = "---\nconfluence_title: Setup Guide\nconfluence_space: DEV\n---\n# Setup Guide\n\n## Install the CLI\n\n## Custom {#custom-id}\n"
+
+func TestLinkResolver(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"setup.md":      setupPage,
+		"docs/notes.md": "# Notes\n",
+		"docs/page.md":  "",
+	})
+	r := newLinkResolver(filepath.Join(root, "docs", "page.md"), "https://wiki.example.com/")
+
+	for _, tt := range []struct {
+		dest string
+		want *storage.PageRef
+	}{
+		{"../setup.md", &storage.PageRef{Title: "Setup Guide", Space: "DEV"}},
+		{"../setup.md#install-the-cli", &storage.PageRef{Title: "Setup Guide", Space: "DEV", Anchor: "InstalltheCLI"}},
+		{"../setup.md#custom-id", &storage.PageRef{Title: "Setup Guide", Space: "DEV", Anchor: "custom-id"}},
+		{"../setup.md#nowhere", &storage.PageRef{Title: "Setup Guide", Space: "DEV", Anchor: "nowhere"}},
+		{"https://wiki.example.com/display/OPS/Run+Book#RunBook-Steps", &storage.PageRef{Title: "Run Book", Space: "OPS", Anchor: "RunBook-Steps"}},
+		{"https://wiki.example.com/wiki/display/OPS/Run+Book", &storage.PageRef{Title: "Run Book", Space: "OPS"}},
+		{"https://other.example.com/display/OPS/Run+Book", nil},
+		{"https://wiki.example.com/pages/viewpage.action?pageId=1", nil},
+		{"spec.pdf", nil},
+		{"#local", nil},
+	} {
+		if got := r.Resolve(tt.dest); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.dest, got, tt.want)
+		}
+	}
+	if len(r.Warnings) != 0 {
+		t.Errorf("warnings for resolvable links: %v", r.Warnings)
+	}
+
+	for _, dest := range []string{"notes.md", "gone.md#intro"} {
+		if got := r.Resolve(dest); got != nil {
+			t.Errorf("%s: got %+v, want no page", dest, got)
+		}
+	}
+	if len(r.Warnings) != 2 ||
+		r.Warnings[0] != "link to notes.md: file has no confluence_title/confluence_space frontmatter (push or pull it first)" ||
+		!strings.HasPrefix(r.Warnings[1], "link to gone.md#intro: ") {
+		t.Errorf("warnings %q, want the untracked and missing files", r.Warnings)
+	}
+
+	// Without an instance URL, page URLs are left as links
+	if got := newLinkResolver(filepath.Join(root, "page.md"), "").Resolve("https://wiki.example.com/display/OPS/Run+Book"); got != nil {
+		t.Errorf("got %+v without a base URL", got)
+	}
+}
+
+func TestLocalPagesLink(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"setup.md":             setupPage,
+		"ops/run book.md":      "---\nconfluence_title: Run Book\nconfluence_space: OPS\n---\n",
+		"ops/untracked.md":     "# Untracked\n",
+		".trash/old.md":        "---\nconfluence_title: Old\nconfluence_space: OPS\n---\n",
+		"ops/notes.markdown":   "---\nconfluence_title: Notes\nconfluence_space: OPS\n---\n",
+		"ops/tracked.txt":      "---\nconfluence_title: Text\nconfluence_space: OPS\n---\n",
+		"ops/nested/deeper.md": "---\nconfluence_title: Deeper\nconfluence_space: OPS\n---\n",
+	})
+	pages := indexLocalPages(filepath.Join(root, "ops"))
+
+	for _, tt := range []struct {
+		space, title, anchor string
+		want                 string
+	}{
+		{"OPS", "Run Book", "", "run%20book.md"},
+		{"OPS", "Notes", "", "notes.markdown"},
+		{"OPS", "Deeper", "", "nested/deeper.md"},
+		{"OPS", "Old", "", ""},
+		{"OPS", "Text", "", ""},
+		{"DEV", "Setup Guide", "", ""},
+	} {
+		got, ok := pages.link(tt.space, tt.title, tt.anchor)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("%s/%s: got %q, %v, want %q", tt.space, tt.title, got, ok, tt.want)
+		}
+	}
+
+	// Anchors go back to the fragments of the file's headings
+	pages = indexLocalPages(root)
+	for anchor, want := range map[string]string{
+		"InstalltheCLI": "setup.md#install-the-cli",
+		"custom-id":     "setup.md#custom-id",
+		"Unknown":       "setup.md#Unknown",
+	} {
+		if got, ok := pages.link("DEV", "Setup Guide", anchor); !ok || got != want {
+			t.Errorf("anchor %s: got %q, want %q", anchor, got, want)
+		}
+	}
+	if _, ok := pages.link("OPS", "Old", ""); ok {
+		t.Error("a page under a hidden directory was indexed")
+	}
+
+	var none *localPages
+	if _, ok := none.link("DEV", "Setup Guide", ""); ok {
+		t.Error("a nil index tracks pages")
+	}
+}
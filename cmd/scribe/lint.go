@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/wmorley/scribe-cli/storage"
+	"github.com/yuin/goldmark/ast"
+	east "github.com/yuin/goldmark/extension/ast"
+)
+
+// Tables beyond these sizes are hard to read and slow to edit on Confluence
+const (
+	lintMaxTableRows    = 200
+	lintMaxTableColumns = 12
+)
+
+// LintIssue is a construct in a Markdown file that will not survive
+// conversion as written
+type LintIssue struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// String formats the issue for a quickfix list: file:line:column: message [rule]
+func (i LintIssue) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s [%s]", i.File, i.Line, i.Column, i.Message, i.Rule)
+}
+
+var htmlTagPattern = regexp.MustCompile(`<!--|<([A-Za-z][A-Za-z0-9:-]*)`)
+
+// codeLanguages are the languages the code macro highlights, with
+// any SCRIBE_CODE_LANGUAGES (comma-separated) the instance adds
+func codeLanguages() map[string]bool {
+	languages := map[string]bool{}
+	for language := range storage.CodeLanguages {
+		languages[language] = true
+	}
+	for _, language := range strings.Split(os.Getenv("SCRIBE_CODE_LANGUAGES"), ",") {
+		if language = strings.TrimSpace(strings.ToLower(language)); language != "" {
+			languages[language] = true
+		}
+	}
+	return languages
+}
+
+// lintMarkdown checks markdown, the contents of file, on the document
+// ConvertMarkdownToConfluence would render
+func lintMarkdown(file, markdown string) []LintIssue {
+	doc, source := parseMarkdown(markdown, file)
+	l := &linter{
+		file:      file,
+		source:    source,
+		skipLines: strings.Count(markdown[:len(markdown)-len(source)], "\n"),
+		languages: codeLanguages(),
+		aliases:   codeAliases(filepath.Dir(file)),
+		links:     newLinkResolver(file, ""),
+		anchors:   map[string]bool{},
+	}
+	for _, anchor := range storage.AnchorsByFragment(source) {
+		l.anchors[anchor] = true
+	}
+
+	headings := map[string]int{} // anchor -> line of its first heading
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.RawHTML:
+			for i := 0; i < n.Segments.Len(); i++ {
+				segment := n.Segments.At(i)
+				l.html(segment.Start, segment.Value(source))
+			}
+		case *ast.HTMLBlock:
+			if n.Lines().Len() > 0 {
+				l.html(n.Lines().At(0).Start, n.Lines().Value(source))
+			}
+		case *ast.FencedCodeBlock:
+			language := string(n.Language(source))
+			if storage.DiagramLanguages[language] || language == storage.RawLanguage || language == storage.MathLanguage {
+				break
+			}
+			if language != "" && !l.languages[storage.ResolveCodeLanguage(language, l.aliases)] {
+				l.report(n, "code-language", "code language %q is not one the code macro highlights, so it shows as plain text", language)
+			}
+			if n.Info != nil {
+				_, params := storage.ParseCodeInfo(string(n.Info.Segment.Value(source)))
+				for _, p := range params {
+					if !storage.CodeParameters[p.Name] {
+						l.report(n, "code-parameter", "%q is not a code macro parameter, so push drops it", p.Name)
+					}
+				}
+			}
+		case *ast.Link:
+			l.link(n, string(n.Destination))
+		case *storage.PageLink:
+			if n.Page.Title == "" && !l.anchors[n.Page.Anchor] {
+				l.report(n, "broken-link", "link to #%s matches no heading or anchor on the page", n.Page.Anchor)
+			}
+		case *ast.Image:
+			l.image(n, string(n.Destination))
+		case *ast.Heading:
+			// A `{#custom-id}` heading is linked to by its id
+			if _, custom := n.FirstChild().(*storage.Anchor); custom {
+				break
+			}
+			anchor := storage.HeadingAnchor(inlineText(n, source))
+			line, _ := l.position(n)
+			if first, ok := headings[anchor]; ok {
+				l.report(n, "duplicate-anchor", "heading anchor %q is taken by the heading on line %d; Confluence numbers this one, so links to it break when headings move", anchor, first)
+			} else {
+				headings[anchor] = line
+			}
+		case *east.Table:
+			rows := 0
+			for row := n.FirstChild(); row != nil; row = row.NextSibling() {
+				rows++
+			}
+			if rows > lintMaxTableRows || len(n.Alignments) > lintMaxTableColumns {
+				l.report(n, "large-table", "table of %d rows and %d columns is larger than %d rows or %d columns", rows, len(n.Alignments), lintMaxTableRows, lintMaxTableColumns)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+
+	// Rendering runs the sanitizer, whose removed elements raw-html has covered
+	sanitizer := newHTMLSanitizer(file, markdown)
+	_ = storage.New(append(markdownExtenders(markdown, file), sanitizer.Extender())...).Renderer().Render(io.Discard, source, doc)
+	for _, issue := range sanitizer.issues {
+		if issue.Rule != "raw-html" {
+			l.issues = append(l.issues, issue)
+		}
+	}
+
+	sortIssues(l.issues)
+	return l.issues
+}
+
+// sortIssues orders issues by where they are in the file
+func sortIssues(issues []LintIssue) {
+	sort.SliceStable(issues, func(i, j int) bool {
+		a, b := issues[i], issues[j]
+		return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+	})
+}
+
+type linter struct {
+	file      string
+	source    []byte
+	skipLines int // frontmatter lines before source
+	languages map[string]bool
+	aliases   map[string]string
+	links     *linkResolver
+	anchors   map[string]bool
+	issues    []LintIssue
+}
+
+func (l *linter) report(n ast.Node, rule, format string, args ...interface{}) {
+	line, column := l.position(n)
+	l.reportAt(line, column, rule, format, args...)
+}
+
+func (l *linter) reportAt(line, column int, rule, format string, args ...interface{}) {
+	l.issues = append(l.issues, LintIssue{File: l.file, Line: line, Column: column, Rule: rule, Message: fmt.Sprintf(format, args...)})
+}
+
+// position is the line and column of n in the file, counting the
+// frontmatter that source lacks
+func (l *linter) position(n ast.Node) (int, int) {
+	return l.positionOf(nodeOffset(n))
+}
+
+func (l *linter) positionOf(offset int) (int, int) {
+	return sourcePosition(l.source, offset, l.skipLines)
+}
+
+// html reports the elements and comments of raw HTML at offset that
+// Confluence strips
+func (l *linter) html(offset int, raw []byte) {
+	if strings.HasPrefix(string(raw), "<!-- "+storage.RawLanguage+":") {
+		return
+	}
+	for _, m := range htmlTagPattern.FindAllSubmatchIndex(raw, -1) {
+		line, column := l.positionOf(offset + m[0])
+		if m[2] < 0 {
+			l.reportAt(line, column, "raw-html", "HTML comments are stripped by Confluence")
+			continue
+		}
+		tag := strings.ToLower(string(raw[m[2]:m[3]]))
+		if !storage.AllowedHTMLTags[tag] && !strings.Contains(tag, ":") {
+			l.reportAt(line, column, "raw-html", "<%s> is stripped by Confluence", tag)
+		}
+	}
+}
+
+// link reports a relative link to a file that does not exist, or to a
+// Markdown file push cannot turn into a page link
+func (l *linter) link(n ast.Node, dest string) {
+	u, err := url.Parse(dest)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return
+	}
+	if isMarkdownPath(u.Path) {
+		warnings := len(l.links.Warnings)
+		l.links.Resolve(dest)
+		for _, warning := range l.links.Warnings[warnings:] {
+			l.report(n, "broken-link", "%s", warning)
+		}
+		return
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(l.file), filepath.FromSlash(u.Path))); err != nil {
+		l.report(n, "broken-link", "link to %s: no such file", dest)
+	}
+}
+
+// image reports a local image that is not there to attach
+func (l *linter) image(n ast.Node, dest string) {
+	u, err := url.Parse(dest)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(l.file), filepath.FromSlash(u.Path))); err != nil {
+		offset := nodeOffset(n)
+		// Without alt text the image has no text of its own to point at
+		if n.ChildCount() == 0 {
+			if i := strings.Index(string(l.source[offset:]), "![]("+dest); i >= 0 {
+				offset += i
+			}
+		}
+		line, column := l.positionOf(offset)
+		l.reportAt(line, column, "missing-image", "image %s: no such file to attach", dest)
+	}
+}
+
+// nodeOffset is where n starts in the source: its first line, or the
+// first text inside it, or else where its parent starts
+func nodeOffset(n ast.Node) int {
+	for node := n; node != nil; node = node.Parent() {
+		offset := -1
+		_ = ast.Walk(node, func(c ast.Node, entering bool) (ast.WalkStatus, error) {
+			if !entering {
+				return ast.WalkContinue, nil
+			}
+			switch c := c.(type) {
+			case *ast.FencedCodeBlock:
+				if c.Info != nil {
+					offset = c.Info.Segment.Start
+				}
+			case *ast.Text:
+				offset = c.Segment.Start
+			case *ast.RawHTML:
+				if c.Segments.Len() > 0 {
+					offset = c.Segments.At(0).Start
+				}
+			default:
+				if c.Type() == ast.TypeBlock && c.Lines().Len() > 0 {
+					offset = c.Lines().At(0).Start
+				}
+			}
+			if offset >= 0 {
+				return ast.WalkStop, nil
+			}
+			return ast.WalkContinue, nil
+		})
+		if offset >= 0 {
+			return offset
+		}
+	}
+	return 0
+}
+
+// inlineText is the text of n's inlines
+func inlineText(n ast.Node, source []byte) string {
+	var b strings.Builder
+	_ = ast.Walk(n, func(c ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			switch c := c.(type) {
+			case *ast.Text:
+				b.Write(c.Segment.Value(source))
+			case *ast.String:
+				b.Write(c.Value)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	return b.String()
+}
+
+// LintParams name the file to check. Content, when set, is checked in
+// place of what is on disk, such as an editor's unsaved buffer.
+type LintParams struct {
+	File    string `json:"file"`
+	Content string `json:"content"`
+}
+
+func lintFile(ctx context.Context, client ScribeProvider, p LintParams, progress ProgressFunc) ([]LintIssue, error) {
+	if p.File == "" {
+		return nil, fmt.Errorf("file is required")
+	}
+	content := p.Content
+	if content == "" {
+		data, err := os.ReadFile(p.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+		content = string(data)
+	}
+	issues := lintMarkdown(p.File, content)
+	if issues == nil {
+		issues = []LintIssue{}
+	}
+	return issues, nil
+}
+
+func runLint(cmd *cobra.Command, args []string) error {
+	issues, err := lintFile(cmd.Context(), nil, LintParams{File: filePath}, nil)
+	if err != nil {
+		return err
+	}
+	if lintJSON {
+		if err := printJSON(issues); err != nil {
+			return err
+		}
+	} else {
+		for _, issue := range issues {
+			fmt.Println(issue)
+		}
+	}
+	if len(issues) > 0 {
+		cmd.SilenceUsage, cmd.SilenceErrors = true, true
+		return errReported
+	}
+	return nil
+}
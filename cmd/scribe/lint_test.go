@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestLintMarkdown(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"logo.png":   "",
+		"spec.pdf":   "",
+		"tracked.md": "---\nconfluence_title: Tracked\nconfluence_space: DEV\n---\n# Tracked\n",
+		"local.md":   "# Untracked\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("SCRIBE_CODE_LANGUAGES", "kotlin")
+
+	file := filepath.Join(dir, "doc.md")
+	markdown := strings.Join([]string{
+		"---",
+		"confluence_title: Doc",
+		"---",
+		"# Notes",
+		"",
+		"Text with <span>kept</span> and <iframe src=x></iframe>.",
+		"",
+		"<!-- draft -->",
+		"",
+		"```golang",
+		"x",
+		"```",
+		"",
+		"```kotlin",
+		"y",
+		"```",
+		"",
+		"```mermaid",
+		"graph TD",
+		"```",
+		"",
+		"[a](tracked.md) [b](local.md) [c](spec.pdf) [d](gone.pdf) [e](#notes) [f](#nowhere) [g](https://example.com)",
+		"",
+		"![logo](logo.png) ![](missing.png)",
+		"",
+		"## Notes",
+		"",
+		"## Other {#other}",
+		"",
+		"## Other",
+		"",
+		"| " + strings.Repeat("c | ", 13),
+		"|" + strings.Repeat("---|", 13),
+	}, "\n")
+
+	var got []string
+	for _, issue := range lintMarkdown(file, markdown) {
+		if issue.File != file {
+			t.Errorf("issue for %s", issue.File)
+		}
+		got = append(got, strings.TrimPrefix(issue.String(), file+":"))
+	}
+	want := []string{
+		"6:33: <iframe> is stripped by Confluence [raw-html]",
+		"8:1: HTML comments are stripped by Confluence [raw-html]",
+		`10:4: code language "golang" is not one the code macro highlights, so it shows as plain text [code-language]`,
+		"22:18: link to local.md: file has no confluence_title/confluence_space frontmatter (push or pull it first) [broken-link]",
+		"22:46: link to gone.pdf: no such file [broken-link]",
+		"22:72: link to #nowhere matches no heading or anchor on the page [broken-link]",
+		"24:19: image missing.png: no such file to attach [missing-image]",
+		`26:4: heading anchor "Notes" is taken by the heading on line 4; Confluence numbers this one, so links to it break when headings move [duplicate-anchor]`,
+		"32:3: table of 1 rows and 13 columns is larger than 200 rows or 12 columns [large-table]",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if issues := lintMarkdown(file, "# Clean\n\nJust **text** and `code`.\n"); len(issues) != 0 {
+		t.Errorf("clean file: %v", issues)
+	}
+}
+
+func TestLintJSONReportsOnlyIssues(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "doc.md")
+	if err := os.WriteFile(file, []byte("<iframe></iframe>\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	savedFile, savedJSON, savedStdout := filePath, lintJSON, os.Stdout
+	t.Cleanup(func() { filePath, lintJSON, os.Stdout = savedFile, savedJSON, savedStdout })
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	filePath, lintJSON, os.Stdout = file, true, w
+
+	cmd := &cobra.Command{}
+	err = runLint(cmd, nil)
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	// main exits non-zero on errReported without printing it
+	if !errors.Is(err, errReported) || !cmd.SilenceErrors {
+		t.Errorf("got %v (errors silenced: %v), want errReported", err, cmd.SilenceErrors)
+	}
+	var issues []LintIssue
+	if err := json.Unmarshal(out, &issues); err != nil || len(issues) != 1 || issues[0].Rule != "raw-html" {
+		t.Errorf("stdout is not the issues alone (%v):\n%s", err, out)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+
+	htmltomarkdown "github.com/JohannesKaufmann/html-to-markdown"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/wmorley/scribe-cli/storage"
+)
+
+// Pull side of the toc, status and expand shorthands. A macro whose
+// parameters the shorthand cannot carry is preserved as storage instead.
+
+var macroParamName = regexp.MustCompile(`^[\w-]+$`)
+
+// tocToMarkdown writes `[[toc]]`, with any parameters as name=value pairs
+func tocToMarkdown(macro *goquery.Selection) string {
+	var b strings.Builder
+	b.WriteString("[[toc")
+	ok := true
+	macro.ChildrenFiltered("ac\\:parameter").Each(func(_ int, param *goquery.Selection) {
+		name, value := param.AttrOr("ac:name", ""), param.Text()
+		if !macroParamName.MatchString(name) || strings.Contains(value, `"`) {
+			ok = false
+		}
+		if value == "" || strings.ContainsAny(value, " \t\n]") {
+			value = `"` + value + `"`
+		}
+		b.WriteString(" " + name + "=" + value)
+	})
+	if !ok {
+		return preservedMacro(macro)
+	}
+	return "\n\n" + b.String() + "]]\n\n"
+}
+
+// statusToMarkdown writes `{status:colour|Title}`
+func statusToMarkdown(macro *goquery.Selection) string {
+	param := func(name string) string {
+		return macro.ChildrenFiltered("ac\\:parameter[ac\\:name='" + name + "']").Text()
+	}
+	colour := strings.ToLower(param("colour"))
+	if colour == "" {
+		colour = "grey"
+	}
+	title := strings.TrimSpace(param("title"))
+	if _, ok := storage.StatusColours[colour]; !ok || strings.ContainsAny(title, "|}\\\n") {
+		return preservedMacro(macro)
+	}
+	status := "{status:" + colour
+	if title != "" {
+		status += "|" + title
+	}
+	if param("subtle") == "true" {
+		if title == "" {
+			status += "|"
+		}
+		status += "|subtle"
+	}
+	return status + "}"
+}
+
+// expandToMarkdown writes a <details> block with the title as its summary
+func expandToMarkdown(converter *htmltomarkdown.Converter, macro *goquery.Selection) string {
+	if !isBlockContext(macro.Parent()) {
+		return preservedMacro(macro)
+	}
+	var b strings.Builder
+	b.WriteString("\n\n<details>\n")
+	if title := macro.ChildrenFiltered("ac\\:parameter[ac\\:name='title']").Text(); title != "" {
+		b.WriteString("<summary>" + html.EscapeString(title) + "</summary>\n")
+	}
+	if body := strings.TrimSpace(converter.Convert(macro.ChildrenFiltered("ac\\:rich-text-body"))); body != "" {
+		b.WriteString("\n" + body + "\n")
+	}
+	b.WriteString("\n</details>\n\n")
+	return b.String()
+}
+
+// preservedMacro keeps macro as storage, the way unknown macros are kept
+func preservedMacro(macro *goquery.Selection) string {
+	var b strings.Builder
+	writeStorageHTML(&b, macro.Nodes[0], false)
+	raw := strings.TrimSpace(b.String())
+	if !isBlockContext(macro.Parent()) {
+		return storage.RawComment(raw)
+	}
+	return "\n\n" + fencedBlock(storage.RawLanguage, raw) + "\n\n"
+}
+
+// fencedBlock fences body with enough backticks that it cannot close the fence early
+func fencedBlock(language, body string) string {
+	fence := "```"
+	for strings.Contains(body, fence) {
+		fence += "`"
+	}
+	return fence + language + "\n" + strings.TrimSuffix(body, "\n") + "\n" + fence
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/spf13/cobra"
+	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
 )
 
@@ -13,21 +18,50 @@ var (
 	apiToken string
 	spaceKey string
 	pageID   string
+	pageDir  string
 	title    string
 	filePath string
 	parentID string
 	limit    int
 	offset   int
 	query    string
+	all      bool
+
+	serveStdio  bool
+	offline     bool
+	queue       bool
+	baseVersion int
+	force       bool
+	format      string
+
+	convertFrom        string
+	convertTo          string
+	convertFrontmatter string
+	convertMacros      []string
+	convertOutputDir   string
+
+	previewAddr string
+
+	lintJSON bool
+	pageJSON bool
+
+	profileName string
+
+	authStore string
 )
 
+// errReported is returned by commands that have already printed why they
+// fail, such as lint's issues: main exits non-zero without an error message
+var errReported = errors.New("failure already reported")
+
 func main() {
 	rootCmd := &cobra.Command{
 		Use:   "scribe-cli",
 		Short: "Documentation CLI for Neovim integration",
 	}
 
-	// Get credentials from environment variables
+	rootCmd.PersistentFlags().BoolVar(&offline, "offline", false, "Serve space and page listings from the cache without touching the network")
+	rootCmd.PersistentFlags().StringVar(&profileName, "profile", "", "Config profile naming the instance to use (default: SCRIBE_PROFILE, then default_profile; page update follows the file's confluence_profile)")
 
 	// Spaces command
 	spacesCmd := &cobra.Command{
@@ -44,6 +78,7 @@ func main() {
 	listSpacesCmd.Flags().StringVar(&query, "query", "", "Filter spaces by key or name")
 	listSpacesCmd.Flags().IntVar(&limit, "limit", 100, "Limit the number of results")
 	listSpacesCmd.Flags().IntVar(&offset, "offset", 0, "Starting offset for results")
+	listSpacesCmd.Flags().BoolVar(&all, "all", false, "Fetch every page of results and stream them as NDJSON (--limit sets the page size)")
 
 	spacesCmd.AddCommand(listSpacesCmd)
 
@@ -62,6 +97,8 @@ func main() {
 	createPageCmd.Flags().StringVar(&title, "title", "", "Page title (required)")
 	createPageCmd.Flags().StringVar(&filePath, "file", "", "Markdown file path (required)")
 	createPageCmd.Flags().StringVar(&parentID, "parent", "", "Parent page ID (optional)")
+	createPageCmd.Flags().BoolVar(&queue, "queue", false, "Store the page in the outbox instead of sending it")
+	createPageCmd.Flags().StringVar(&format, "format", FormatMarkdown, "File format: markdown or wiki (Confluence wiki markup)")
 	createPageCmd.MarkFlagRequired("space")
 	createPageCmd.MarkFlagRequired("title")
 	createPageCmd.MarkFlagRequired("file")
@@ -73,6 +110,9 @@ func main() {
 	}
 	updatePageCmd.Flags().StringVar(&pageID, "id", "", "Page ID (required)")
 	updatePageCmd.Flags().StringVar(&filePath, "file", "", "Markdown file path (required)")
+	updatePageCmd.Flags().BoolVar(&queue, "queue", false, "Store the update in the outbox instead of sending it")
+	updatePageCmd.Flags().IntVar(&baseVersion, "base-version", 0, "Page version the file was based on (default: confluence_version frontmatter)")
+	updatePageCmd.Flags().StringVar(&format, "format", FormatMarkdown, "File format: markdown or wiki (Confluence wiki markup)")
 	updatePageCmd.MarkFlagRequired("id")
 	updatePageCmd.MarkFlagRequired("file")
 
@@ -82,6 +122,9 @@ func main() {
 		RunE:  runGetPage,
 	}
 	getPageCmd.Flags().StringVar(&pageID, "id", "", "Page ID (required)")
+	getPageCmd.Flags().StringVar(&pageDir, "dir", "", "Directory the page is pulled into; links to pages tracked by Markdown files under it become relative links")
+	getPageCmd.Flags().StringVar(&format, "format", FormatMarkdown, "Output format: markdown or wiki (Confluence wiki markup)")
+	getPageCmd.Flags().BoolVar(&pageJSON, "json", false, "Print the content with the page's id, title, space and version as JSON")
 	getPageCmd.MarkFlagRequired("id")
 
 	searchPagesCmd := &cobra.Command{
@@ -94,139 +137,375 @@ func main() {
 	searchPagesCmd.Flags().StringVar(&query, "query", "", "Filter pages by title (CQL contains); empty = all")
 	searchPagesCmd.Flags().IntVar(&limit, "limit", 100, "Limit the number of results")
 	searchPagesCmd.Flags().IntVar(&offset, "offset", 0, "Starting offset for results")
+	searchPagesCmd.Flags().BoolVar(&all, "all", false, "Fetch every page of results and stream them as NDJSON (--limit sets the page size)")
 
 	pagesCmd.AddCommand(createPageCmd, updatePageCmd, getPageCmd, searchPagesCmd)
 
-	rootCmd.AddCommand(spacesCmd, pagesCmd)
+	serveCmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Run a long-lived JSON-RPC 2.0 server",
+		Long: `Serve every command over JSON-RPC 2.0, one JSON document per line.
+
+Methods mirror the subcommands (spaces/list, page/search, page/get,
+page/create, page/update, outbox/list, outbox/flush) and take params
+named after their flags.
+Send "$/cancelRequest" with {"id": ...} to cancel an in-flight call;
+progress is reported through "$/progress" notifications.`,
+		RunE: runServe,
+	}
+	serveCmd.Flags().BoolVar(&serveStdio, "stdio", false, "Serve over stdin/stdout")
+
+	// Cache command
+	cacheCmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the on-disk cache of space and page listings",
+	}
+	cacheClearCmd := &cobra.Command{
+		Use:   "clear",
+		Short: "Remove every cached listing",
+		RunE:  runCacheClear,
+	}
+	cacheStatsCmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Show cache location, size and freshness",
+		RunE:  runCacheStats,
+	}
+	cacheCmd.AddCommand(cacheClearCmd, cacheStatsCmd)
+
+	// Outbox command
+	outboxCmd := &cobra.Command{
+		Use:   "outbox",
+		Short: "Manage page creates and updates queued while offline",
+	}
+	outboxListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "Show queued operations",
+		RunE:  runOutboxList,
+	}
+	outboxFlushCmd := &cobra.Command{
+		Use:   "flush",
+		Short: "Send queued operations, oldest first",
+		Long:  "Send queued operations, oldest first. Updates whose page changed since their base version, and creates whose title already exists, are reported as conflicts and stay queued.",
+		RunE:  runOutboxFlush,
+	}
+	outboxFlushCmd.Flags().BoolVar(&force, "force", false, "Send conflicting operations anyway")
+	outboxCmd.AddCommand(outboxListCmd, outboxFlushCmd)
+
+	convertCmd := &cobra.Command{
+		Use:   "convert [file...]",
+		Short: "Convert documents between Markdown, wiki markup and storage format",
+		Long: `Convert files, or stdin, from one of markdown, wiki or storage to another
+without contacting Confluence. Output goes to stdout, or with --output-dir to
+one file per input named after it.
+
+Links, mentions and diagrams are written as they are rather than resolved.`,
+		RunE: runConvert,
+	}
+	convertCmd.Flags().StringVar(&convertFrom, "from", "", "Input format: markdown, wiki or storage (default: from the file extension, .md, .wiki or .xml, else markdown)")
+	convertCmd.Flags().StringVar(&convertTo, "to", FormatStorage, "Output format: markdown, wiki or storage")
+	convertCmd.Flags().StringVar(&convertFrontmatter, "frontmatter", "strip", "Frontmatter handling: strip, or keep to copy it to Markdown and wiki output")
+	convertCmd.Flags().StringArrayVar(&convertMacros, "macro", nil, "Rename a macro between Markdown and Confluence, as markdown-name=confluence-name (repeatable)")
+	convertCmd.Flags().StringVar(&convertOutputDir, "output-dir", "", "Write each converted file into this directory instead of stdout")
+
+	previewCmd := &cobra.Command{
+		Use:   "preview",
+		Short: "Serve a live HTML preview of a file",
+		Long: `Render a Markdown, wiki or storage file the way its page would look and
+serve it over HTTP, reloading in the browser whenever the file is saved.
+The URL is printed as JSON on startup; stop the server with Ctrl-C.`,
+		RunE: runPreview,
+	}
+	previewCmd.Flags().StringVar(&filePath, "file", "", "File to preview (required)")
+	previewCmd.Flags().StringVar(&previewAddr, "addr", "127.0.0.1:0", "Address to listen on (default: a free local port)")
+	previewCmd.MarkFlagRequired("file")
+
+	lintCmd := &cobra.Command{
+		Use:   "lint",
+		Short: "Check a Markdown file for constructs that will not survive conversion",
+		Long: `Report raw HTML Confluence strips, code languages the code macro does not
+highlight, broken relative links, missing images, headings whose anchors
+collide and oversized tables, one file:line:column: message per line.
+Exits non-zero when anything is found.`,
+		RunE: runLint,
+	}
+	lintCmd.Flags().StringVar(&filePath, "file", "", "Markdown file to check (required)")
+	lintCmd.Flags().BoolVar(&lintJSON, "json", false, "Print the issues as a JSON array")
+	lintCmd.MarkFlagRequired("file")
+
+	// Profile command
+	profileCmd := &cobra.Command{
+		Use:   "profile",
+		Short: "Show the instances configured as profiles",
+	}
+	profileListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List configured profiles and which one is in use",
+		RunE:  runProfileList,
+	}
+	profileCmd.AddCommand(profileListCmd)
+
+	// Auth command
+	authCmd := &cobra.Command{
+		Use:   "auth",
+		Short: "Keep API tokens in a credential store instead of the environment",
+		Long: `Store, remove and check the API token of the instance in use (see --profile).
+
+A token is looked up in the profile's api_token (or SCRIBE_API_TOKEN without
+a profile), then the credential helper, the Secret Service keyring and the
+encrypted credentials file.`,
+	}
+	authLoginCmd := &cobra.Command{
+		Use:   "login",
+		Short: "Read an API token from stdin and store it",
+		RunE:  runAuthLogin,
+	}
+	authLoginCmd.Flags().StringVar(&authStore, "store", "", "Store to use: helper, keyring or file (default: the first available)")
+	authLogoutCmd := &cobra.Command{
+		Use:   "logout",
+		Short: "Remove the stored API token from every store",
+		RunE:  runAuthLogout,
+	}
+	authStatusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show where the API token comes from; exits non-zero without one",
+		RunE:  runAuthStatus,
+	}
+	authCmd.AddCommand(authLoginCmd, authLogoutCmd, authStatusCmd)
+
+	rootCmd.AddCommand(spacesCmd, pagesCmd, serveCmd, cacheCmd, outboxCmd, convertCmd, previewCmd, lintCmd, profileCmd, authCmd)
 
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		if !errors.Is(err, errReported) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
 		os.Exit(1)
 	}
 }
 
 func runListSpaces(cmd *cobra.Command, args []string) error {
-	client := NewScribeClient()
-	opts := &ListOptions{
-		Limit:  limit,
-		Offset: offset,
-		Query:  strings.TrimSpace(query),
-	}
-	spaces, err := client.ListSpaces(opts)
+	client, err := NewScribeClient(profileName, ".")
 	if err != nil {
 		return err
 	}
-
-	output, err := json.MarshalIndent(spaces, "", "  ")
+	if all {
+		return writeNDJSON(os.Stdout, client.IterSpaces(cmd.Context(), newListOptions(query, limit, offset)))
+	}
+	spaces, err := listSpaces(cmd.Context(), client, ListSpacesParams{
+		Query:  query,
+		Limit:  limit,
+		Offset: offset,
+	}, nil)
 	if err != nil {
 		return err
 	}
-
-	fmt.Println(string(output))
-	return nil
+	return printJSON(spaces)
 }
 
 func runCreatePage(cmd *cobra.Command, args []string) error {
-	// Validate inputs
-	if spaceKey == "" || title == "" || filePath == "" {
-		return fmt.Errorf("space, title, and file are required")
+	client, err := NewScribeClient(profileName, filepath.Dir(filePath))
+	if err != nil {
+		return err
 	}
-
-	// Validate file path to prevent directory traversal
-	if strings.Contains(filePath, "..") {
-		return fmt.Errorf("invalid file path")
+	page, err := createPage(cmd.Context(), client, CreatePageParams{
+		Space:  spaceKey,
+		Title:  title,
+		File:   filePath,
+		Parent: parentID,
+		Queue:  queue,
+		Format: format,
+	}, nil)
+	if err != nil {
+		return queuedResult(err)
 	}
+	return printJSON(page)
+}
 
-	client := NewScribeClient()
-
-	content, err := os.ReadFile(filePath)
+func runUpdatePage(cmd *cobra.Command, args []string) error {
+	client, err := NewScribeClient(profileName, filepath.Dir(filePath))
+	if err != nil {
+		return err
+	}
+	page, err := updatePage(cmd.Context(), client, UpdatePageParams{
+		ID:          pageID,
+		File:        filePath,
+		BaseVersion: baseVersion,
+		Queue:       queue,
+		Format:      format,
+	}, nil)
 	if err != nil {
-		return fmt.Errorf("failed to read file: %w", err)
+		return queuedResult(err)
 	}
+	return printJSON(page)
+}
 
-	confluenceContent := ConvertMarkdownToConfluence(string(content))
+// queuedResult prints the outbox entry for an explicit --queue; anything else stays an error
+func queuedResult(err error) error {
+	var queued *QueuedError
+	if errors.As(err, &queued) && queued.Cause == nil {
+		return printJSON(queued.Entry)
+	}
+	return err
+}
 
-	page, err := client.CreatePage(spaceKey, title, confluenceContent, parentID)
+func runGetPage(cmd *cobra.Command, args []string) error {
+	dir := pageDir
+	if dir == "" {
+		dir = "."
+	}
+	client, err := NewScribeClient(profileName, dir)
 	if err != nil {
 		return err
 	}
-
-	output, err := json.MarshalIndent(page, "", "  ")
+	pulled, err := getPage(cmd.Context(), client, GetPageParams{ID: pageID, Dir: pageDir, Format: format}, nil)
 	if err != nil {
 		return err
 	}
+	if pageJSON {
+		return printJSON(pulled)
+	}
 
-	fmt.Println(string(output))
+	fmt.Println(pulled.Content)
 	return nil
 }
 
-func runUpdatePage(cmd *cobra.Command, args []string) error {
-	// Validate inputs
-	if pageID == "" || filePath == "" {
-		return fmt.Errorf("page ID and file are required")
+func runSearchPages(cmd *cobra.Command, args []string) error {
+	client, err := NewScribeClient(profileName, ".")
+	if err != nil {
+		return err
 	}
-
-	// Validate file path to prevent directory traversal
-	if strings.Contains(filePath, "..") {
-		return fmt.Errorf("invalid file path")
+	if all {
+		return writeNDJSON(os.Stdout, client.IterPages(cmd.Context(), spaceKey, newListOptions(query, limit, offset)))
 	}
-
-	client := NewScribeClient()
-
-	content, err := os.ReadFile(filePath)
+	pages, err := searchPages(cmd.Context(), client, SearchPagesParams{
+		Space:  spaceKey,
+		Query:  query,
+		Limit:  limit,
+		Offset: offset,
+	}, nil)
 	if err != nil {
-		return fmt.Errorf("failed to read file: %w", err)
+		return err
 	}
+	return printJSON(pages)
+}
 
-	confluenceContent := ConvertMarkdownToConfluence(string(content))
-
-	page, err := client.UpdatePage(pageID, confluenceContent)
+func runCacheClear(cmd *cobra.Command, args []string) error {
+	cleared, err := clearCache(cmd.Context(), nil, CacheParams{}, nil)
 	if err != nil {
 		return err
 	}
+	return printJSON(cleared)
+}
 
-	output, err := json.MarshalIndent(page, "", "  ")
+func runCacheStats(cmd *cobra.Command, args []string) error {
+	stats, err := cacheStats(cmd.Context(), nil, CacheParams{}, nil)
 	if err != nil {
 		return err
 	}
+	return printJSON(stats)
+}
 
-	fmt.Println(string(output))
-	return nil
+func runProfileList(cmd *cobra.Command, args []string) error {
+	profiles, err := profileList(cmd.Context(), nil, ProfileListParams{}, nil)
+	if err != nil {
+		return err
+	}
+	return printJSON(profiles)
 }
 
-func runGetPage(cmd *cobra.Command, args []string) error {
-	// Validate page ID (should be numeric)
-	if pageID == "" {
-		return fmt.Errorf("page ID is required")
+func runAuthLogin(cmd *cobra.Command, args []string) error {
+	token, err := readToken()
+	if err != nil {
+		return err
 	}
+	status, err := authLogin(profileName, authStore, token)
+	if err != nil {
+		return err
+	}
+	return printJSON(status)
+}
 
-	client := NewScribeClient()
+// readToken reads one line from stdin, prompting without echo on a terminal
+func readToken() (string, error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "API token: ")
+		stty := exec.Command("stty", "-echo")
+		stty.Stdin = os.Stdin
+		if stty.Run() == nil {
+			defer func() {
+				restore := exec.Command("stty", "echo")
+				restore.Stdin = os.Stdin
+				restore.Run()
+				fmt.Fprintln(os.Stderr)
+			}()
+		}
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
 
-	page, err := client.GetPage(pageID)
+func runAuthLogout(cmd *cobra.Command, args []string) error {
+	status, err := authLogout(profileName)
 	if err != nil {
 		return err
 	}
+	return printJSON(status)
+}
 
-	markdown := ConvertConfluenceToMarkdown(page.Body.Storage.Value)
-
-	fmt.Println(markdown)
+func runAuthStatus(cmd *cobra.Command, args []string) error {
+	status, err := authStatus(profileName)
+	if err != nil {
+		return err
+	}
+	if err := printJSON(status); err != nil {
+		return err
+	}
+	if status.Source == "" {
+		return fmt.Errorf("no API token for %s; run `scribe-cli auth login`", status.URL)
+	}
 	return nil
 }
 
-func runSearchPages(cmd *cobra.Command, args []string) error {
-	client := NewScribeClient()
-	opts := &ListOptions{
-		Limit:  limit,
-		Offset: offset,
-		Query:  strings.TrimSpace(query),
+func runOutboxList(cmd *cobra.Command, args []string) error {
+	entries, err := listOutbox(cmd.Context(), nil, OutboxListParams{}, nil)
+	if err != nil {
+		return err
 	}
+	return printJSON(entries)
+}
 
-	pages, err := client.SearchPages(spaceKey, opts)
+func runOutboxFlush(cmd *cobra.Command, args []string) error {
+	client, err := NewScribeClient(profileName, ".")
 	if err != nil {
 		return err
 	}
+	results, err := flushOutbox(cmd.Context(), client, OutboxFlushParams{Force: force}, nil)
+	if err != nil {
+		return err
+	}
+	if err := printJSON(results); err != nil {
+		return err
+	}
+	if unsent := countUnsent(results); unsent > 0 {
+		return fmt.Errorf("%d of %d queued operations were not sent", unsent, len(results))
+	}
+	return nil
+}
+
+func countUnsent(results []FlushResult) int {
+	n := 0
+	for _, result := range results {
+		if result.Status != "sent" {
+			n++
+		}
+	}
+	return n
+}
 
-	output, err := json.MarshalIndent(pages, "", "  ")
+func printJSON(v interface{}) error {
+	output, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"html"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	htmltomarkdown "github.com/JohannesKaufmann/html-to-markdown"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/wmorley/scribe-cli/storage"
+)
+
+// mathMacros reads SCRIBE_MATH_MACROS, the inline and block math macro
+// names separated by a comma (default "mathinline,mathblock")
+func mathMacros() storage.MathMacros {
+	macros := storage.DefaultMathMacros
+	if inline, block, ok := strings.Cut(os.Getenv("SCRIBE_MATH_MACROS"), ","); ok {
+		macros.Inline, macros.Block = strings.TrimSpace(inline), strings.TrimSpace(block)
+	}
+	return macros
+}
+
+// mathRenderer renders formulas to images with SCRIBE_MATH_CMD when it is
+// set, or returns nil to push them as macros
+func mathRenderer(diagrams *diagramRenderer) storage.DiagramRenderer {
+	if diagrams.Commands[storage.MathLanguage] == "" {
+		return nil
+	}
+	return diagrams.Render
+}
+
+// mathToMarkdown writes a math macro as `$...$`, or a `$$` block
+func mathToMarkdown(macro *goquery.Selection, macros storage.MathMacros) string {
+	if macro.AttrOr("ac:name", "") == macros.Inline {
+		return "$" + macro.ChildrenFiltered("ac\\:parameter[ac\\:name='body']").Text() + "$"
+	}
+	source := macro.ChildrenFiltered("ac\\:plain-text-body").Text()
+	if !isBlockContext(macro.Parent()) {
+		return storage.MathFormula(source, true)
+	}
+	return "\n\n$$\n" + source + "\n$$\n\n"
+}
+
+// mathImageToMarkdown returns the formula a rendered math image was made
+// from, which push keeps as its alt text
+func mathImageToMarkdown(image *goquery.Selection) (string, bool) {
+	filename := image.Find("ri\\:attachment").AttrOr("ri:filename", "")
+	alt := image.AttrOr("ac:alt", "")
+	if !strings.HasPrefix(filename, storage.MathLanguage+"-") || len(alt) < 3 || alt[0] != '$' || alt[len(alt)-1] != '$' {
+		return "", false
+	}
+	if source, ok := strings.CutPrefix(alt, "$$"); ok && strings.HasSuffix(source, "$$") && isBlockContext(image.Parent().Parent()) {
+		return "$$\n" + strings.TrimSuffix(source, "$$") + "\n$$", true
+	}
+	return alt, true
+}
+
+var footnoteAnchorPattern = regexp.MustCompile(`^fn-(\d+)$`)
+
+// footnoteNumber reads the number of a footnote anchor macro
+func footnoteNumber(anchor *goquery.Selection) (int, bool) {
+	if !anchor.Is("ac\\:structured-macro[ac\\:name='anchor']") {
+		return 0, false
+	}
+	m := footnoteAnchorPattern.FindStringSubmatch(strings.TrimSpace(anchor.ChildrenFiltered("ac\\:parameter").Text()))
+	if m == nil {
+		return 0, false
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n, true
+}
+
+// isFootnoteList reports whether every item of list starts with a footnote anchor
+func isFootnoteList(list *goquery.Selection) bool {
+	items := list.ChildrenFiltered("li")
+	if items.Length() == 0 || items.Length() != list.Children().Length() {
+		return false
+	}
+	ok := true
+	items.Each(func(_ int, item *goquery.Selection) {
+		_, isNote := footnoteNumber(item.Children().First())
+		ok = ok && isNote
+	})
+	return ok
+}
+
+// footnotesToMarkdown turns the numbered footnote list push writes, and the
+// rule before it, into `[^1]:` definitions, and the superscript references
+// to them into `[^1]`
+func footnotesToMarkdown(converter *htmltomarkdown.Converter, selec *goquery.Selection) {
+	selec.Find("ol").Each(func(_ int, list *goquery.Selection) {
+		if !isFootnoteList(list) {
+			return
+		}
+		var b strings.Builder
+		list.ChildrenFiltered("li").Each(func(_ int, item *goquery.Selection) {
+			anchor := item.Children().First()
+			n, _ := footnoteNumber(anchor)
+			anchor.Remove()
+			item.Find("ac\\:link").Each(func(_ int, link *goquery.Selection) {
+				if strings.HasPrefix(link.AttrOr("ac:anchor", ""), "fnref-") {
+					link.Remove()
+				}
+			})
+			b.WriteString(footnoteDefinition(n, strings.TrimSpace(converter.Convert(item))) + "\n")
+		})
+		if prev := list.Prev(); prev.Is("hr") {
+			prev.Remove()
+		}
+		list.ReplaceWithHtml(`<div><scribe-markdown data-md="` + html.EscapeString(b.String()) + `"></scribe-markdown></div>`)
+	})
+
+	selec.Find("sup").Each(func(_ int, sup *goquery.Selection) {
+		link := sup.ChildrenFiltered("ac\\:link")
+		m := footnoteAnchorPattern.FindStringSubmatch(link.AttrOr("ac:anchor", ""))
+		if link.Length() != 1 || m == nil {
+			return
+		}
+		sup.ReplaceWithHtml(`<scribe-markdown data-md="[^` + m[1] + `]"></scribe-markdown>`)
+	})
+}
+
+// footnoteDefinition writes `[^n]: body`, indenting later lines of body
+func footnoteDefinition(n int, body string) string {
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		if i > 0 && line != "" {
+			lines[i] = "    " + line
+		}
+	}
+	return "[^" + strconv.Itoa(n) + "]: " + strings.Join(lines, "\n")
+}
@@ -1,17 +1,39 @@
 package main
 
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+)
+
 type ScribeProvider interface {
-	ListSpaces(opts *ListOptions) ([]Space, error)
-	CreatePage(spaceKey, title, content, parentID string) (*Page, error)
-	GetPage(pageID string) (*Page, error)
-	UpdatePage(pageID, content string) (*Page, error)
-	SearchPages(spaceKey string, opts *ListOptions) ([]Page, error)
+	ListSpaces(ctx context.Context, opts *ListOptions) ([]Space, error)
+	CreatePage(ctx context.Context, spaceKey, title, content, parentID string) (*Page, error)
+	GetPage(ctx context.Context, pageID string) (*Page, error)
+	UpdatePage(ctx context.Context, pageID, content string) (*Page, error)
+	SearchPages(ctx context.Context, spaceKey string, opts *ListOptions) ([]Page, error)
+	IterSpaces(ctx context.Context, opts *ListOptions) *Iterator[Space]
+	IterPages(ctx context.Context, spaceKey string, opts *ListOptions) *Iterator[Page]
+	UploadAttachment(ctx context.Context, pageID, path string) error
+	FindUser(ctx context.Context, name string) (*User, error)
+	GetUser(ctx context.Context, id string) (*User, error)
 }
 type ListOptions struct {
 	Limit  int
 	Offset int
 	Query  string // optional title search (CQL: title ~ "query")
 }
+
+// startOffset returns the first result index requested by opts
+func startOffset(opts *ListOptions) int {
+	if opts != nil && opts.Offset > 0 {
+		return opts.Offset
+	}
+	return 0
+}
+
 type Space struct {
 	ID   int    `json:"id"`
 	Key  string `json:"key"`
@@ -37,12 +59,66 @@ type Page struct {
 			Value          string `json:"value"`
 			Representation string `json:"representation"`
 		} `json:"storage"`
+		// AtlasDocFormat is the ADF body of a page from the v2 API
+		AtlasDocFormat struct {
+			Value          string `json:"value"`
+			Representation string `json:"representation"`
+		} `json:"atlas_doc_format"`
 	} `json:"body"`
 	Links struct {
 		WebUI string `json:"webui"`
 	} `json:"_links"`
+	// Profile names the instance profile the page was written through; it
+	// is filled in by scribe-cli, not the API
+	Profile string `json:"profile,omitempty"`
 }
 
 type PagesResponse struct {
 	Results []Page `json:"results"`
 }
+
+// User is a Cloud user (AccountID) or a Data Center user (UserKey, Username)
+type User struct {
+	AccountID   string `json:"accountId,omitempty"`
+	UserKey     string `json:"userKey,omitempty"`
+	Username    string `json:"username,omitempty"`
+	DisplayName string `json:"displayName"`
+	PublicName  string `json:"publicName,omitempty"`
+	Email       string `json:"email,omitempty"`
+}
+
+type UserSearchResponse struct {
+	Results []struct {
+		User User `json:"user"`
+	} `json:"results"`
+}
+
+// attachmentUpload is a multipart request body, sent by doRequest as it is
+type attachmentUpload struct {
+	ContentType string
+	Data        []byte
+}
+
+// newAttachmentUpload reads path into a multipart form with a single "file" field
+func newAttachmentUpload(path string) (*attachmentUpload, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	part, err := form.CreateFormFile("file", filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(data); err != nil {
+		return nil, err
+	}
+	if err := form.WriteField("minorEdit", "true"); err != nil {
+		return nil, err
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+	return &attachmentUpload{ContentType: form.FormDataContentType(), Data: buf.Bytes()}, nil
+}
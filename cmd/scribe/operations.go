@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Operations shared by the CLI subcommands and the JSON-RPC server. Param
+// field names mirror the CLI flag names so both front ends stay in step.
+
+// ProgressFunc receives human-readable status updates from long-running operations
+type ProgressFunc func(message string)
+
+func (p ProgressFunc) report(format string, args ...interface{}) {
+	if p != nil {
+		p(fmt.Sprintf(format, args...))
+	}
+}
+
+type ListSpacesParams struct {
+	Query  string `json:"query"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+	All    bool   `json:"all"`
+}
+
+type SearchPagesParams struct {
+	Space  string `json:"space"`
+	Query  string `json:"query"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+	All    bool   `json:"all"`
+}
+
+type CreatePageParams struct {
+	Space  string `json:"space"`
+	Title  string `json:"title"`
+	File   string `json:"file"`
+	Parent string `json:"parent"`
+	Queue  bool   `json:"queue"`
+	Format string `json:"format"`
+}
+
+type UpdatePageParams struct {
+	ID          string `json:"id"`
+	File        string `json:"file"`
+	BaseVersion int    `json:"base_version"`
+	Queue       bool   `json:"queue"`
+	Format      string `json:"format"`
+}
+
+type GetPageParams struct {
+	ID     string `json:"id"`
+	Dir    string `json:"dir"`
+	Format string `json:"format"`
+}
+
+// PulledPage is a page converted for a local file, with the version it was
+// converted at so later updates can be checked against it, and the profile
+// of the instance it came from
+type PulledPage struct {
+	ID      string `json:"id"`
+	Title   string `json:"title"`
+	Space   string `json:"space"`
+	Version int    `json:"version"`
+	Profile string `json:"profile,omitempty"`
+	Content string `json:"content"`
+}
+
+func newListOptions(q string, limit, offset int) *ListOptions {
+	return &ListOptions{
+		Limit:  limit,
+		Offset: offset,
+		Query:  strings.TrimSpace(q),
+	}
+}
+
+func listSpaces(ctx context.Context, client ScribeProvider, p ListSpacesParams, progress ProgressFunc) ([]Space, error) {
+	opts := newListOptions(p.Query, p.Limit, p.Offset)
+	if p.All {
+		return collectAll(client.IterSpaces(ctx, opts), opts, "spaces", progress)
+	}
+	return client.ListSpaces(ctx, opts)
+}
+
+func searchPages(ctx context.Context, client ScribeProvider, p SearchPagesParams, progress ProgressFunc) ([]Page, error) {
+	if p.Space == "" {
+		return nil, fmt.Errorf("space is required")
+	}
+	opts := newListOptions(p.Query, p.Limit, p.Offset)
+	if p.All {
+		return collectAll(client.IterPages(ctx, p.Space, opts), opts, "pages", progress)
+	}
+	return client.SearchPages(ctx, p.Space, opts)
+}
+
+// collectAll drains it, reporting progress after every page of results
+func collectAll[T any](it *Iterator[T], opts *ListOptions, noun string, progress ProgressFunc) ([]T, error) {
+	pageSize := 100
+	if opts.Limit > 0 {
+		pageSize = opts.Limit
+	}
+	results := []T{}
+	for it.Next() {
+		results = append(results, it.Value())
+		if len(results)%pageSize == 0 {
+			progress.report("Fetched %d %s...", len(results), noun)
+		}
+	}
+	return results, it.Err()
+}
+
+func createPage(ctx context.Context, client ScribeProvider, p CreatePageParams, progress ProgressFunc) (*Page, error) {
+	// Validate inputs
+	if p.Space == "" || p.Title == "" || p.File == "" {
+		return nil, fmt.Errorf("space, title, and file are required")
+	}
+	if err := checkFormat(client, p.Format); err != nil {
+		return nil, err
+	}
+
+	content, err := readMarkdownFile(p.File)
+	if err != nil {
+		return nil, err
+	}
+
+	progress.report("Converting %s...", p.File)
+	converted, err := convertFile(ctx, client, p.File, content, p.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &OutboxEntry{
+		Op:          "create",
+		Profile:     profileOf(client),
+		Space:       p.Space,
+		Title:       p.Title,
+		Parent:      p.Parent,
+		File:        p.File,
+		Content:     converted.Body,
+		Attachments: converted.Attachments,
+	}
+	if p.Queue {
+		return nil, enqueue(entry, nil)
+	}
+
+	progress.report("Creating page %q...", p.Title)
+	page, err := client.CreatePage(ctx, p.Space, p.Title, converted.Body, p.Parent)
+	if err != nil && isNetworkError(err) {
+		return nil, enqueue(entry, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	page.Profile = profileOf(client)
+	// The page has to exist before anything can be attached to it
+	if err := uploadAttachments(ctx, client, page.ID, converted.Attachments, progress); err != nil {
+		return page, fmt.Errorf("page created but its diagrams were not attached: %w", err)
+	}
+	return page, nil
+}
+
+func updatePage(ctx context.Context, client ScribeProvider, p UpdatePageParams, progress ProgressFunc) (*Page, error) {
+	// Validate inputs
+	if p.ID == "" || p.File == "" {
+		return nil, fmt.Errorf("page ID and file are required")
+	}
+
+	content, err := readMarkdownFile(p.File)
+	if err != nil {
+		return nil, err
+	}
+
+	// The page ID only means something on the instance the page came from
+	client, err = clientForProfile(client, parseFrontmatter(content)["confluence_profile"])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p.File, err)
+	}
+	if err := checkFormat(client, p.Format); err != nil {
+		return nil, err
+	}
+
+	// The version the local file was pulled at, for conflict checks on flush
+	baseVersion := p.BaseVersion
+	if baseVersion == 0 {
+		baseVersion, _ = strconv.Atoi(parseFrontmatter(content)["confluence_version"])
+	}
+
+	progress.report("Converting %s...", p.File)
+	converted, err := convertFile(ctx, client, p.File, content, p.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &OutboxEntry{
+		Op:          "update",
+		Profile:     profileOf(client),
+		PageID:      p.ID,
+		File:        p.File,
+		Content:     converted.Body,
+		Attachments: converted.Attachments,
+		BaseVersion: baseVersion,
+	}
+	if p.Queue {
+		return nil, enqueue(entry, nil)
+	}
+
+	// Diagrams go up first so the new version never shows a missing image
+	err = uploadAttachments(ctx, client, p.ID, converted.Attachments, progress)
+	if err != nil && isNetworkError(err) {
+		return nil, enqueue(entry, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	progress.report("Updating page %s...", p.ID)
+	page, err := client.UpdatePage(ctx, p.ID, converted.Body)
+	if err != nil && isNetworkError(err) {
+		return nil, enqueue(entry, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	page.Profile = profileOf(client)
+	return page, nil
+}
+
+// enqueue stores entry in the outbox and reports it as a QueuedError
+func enqueue(entry *OutboxEntry, cause error) error {
+	if cause != nil {
+		entry.LastError = cause.Error()
+	}
+	if err := newOutbox().Add(entry); err != nil {
+		if cause != nil {
+			return fmt.Errorf("%w (queueing also failed: %v)", cause, err)
+		}
+		return err
+	}
+	return &QueuedError{Entry: entry, Cause: cause}
+}
+
+// getPage returns the page body converted to Markdown, after the
+// pipeline's after-pull stages
+func getPage(ctx context.Context, client ScribeProvider, p GetPageParams, progress ProgressFunc) (*PulledPage, error) {
+	if p.ID == "" {
+		return nil, fmt.Errorf("page ID is required")
+	}
+	if err := checkFormat(client, p.Format); err != nil {
+		return nil, err
+	}
+
+	page, err := client.GetPage(ctx, p.ID)
+	if err != nil {
+		return nil, err
+	}
+	pulled := &PulledPage{ID: page.ID, Title: page.Title, Space: page.Space.Key, Version: page.Version.Number, Profile: profileOf(client)}
+	if p.Format == FormatWiki {
+		pulled.Content = ConvertConfluenceToWiki(page.Body.Storage.Value)
+		return pulled, nil
+	}
+
+	users := newUserDirectory(ctx, client)
+	var markdown string
+	if page.Body.AtlasDocFormat.Value != "" {
+		markdown = ConvertADFToMarkdown(page.Body.AtlasDocFormat.Value, users)
+	} else {
+		markdown = ConvertConfluencePageToMarkdown(page, p.Dir, instanceURL(client), users)
+	}
+	pulled.Content, err = pullThroughPipeline(p.Dir, markdown)
+	if err != nil {
+		return nil, err
+	}
+	return pulled, nil
+}
+
+// pullThroughPipeline runs the after-pull stages configured for files in
+// dir on pulled Markdown
+func pullThroughPipeline(dir, markdown string) (string, error) {
+	if dir == "" {
+		dir = "."
+	}
+	pipe, err := loadPipeline(dir)
+	if err != nil {
+		return "", err
+	}
+	var warnings []string
+	markdown, err = pipe.run(HookAfterPull, "", FormatMarkdown, markdown, &warnings)
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	return markdown, err
+}
+
+// convertFile converts a Markdown or wiki markup file for upload in the
+// format client takes. Links, diagrams and mentions that cannot be resolved
+// are pushed as they are, with a warning on stderr (which the editor plugin
+// surfaces in both CLI and server mode). Content Confluence would reject,
+// or a failing pipeline stage, is an error returned before anything is sent.
+func convertFile(ctx context.Context, client ScribeProvider, file, content, format string) (*ConvertedFile, error) {
+	var converted *ConvertedFile
+	switch {
+	case format == FormatWiki:
+		body := ConvertWikiToConfluence(content)
+		converted = &ConvertedFile{Body: body, Errors: validateStorage(body)}
+	case pageFormat(client) == "atlas_doc_format":
+		converted = ConvertMarkdownFileToADF(content, file, newUserDirectory(ctx, client))
+	default:
+		converted = ConvertMarkdownFileToConfluence(content, file, instanceURL(client), newUserDirectory(ctx, client))
+	}
+	for _, warning := range converted.Warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s: %s\n", file, warning)
+	}
+	if len(converted.Errors) > 0 {
+		return nil, fmt.Errorf("%s cannot be pushed, so nothing was sent:\n  %s", file, strings.Join(converted.Errors, "\n  "))
+	}
+	return converted, nil
+}
+
+// checkFormat rejects a file format the client cannot take. Wiki markup
+// converts to and from storage format only.
+func checkFormat(client ScribeProvider, format string) error {
+	switch format {
+	case "", FormatMarkdown:
+		return nil
+	case FormatWiki:
+		if pageFormat(client) == "atlas_doc_format" {
+			return fmt.Errorf("wiki markup needs a provider that takes storage format, not ADF")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown format %q (want %s or %s)", format, FormatMarkdown, FormatWiki)
+}
+
+// uploadAttachments attaches the rendered diagrams at paths to a page
+func uploadAttachments(ctx context.Context, client ScribeProvider, pageID string, paths []string, progress ProgressFunc) error {
+	for _, path := range paths {
+		progress.report("Attaching %s...", filepath.Base(path))
+		if err := client.UploadAttachment(ctx, pageID, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readMarkdownFile(path string) (string, error) {
+	// Validate file path to prevent directory traversal
+	if strings.Contains(path, "..") {
+		return "", fmt.Errorf("invalid file path")
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	return string(content), nil
+}
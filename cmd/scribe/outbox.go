@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// OutboxEntry is a page create or update that has not reached the server yet.
+// It keeps the converted storage payload so a later flush sends exactly what
+// was queued, and the page version the edit was based on for conflict checks.
+type OutboxEntry struct {
+	ID          string    `json:"id"`
+	Op          string    `json:"op"` // "create" or "update"
+	Profile     string    `json:"profile,omitempty"`
+	PageID      string    `json:"page_id,omitempty"`
+	Space       string    `json:"space,omitempty"`
+	Title       string    `json:"title,omitempty"`
+	Parent      string    `json:"parent,omitempty"`
+	File        string    `json:"file,omitempty"`
+	Content     string    `json:"content"`
+	Attachments []string  `json:"attachments,omitempty"` // rendered diagrams in the local cache
+	BaseVersion int       `json:"base_version,omitempty"`
+	QueuedAt    time.Time `json:"queued_at"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error,omitempty"`
+	Conflict    bool      `json:"conflict,omitempty"`
+}
+
+// FlushResult reports what happened to one entry during `outbox flush`
+type FlushResult struct {
+	ID     string `json:"id"`
+	Op     string `json:"op"`
+	Status string `json:"status"` // "sent", "conflict" or "failed"
+	Page   *Page  `json:"page,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// QueuedError reports that an operation was stored in the outbox instead of
+// being sent. Cause is nil when queueing was requested explicitly.
+type QueuedError struct {
+	Entry *OutboxEntry
+	Cause error
+}
+
+func (e *QueuedError) Error() string {
+	if e.Cause == nil {
+		return fmt.Sprintf("queued as outbox entry %s", e.Entry.ID)
+	}
+	return fmt.Sprintf("%v; queued as outbox entry %s (run `scribe-cli outbox flush` to retry)", e.Cause, e.Entry.ID)
+}
+
+type Outbox struct {
+	Dir string
+}
+
+// newOutbox stores entries under SCRIBE_OUTBOX_DIR, or $XDG_DATA_HOME/scribe/outbox
+func newOutbox() *Outbox {
+	dir := os.Getenv("SCRIBE_OUTBOX_DIR")
+	if dir == "" {
+		base := os.Getenv("XDG_DATA_HOME")
+		if base == "" {
+			if home, err := os.UserHomeDir(); err == nil {
+				base = filepath.Join(home, ".local", "share")
+			}
+		}
+		dir = filepath.Join(base, "scribe", "outbox")
+	}
+	return &Outbox{Dir: dir}
+}
+
+// isNetworkError separates "could not reach the server" from every other
+// failure: only the former is worth queueing and retrying unchanged. A
+// cancelled or timed out request, a certificate the server should not be
+// trusted with and a host name that does not resolve are all reported as
+// they are instead.
+func isNetworkError(err error) bool {
+	if errors.Is(err, errOffline) {
+		return true
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial" && !opErr.Timeout()
+}
+
+func (o *Outbox) Add(entry *OutboxEntry) error {
+	if entry.ID == "" {
+		id := make([]byte, 6)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		entry.ID = time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(id)
+	}
+	if entry.QueuedAt.IsZero() {
+		entry.QueuedAt = time.Now()
+	}
+	return o.save(entry)
+}
+
+func (o *Outbox) save(entry *OutboxEntry) error {
+	if err := os.MkdirAll(o.Dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create outbox: %w", err)
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(o.Dir, entry.ID+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write outbox entry: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// List returns pending entries, oldest first
+func (o *Outbox) List() ([]*OutboxEntry, error) {
+	files, err := filepath.Glob(filepath.Join(o.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	entries := []*OutboxEntry{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read outbox entry: %w", err)
+		}
+		var entry OutboxEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, fmt.Errorf("invalid outbox entry %s: %w", filepath.Base(file), err)
+		}
+		entries = append(entries, &entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].QueuedAt.Before(entries[j].QueuedAt)
+	})
+	return entries, nil
+}
+
+func (o *Outbox) Remove(id string) error {
+	err := os.Remove(filepath.Join(o.Dir, id+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Flush replays entries in the order they were queued, each through the
+// client of the profile it was queued under. An update whose page has moved
+// past its base version, or a create whose title already exists, is a
+// conflict and stays queued unless force is set. Flushing stops at the first
+// network failure since every later entry would fail the same way.
+func (o *Outbox) Flush(ctx context.Context, client ScribeProvider, force bool, progress ProgressFunc) ([]FlushResult, error) {
+	entries, err := o.List()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []FlushResult{}
+	for _, entry := range entries {
+		progress.report("Flushing %s %s...", entry.Op, entry.ID)
+		var page *Page
+		entryClient, err := clientForProfile(client, entry.Profile)
+		if err == nil {
+			page, err = o.replay(ctx, entryClient, entry, force)
+		}
+		result := FlushResult{ID: entry.ID, Op: entry.Op, Page: page}
+
+		var conflict *conflictError
+		switch {
+		case err == nil:
+			result.Status = "sent"
+			if err := o.Remove(entry.ID); err != nil {
+				return results, err
+			}
+		case errors.As(err, &conflict):
+			result.Status = "conflict"
+			result.Error = err.Error()
+			entry.Conflict = true
+		default:
+			result.Status = "failed"
+			result.Error = err.Error()
+		}
+
+		if err != nil {
+			entry.Attempts++
+			entry.LastError = err.Error()
+			if serr := o.save(entry); serr != nil {
+				return results, serr
+			}
+		}
+		results = append(results, result)
+
+		if err != nil && isNetworkError(err) {
+			break
+		}
+	}
+	return results, nil
+}
+
+type conflictError struct {
+	msg string
+}
+
+func (e *conflictError) Error() string {
+	return e.msg
+}
+
+func (o *Outbox) replay(ctx context.Context, client ScribeProvider, entry *OutboxEntry, force bool) (*Page, error) {
+	// Conflict checks must see the server's current state, not a cached listing
+	ctx = withoutCache(ctx)
+
+	switch entry.Op {
+	case "update":
+		if !force && entry.BaseVersion > 0 {
+			current, err := client.GetPage(ctx, entry.PageID)
+			if err != nil {
+				return nil, err
+			}
+			if current.Version.Number != entry.BaseVersion {
+				return nil, &conflictError{fmt.Sprintf("page %s is at version %d but the queued edit was based on version %d", entry.PageID, current.Version.Number, entry.BaseVersion)}
+			}
+		}
+		if err := uploadAttachments(ctx, client, entry.PageID, entry.Attachments, nil); err != nil {
+			return nil, err
+		}
+		return client.UpdatePage(ctx, entry.PageID, entry.Content)
+	case "create":
+		if !force {
+			it := client.IterPages(ctx, entry.Space, &ListOptions{Query: entry.Title})
+			for it.Next() {
+				if it.Value().Title == entry.Title {
+					return nil, &conflictError{fmt.Sprintf("a page titled %q already exists in space %s (id %s)", entry.Title, entry.Space, it.Value().ID)}
+				}
+			}
+			if err := it.Err(); err != nil {
+				return nil, err
+			}
+		}
+		page, err := client.CreatePage(ctx, entry.Space, entry.Title, entry.Content, entry.Parent)
+		if err != nil {
+			return nil, err
+		}
+		if err := uploadAttachments(ctx, client, page.ID, entry.Attachments, nil); err != nil {
+			// Retry as an update of the new page rather than creating it twice
+			entry.Op, entry.PageID, entry.BaseVersion = "update", page.ID, page.Version.Number
+			return page, fmt.Errorf("page created but its diagrams were not attached: %w", err)
+		}
+		return page, nil
+	}
+	return nil, fmt.Errorf("unknown outbox operation %q", entry.Op)
+}
+
+type OutboxListParams struct{}
+
+type OutboxFlushParams struct {
+	Force bool `json:"force"`
+}
+
+func listOutbox(ctx context.Context, client ScribeProvider, p OutboxListParams, progress ProgressFunc) ([]*OutboxEntry, error) {
+	return newOutbox().List()
+}
+
+func flushOutbox(ctx context.Context, client ScribeProvider, p OutboxFlushParams, progress ProgressFunc) ([]FlushResult, error) {
+	return newOutbox().Flush(ctx, client, p.Force, progress)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// flakyConfluence is a minimal stand-in for the content API whose network can
+// be switched off: while down, its clients' connections are refused.
+type flakyConfluence struct {
+	*httptest.Server
+	up      atomic.Bool
+	version atomic.Int32
+	puts    atomic.Int32
+	closed  string // an address nothing listens on
+}
+
+func newFlakyConfluence(t *testing.T) *flakyConfluence {
+	f := &flakyConfluence{}
+	f.up.Store(true)
+	f.version.Store(3)
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			fmt.Fprintf(w, `{"id":"42","title":"Runbook","version":{"number":%d}}`, f.version.Load())
+		case http.MethodPut:
+			f.puts.Add(1)
+			var req UpdatePageRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			f.version.Store(int32(req.Version.Number))
+			fmt.Fprintf(w, `{"id":"42","title":"Runbook","version":{"number":%d}}`, req.Version.Number)
+		}
+	}))
+	t.Cleanup(f.Close)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.closed = listener.Addr().String()
+	listener.Close()
+	return f
+}
+
+func (f *flakyConfluence) client() ScribeProvider {
+	transport := f.Server.Client().Transport.(*http.Transport).Clone()
+	var dialer net.Dialer
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if !f.up.Load() {
+			addr = f.closed
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return &ConfluenceClient{BaseURL: f.URL, Client: &http.Client{Transport: transport}}
+}
+
+func writeDoc(t *testing.T, frontmatter string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "runbook.md")
+	if err := os.WriteFile(path, []byte("---\n"+frontmatter+"\n---\n# Runbook\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestUpdateQueuesWhenNetworkIsDown(t *testing.T) {
+	t.Setenv("SCRIBE_OUTBOX_DIR", t.TempDir())
+	server := newFlakyConfluence(t)
+	file := writeDoc(t, "confluence_page_id: 42\nconfluence_version: 3")
+	ctx := context.Background()
+
+	server.up.Store(false)
+	_, err := updatePage(ctx, server.client(), UpdatePageParams{ID: "42", File: file}, nil)
+	var queued *QueuedError
+	if !errors.As(err, &queued) || queued.Cause == nil {
+		t.Fatalf("update while down: got %v, want a QueuedError with a cause", err)
+	}
+
+	entries, err := newOutbox().List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].BaseVersion != 3 || entries[0].Content == "" {
+		t.Fatalf("outbox = %+v, want one update based on version 3 with converted content", entries)
+	}
+
+	// Still down: the entry stays queued and records the attempt
+	results, err := newOutbox().Flush(ctx, server.client(), false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Status != "failed" {
+		t.Fatalf("flush while down = %+v, want one failed result", results)
+	}
+
+	server.up.Store(true)
+	results, err = newOutbox().Flush(ctx, server.client(), false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Status != "sent" || results[0].Page.Version.Number != 4 {
+		t.Fatalf("flush while up = %+v, want the update sent as version 4", results)
+	}
+	if entries, _ := newOutbox().List(); len(entries) != 0 {
+		t.Fatalf("outbox still holds %d entries after a successful flush", len(entries))
+	}
+}
+
+func TestUpdateDoesNotQueueCancelledRequests(t *testing.T) {
+	t.Setenv("SCRIBE_OUTBOX_DIR", t.TempDir())
+	server := newFlakyConfluence(t)
+	file := writeDoc(t, "confluence_page_id: 42\nconfluence_version: 3")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := updatePage(ctx, server.client(), UpdatePageParams{ID: "42", File: file}, nil)
+	var queued *QueuedError
+	if err == nil || errors.As(err, &queued) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled update: got %v, want the cancellation reported", err)
+	}
+	if entries, _ := newOutbox().List(); len(entries) != 0 {
+		t.Fatalf("cancelled update queued %d entries", len(entries))
+	}
+
+	for _, err := range []error{
+		&url.Error{Op: "Put", URL: server.URL, Err: context.DeadlineExceeded},
+		&url.Error{Op: "Put", URL: server.URL, Err: x509.UnknownAuthorityError{}},
+		&url.Error{Op: "Put", URL: server.URL, Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Name: "wiki.example.invalid", IsNotFound: true}}},
+	} {
+		if isNetworkError(err) {
+			t.Errorf("%v should not be queued", err)
+		}
+	}
+	if !isNetworkError(fmt.Errorf("get page: %w", errOffline)) {
+		t.Error("offline mode should be queued")
+	}
+}
+
+func TestFlushDetectsConflicts(t *testing.T) {
+	t.Setenv("SCRIBE_OUTBOX_DIR", t.TempDir())
+	server := newFlakyConfluence(t)
+	file := writeDoc(t, "confluence_page_id: 42\nconfluence_version: 3")
+	ctx := context.Background()
+
+	if _, err := updatePage(ctx, server.client(), UpdatePageParams{ID: "42", File: file, Queue: true}, nil); err == nil {
+		t.Fatal("explicit --queue should report a QueuedError")
+	}
+
+	// Someone else edits the page before the outbox is flushed
+	server.version.Store(5)
+	results, err := newOutbox().Flush(ctx, server.client(), false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Status != "conflict" || server.puts.Load() != 0 {
+		t.Fatalf("flush = %+v with %d PUTs, want a conflict and nothing sent", results, server.puts.Load())
+	}
+
+	entries, _ := newOutbox().List()
+	if len(entries) != 1 || !entries[0].Conflict {
+		t.Fatalf("outbox = %+v, want the entry kept and marked as a conflict", entries)
+	}
+
+	results, err = newOutbox().Flush(ctx, server.client(), true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Status != "sent" || server.puts.Load() != 1 {
+		t.Fatalf("forced flush = %+v, want the update sent", results)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+)
+
+// resultPage is the envelope Confluence wraps around every paginated collection
+type resultPage[T any] struct {
+	Results []T `json:"results"`
+	Start   int `json:"start"`
+	Limit   int `json:"limit"`
+	Size    int `json:"size"`
+	Links   struct {
+		Next string `json:"next"`
+	} `json:"_links"`
+}
+
+// Iterator walks a paginated collection one result at a time. Pages are fetched
+// lazily: _links.next is followed when the server provides it, otherwise the
+// next request is built from start+size until a short page comes back.
+//
+//	it := client.IterSpaces(ctx, opts)
+//	for it.Next() {
+//		space := it.Value()
+//	}
+//	if err := it.Err(); err != nil { ... }
+type Iterator[T any] struct {
+	ctx     context.Context
+	fetch   requestFunc
+	pathFor func(start int) string
+	next    string
+	decode  func(body []byte) (results []T, next string, err error)
+	buf     []T
+	cur     T
+	err     error
+}
+
+// requestFunc matches the clients' doRequest
+type requestFunc func(ctx context.Context, method, path string, body interface{}) ([]byte, error)
+
+func newIterator[T any](ctx context.Context, fetch requestFunc, pathFor func(start int) string, start int) *Iterator[T] {
+	return &Iterator[T]{
+		ctx:     ctx,
+		fetch:   fetch,
+		pathFor: pathFor,
+		next:    pathFor(start),
+	}
+}
+
+// newCursorIterator walks a v2 collection, which only pages by the opaque
+// cursor in _links.next. Each result is decoded as a V and converted to a T.
+// Cursors cannot jump ahead, so the first skip results are dropped instead.
+func newCursorIterator[V, T any](ctx context.Context, fetch requestFunc, first string, skip int, convert func(V) T) *Iterator[T] {
+	return &Iterator[T]{
+		ctx:   ctx,
+		fetch: fetch,
+		next:  first,
+		decode: func(body []byte) ([]T, string, error) {
+			var page resultPage[V]
+			if err := json.Unmarshal(body, &page); err != nil {
+				return nil, "", err
+			}
+			results := make([]T, 0, len(page.Results))
+			for _, result := range page.Results {
+				if skip > 0 {
+					skip--
+					continue
+				}
+				results = append(results, convert(result))
+			}
+			next := ""
+			if len(page.Results) > 0 && page.Links.Next != "" {
+				next = relativePath(page.Links.Next)
+			}
+			return results, next, nil
+		},
+	}
+}
+
+// Next advances to the following result, fetching another page if needed.
+// It returns false once the collection is exhausted or a request fails.
+func (it *Iterator[T]) Next() bool {
+	for len(it.buf) == 0 {
+		if it.err != nil || it.next == "" {
+			return false
+		}
+		it.err = it.load()
+	}
+	it.cur, it.buf = it.buf[0], it.buf[1:]
+	return true
+}
+
+// Value returns the current result
+func (it *Iterator[T]) Value() T {
+	return it.cur
+}
+
+// Err returns the first error hit while fetching pages
+func (it *Iterator[T]) Err() error {
+	return it.err
+}
+
+func (it *Iterator[T]) load() error {
+	respBody, err := it.fetch(it.ctx, "GET", it.next, nil)
+	if err != nil {
+		return err
+	}
+	if it.decode != nil {
+		it.buf, it.next, err = it.decode(respBody)
+		return err
+	}
+
+	var page resultPage[T]
+	if err := json.Unmarshal(respBody, &page); err != nil {
+		return err
+	}
+	it.buf = page.Results
+
+	switch {
+	case len(page.Results) == 0:
+		it.next = ""
+	case page.Links.Next != "":
+		it.next = relativePath(page.Links.Next)
+	case page.Limit > 0 && page.Size >= page.Limit:
+		it.next = it.pathFor(page.Start + page.Size)
+	default:
+		it.next = ""
+	}
+	return nil
+}
+
+// relativePath reduces an absolute _links.next URL to the path doRequest expects
+func relativePath(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return link
+	}
+	return u.RequestURI()
+}
+
+// writeNDJSON streams every result of it to w, one JSON document per line
+func writeNDJSON[T any](w io.Writer, it *Iterator[T]) error {
+	enc := json.NewEncoder(w)
+	for it.Next() {
+		if err := enc.Encode(it.Value()); err != nil {
+			return fmt.Errorf("failed to write result: %w", err)
+		}
+	}
+	return it.Err()
+}
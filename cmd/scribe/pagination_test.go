@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// pagedServer answers each request URI with its body from pages, which
+// may refer to the server as {url}, and logs the URIs it is asked for
+func pagedServer(t *testing.T, pages map[string]string) (*ConfluenceClient, *[]string) {
+	var requests []string
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RequestURI())
+		body, ok := pages[r.URL.RequestURI()]
+		if !ok {
+			http.Error(w, "no such page", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(strings.ReplaceAll(body, "{url}", server.URL)))
+	}))
+	t.Cleanup(server.Close)
+	return &ConfluenceClient{BaseURL: server.URL, Client: server.Client()}, &requests
+}
+
+func spaceKeys(t *testing.T, it *Iterator[Space]) string {
+	t.Helper()
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Value().Key)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestIteratorPagesByStart(t *testing.T) {
+	client, requests := pagedServer(t, map[string]string{
+		"/rest/api/space?limit=2&start=1": `{"results":[{"key":"A"},{"key":"B"}],"start":1,"limit":2,"size":2}`,
+		"/rest/api/space?limit=2&start=3": `{"results":[{"key":"C"}],"start":3,"limit":2,"size":1}`,
+	})
+	if got := spaceKeys(t, client.IterSpaces(context.Background(), &ListOptions{Limit: 2, Offset: 1})); got != "A,B,C" {
+		t.Errorf("got %s, want A,B,C", got)
+	}
+	// The short page is the last; nothing is asked for after it
+	if len(*requests) != 2 {
+		t.Errorf("requests %v, want two", *requests)
+	}
+}
+
+func TestIteratorStopsOnEmptyPage(t *testing.T) {
+	client, requests := pagedServer(t, map[string]string{
+		"/rest/api/space?limit=2&start=0": `{"results":[{"key":"A"},{"key":"B"}],"start":0,"limit":2,"size":2}`,
+		"/rest/api/space?limit=2&start=2": `{"results":[],"start":2,"limit":2,"size":0,"_links":{"next":"/rest/api/space?limit=2&start=4"}}`,
+	})
+	if got := spaceKeys(t, client.IterSpaces(context.Background(), &ListOptions{Limit: 2})); got != "A,B" {
+		t.Errorf("got %s, want A,B", got)
+	}
+	if len(*requests) != 2 {
+		t.Errorf("requests %v, want the empty page's next link ignored", *requests)
+	}
+}
+
+func TestIteratorFollowsNextLinks(t *testing.T) {
+	client, requests := pagedServer(t, map[string]string{
+		// A next link wins over start+size, even after a short page
+		"/rest/api/space?limit=2&start=0": `{"results":[{"key":"A"}],"start":0,"limit":2,"size":1,"_links":{"next":"{url}/rest/api/space?cursor=b"}}`,
+		"/rest/api/space?cursor=b":        `{"results":[{"key":"B"},{"key":"C"}],"_links":{"next":"/rest/api/space?cursor=c"}}`,
+		"/rest/api/space?cursor=c":        `{"results":[{"key":"D"}]}`,
+	})
+	if got := spaceKeys(t, client.IterSpaces(context.Background(), &ListOptions{Limit: 2})); got != "A,B,C,D" {
+		t.Errorf("got %s, want A,B,C,D", got)
+	}
+	want := "/rest/api/space?limit=2&start=0 /rest/api/space?cursor=b /rest/api/space?cursor=c"
+	if got := strings.Join(*requests, " "); got != want {
+		t.Errorf("requests %s, want %s", got, want)
+	}
+}
+
+func TestCursorIteratorSkipsOffset(t *testing.T) {
+	client, _ := pagedServer(t, map[string]string{
+		"/wiki/api/v2/spaces?limit=2":          `{"results":[{"id":"1","key":"A"},{"id":"2","key":"B"}],"_links":{"next":"/wiki/api/v2/spaces?cursor=x&limit=2"}}`,
+		"/wiki/api/v2/spaces?cursor=x&limit=2": `{"results":[{"id":"3","key":"C"}]}`,
+	})
+	v2 := &ConfluenceV2Client{ConfluenceClient: client}
+	if got := spaceKeys(t, v2.IterSpaces(context.Background(), &ListOptions{Limit: 2, Offset: 1})); got != "B,C" {
+		t.Errorf("got %s, want B,C", got)
+	}
+}
+
+func TestIteratorReportsFailedPage(t *testing.T) {
+	client, _ := pagedServer(t, map[string]string{
+		"/rest/api/space?limit=1&start=0": `{"results":[{"key":"A"}],"start":0,"limit":1,"size":1}`,
+	})
+	it := client.IterSpaces(context.Background(), &ListOptions{Limit: 1})
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Value().Key)
+	}
+	if len(keys) != 1 || it.Err() == nil || !strings.Contains(it.Err().Error(), "status 500") {
+		t.Errorf("got %v (%v), want A then the failed second page", keys, it.Err())
+	}
+	if it.Next() {
+		t.Error("Next kept going after a failed page")
+	}
+}
+
+func TestWriteNDJSON(t *testing.T) {
+	client, _ := pagedServer(t, map[string]string{
+		"/rest/api/space?limit=2&start=0": `{"results":[{"id":1,"key":"A","name":"Alpha"},{"id":2,"key":"B","name":"Beta"}],"start":0,"limit":2,"size":2}`,
+		"/rest/api/space?limit=2&start=2": `{"results":[{"id":3,"key":"C","name":"Gamma"}],"start":2,"limit":2,"size":1}`,
+	})
+	var out bytes.Buffer
+	if err := writeNDJSON(&out, client.IterSpaces(context.Background(), &ListOptions{Limit: 2})); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"id":1,"key":"A","name":"Alpha","type":""}
+{"id":2,"key":"B","name":"Beta","type":""}
+{"id":3,"key":"C","name":"Gamma","type":""}
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+
+	// Results written before a failure stay written, and the failure is returned
+	client, _ = pagedServer(t, map[string]string{
+		"/rest/api/space?limit=1&start=0": `{"results":[{"id":1,"key":"A"}],"start":0,"limit":1,"size":1}`,
+	})
+	out.Reset()
+	err := writeNDJSON(&out, client.IterSpaces(context.Background(), &ListOptions{Limit: 1}))
+	if err == nil || strings.Count(out.String(), "\n") != 1 {
+		t.Errorf("got %q (%v), want one line and an error", out.String(), err)
+	}
+}
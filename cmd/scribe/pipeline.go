@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/wmorley/scribe-cli/adf"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// The points in a conversion where pipeline stages run. Push runs
+// before-parse on the Markdown, transform on the parsed document and
+// after-render on the storage or ADF body; pull runs after-pull on the
+// Markdown it writes. Only the built-in astTransforms run at transform.
+const (
+	HookBeforeParse = "before-parse"
+	HookTransform   = "transform"
+	HookAfterRender = "after-render"
+	HookAfterPull   = "after-pull"
+)
+
+// StageConfig is a pipeline stage as a config file sets it:
+//
+//	pipeline:
+//	  - name: shortcodes
+//	    type: replace
+//	    pattern: '\{\{< jira (\S+) >\}\}'
+//	    replacement: '[$1](https://jira.example.com/browse/$1)'
+//	  - name: internal-links
+//	    type: rewrite-links
+//	    from: http://wiki.internal/
+//	    to: https://wiki.example.com/
+//	  - name: editor-notes
+//	    type: strip-comments
+//	  - name: git-footer
+//	    type: footer
+//	    text: Generated from {file} at {commit}
+//	  - name: house-style
+//	    type: exec
+//	    command: ./tools/house-style --strict
+//	    hooks: [before-parse, after-pull]
+type StageConfig struct {
+	Name        string            `yaml:"name"`
+	Type        string            `yaml:"type"`
+	Hooks       []string          `yaml:"hooks"`       // replace and exec
+	Pattern     string            `yaml:"pattern"`     // replace
+	Replacement string            `yaml:"replacement"` // replace
+	From        string            `yaml:"from"`        // rewrite-links
+	To          string            `yaml:"to"`          // rewrite-links
+	Text        string            `yaml:"text"`        // footer
+	Command     string            `yaml:"command"`     // exec
+	Options     map[string]string `yaml:"options"`     // exec, passed on in each request
+
+	dir     string // of the config file, which relative commands start from
+	trusted bool   // set in the user's config, or a repository's the user trusts
+}
+
+// astTransforms are the stages that run at the transform hook, on the parsed
+// Markdown, by the type that selects them
+var astTransforms = map[string]func(config StageConfig) (parser.ASTTransformer, error){
+	"rewrite-links":  newLinkRewriter,
+	"strip-comments": newCommentStripper,
+}
+
+// transformTypes is the sorted types of astTransforms
+func transformTypes() []string {
+	types := make([]string, 0, len(astTransforms))
+	for t := range astTransforms {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// HookRequest is what an exec stage reads on stdin at each of its hooks.
+// Format is markdown for before-parse and after-pull, and storage or adf
+// for after-render.
+type HookRequest struct {
+	Hook    string            `json:"hook"`
+	File    string            `json:"file,omitempty"`
+	Format  string            `json:"format"`
+	Content string            `json:"content"`
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// HookResponse is what an exec stage writes on stdout. Without content
+// the document is left as it was; warnings are shown like other
+// conversion warnings.
+type HookResponse struct {
+	Content  *string  `json:"content"`
+	Warnings []string `json:"warnings"`
+}
+
+// textHook rewrites req.Content, returning anything worth a warning
+type textHook func(req *HookRequest) ([]string, error)
+
+// stage is a named step of the conversion pipeline, with a function for
+// each hook it runs at
+type stage struct {
+	name      string
+	hooks     map[string]textHook
+	transform parser.ASTTransformer
+}
+
+// pipeline is the stages configured for a file, in the order they run
+type pipeline struct {
+	stages []*stage
+}
+
+// loadPipeline builds the pipeline the config files set for files in dir
+func loadPipeline(dir string) (*pipeline, error) {
+	config, err := loadConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+	return newPipeline(config.Pipeline)
+}
+
+func newPipeline(configs []StageConfig) (*pipeline, error) {
+	p := &pipeline{}
+	for _, config := range configs {
+		s, err := newStage(config)
+		if err != nil {
+			name := config.Name
+			if name == "" {
+				name = config.Type
+			}
+			return nil, fmt.Errorf("pipeline stage %s: %w", name, err)
+		}
+		p.stages = append(p.stages, s)
+	}
+	return p, nil
+}
+
+func newStage(config StageConfig) (*stage, error) {
+	s := &stage{name: config.Name, hooks: map[string]textHook{}}
+	if s.name == "" {
+		s.name = config.Type
+	}
+	if len(config.Hooks) > 0 && config.Type != "replace" && config.Type != "exec" {
+		return nil, fmt.Errorf("only replace and exec stages take hooks")
+	}
+	switch config.Type {
+	case "replace":
+		pattern, err := regexp.Compile(config.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		replace := func(req *HookRequest) ([]string, error) {
+			req.Content = pattern.ReplaceAllString(req.Content, config.Replacement)
+			return nil, nil
+		}
+		return s, s.setHooks(config.Hooks, []string{HookBeforeParse}, replace)
+	case "footer":
+		if config.Text == "" {
+			return nil, fmt.Errorf("footer needs text")
+		}
+		s.hooks[HookAfterRender] = addFooter(config.Text)
+		s.hooks[HookAfterPull] = removeFooter(config.Text)
+	case "exec":
+		args := strings.Fields(config.Command)
+		if len(args) == 0 {
+			return nil, fmt.Errorf("exec needs a command")
+		}
+		if strings.HasPrefix(args[0], "./") || strings.HasPrefix(args[0], "../") {
+			args[0] = filepath.Join(config.dir, args[0])
+		}
+		if len(config.Hooks) == 0 {
+			return nil, fmt.Errorf("exec needs hooks (%s, %s or %s)", HookBeforeParse, HookAfterRender, HookAfterPull)
+		}
+		// A cloned repository must not run commands on its own say-so
+		if !config.trusted {
+			return nil, fmt.Errorf("exec stages from %s only run once it is listed under trusted_repositories in %s", filepath.Join(config.dir, RepoConfigFile), userConfigPath())
+		}
+		return s, s.setHooks(config.Hooks, nil, runHookCommand(args, config.Options))
+	default:
+		newTransform, ok := astTransforms[config.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown type %q (want replace, footer, exec, %s)", config.Type, strings.Join(transformTypes(), ", "))
+		}
+		transform, err := newTransform(config)
+		if err != nil {
+			return nil, err
+		}
+		s.transform = transform
+	}
+	return s, nil
+}
+
+// setHooks runs fn at each of hooks, or at defaults when none are given
+func (s *stage) setHooks(hooks, defaults []string, fn textHook) error {
+	if len(hooks) == 0 {
+		hooks = defaults
+	}
+	for _, hook := range hooks {
+		switch hook {
+		case HookBeforeParse, HookAfterRender, HookAfterPull:
+			s.hooks[hook] = fn
+		case HookTransform:
+			return fmt.Errorf("cannot run at %q, where only %s stages run", hook, strings.Join(transformTypes(), " and "))
+		default:
+			return fmt.Errorf("cannot run at %q (want %s, %s or %s)", hook, HookBeforeParse, HookAfterRender, HookAfterPull)
+		}
+	}
+	return nil
+}
+
+// run passes content through each stage that has hook, adding their
+// warnings to warnings
+func (p *pipeline) run(hook, file, format, content string, warnings *[]string) (string, error) {
+	if p == nil {
+		return content, nil
+	}
+	for _, s := range p.stages {
+		fn := s.hooks[hook]
+		if fn == nil {
+			continue
+		}
+		req := &HookRequest{Hook: hook, File: file, Format: format, Content: content}
+		stageWarnings, err := fn(req)
+		if err != nil {
+			return "", fmt.Errorf("pipeline stage %s at %s: %w", s.name, hook, err)
+		}
+		for _, warning := range stageWarnings {
+			*warnings = append(*warnings, s.name+": "+warning)
+		}
+		content = req.Content
+	}
+	return content, nil
+}
+
+// extender adds the stages' AST transforms to a conversion
+func (p *pipeline) extender() goldmark.Extender {
+	return &pipelineTransforms{p: p}
+}
+
+type pipelineTransforms struct {
+	p *pipeline
+}
+
+func (e *pipelineTransforms) Extend(m goldmark.Markdown) {
+	// Ahead of the storage transforms (100), so a rewritten link can still
+	// become a page link
+	m.Parser().AddOptions(parser.WithASTTransformers(util.Prioritized(e, 50)))
+}
+
+// Transform runs the stages' transforms in order
+func (e *pipelineTransforms) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	if e.p == nil {
+		return
+	}
+	for _, s := range e.p.stages {
+		if s.transform != nil {
+			s.transform.Transform(doc, reader, pc)
+		}
+	}
+}
+
+// linkRewriter points links and images that start with from at to instead
+type linkRewriter struct {
+	from, to string
+}
+
+func newLinkRewriter(config StageConfig) (parser.ASTTransformer, error) {
+	if config.From == "" {
+		return nil, fmt.Errorf("rewrite-links needs from")
+	}
+	return &linkRewriter{from: config.From, to: config.To}, nil
+}
+
+func (t *linkRewriter) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	var autolinks []*ast.AutoLink
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.Link:
+			n.Destination = t.rewrite(n.Destination)
+		case *ast.Image:
+			n.Destination = t.rewrite(n.Destination)
+		case *ast.AutoLink:
+			if n.AutoLinkType == ast.AutoLinkURL && bytes.HasPrefix(n.URL(source), []byte(t.from)) {
+				autolinks = append(autolinks, n)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	// An autolink shows its URL, so it becomes a link showing the new one
+	for _, n := range autolinks {
+		link := ast.NewLink()
+		link.Destination = t.rewrite(n.URL(source))
+		link.AppendChild(link, ast.NewString(link.Destination))
+		n.Parent().ReplaceChild(n.Parent(), n, link)
+	}
+}
+
+func (t *linkRewriter) rewrite(dest []byte) []byte {
+	if rest, ok := bytes.CutPrefix(dest, []byte(t.from)); ok {
+		return append([]byte(t.to), rest...)
+	}
+	return dest
+}
+
+// commentStripper drops HTML comments, so notes left for the people editing
+// the Markdown are not published
+type commentStripper struct{}
+
+func newCommentStripper(config StageConfig) (parser.ASTTransformer, error) {
+	return commentStripper{}, nil
+}
+
+func (commentStripper) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	var comments []ast.Node
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.HTMLBlock:
+			if n.HTMLBlockType == ast.HTMLBlockType2 {
+				comments = append(comments, n)
+			}
+		case *ast.RawHTML:
+			if n.Segments.Len() == 0 {
+				break
+			}
+			if first := n.Segments.At(0); bytes.HasPrefix(first.Value(source), []byte("<!--")) {
+				comments = append(comments, n)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	for _, n := range comments {
+		parent := n.Parent()
+		parent.RemoveChild(parent, n)
+		// A paragraph that only held a comment would render empty
+		if _, ok := parent.(*ast.Paragraph); ok && !parent.HasChildren() {
+			parent.Parent().RemoveChild(parent.Parent(), parent)
+		}
+	}
+}
+
+// footerText fills in the footer's {file}, its path in the repository,
+// and {commit}, the last commit that changed it
+func footerText(template, file string) string {
+	path, commit := filepath.Base(file), "uncommitted"
+	dir := filepath.Dir(file)
+	if out, err := exec.Command("git", "-C", dir, "rev-parse", "--show-prefix").Output(); err == nil {
+		path = strings.TrimSpace(string(out)) + filepath.Base(file)
+	}
+	if out, err := exec.Command("git", "-C", dir, "log", "-1", "--format=%h", "--", filepath.Base(file)).Output(); err == nil && len(bytes.TrimSpace(out)) > 0 {
+		commit = strings.TrimSpace(string(out))
+	}
+	return strings.NewReplacer("{file}", path, "{commit}", commit).Replace(template)
+}
+
+// addFooter appends an info panel holding the footer text to the page
+func addFooter(template string) textHook {
+	return func(req *HookRequest) ([]string, error) {
+		footer := footerText(template, req.File)
+		if req.Format != "adf" {
+			req.Content += `<ac:structured-macro ac:name="info"><ac:rich-text-body><p>` + html.EscapeString(footer) + "</p></ac:rich-text-body></ac:structured-macro>\n"
+			return nil, nil
+		}
+		var doc adf.Node
+		if err := json.Unmarshal([]byte(req.Content), &doc); err != nil {
+			return nil, err
+		}
+		doc.Content = append(doc.Content, &adf.Node{Type: "panel", Attrs: map[string]interface{}{"panelType": "info"}, Content: []*adf.Node{
+			{Type: "paragraph", Content: []*adf.Node{{Type: "text", Text: footer}}},
+		}})
+		body, err := json.Marshal(&doc)
+		req.Content = string(body)
+		return nil, err
+	}
+}
+
+// removeFooter drops the footer panel from the end of a pulled page, so
+// pushing it again does not add a second one
+func removeFooter(template string) textHook {
+	// The placeholders match anything; the rest must match as written
+	quoted := regexp.QuoteMeta(template)
+	for _, placeholder := range []string{"{file}", "{commit}"} {
+		quoted = strings.ReplaceAll(quoted, regexp.QuoteMeta(placeholder), ".*?")
+	}
+	footer := regexp.MustCompile(`^` + quoted + `$`)
+	panel := regexp.MustCompile(`(?:^|\n\n)> \[![A-Z]+\]\n> (.*)\n*$`)
+	unescape := regexp.MustCompile(`\\([!-/:-@\[-` + "`" + `{-~])`)
+	return func(req *HookRequest) ([]string, error) {
+		if m := panel.FindStringSubmatchIndex(req.Content); m != nil && footer.MatchString(unescape.ReplaceAllString(req.Content[m[2]:m[3]], "$1")) {
+			req.Content = req.Content[:m[0]] + "\n"
+		}
+		return nil, nil
+	}
+}
+
+// runHookCommand runs args with the request as JSON on stdin and reads a
+// HookResponse from stdout
+func runHookCommand(args []string, options map[string]string) textHook {
+	return func(req *HookRequest) ([]string, error) {
+		req.Options = options
+		input, err := json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(input), &stdout, &stderr
+		if err := cmd.Run(); err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return nil, fmt.Errorf("%s: %w: %s", args[0], err, msg)
+			}
+			return nil, fmt.Errorf("%s: %w", args[0], err)
+		}
+		var resp HookResponse
+		if len(bytes.TrimSpace(stdout.Bytes())) > 0 {
+			if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+				return nil, fmt.Errorf("%s wrote an invalid response: %w", args[0], err)
+			}
+		}
+		if resp.Content != nil {
+			req.Content = *resp.Content
+		}
+		return resp.Warnings, nil
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfigs writes a user config and a repository .scribe.yaml, and
+// returns a directory under the repository to put files in
+func writeConfigs(t *testing.T, user, repo string) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", home)
+	if user != "" {
+		if err := os.MkdirAll(filepath.Join(home, "scribe"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(home, "scribe", "config.yaml"), []byte(user), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, RepoConfigFile), []byte(repo), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(root, "docs")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestPipelineStages(t *testing.T) {
+	dir := writeConfigs(t, `
+pipeline:
+  - name: shortcodes
+    type: replace
+    pattern: '\{\{< jira (\S+) >\}\}'
+    replacement: '[$1](http://jira.internal/browse/$1)'
+`, `
+pipeline:
+  - name: internal-links
+    type: rewrite-links
+    from: http://jira.internal/
+    to: https://jira.example.com/
+  - name: git-footer
+    type: footer
+    text: Generated from {file} at {commit}
+`)
+	file := filepath.Join(dir, "doc.md")
+	markdown := "---\nconfluence_title: Doc\n---\nFixed in {{< jira OPS-1 >}}, see <http://jira.internal/browse/OPS-2>."
+
+	converted := ConvertMarkdownFileToConfluence(markdown, file, "", nil)
+	if len(converted.Errors) != 0 || len(converted.Warnings) != 0 {
+		t.Fatalf("errors %v, warnings %v", converted.Errors, converted.Warnings)
+	}
+	want := `<p>Fixed in <a href="https://jira.example.com/browse/OPS-1">OPS-1</a>, see <a href="https://jira.example.com/browse/OPS-2">https://jira.example.com/browse/OPS-2</a>.</p>
+<ac:structured-macro ac:name="info"><ac:rich-text-body><p>Generated from doc.md at uncommitted</p></ac:rich-text-body></ac:structured-macro>
+`
+	if converted.Body != want {
+		t.Errorf("body:\n%s\nwant\n%s", converted.Body, want)
+	}
+
+	// Pull drops the footer again, so pushing the result does not add another
+	pulled, err := pullThroughPipeline(dir, ConvertConfluenceToMarkdown(converted.Body))
+	if err != nil || strings.Contains(pulled, "Generated") || !strings.HasSuffix(pulled, "OPS-2).\n") {
+		t.Errorf("pulled %q, %v", pulled, err)
+	}
+
+	adf := ConvertMarkdownFileToADF(markdown, file, nil)
+	if len(adf.Errors) != 0 || !strings.Contains(adf.Body, `{"type":"panel","attrs":{"panelType":"info"}`) {
+		t.Errorf("ADF body %s, errors %v", adf.Body, adf.Errors)
+	}
+}
+
+func TestPipelineExecStage(t *testing.T) {
+	dir := writeConfigs(t, "", `
+pipeline:
+  - name: house-style
+    type: exec
+    command: ./hook.sh
+    hooks: [before-parse]
+    options:
+      style: strict
+`)
+	script := "#!/bin/sh\ncat > \"$(dirname \"$0\")/request.json\"\necho '{\"content\": \"# Replaced\", \"warnings\": [\"house style applied\"]}'\n"
+	if err := os.WriteFile(filepath.Join(filepath.Dir(dir), "hook.sh"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "doc.md")
+
+	// Commands from a repository only run once the user trusts it
+	untrusted := ConvertMarkdownFileToConfluence("# Original", file, "", nil)
+	if len(untrusted.Errors) != 1 || !strings.Contains(untrusted.Errors[0], "only run once it is listed under trusted_repositories") {
+		t.Fatalf("errors %v, want the untrusted repository reported", untrusted.Errors)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "request.json")); !os.IsNotExist(err) {
+		t.Fatalf("untrusted command ran: %v", err)
+	}
+	userConfig := filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "scribe", "config.yaml")
+	if err := os.MkdirAll(filepath.Dir(userConfig), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(userConfig, []byte("trusted_repositories: ["+filepath.Dir(dir)+"]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	converted := ConvertMarkdownFileToConfluence("# Original", file, "", nil)
+	if converted.Body != `<h1 id="Replaced">Replaced</h1>`+"\n" || strings.Join(converted.Warnings, ",") != "house-style: house style applied" {
+		t.Errorf("body %q, warnings %v, errors %v", converted.Body, converted.Warnings, converted.Errors)
+	}
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(dir), "request.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req HookRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Hook != HookBeforeParse || req.File != file || req.Format != FormatMarkdown || req.Content != "# Original" || req.Options["style"] != "strict" {
+		t.Errorf("request %+v", req)
+	}
+
+	// A failing stage stops the push
+	if err := os.WriteFile(filepath.Join(filepath.Dir(dir), RepoConfigFile), []byte("pipeline:\n  - {name: broken, type: exec, command: false, hooks: [after-render]}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	failed := ConvertMarkdownFileToConfluence("# Original", file, "", nil)
+	if len(failed.Errors) != 1 || !strings.HasPrefix(failed.Errors[0], "pipeline stage broken at after-render: false: exit status 1") {
+		t.Errorf("errors %v", failed.Errors)
+	}
+}
+
+func TestPipelineStripComments(t *testing.T) {
+	dir := writeConfigs(t, "", "pipeline:\n  - type: strip-comments\n")
+	file := filepath.Join(dir, "doc.md")
+	markdown := "Intro<!-- link the runbook --> text.\n\n<!--\nreviewers: check the numbers\n-->\n\nBody."
+
+	converted := ConvertMarkdownFileToConfluence(markdown, file, "", nil)
+	if want := "<p>Intro text.</p>\n<p>Body.</p>\n"; converted.Body != want {
+		t.Errorf("body %q, want %q", converted.Body, want)
+	}
+	adf := ConvertMarkdownFileToADF(markdown, file, nil)
+	if len(adf.Errors) != 0 || strings.Contains(adf.Body, "reviewers") || strings.Contains(adf.Body, "runbook") {
+		t.Errorf("ADF body %s, errors %v", adf.Body, adf.Errors)
+	}
+}
+
+func TestPipelineConfigErrors(t *testing.T) {
+	for config, want := range map[string]string{
+		"pipeline:\n  - {type: shout}\n":                        `pipeline stage shout: unknown type "shout"`,
+		"pipeline:\n  - {type: exec, command: x}\n":             "pipeline stage exec: exec needs hooks",
+		"pipeline:\n  - {type: footer, text: x, hooks: [x]}\n":  "pipeline stage footer: only replace and exec stages take hooks",
+		"pipeline:\n  - {type: replace, hooks: [transform]}\n":  `pipeline stage replace: cannot run at "transform", where only rewrite-links and strip-comments stages run`,
+		"pipeline:\n  - {type: replace, patern: x}\n":           "field patern not found",
+		"trusted_repositories: [/]\n":                           "trusted_repositories can only be set in",
+		"pipeline:\n  - {type: rewrite-links, to: https://x}\n": "pipeline stage rewrite-links: rewrite-links needs from",
+	} {
+		dir := writeConfigs(t, "", config)
+		if _, err := loadPipeline(dir); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %s", config, err, want)
+		}
+	}
+}
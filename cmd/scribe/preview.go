@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/spf13/cobra"
+	"github.com/wmorley/scribe-cli/storage"
+)
+
+// The preview server renders a file the way its page would look, without
+// publishing it. The page subscribes to /events, a server-sent event stream
+// that sends "reload" whenever the file changes, and then fetches /body.
+
+// previewPoll is how often the previewed file is checked for changes
+var previewPoll = 300 * time.Millisecond
+
+type previewServer struct {
+	file string
+
+	mu      sync.Mutex
+	clients map[chan struct{}]bool
+}
+
+func newPreviewServer(file string) *previewServer {
+	return &previewServer{file: file, clients: map[chan struct{}]bool{}}
+}
+
+func (s *previewServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.servePage)
+	mux.HandleFunc("/body", s.serveBody)
+	mux.HandleFunc("/events", s.serveEvents)
+	// Attachments are looked up next to the file, as push uploads them
+	mux.Handle("/files/", http.StripPrefix("/files/", http.FileServer(http.Dir(filepath.Dir(s.file)))))
+	return mux
+}
+
+// render converts the file to storage format and then to preview HTML
+func (s *previewServer) render() (string, error) {
+	content, err := os.ReadFile(s.file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	pipe, err := loadPipeline(filepath.Dir(s.file))
+	if err != nil {
+		return "", err
+	}
+	converted, err := convertDocument(string(content), ConvertOptions{From: formatOf(s.file), To: FormatStorage, Pipeline: pipe, File: s.file})
+	if err != nil {
+		return "", err
+	}
+	return renderPreviewHTML(converted), nil
+}
+
+func (s *previewServer) servePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := s.render()
+	if err != nil {
+		body = `<p class="preview-error">` + html.EscapeString(err.Error()) + `</p>`
+	}
+	title := parseFrontmatter(readFileOrEmpty(s.file))["confluence_title"]
+	if title == "" {
+		title = filepath.Base(s.file)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = previewPage.Execute(w, struct {
+		Title string
+		Body  template.HTML
+	}{title, template.HTML(body)})
+}
+
+func (s *previewServer) serveBody(w http.ResponseWriter, r *http.Request) {
+	body, err := s.render()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, body)
+}
+
+func (s *previewServer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	changed := s.subscribe()
+	defer s.unsubscribe(changed)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+			fmt.Fprint(w, "event: reload\ndata: {}\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func (s *previewServer) subscribe() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan struct{}, 1)
+	s.clients[ch] = true
+	return ch
+}
+
+func (s *previewServer) unsubscribe(ch chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, ch)
+}
+
+// watch polls the file until ctx is done, telling every client when its
+// modification time or size changes. A client that has not caught up with
+// the last change is not sent another.
+func (s *previewServer) watch(ctx context.Context) {
+	stamp := func() string {
+		info, err := os.Stat(s.file)
+		if err != nil {
+			return ""
+		}
+		return info.ModTime().String() + "/" + strconv.FormatInt(info.Size(), 10)
+	}
+	last := stamp()
+	ticker := time.NewTicker(previewPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := stamp()
+		if current == last {
+			continue
+		}
+		last = current
+		s.mu.Lock()
+		for ch := range s.clients {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func readFileOrEmpty(file string) string {
+	content, _ := os.ReadFile(file)
+	return string(content)
+}
+
+func runPreview(cmd *cobra.Command, args []string) error {
+	if _, err := os.Stat(filePath); err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	listener, err := net.Listen("tcp", previewAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+	defer stop()
+
+	s := newPreviewServer(filePath)
+	go s.watch(ctx)
+	server := &http.Server{Handler: s.handler()}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	// The plugin reads the URL off the first line to open a browser
+	if err := printJSON(map[string]string{"url": "http://" + listener.Addr().String() + "/", "file": filePath}); err != nil {
+		return err
+	}
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// renderPreviewHTML turns storage format into HTML a browser can show,
+// approximating the macros Confluence would render
+func renderPreviewHTML(confluence string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(normalizeStorageFor(confluence, func(string) bool { return true })))
+	if err != nil {
+		return "<pre>" + html.EscapeString(confluence) + "</pre>"
+	}
+	body := doc.Find("body")
+
+	// Innermost first, so a macro's body is already HTML when it is replaced
+	nodes := body.Find("ac\\:structured-macro, ac\\:task-list, ac\\:link, ac\\:image, ac\\:emoticon, time")
+	for i := nodes.Length() - 1; i >= 0; i-- {
+		node := nodes.Eq(i)
+		node.ReplaceWithHtml(previewElement(node))
+	}
+
+	// Headings take the anchors ac:link refers to them by
+	var toc strings.Builder
+	seen := map[string]int{}
+	body.Find("h1, h2, h3, h4, h5, h6").Each(func(_ int, heading *goquery.Selection) {
+		text := strings.TrimSpace(heading.Text())
+		anchor := storage.HeadingAnchor(text)
+		if count := seen[anchor]; count > 0 {
+			seen[anchor]++
+			anchor += "." + strconv.Itoa(count)
+		} else {
+			seen[anchor] = 1
+		}
+		heading.SetAttr("id", anchor)
+		toc.WriteString(`<li class="toc-` + goquery.NodeName(heading) + `"><a href="#` + html.EscapeString(anchor) + `">` + html.EscapeString(text) + `</a></li>`)
+	})
+	body.Find("nav.toc").SetHtml("<ul>" + toc.String() + "</ul>")
+
+	out, err := body.Html()
+	if err != nil {
+		return "<pre>" + html.EscapeString(confluence) + "</pre>"
+	}
+	return out
+}
+
+// previewElement is the HTML standing in for a storage element
+func previewElement(node *goquery.Selection) string {
+	switch goquery.NodeName(node) {
+	case "ac:task-list":
+		var b strings.Builder
+		b.WriteString(`<ul class="tasks">`)
+		node.ChildrenFiltered("ac\\:task").Each(func(_ int, task *goquery.Selection) {
+			checked := ""
+			if strings.TrimSpace(task.ChildrenFiltered("ac\\:task-status").Text()) == "complete" {
+				checked = " checked"
+			}
+			body, _ := task.ChildrenFiltered("ac\\:task-body").Html()
+			b.WriteString(`<li><input type="checkbox" disabled` + checked + `> ` + body + `</li>`)
+		})
+		b.WriteString(`</ul>`)
+		return b.String()
+	case "ac:link":
+		return previewLink(node)
+	case "ac:image":
+		src := node.Find("ri\\:url").AttrOr("ri:value", "")
+		if filename := node.Find("ri\\:attachment").AttrOr("ri:filename", ""); filename != "" {
+			src = "files/" + filename
+		}
+		return `<img src="` + html.EscapeString(src) + `" alt="` + html.EscapeString(node.AttrOr("ac:alt", "")) + `">`
+	case "ac:emoticon":
+		return `<span class="emoticon">(` + html.EscapeString(node.AttrOr("ac:name", "")) + `)</span>`
+	case "time":
+		return `<span class="date">` + html.EscapeString(node.AttrOr("datetime", "")) + `</span>`
+	}
+	return previewMacro(node)
+}
+
+func previewMacro(macro *goquery.Selection) string {
+	name := macro.AttrOr("ac:name", "")
+	param := func(name string) string {
+		return macro.ChildrenFiltered("ac\\:parameter[ac\\:name='" + name + "']").Text()
+	}
+	richBody := func() string {
+		body, _ := macro.ChildrenFiltered("ac\\:rich-text-body").Html()
+		return body
+	}
+	plainBody := html.EscapeString(macro.ChildrenFiltered("ac\\:plain-text-body").Text())
+
+	if _, ok := storage.AdmonitionTypes[name]; ok {
+		title := ""
+		if t := param("title"); t != "" {
+			title = `<p class="panel-title">` + html.EscapeString(t) + `</p>`
+		}
+		return `<div class="panel panel-` + name + `">` + title + richBody() + `</div>`
+	}
+	macros := mathMacros()
+	switch name {
+	case "code", "noformat":
+		title := ""
+		if t := param("title"); t != "" {
+			title = `<div class="code-title">` + html.EscapeString(t) + `</div>`
+		}
+		language := param("language")
+		return `<div class="code">` + title + `<pre><code class="language-` + html.EscapeString(language) + `">` + plainBody + `</code></pre></div>`
+	case "expand":
+		title := param("title")
+		if title == "" {
+			title = "Click here to expand..."
+		}
+		return `<details class="expand"><summary>` + html.EscapeString(title) + `</summary>` + richBody() + `</details>`
+	case "toc":
+		return `<nav class="toc"></nav>`
+	case "status":
+		colour := strings.ToLower(param("colour"))
+		if colour == "" {
+			colour = "grey"
+		}
+		return `<span class="status status-` + html.EscapeString(colour) + `">` + html.EscapeString(strings.ToUpper(param("title"))) + `</span>`
+	case "anchor":
+		return `<a id="` + html.EscapeString(param("")) + `"></a>`
+	case macros.Inline:
+		return `<code class="math">` + html.EscapeString(param("body")) + `</code>`
+	case macros.Block:
+		return `<pre class="math">` + plainBody + `</pre>`
+	}
+
+	// Other macros are shown as a labelled box around any body they have
+	content := richBody()
+	if content == "" && plainBody != "" {
+		content = "<pre>" + plainBody + "</pre>"
+	}
+	if !isBlockContext(macro.Parent()) {
+		return `<span class="macro" title="` + html.EscapeString(name) + ` macro">{` + html.EscapeString(name) + `}</span>`
+	}
+	return `<div class="macro"><div class="macro-name">` + html.EscapeString(name) + `</div>` + content + `</div>`
+}
+
+// previewLink renders ac:link as a link, or a mention for a user
+func previewLink(link *goquery.Selection) string {
+	label, _ := link.ChildrenFiltered("ac\\:link-body").Html()
+	if label == "" {
+		label = html.EscapeString(link.ChildrenFiltered("ac\\:plain-text-link-body").Text())
+	}
+	if user := link.ChildrenFiltered("ri\\:user"); user.Length() > 0 {
+		name := user.AttrOr("ri:username", user.AttrOr("ri:account-id", user.AttrOr("ri:userkey", "")))
+		return `<span class="mention">@` + html.EscapeString(name) + `</span>`
+	}
+	href, target := "", ""
+	if attachment := link.ChildrenFiltered("ri\\:attachment"); attachment.Length() > 0 {
+		target = attachment.AttrOr("ri:filename", "")
+		href = "files/" + target
+	}
+	if page := link.ChildrenFiltered("ri\\:page"); page.Length() > 0 {
+		target = page.AttrOr("ri:content-title", "")
+		href = "#"
+	}
+	if anchor := link.AttrOr("ac:anchor", ""); anchor != "" {
+		if href == "" {
+			href = "#" + anchor
+		}
+		target = strings.TrimPrefix(target+"#"+anchor, "#")
+	}
+	if label == "" {
+		label = html.EscapeString(target)
+	}
+	return `<a href="` + html.EscapeString(href) + `" title="` + html.EscapeString(target) + `">` + label + `</a>`
+}
+
+var previewPage = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}} (preview)</title>
+<style>
+body { font: 14px/1.7 -apple-system, "Segoe UI", Roboto, sans-serif; color: #172b4d; max-width: 960px; margin: 2em auto; padding: 0 1em; }
+h1.page-title { font-size: 2em; border-bottom: 1px solid #dfe1e6; padding-bottom: .3em; }
+a { color: #0052cc; text-decoration: none; }
+table { border-collapse: collapse; } th, td { border: 1px solid #c1c7d0; padding: 7px 10px; } th { background: #f4f5f7; }
+code { background: #f4f5f7; padding: 0 3px; border-radius: 3px; }
+blockquote { border-left: 2px solid #c1c7d0; margin-left: 0; padding-left: 1em; color: #5e6c84; }
+.code { border: 1px solid #dfe1e6; border-radius: 3px; margin: 1em 0; }
+.code pre { margin: 0; padding: 8px 12px; background: #f4f5f7; overflow-x: auto; } .code pre code { padding: 0; }
+.code-title { padding: 4px 12px; border-bottom: 1px solid #dfe1e6; font-weight: 600; }
+.panel { border-radius: 3px; padding: 8px 12px 8px 16px; margin: 1em 0; border-left: 4px solid; }
+.panel-title { font-weight: 600; margin: 0; }
+.panel-info { background: #deebff; border-color: #0065ff; } .panel-note { background: #eae6ff; border-color: #6554c0; }
+.panel-tip { background: #e3fcef; border-color: #36b37e; } .panel-warning { background: #ffebe6; border-color: #ff5630; }
+.panel-panel { background: #f4f5f7; border-color: #c1c7d0; }
+.status { font-size: 11px; font-weight: 700; padding: 2px 4px; border-radius: 3px; background: #dfe1e6; }
+.status-green { background: #e3fcef; color: #006644; } .status-red { background: #ffebe6; color: #bf2600; }
+.status-yellow { background: #fffae6; color: #ff8b00; } .status-blue { background: #deebff; color: #0747a6; }
+.status-purple { background: #eae6ff; color: #403294; }
+.toc ul { list-style: none; padding-left: 0; } .toc-h2 { margin-left: 1em; } .toc-h3 { margin-left: 2em; }
+.toc-h4 { margin-left: 3em; } .toc-h5 { margin-left: 4em; } .toc-h6 { margin-left: 5em; }
+.expand summary { cursor: pointer; color: #0052cc; }
+.tasks { list-style: none; padding-left: 0; }
+.mention { background: #dfe1e6; border-radius: 20px; padding: 0 6px; }
+.macro { border: 1px dashed #c1c7d0; border-radius: 3px; padding: 4px 8px; margin: 1em 0; color: #5e6c84; }
+.macro-name { font-size: 11px; text-transform: uppercase; }
+.preview-error { color: #bf2600; }
+</style>
+</head>
+<body>
+<h1 class="page-title">{{.Title}}</h1>
+<main id="content">{{.Body}}</main>
+<script>
+new EventSource("/events").addEventListener("reload", function () {
+  fetch("/body").then(function (r) { return r.ok ? r.text() : Promise.reject(r.statusText); })
+    .then(function (html) { document.getElementById("content").innerHTML = html; });
+});
+</script>
+</body>
+</html>
+`))
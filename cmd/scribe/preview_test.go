@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderPreviewHTML(t *testing.T) {
+	markdown := strings.Join([]string{
+		"[[toc]]",
+		"",
+		"## Setup",
+		"",
+		"> [!WARNING]",
+		"> Back it up.",
+		"",
+		"- [ ] todo",
+		"- [x] done",
+		"",
+		"Status {status:green|Done}, see [setup](#setup).",
+		"",
+		"<details><summary>More</summary>",
+		"",
+		"```go",
+		"fmt.Println(\"<hi>\")",
+		"```",
+		"",
+		"</details>",
+	}, "\n")
+
+	got := renderPreviewHTML(ConvertMarkdownToConfluence(markdown))
+	for _, want := range []string{
+		`<nav class="toc"><ul><li class="toc-h2"><a href="#Setup">Setup</a></li></ul></nav>`,
+		`<h2 id="Setup">Setup</h2>`,
+		`<div class="panel panel-warning">`,
+		`<input type="checkbox" disabled=""/> todo`,
+		`<input type="checkbox" disabled="" checked=""/> done`,
+		`<span class="status status-green">DONE</span>`,
+		`<a href="#Setup" title="Setup">setup</a>`,
+		`<details class="expand"><summary>More</summary>`,
+		`<code class="language-go">fmt.Println(&#34;&lt;hi&gt;&#34;)</code>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("preview lacks %s:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "ac:") {
+		t.Errorf("preview holds storage elements:\n%s", got)
+	}
+
+	got = renderPreviewHTML(`<ac:structured-macro ac:name="jira"><ac:parameter ac:name="key">OPS-1</ac:parameter></ac:structured-macro>`)
+	if !strings.Contains(got, `<div class="macro-name">jira</div>`) {
+		t.Errorf("unknown macro not shown as a box:\n%s", got)
+	}
+}
+
+func TestPreviewReloadsOnChange(t *testing.T) {
+	poll := previewPoll
+	previewPoll = 10 * time.Millisecond
+	t.Cleanup(func() { previewPoll = poll })
+	file := filepath.Join(t.TempDir(), "doc.md")
+	if err := os.WriteFile(file, []byte("---\nconfluence_title: Guide\n---\n\n# First"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newPreviewServer(file)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.watch(ctx)
+	server := httptest.NewServer(s.handler())
+	defer server.Close()
+
+	page := fetchBody(t, server.URL+"/")
+	if !strings.Contains(page, "<title>Guide (preview)</title>") || !strings.Contains(page, `<h1 id="First">First</h1>`) {
+		t.Errorf("page:\n%s", page)
+	}
+
+	resp, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+	if line, _ := events.ReadString('\n'); line != ": connected\n" {
+		t.Fatalf("stream opened with %q", line)
+	}
+
+	if err := os.WriteFile(file, []byte("# Second heading"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string)
+	go func() {
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+	for reloaded := false; !reloaded; {
+		select {
+		case line := <-lines:
+			reloaded = line == "event: reload\n"
+		case <-time.After(5 * time.Second):
+			t.Fatal("no reload event after the file changed")
+		}
+	}
+
+	if body := fetchBody(t, server.URL+"/body"); !strings.Contains(body, "Second heading") {
+		t.Errorf("body after change:\n%s", body)
+	}
+}
+
+func fetchBody(t *testing.T, url string) string {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newInstance is a content API that only counts the page updates it takes
+func newInstance(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	puts := &atomic.Int32{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			puts.Add(1)
+			var req UpdatePageRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			fmt.Fprintf(w, `{"id":"42","title":"Runbook","version":{"number":%d}}`, req.Version.Number)
+			return
+		}
+		fmt.Fprint(w, `{"id":"42","title":"Runbook","version":{"number":3}}`)
+	}))
+	t.Cleanup(server.Close)
+	return server, puts
+}
+
+func TestProfilesRouteUpdates(t *testing.T) {
+	t.Setenv("SCRIBE_CACHE_DIR", t.TempDir())
+	t.Setenv("SCRIBE_PROFILE", "")
+	cloud, cloudPuts := newInstance(t)
+	onprem, onpremPuts := newInstance(t)
+	// Profile clients are built on the default transport; trust the test certificate
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = cloud.Client().Transport
+	t.Cleanup(func() { http.DefaultTransport = defaultTransport })
+	writeConfigs(t, fmt.Sprintf(`
+default_profile: cloud
+profiles:
+  cloud: {url: %q, username: me@example.com, api_token: cloud-token}
+  onprem: {url: %q, username: me, api_token: onprem-token}
+`, cloud.URL, onprem.URL), "")
+
+	profiles, err := listProfiles("", ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 || profiles[0].Name != "cloud" || !profiles[0].Current || profiles[1].Current {
+		t.Errorf("profiles %+v, want cloud current", profiles)
+	}
+
+	client, err := NewScribeClient("", ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profileOf(client) != "cloud" || instanceURL(client) != cloud.URL {
+		t.Fatalf("default client is for %q at %s", profileOf(client), instanceURL(client))
+	}
+
+	// The file's confluence_profile wins over the profile in use
+	file := writeDoc(t, "confluence_page_id: 42\nconfluence_profile: onprem")
+	page, err := updatePage(context.Background(), client, UpdatePageParams{ID: "42", File: file}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Profile != "onprem" {
+		t.Errorf("update reports profile %q, want onprem", page.Profile)
+	}
+	pulled, err := getPage(context.Background(), client, GetPageParams{ID: "42"}, nil)
+	if err != nil || pulled.Profile != "cloud" {
+		t.Errorf("get reports %+v (%v), want the cloud profile", pulled, err)
+	}
+	if cloudPuts.Load() != 0 || onpremPuts.Load() != 1 {
+		t.Errorf("cloud took %d updates and onprem %d, want only onprem", cloudPuts.Load(), onpremPuts.Load())
+	}
+
+	// Queued updates remember the instance they are for
+	t.Setenv("SCRIBE_OUTBOX_DIR", t.TempDir())
+	if _, err := updatePage(context.Background(), client, UpdatePageParams{ID: "42", File: file, Queue: true}, nil); err == nil {
+		t.Fatal("explicit --queue should report a QueuedError")
+	}
+	if _, err := newOutbox().Flush(context.Background(), client, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if cloudPuts.Load() != 0 || onpremPuts.Load() != 2 {
+		t.Errorf("flush went to cloud %d times and onprem %d, want only onprem", cloudPuts.Load(), onpremPuts.Load())
+	}
+
+	// A file with no profile belongs to the instance of the SCRIBE_* variables
+	t.Setenv("SCRIBE_URL", "")
+	plain := writeDoc(t, "confluence_page_id: 42")
+	_, err = updatePage(context.Background(), client, UpdatePageParams{ID: "42", File: plain}, nil)
+	if err == nil || !strings.Contains(err.Error(), "SCRIBE_URL is not set") {
+		t.Errorf("got %v, want the missing SCRIBE_URL reported", err)
+	}
+	t.Setenv("SCRIBE_URL", onprem.URL)
+	t.Setenv("SCRIBE_USERNAME", "me")
+	t.Setenv("SCRIBE_API_TOKEN", "onprem-token")
+	page, err = updatePage(context.Background(), client, UpdatePageParams{ID: "42", File: plain}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cloudPuts.Load() != 0 || onpremPuts.Load() != 3 || page.Profile != "" {
+		t.Errorf("cloud took %d updates and onprem %d (profile %q), want the SCRIBE_URL instance", cloudPuts.Load(), onpremPuts.Load(), page.Profile)
+	}
+
+	unknown := writeDoc(t, "confluence_page_id: 42\nconfluence_profile: staging")
+	_, err = updatePage(context.Background(), client, UpdatePageParams{ID: "42", File: unknown}, nil)
+	if err == nil || !strings.Contains(err.Error(), `unknown profile "staging" (configured: cloud, onprem)`) {
+		t.Errorf("got %v, want the unknown profile named", err)
+	}
+}
+
+func TestProfileConfigLayers(t *testing.T) {
+	dir := writeConfigs(t, `
+profiles:
+  dc: {url: https://wiki.example.com, username: me}
+`, `
+default_profile: dc
+profiles:
+  dc: {url: https://wiki.internal.example.com}
+`)
+	config, err := loadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Profile{URL: "https://wiki.internal.example.com", Username: "me"}
+	if config.DefaultProfile != "dc" || config.Profiles["dc"] != want {
+		t.Errorf("config %+v, want the repository's url over the user's profile", config)
+	}
+
+	// The repository config is the one beside the file, whatever the working directory
+	t.Setenv("SCRIBE_PROFILE", "")
+	client, err := NewScribeClient("", dir)
+	if err != nil || profileOf(client) != "dc" {
+		t.Errorf("client for %s is for profile %q (%v), want the repository's default dc", dir, profileOf(client), err)
+	}
+	if url, err := profileURL("", dir); err != nil || url != want.URL {
+		t.Errorf("profile URL for %s is %q (%v), want %s", dir, url, err, want.URL)
+	}
+	if profiles, err := listProfiles("", "."); err != nil || len(profiles) != 1 || profiles[0].Current {
+		t.Errorf("profiles outside the repository %+v (%v), want dc not in use", profiles, err)
+	}
+
+	if _, err := NewScribeClient("nope", dir); err == nil || !strings.Contains(err.Error(), `unknown profile "nope" (configured: dc)`) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestRepoConfigCannotRedirectUserToken(t *testing.T) {
+	for _, repo := range []string{
+		"profiles:\n  dc: {url: https://attacker.example.com}\n",
+		"profiles:\n  dc: {provider: chalk}\n",
+	} {
+		dir := writeConfigs(t, `
+profiles:
+  dc: {url: https://wiki.example.com, username: me, api_token: secret}
+`, repo)
+		if _, err := loadConfig(dir); err == nil || !strings.Contains(err.Error(), "profile dc has its api_token in") {
+			t.Errorf("%s: got %v, want the override rejected", repo, err)
+		}
+	}
+
+	dir := writeConfigs(t, `
+profiles:
+  dc: {url: https://wiki.example.com, username: me, api_token: secret}
+`, "profiles:\n  dc: {url: https://wiki.example.com, username: other}\n")
+	config, err := loadConfig(dir)
+	if err != nil || config.Profiles["dc"].Username != "other" {
+		t.Errorf("got %+v (%v), want the repository's username", config, err)
+	}
+}
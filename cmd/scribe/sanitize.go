@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/wmorley/scribe-cli/storage"
+	"github.com/yuin/goldmark"
+)
+
+// Lint rules for what the sanitizer finds in raw HTML
+var htmlIssueRules = map[storage.HTMLIssueKind]string{
+	storage.HTMLRemovedElement:   "raw-html",
+	storage.HTMLRemovedAttribute: "unsafe-html",
+	storage.HTMLInvalid:          "invalid-html",
+}
+
+// htmlSanitizer collects what storage.SanitizeHTML reports while
+// converting markdown, the contents of file, at positions in the file
+type htmlSanitizer struct {
+	file      string
+	source    []byte
+	skipLines int // frontmatter lines before source
+	issues    []LintIssue
+}
+
+func newHTMLSanitizer(file, markdown string) *htmlSanitizer {
+	source := stripFrontmatter(markdown)
+	return &htmlSanitizer{
+		file:      file,
+		source:    []byte(source),
+		skipLines: strings.Count(markdown[:len(markdown)-len(source)], "\n"),
+	}
+}
+
+// Extender sanitizes the raw HTML of a conversion of the file
+func (s *htmlSanitizer) Extender() goldmark.Extender {
+	return storage.SanitizeHTML(func(issue storage.HTMLIssue) {
+		line, column := sourcePosition(s.source, issue.Offset, s.skipLines)
+		s.issues = append(s.issues, LintIssue{File: s.file, Line: line, Column: column, Rule: htmlIssueRules[issue.Kind], Message: issue.Message})
+	})
+}
+
+// report adds the issues found to warnings, or to errors for HTML
+// Confluence would reject
+func (s *htmlSanitizer) report(warnings, errors *[]string) {
+	sortIssues(s.issues)
+	for _, issue := range s.issues {
+		message := fmt.Sprintf("line %d, column %d: %s", issue.Line, issue.Column, issue.Message)
+		if issue.Rule == "invalid-html" {
+			*errors = append(*errors, message)
+		} else {
+			*warnings = append(*warnings, message)
+		}
+	}
+}
+
+// sourcePosition is the line and column of offset into source, a file
+// with its first skipLines lines cut off
+func sourcePosition(source []byte, offset, skipLines int) (int, int) {
+	before := string(source[:offset])
+	line := strings.Count(before, "\n") + 1
+	column := offset - strings.LastIndex(before, "\n")
+	return line + skipLines, column
+}
+
+// Namespaces for the storage prefixes, so the decoder can check them
+const storageRoot = `<scribe-storage xmlns:ac="ac" xmlns:ri="ri" xmlns:at="at">`
+
+// validateStorage checks that body is well-formed storage format made of
+// allowed elements without event handlers, which is what Data Center
+// accepts. Each problem is described with its line and column in body.
+func validateStorage(body string) []string {
+	decoder := xml.NewDecoder(strings.NewReader(storageRoot + body + "</scribe-storage>"))
+	decoder.Entity = xml.HTMLEntity
+
+	var problems []string
+	position := func() string {
+		line, column := decoder.InputPos()
+		if line == 1 {
+			column -= len(storageRoot)
+		}
+		return fmt.Sprintf("storage line %d, column %d", line, column)
+	}
+	for {
+		at := position()
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			return problems
+		}
+		if syntax, ok := err.(*xml.SyntaxError); ok {
+			// The wrapping root is ours, not the page's
+			msg := strings.Replace(syntax.Msg, " closed by </scribe-storage>", " is never closed", 1)
+			return append(problems, fmt.Sprintf("storage line %d: %s", syntax.Line, msg))
+		}
+		if err != nil {
+			return append(problems, fmt.Sprintf("%s: %v", at, err))
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local == "scribe-storage" {
+			continue
+		}
+		name := start.Name.Local
+		if start.Name.Space != "" {
+			name = start.Name.Space + ":" + name
+		}
+		if !storage.AllowedHTMLTags[name] && !storage.IsStorageElement(name) {
+			problems = append(problems, fmt.Sprintf("%s: <%s> is not allowed in storage format", at, name))
+		}
+		for _, attr := range start.Attr {
+			if strings.HasPrefix(strings.ToLower(attr.Name.Local), "on") && attr.Name.Space == "" {
+				problems = append(problems, fmt.Sprintf("%s: event handler %s on <%s>", at, attr.Name.Local, name))
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeRawHTML(t *testing.T) {
+	markdown := strings.Join([]string{
+		"---",
+		"confluence_title: Doc",
+		"---",
+		`Click <a href="javascript:alert(1)" onclick='go()'>here</a> or <kbd title='say "hi"'>K</kbd>.`,
+		"",
+		"<script>",
+		"alert(1)",
+		"</script>",
+		"",
+		"<div class=note>",
+		"a < b & c &amp; d<br>",
+		"</div>",
+	}, "\n")
+
+	converted := ConvertMarkdownFileToConfluence(markdown, "doc.md", "", nil)
+	if len(converted.Errors) != 0 {
+		t.Errorf("errors: %v", converted.Errors)
+	}
+	wantWarnings := []string{
+		"line 4, column 7: removed script URL in href from <a>",
+		"line 4, column 7: removed event handler onclick from <a>",
+		"line 6, column 1: removed <script>, which storage format does not allow",
+	}
+	if strings.Join(converted.Warnings, "\n") != strings.Join(wantWarnings, "\n") {
+		t.Errorf("warnings:\n%s\nwant\n%s", strings.Join(converted.Warnings, "\n"), strings.Join(wantWarnings, "\n"))
+	}
+	for _, want := range []string{
+		`<p>Click <a>here</a> or <kbd title="say &quot;hi&quot;">K</kbd>.</p>`,
+		"<div class=\"note\">\na &lt; b &amp; c &amp; d<br />\n</div>",
+	} {
+		if !strings.Contains(converted.Body, want) {
+			t.Errorf("body lacks %s:\n%s", want, converted.Body)
+		}
+	}
+	if strings.Contains(converted.Body, "alert") {
+		t.Errorf("script kept:\n%s", converted.Body)
+	}
+	if problems := validateStorage(converted.Body); len(problems) != 0 {
+		t.Errorf("sanitized body is not valid: %v", problems)
+	}
+}
+
+func TestInvalidHTMLStopsPush(t *testing.T) {
+	markdown := strings.Join([]string{
+		"# Title",
+		"",
+		"Some <b>bold text",
+		"",
+		"<span>opened",
+		"",
+		"closed</span> and stray </em>",
+	}, "\n")
+
+	want := []string{
+		"line 3, column 6: <b> is never closed",
+		"line 7, column 7: </span> is in a different block from its <span>",
+		"line 7, column 25: </em> closes no open <em>",
+	}
+	if got := ConvertMarkdownFileToConfluence(markdown, "doc.md", "", nil).Errors; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("errors:\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	var lint []string
+	for _, issue := range lintMarkdown("doc.md", markdown) {
+		lint = append(lint, issue.String())
+	}
+	if !strings.Contains(strings.Join(lint, "\n"), "doc.md:3:6: <b> is never closed [invalid-html]") {
+		t.Errorf("lint: %v", lint)
+	}
+
+	server := newFlakyConfluence(t)
+	file := filepath.Join(t.TempDir(), "doc.md")
+	if err := os.WriteFile(file, []byte(markdown), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := updatePage(context.Background(), server.client(), UpdatePageParams{ID: "42", File: file}, nil)
+	if err == nil || !strings.Contains(err.Error(), "line 3, column 6: <b> is never closed") {
+		t.Errorf("got %v, want the invalid HTML reported", err)
+	}
+	if server.puts.Load() != 0 {
+		t.Error("page was updated despite invalid HTML")
+	}
+}
+
+func TestValidateStorage(t *testing.T) {
+	problems := validateStorage("<p>ok</p>\n<ac:structured-macro ac:name=\"code\"><ac:plain-text-body><![CDATA[x]]></ac:plain-text-body></ac:structured-macro>\n<p onclick=\"x()\"><blink>a</blink>\n")
+	want := []string{
+		"storage line 3, column 1: event handler onclick on <p>",
+		"storage line 3, column 18: <blink> is not allowed in storage format",
+		"storage line 4: element <p> is never closed",
+	}
+	if strings.Join(problems, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(problems, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestOfflineConvertSanitizes(t *testing.T) {
+	opts := ConvertOptions{From: FormatMarkdown, To: FormatStorage, File: "doc.md"}
+	got, err := convertDocument("Hi <script>alert(1)</script> there", opts)
+	if err != nil || got != "<p>Hi alert(1) there</p>\n" {
+		t.Errorf("got %q (%v), want the script tags removed", got, err)
+	}
+
+	_, err = convertDocument("Some <b>bold text", opts)
+	if err == nil || !strings.Contains(err.Error(), "line 1, column 6: <b> is never closed") {
+		t.Errorf("got %v, want the unclosed tag reported", err)
+	}
+	_, err = convertDocument("```confluence-storage\n<p onclick=\"x()\">hi</p>\n```", opts)
+	if err == nil || !strings.Contains(err.Error(), "onclick") {
+		t.Errorf("got %v, want the event handler in the verbatim storage reported", err)
+	}
+}
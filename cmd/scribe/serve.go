@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+// JSON-RPC 2.0 over newline-delimited JSON: every request, response and
+// notification is a single JSON document on its own line. One provider per
+// profile (and therefore one http.Client and connection pool) serves every
+// call.
+
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcCancelled      = -32800
+	// rpcQueued is a push that could not reach Confluence and was stored in
+	// the outbox instead; the error's data is the outbox entry
+	rpcQueued = -32001
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+type rpcHandler func(ctx context.Context, params json.RawMessage, progress ProgressFunc) (interface{}, error)
+
+// rpcMethod adapts an operation to the server's handler signature
+func rpcMethod[P any, R any](client ScribeProvider, op func(context.Context, ScribeProvider, P, ProgressFunc) (R, error)) rpcHandler {
+	return func(ctx context.Context, raw json.RawMessage, progress ProgressFunc) (interface{}, error) {
+		var params P
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &params); err != nil {
+				return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+			}
+		}
+		return op(ctx, client, params, progress)
+	}
+}
+
+type rpcServer struct {
+	methods map[string]rpcHandler
+
+	writeMu sync.Mutex
+	out     *json.Encoder
+
+	mu       sync.Mutex
+	inflight map[string]context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func newRPCServer(client ScribeProvider, out io.Writer) *rpcServer {
+	return &rpcServer{
+		methods: map[string]rpcHandler{
+			"spaces/list":  rpcMethod(client, listSpaces),
+			"page/search":  rpcMethod(client, searchPages),
+			"page/get":     rpcMethod(client, getPage),
+			"page/create":  rpcMethod(client, createPage),
+			"page/update":  rpcMethod(client, updatePage),
+			"outbox/list":  rpcMethod(client, listOutbox),
+			"outbox/flush": rpcMethod(client, flushOutbox),
+			"cache/clear":  rpcMethod(client, clearCache),
+			"cache/stats":  rpcMethod(client, cacheStats),
+			"convert":      rpcMethod(client, convertContent),
+			"lint":         rpcMethod(client, lintFile),
+			"profile/list": rpcMethod(client, profileList),
+		},
+		out:      json.NewEncoder(out),
+		inflight: make(map[string]context.CancelFunc),
+	}
+}
+
+func runServe(cmd *cobra.Command, args []string) error {
+	if !serveStdio {
+		return fmt.Errorf("only --stdio transport is supported")
+	}
+	client, err := NewScribeClient(profileName, ".")
+	if err != nil {
+		return err
+	}
+	server := newRPCServer(client, os.Stdout)
+	return server.serve(cmd.Context(), os.Stdin)
+}
+
+// serve reads requests until EOF or a "shutdown" request, then waits for
+// in-flight calls to finish
+func (s *rpcServer) serve(ctx context.Context, in io.Reader) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var req rpcRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			s.reply(nil, nil, &rpcError{Code: rpcParseError, Message: err.Error()})
+			continue
+		}
+		if req.Method == "shutdown" {
+			s.reply(req.ID, nil, nil)
+			break
+		}
+		s.dispatch(ctx, req)
+	}
+	s.wg.Wait()
+	return scanner.Err()
+}
+
+func (s *rpcServer) dispatch(ctx context.Context, req rpcRequest) {
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		s.reply(req.ID, nil, &rpcError{Code: rpcInvalidRequest, Message: "invalid JSON-RPC 2.0 request"})
+		return
+	}
+
+	if req.Method == "$/cancelRequest" {
+		var params struct {
+			ID json.RawMessage `json:"id"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err == nil {
+			s.cancel(params.ID)
+		}
+		return
+	}
+
+	handler, ok := s.methods[req.Method]
+	if !ok {
+		s.reply(req.ID, nil, &rpcError{Code: rpcMethodNotFound, Message: "method not found: " + req.Method})
+		return
+	}
+
+	callCtx, cancel := context.WithCancel(ctx)
+	key := string(req.ID)
+	if req.ID != nil {
+		s.mu.Lock()
+		_, busy := s.inflight[key]
+		if !busy {
+			s.inflight[key] = cancel
+		}
+		s.mu.Unlock()
+		// A second call under the same id would take over the first's cancel
+		if busy {
+			cancel()
+			s.reply(req.ID, nil, &rpcError{Code: rpcInvalidRequest, Message: "request id " + key + " is already in flight"})
+			return
+		}
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+
+		progress := func(message string) {
+			if req.ID != nil {
+				s.notify("$/progress", map[string]interface{}{"id": req.ID, "message": message})
+			}
+		}
+		result, err := handler(callCtx, req.Params, progress)
+		if req.ID == nil {
+			// Notifications never get a response
+			return
+		}
+		if errors.Is(callCtx.Err(), context.Canceled) && ctx.Err() == nil {
+			err = &rpcError{Code: rpcCancelled, Message: "request cancelled"}
+		}
+		// Free the id before answering, so the client may reuse it as soon
+		// as it has the response
+		s.mu.Lock()
+		delete(s.inflight, key)
+		s.mu.Unlock()
+		s.reply(req.ID, result, err)
+	}()
+}
+
+func (s *rpcServer) cancel(id json.RawMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cancel, ok := s.inflight[string(id)]; ok {
+		cancel()
+	}
+}
+
+func (s *rpcServer) reply(id json.RawMessage, result interface{}, err error) {
+	msg := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+	if id == nil {
+		msg["id"] = nil
+	}
+	var queued *QueuedError
+	if errors.As(err, &queued) && queued.Cause == nil {
+		// Queueing on purpose succeeds with the entry, as on the CLI
+		result, err = queued.Entry, nil
+	}
+	if err != nil {
+		msg["error"] = toRPCError(err)
+	} else {
+		msg["result"] = result
+	}
+	s.write(msg)
+}
+
+// toRPCError keeps an rpcError's code, reports a push queued in the outbox
+// with the entry as data, and anything else as an internal error
+func toRPCError(err error) *rpcError {
+	var rerr *rpcError
+	if errors.As(err, &rerr) {
+		return rerr
+	}
+	var queued *QueuedError
+	if errors.As(err, &queued) {
+		return &rpcError{Code: rpcQueued, Message: err.Error(), Data: queued.Entry}
+	}
+	return &rpcError{Code: rpcInternalError, Message: err.Error()}
+}
+
+func (s *rpcServer) notify(method string, params interface{}) {
+	s.write(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+func (s *rpcServer) write(msg interface{}) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.out.Encode(msg); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to write response: %v\n", err)
+	}
+}
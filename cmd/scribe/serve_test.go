@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rpcMessage is any line the server writes: a response or a notification
+type rpcMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+// rpcConn drives a server over pipes, the way an editor does over stdio
+type rpcConn struct {
+	t    *testing.T
+	in   *io.PipeWriter
+	out  *bufio.Scanner
+	done chan error
+}
+
+// startRPC serves a server for client, after setup has had a chance to
+// add methods of its own
+func startRPC(t *testing.T, client ScribeProvider, setup func(*rpcServer)) *rpcConn {
+	t.Helper()
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	server := newRPCServer(client, outW)
+	if setup != nil {
+		setup(server)
+	}
+	c := &rpcConn{t: t, in: inW, out: bufio.NewScanner(outR), done: make(chan error, 1)}
+	go func() {
+		c.done <- server.serve(context.Background(), inR)
+		outW.Close()
+	}()
+	t.Cleanup(func() {
+		inW.Close()
+		outR.Close()
+	})
+	return c
+}
+
+func (c *rpcConn) send(line string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.in, line+"\n"); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *rpcConn) recv() rpcMessage {
+	c.t.Helper()
+	if !c.out.Scan() {
+		c.t.Fatalf("server wrote nothing more (%v)", c.out.Err())
+	}
+	var msg rpcMessage
+	if err := json.Unmarshal(c.out.Bytes(), &msg); err != nil {
+		c.t.Fatalf("%s: %v", c.out.Bytes(), err)
+	}
+	return msg
+}
+
+// call sends a request and returns its response
+func (c *rpcConn) call(id int, method string, params interface{}) rpcMessage {
+	c.t.Helper()
+	raw, err := json.Marshal(params)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.send(fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":%q,"params":%s}`, id, method, raw))
+	msg := c.recv()
+	if string(msg.ID) != fmt.Sprint(id) {
+		c.t.Fatalf("got %s in answer to request %d", c.out.Bytes(), id)
+	}
+	return msg
+}
+
+func TestRPCErrorCodes(t *testing.T) {
+	c := startRPC(t, nil, nil)
+	for _, tt := range []struct {
+		line string
+		id   string
+		code int
+	}{
+		{`{"jsonrpc":"2.0","id":1,`, "null", rpcParseError},
+		{`{"jsonrpc":"1.0","id":2,"method":"page/search"}`, "2", rpcInvalidRequest},
+		{`{"jsonrpc":"2.0","id":3}`, "3", rpcInvalidRequest},
+		{`{"jsonrpc":"2.0","id":4,"method":"page/delete"}`, "4", rpcMethodNotFound},
+		{`{"jsonrpc":"2.0","id":5,"method":"page/search","params":{"space":5}}`, "5", rpcInvalidParams},
+		{`{"jsonrpc":"2.0","id":6,"method":"page/search","params":{}}`, "6", rpcInternalError},
+	} {
+		c.send(tt.line)
+		msg := c.recv()
+		if string(msg.ID) != tt.id || msg.Error == nil || msg.Error.Code != tt.code || msg.Result != nil {
+			t.Errorf("%s: got %s, want error %d for id %s", tt.line, c.out.Bytes(), tt.code, tt.id)
+		}
+	}
+}
+
+func TestRPCListSpaces(t *testing.T) {
+	client, _ := pagedServer(t, map[string]string{
+		"/rest/api/space?limit=2&start=0": `{"results":[{"key":"A"},{"key":"B"}],"start":0,"limit":2,"size":2}`,
+		"/rest/api/space?limit=2&start=2": `{"results":[{"key":"C"}],"start":2,"limit":2,"size":1}`,
+	})
+	c := startRPC(t, client, nil)
+
+	// Fetching every page reports progress after each full one
+	c.send(`{"jsonrpc":"2.0","id":1,"method":"spaces/list","params":{"limit":2,"all":true}}`)
+	msg := c.recv()
+	if msg.Method != "$/progress" || string(msg.Params) != `{"id":1,"message":"Fetched 2 spaces..."}` {
+		t.Errorf("got %s, want progress for 1", c.out.Bytes())
+	}
+	msg = c.recv()
+	var spaces []Space
+	if err := json.Unmarshal(msg.Result, &spaces); err != nil || len(spaces) != 3 || spaces[2].Key != "C" {
+		t.Errorf("spaces/list: %s", c.out.Bytes())
+	}
+}
+
+func TestRPCProgressAndCancel(t *testing.T) {
+	c := startRPC(t, nil, func(s *rpcServer) {
+		s.methods["test/wait"] = func(ctx context.Context, params json.RawMessage, progress ProgressFunc) (interface{}, error) {
+			progress("waiting")
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+	})
+
+	c.send(`{"jsonrpc":"2.0","id":"a","method":"test/wait"}`)
+	msg := c.recv()
+	if msg.Method != "$/progress" || string(msg.Params) != `{"id":"a","message":"waiting"}` {
+		t.Fatalf("got %s, want progress for a", c.out.Bytes())
+	}
+
+	// Cancelling an unknown request does nothing; the known one is answered
+	c.send(`{"jsonrpc":"2.0","method":"$/cancelRequest","params":{"id":"b"}}`)
+	c.send(`{"jsonrpc":"2.0","method":"$/cancelRequest","params":{"id":"a"}}`)
+	msg = c.recv()
+	if string(msg.ID) != `"a"` || msg.Error == nil || msg.Error.Code != rpcCancelled {
+		t.Errorf("got %s, want a cancelled", c.out.Bytes())
+	}
+}
+
+func TestRPCShutdownWaitsForCalls(t *testing.T) {
+	release := make(chan struct{})
+	c := startRPC(t, nil, func(s *rpcServer) {
+		s.methods["test/slow"] = func(ctx context.Context, params json.RawMessage, progress ProgressFunc) (interface{}, error) {
+			<-release
+			return "done", nil
+		}
+	})
+
+	c.send(`{"jsonrpc":"2.0","id":1,"method":"test/slow"}`)
+	c.send(`{"jsonrpc":"2.0","id":2,"method":"shutdown"}`)
+	msg := c.recv()
+	if string(msg.ID) != "2" || msg.Error != nil {
+		t.Fatalf("got %s, want the shutdown acknowledged", c.out.Bytes())
+	}
+	select {
+	case err := <-c.done:
+		t.Fatalf("server stopped (%v) with a call in flight", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	msg = c.recv()
+	if string(msg.ID) != "1" || string(msg.Result) != `"done"` {
+		t.Errorf("got %s, want the slow call answered", c.out.Bytes())
+	}
+	if err := <-c.done; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+}
+
+func TestRPCCacheMethods(t *testing.T) {
+	t.Setenv("SCRIBE_CACHE_DIR", t.TempDir())
+	c := startRPC(t, nil, nil)
+
+	// Notifications run without an answer; the next response is for id 1
+	c.send(`{"jsonrpc":"2.0","method":"cache/clear"}`)
+
+	var stats CacheStats
+	msg := c.call(1, "cache/stats", nil)
+	if err := json.Unmarshal(msg.Result, &stats); err != nil || stats.Dir != os.Getenv("SCRIBE_CACHE_DIR") {
+		t.Errorf("cache/stats: %s", c.out.Bytes())
+	}
+	msg = c.call(2, "cache/clear", nil)
+	if string(msg.Result) != `{"removed":0}` {
+		t.Errorf("cache/clear: %s", c.out.Bytes())
+	}
+}
+
+func TestRPCConvert(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	file := filepath.Join(t.TempDir(), "doc.md")
+	if err := os.WriteFile(file, []byte("# On disk\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c := startRPC(t, nil, nil)
+
+	var converted ConvertResult
+	msg := c.call(1, "convert", ConvertParams{Content: "# Title\n\n!!! tip\n    Hi\n"})
+	if err := json.Unmarshal(msg.Result, &converted); err != nil || !strings.Contains(converted.Content, `>Title</h1>`) || !strings.Contains(converted.Content, `ac:name="tip"`) {
+		t.Errorf("convert: %s", c.out.Bytes())
+	}
+	msg = c.call(2, "convert", ConvertParams{File: file, To: FormatWiki})
+	if err := json.Unmarshal(msg.Result, &converted); err != nil || converted.Content != "h1. On disk" {
+		t.Errorf("convert of the file on disk: %s", c.out.Bytes())
+	}
+}
+
+func TestRPCLint(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "doc.md")
+	if err := os.WriteFile(file, []byte("# On disk\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c := startRPC(t, nil, nil)
+
+	var issues []LintIssue
+	msg := c.call(1, "lint", LintParams{File: file, Content: "![](missing.png)\n"})
+	if err := json.Unmarshal(msg.Result, &issues); err != nil || len(issues) != 1 || issues[0].Rule != "missing-image" {
+		t.Errorf("lint of the unsaved content: %s", c.out.Bytes())
+	}
+	msg = c.call(2, "lint", LintParams{File: file})
+	if string(msg.Result) != "[]" {
+		t.Errorf("lint of the file on disk: %s", c.out.Bytes())
+	}
+	msg = c.call(3, "lint", LintParams{})
+	if msg.Error == nil || msg.Error.Message != "file is required" {
+		t.Errorf("lint without a file: %s", c.out.Bytes())
+	}
+}
+
+func TestRPCProfileList(t *testing.T) {
+	t.Setenv("SCRIBE_PROFILE", "")
+	writeConfigs(t, "profiles:\n  dc: {url: https://wiki.example.com, username: me}\n", "")
+	c := startRPC(t, nil, nil)
+
+	var profiles []ProfileInfo
+	msg := c.call(1, "profile/list", nil)
+	if err := json.Unmarshal(msg.Result, &profiles); err != nil || len(profiles) != 1 || profiles[0].Name != "dc" || profiles[0].URL != "https://wiki.example.com" {
+		t.Errorf("profile/list: %s", c.out.Bytes())
+	}
+}
+
+func TestRPCQueuedPushes(t *testing.T) {
+	entry := &OutboxEntry{ID: "e1", Op: "update", PageID: "42"}
+	c := startRPC(t, nil, func(s *rpcServer) {
+		s.methods["test/queue"] = func(ctx context.Context, params json.RawMessage, progress ProgressFunc) (interface{}, error) {
+			return nil, &QueuedError{Entry: entry}
+		}
+		s.methods["test/unreachable"] = func(ctx context.Context, params json.RawMessage, progress ProgressFunc) (interface{}, error) {
+			return nil, fmt.Errorf("update page: %w", &QueuedError{Entry: entry, Cause: errOffline})
+		}
+	})
+
+	// Queueing on purpose is a result, as the CLI prints it
+	var got OutboxEntry
+	msg := c.call(1, "test/queue", nil)
+	if err := json.Unmarshal(msg.Result, &got); err != nil || msg.Error != nil || got.ID != "e1" {
+		t.Errorf("explicit queue: %s", c.out.Bytes())
+	}
+
+	// A push queued because Confluence could not be reached carries its entry
+	msg = c.call(2, "test/unreachable", nil)
+	if msg.Error == nil || msg.Error.Code != rpcQueued || msg.Result != nil {
+		t.Fatalf("queued push: %s", c.out.Bytes())
+	}
+	data, _ := json.Marshal(msg.Error.Data)
+	if err := json.Unmarshal(data, &got); err != nil || got.ID != "e1" || got.PageID != "42" {
+		t.Errorf("queued push data: %s", c.out.Bytes())
+	}
+}
+
+func TestRPCRejectsDuplicateIDs(t *testing.T) {
+	release := make(chan struct{})
+	c := startRPC(t, nil, func(s *rpcServer) {
+		s.methods["test/wait"] = func(ctx context.Context, params json.RawMessage, progress ProgressFunc) (interface{}, error) {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-release:
+				return "done", nil
+			}
+		}
+	})
+
+	c.send(`{"jsonrpc":"2.0","id":1,"method":"test/wait"}`)
+	c.send(`{"jsonrpc":"2.0","id":1,"method":"test/wait"}`)
+	msg := c.recv()
+	if string(msg.ID) != "1" || msg.Error == nil || msg.Error.Code != rpcInvalidRequest {
+		t.Fatalf("got %s, want the second request 1 rejected", c.out.Bytes())
+	}
+
+	// The first call still owns the id, so cancelling it reaches that call
+	c.send(`{"jsonrpc":"2.0","method":"$/cancelRequest","params":{"id":1}}`)
+	msg = c.recv()
+	if string(msg.ID) != "1" || msg.Error == nil || msg.Error.Code != rpcCancelled {
+		t.Fatalf("got %s, want request 1 cancelled", c.out.Bytes())
+	}
+
+	// Once answered, the id can be used again
+	close(release)
+	if msg = c.call(1, "test/wait", nil); string(msg.Result) != `"done"` {
+		t.Errorf("got %s, want the reused id answered", c.out.Bytes())
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"strings"
+
+	htmltomarkdown "github.com/JohannesKaufmann/html-to-markdown"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/wmorley/scribe-cli/storage"
+	nethtml "golang.org/x/net/html"
+)
+
+// Tables come back as GFM tables when Markdown can say everything they hold:
+// one header row, no merged cells and only inline content in the cells.
+// Anything else (header columns, colspan/rowspan, lists or several
+// paragraphs in a cell, nested tables) is kept as an embedded HTML table in
+// storage format, which push sends back unchanged.
+
+// blockElements are the cell children that make a table too rich for GFM
+var blockElements = map[string]bool{
+	"p": true, "div": true, "ul": true, "ol": true, "pre": true, "blockquote": true, "table": true, "hr": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"ac:structured-macro": true, "ac:task-list": true, "ac:layout": true,
+}
+
+// Macros that sit inside text rather than standing as a block
+var inlineMacros = map[string]bool{"status": true}
+
+func isBlockElement(n *nethtml.Node) bool {
+	if n.Type != nethtml.ElementNode || !blockElements[n.Data] {
+		return false
+	}
+	if n.Data == "ac:structured-macro" {
+		for _, attr := range n.Attr {
+			if attr.Key == "ac:name" && inlineMacros[attr.Val] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// tableRows returns the rows of table, ignoring any nested tables
+func tableRows(table *goquery.Selection) *goquery.Selection {
+	return table.Find("tr").FilterFunction(func(_ int, row *goquery.Selection) bool {
+		return row.ParentsFiltered("table").First().IsSelection(table)
+	})
+}
+
+func isSimpleTable(table *goquery.Selection) bool {
+	if table.Find("table").Length() > 0 {
+		return false
+	}
+	rows := tableRows(table)
+	if rows.Length() == 0 {
+		return false
+	}
+	width := rows.First().ChildrenFiltered("th, td").Length()
+	simple := true
+	rows.EachWithBreak(func(i int, row *goquery.Selection) bool {
+		cells := row.ChildrenFiltered("th, td")
+		headers := row.ChildrenFiltered("th").Length()
+		if cells.Length() != width || (i == 0 && headers != width) || (i > 0 && headers != 0) {
+			simple = false
+			return false
+		}
+		cells.EachWithBreak(func(_ int, cell *goquery.Selection) bool {
+			if span := cell.AttrOr("colspan", "1"); span != "1" {
+				simple = false
+			}
+			if span := cell.AttrOr("rowspan", "1"); span != "1" {
+				simple = false
+			}
+			if !hasInlineContent(cell) {
+				simple = false
+			}
+			return simple
+		})
+		return simple
+	})
+	return simple
+}
+
+// hasInlineContent allows a cell at most one paragraph, which Confluence
+// wraps most cell text in, and nothing else block-level
+func hasInlineContent(cell *goquery.Selection) bool {
+	paragraphs := 0
+	for c := cell.Nodes[0].FirstChild; c != nil; c = c.NextSibling {
+		if !isBlockElement(c) {
+			continue
+		}
+		if c.Data != "p" {
+			return false
+		}
+		if paragraphs++; paragraphs > 1 {
+			return false
+		}
+		for p := c.FirstChild; p != nil; p = p.NextSibling {
+			if isBlockElement(p) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// cellAlignment reads text-align from the cell or the paragraph inside it
+func cellAlignment(cell *goquery.Selection) string {
+	for _, el := range []*goquery.Selection{cell, cell.ChildrenFiltered("p").First()} {
+		if align := el.AttrOr("align", ""); align != "" {
+			return align
+		}
+		for _, decl := range strings.Split(el.AttrOr("style", ""), ";") {
+			if prop, value, ok := strings.Cut(decl, ":"); ok && strings.TrimSpace(prop) == "text-align" {
+				return strings.TrimSpace(value)
+			}
+		}
+	}
+	return ""
+}
+
+// tableToMarkdown writes a simple table as GFM, preceded by a settings
+// comment when the table has attributes or column widths to keep
+func tableToMarkdown(converter *htmltomarkdown.Converter, table *goquery.Selection) string {
+	var b strings.Builder
+	b.WriteString("\n\n")
+	if settings := tableSettings(table); settings != "" {
+		b.WriteString(storage.TableSettingsComment(settings) + "\n")
+	}
+
+	tableRows(table).Each(func(i int, row *goquery.Selection) {
+		cells := row.ChildrenFiltered("th, td")
+		b.WriteString("|")
+		cells.Each(func(_ int, cell *goquery.Selection) {
+			b.WriteString(" " + cellMarkdown(converter, cell) + " |")
+		})
+		b.WriteString("\n")
+		if i > 0 {
+			return
+		}
+		b.WriteString("|")
+		cells.Each(func(_ int, cell *goquery.Selection) {
+			switch cellAlignment(cell) {
+			case "left":
+				b.WriteString(" :--- |")
+			case "center":
+				b.WriteString(" :---: |")
+			case "right":
+				b.WriteString(" ---: |")
+			default:
+				b.WriteString(" --- |")
+			}
+		})
+		b.WriteString("\n")
+	})
+	b.WriteString("\n")
+	return b.String()
+}
+
+// cellMarkdown converts a cell to a single line, keeping line breaks as <br />
+func cellMarkdown(converter *htmltomarkdown.Converter, cell *goquery.Selection) string {
+	md := strings.TrimSpace(converter.Convert(cell))
+	md = strings.ReplaceAll(md, "\n", " ")
+	var b strings.Builder
+	for i := 0; i < len(md); i++ {
+		if md[i] == '|' && (i == 0 || md[i-1] != '\\') {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(md[i])
+	}
+	return b.String()
+}
+
+// tableSettings returns the start tag and <colgroup> of a table that has
+// any attributes or column widths, or "" for a plain <table>
+func tableSettings(table *goquery.Selection) string {
+	node := table.Nodes[0]
+	colgroup := table.ChildrenFiltered("colgroup")
+	if len(node.Attr) == 0 && colgroup.Length() == 0 {
+		return ""
+	}
+	var b strings.Builder
+	writeStartTag(&b, node)
+	colgroup.Each(func(_ int, cg *goquery.Selection) {
+		writeStorageHTML(&b, cg.Nodes[0], false)
+	})
+	return strings.ReplaceAll(b.String(), "\n", "")
+}
+
+// tableToHTML keeps a table Markdown cannot express as storage XHTML. The
+// result has no blank lines, so Markdown reads it as a single HTML block.
+func tableToHTML(table *goquery.Selection) string {
+	var b strings.Builder
+	writeStorageHTML(&b, table.Nodes[0], false)
+	return strings.TrimSpace(b.String())
+}
+
+// Elements that start a new line in tableToHTML output
+var tableLayoutElements = map[string]bool{
+	"table": true, "colgroup": true, "thead": true, "tbody": true, "tfoot": true, "tr": true,
+}
+
+// writeStorageHTML serializes n back to storage XHTML: void elements
+// self-closed, preserved macros restored as placeholders, and newlines in
+// code escaped so none of them turns into a blank line
+func writeStorageHTML(b *strings.Builder, n *nethtml.Node, verbatim bool) {
+	switch n.Type {
+	case nethtml.TextNode:
+		if verbatim {
+			_ = xml.EscapeText(b, []byte(n.Data))
+			return
+		}
+		if strings.TrimSpace(n.Data) == "" {
+			if isInlineNode(n.PrevSibling) && isInlineNode(n.NextSibling) {
+				b.WriteString(" ")
+			}
+			return
+		}
+		text := strings.Join(strings.Fields(n.Data), " ")
+		if strings.TrimLeft(n.Data, " \t\r\n") != n.Data {
+			text = " " + text
+		}
+		if strings.TrimRight(n.Data, " \t\r\n") != n.Data {
+			text += " "
+		}
+		b.WriteString(nethtml.EscapeString(text))
+	case nethtml.CommentNode:
+		b.WriteString("<!--" + n.Data + "-->")
+	case nethtml.ElementNode:
+		if n.Data == "scribe-storage" {
+			for _, attr := range n.Attr {
+				if attr.Key == "data-raw" {
+					if raw, err := base64.StdEncoding.DecodeString(attr.Val); err == nil {
+						b.WriteString(storage.RawComment(string(raw)))
+					}
+				}
+			}
+			return
+		}
+		if tableLayoutElements[n.Data] {
+			b.WriteString("\n")
+		}
+		writeStartTag(b, n)
+		if htmlVoidElements[n.Data] {
+			return
+		}
+		verbatim = verbatim || n.Data == "ac:plain-text-body" || n.Data == "pre"
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			writeStorageHTML(b, c, verbatim)
+		}
+		if n.Data == "table" {
+			b.WriteString("\n")
+		}
+		b.WriteString("</" + n.Data + ">")
+	}
+}
+
+// Attributes the html-to-markdown hooks add for their own bookkeeping
+var converterAttributes = map[string]bool{"data-index": true, "data-converter-list-prefix": true}
+
+func writeStartTag(b *strings.Builder, n *nethtml.Node) {
+	b.WriteString("<" + n.Data)
+	for _, attr := range n.Attr {
+		if converterAttributes[attr.Key] {
+			continue
+		}
+		b.WriteString(" " + attr.Key + `="`)
+		_ = xml.EscapeText(b, []byte(attr.Val))
+		b.WriteString(`"`)
+	}
+	if htmlVoidElements[n.Data] {
+		b.WriteString(" />")
+	} else {
+		b.WriteString(">")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/wmorley/scribe-cli/storage"
+)
+
+// userDirectory resolves @mentions to users on push and user links to names
+// on pull. Lookups go through the provider (and so the on-disk cache) once
+// per name or ID per conversion. A nil directory, or one without a client,
+// only recognises account IDs and leaves other mentions as text.
+type userDirectory struct {
+	ctx      context.Context
+	client   ScribeProvider
+	byName   map[string]*User
+	byID     map[string]*User
+	Warnings []string
+}
+
+func newUserDirectory(ctx context.Context, client ScribeProvider) *userDirectory {
+	return &userDirectory{ctx: ctx, client: client, byName: map[string]*User{}, byID: map[string]*User{}}
+}
+
+// Resolve implements storage.UserResolver
+func (d *userDirectory) Resolve(name string) *storage.UserRef {
+	if d == nil || d.client == nil {
+		return storage.UserByAccountID(name)
+	}
+	guess := storage.GuessUser(name)
+	if guess.AccountID != "" {
+		return guess
+	}
+
+	user, ok := d.byName[name]
+	if !ok {
+		var err error
+		user, err = d.client.FindUser(d.ctx, name)
+		if err != nil {
+			d.Warnings = append(d.Warnings, fmt.Sprintf("could not look up @%s, pushed as a username: %v", name, err))
+			return guess
+		}
+		d.byName[name] = user
+		if user == nil {
+			d.Warnings = append(d.Warnings, fmt.Sprintf("no user matches @%s, left as text", name))
+		}
+	}
+	if user == nil {
+		return nil
+	}
+	return &storage.UserRef{AccountID: user.AccountID, UserKey: user.UserKey, Username: user.Username}
+}
+
+// Lookup returns the user with a Cloud account ID or Data Center user key,
+// or nil if it cannot be found
+func (d *userDirectory) Lookup(id string) *User {
+	if d == nil || d.client == nil {
+		return nil
+	}
+	user, ok := d.byID[id]
+	if !ok {
+		user, _ = d.client.GetUser(d.ctx, id)
+		d.byID[id] = user
+	}
+	return user
+}
+
+// mentionMarkdown writes the user link to a user as an @mention, with the
+// display name when the link identifies the user by ID
+func (d *userDirectory) mentionMarkdown(accountID, userKey, username string) string {
+	if username != "" {
+		return "@" + username
+	}
+	id := accountID + userKey
+	user := d.Lookup(id)
+	if user != nil && userKey != "" && user.Username != "" {
+		return "@" + user.Username
+	}
+	if user == nil || user.DisplayName == "" {
+		if userKey == "" {
+			return "@" + id
+		}
+		return "@[" + id + "](" + id + ")"
+	}
+	name := strings.NewReplacer("[", "\\[", "]", "\\]").Replace(user.DisplayName)
+	return "@[" + name + "](" + id + ")"
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// directoryClient answers user lookups from a fixed list and counts them
+type directoryClient struct {
+	ScribeProvider
+	users   []User
+	lookups int
+}
+
+func (c *directoryClient) FindUser(ctx context.Context, name string) (*User, error) {
+	c.lookups++
+	for i, user := range c.users {
+		if strings.EqualFold(user.PublicName, name) || user.Username == name {
+			return &c.users[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *directoryClient) GetUser(ctx context.Context, id string) (*User, error) {
+	c.lookups++
+	for i, user := range c.users {
+		if user.AccountID == id || user.UserKey == id {
+			return &c.users[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func TestMentionsResolveAndRoundTrip(t *testing.T) {
+	client := &directoryClient{users: []User{
+		{AccountID: "5b10ac8d82e05b22cc7d4ef5", PublicName: "alice", DisplayName: "Alice Smith"},
+	}}
+	users := newUserDirectory(context.Background(), client)
+
+	markdown := "Ping @alice and @bob, then @alice again on {date:2024-05-01}."
+	converted := ConvertMarkdownFileToConfluence(markdown, "doc.md", "", users)
+	if want := `<ac:link><ri:user ri:account-id="5b10ac8d82e05b22cc7d4ef5" /></ac:link>`; strings.Count(converted.Body, want) != 2 {
+		t.Errorf("@alice not resolved to her account ID:\n%s", converted.Body)
+	}
+	if !strings.Contains(converted.Body, "@bob") || len(converted.Warnings) != 1 {
+		t.Errorf("unknown @bob should stay text with one warning, got %v:\n%s", converted.Warnings, converted.Body)
+	}
+	if client.lookups != 2 {
+		t.Errorf("got %d lookups, want one per name", client.lookups)
+	}
+
+	page := &Page{}
+	page.Body.Storage.Value = converted.Body
+	pulled := ConvertConfluencePageToMarkdown(page, "", "", users)
+	want := "Ping @[Alice Smith](5b10ac8d82e05b22cc7d4ef5) and @bob, then @[Alice Smith](5b10ac8d82e05b22cc7d4ef5) again on {date:2024-05-01}."
+	if pulled != want {
+		t.Errorf("pulled\n%s\nwant\n%s", pulled, want)
+	}
+	if again := ConvertMarkdownFileToConfluence(pulled, "doc.md", "", users); again.Body != converted.Body {
+		t.Errorf("pulled mentions push differently:\n%s\n%s", again.Body, converted.Body)
+	}
+}
+
+func TestDataCenterMentions(t *testing.T) {
+	client := &directoryClient{users: []User{
+		{UserKey: "8a7f808a5e1b2c3d", Username: "jdoe", DisplayName: "Jane Doe"},
+	}}
+	users := newUserDirectory(context.Background(), client)
+
+	converted := ConvertMarkdownFileToConfluence("Ask @jdoe.", "doc.md", "", users)
+	if !strings.Contains(converted.Body, `<ri:user ri:userkey="8a7f808a5e1b2c3d" />`) {
+		t.Errorf("@jdoe not resolved to a user key:\n%s", converted.Body)
+	}
+	page := &Page{}
+	page.Body.Storage.Value = converted.Body
+	if pulled := ConvertConfluencePageToMarkdown(page, "", "", users); pulled != "Ask @jdoe." {
+		t.Errorf("got %q, want the username back", pulled)
+	}
+}
+
+func TestMentionsNeedAUser(t *testing.T) {
+	markdown := "Use @Override, install @types/node and ping @5b10ac8d82e05b22cc7d4ef5."
+	offline := ConvertMarkdownFileToConfluence(markdown, "doc.md", "", nil)
+	if strings.Count(offline.Body, "<ri:user") != 1 || !strings.Contains(offline.Body, "@Override") || !strings.Contains(offline.Body, "@types/node") {
+		t.Errorf("only the account ID should be a user link without a directory:\n%s", offline.Body)
+	}
+
+	client := &directoryClient{users: []User{{UserKey: "8a7f808a5e1b2c3d", Username: "types"}}}
+	converted := ConvertMarkdownFileToConfluence("Install @types/node.", "doc.md", "", newUserDirectory(context.Background(), client))
+	if client.lookups != 0 || strings.Contains(converted.Body, "<ri:user") {
+		t.Errorf("a package path is not a mention (%d lookups):\n%s", client.lookups, converted.Body)
+	}
+}
+
+func TestFindUserNeedsAnExactName(t *testing.T) {
+	var results string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"results":[%s]}`, results)
+	}))
+	defer server.Close()
+	client := &ConfluenceClient{BaseURL: server.URL, Client: server.Client()}
+
+	for _, tt := range []struct {
+		results string
+		want    string
+	}{
+		{`{"user":{"accountId":"1","displayName":"Alice Smith","publicName":"asmith"}}`, ""},
+		{`{"user":{"accountId":"1","displayName":"Alice","email":"al@example.com"}}`, "1"},
+		{`{"user":{"accountId":"1","displayName":"Al Jones","email":"alice@example.com"}}`, "1"},
+		{`{"user":{"accountId":"1","displayName":"Alice"}},{"user":{"accountId":"2","publicName":"alice"}}`, ""},
+	} {
+		results = tt.results
+		user, err := client.FindUser(context.Background(), "alice")
+		got := ""
+		if user != nil {
+			got = user.AccountID
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %q (%v), want %q", tt.results, got, err, tt.want)
+		}
+	}
+}
+
+func TestChalkFindUserOnlyIgnoresNotFound(t *testing.T) {
+	var status int
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		fmt.Fprint(w, `{"userKey":"k1","username":"alice"}`)
+	}))
+	defer server.Close()
+	client := &ChalkClient{BaseURL: server.URL, Client: server.Client()}
+
+	status = http.StatusOK
+	if user, err := client.FindUser(context.Background(), "alice"); err != nil || user == nil || user.UserKey != "k1" {
+		t.Errorf("got %+v (%v), want alice", user, err)
+	}
+	status = http.StatusNotFound
+	if user, err := client.FindUser(context.Background(), "nobody"); err != nil || user != nil {
+		t.Errorf("404: got %+v (%v), want no user and no error", user, err)
+	}
+	// Anything else is a failed lookup, not a missing user
+	for _, status = range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusInternalServerError} {
+		if user, err := client.FindUser(context.Background(), "alice"); err == nil || user != nil {
+			t.Errorf("%d: got %+v (%v), want an error", status, user, err)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/wmorley/scribe-cli/wiki"
+	nethtml "golang.org/x/net/html"
+)
+
+// The --format of the files pages are pushed from and pulled to
+const (
+	FormatMarkdown = "markdown"
+	FormatWiki     = "wiki"
+)
+
+// ConvertWikiToConfluence converts a wiki markup file to storage format
+func ConvertWikiToConfluence(markup string) string {
+	content := stripFrontmatter(markup)
+	var buf bytes.Buffer
+	if err := wiki.Convert([]byte(content), &buf); err != nil {
+		return content
+	}
+	return buf.String()
+}
+
+// ConvertConfluenceToWiki writes a storage format page as wiki markup.
+// Every macro is written in its `{name:param=value}` form.
+func ConvertConfluenceToWiki(confluence string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(normalizeStorageFor(confluence, func(string) bool { return true })))
+	if err != nil {
+		return confluence
+	}
+	return strings.TrimSpace(wikiBlocks(doc.Find("body")))
+}
+
+// wikiBlockElements are written as blocks; anything else is inline
+var wikiBlockElements = map[string]bool{
+	"p": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"ul": true, "ol": true, "table": true, "blockquote": true, "hr": true, "pre": true, "div": true,
+	"ac:task-list": true, "ac:layout": true, "ac:layout-section": true, "ac:layout-cell": true,
+}
+
+// isWikiBlockMacro reports whether macro is written as a block, with any
+// body closed by `{name}`
+func isWikiBlockMacro(macro *goquery.Selection) bool {
+	switch macro.AttrOr("ac:name", "") {
+	case "status", "anchor":
+		return false
+	}
+	return isBlockContext(macro.Parent()) || macro.ChildrenFiltered("ac\\:rich-text-body, ac\\:plain-text-body").Length() > 0
+}
+
+// wikiBlockStart matches paragraph text that wiki markup would read as a
+// list, heading, quote or table
+var wikiBlockStart = regexp.MustCompile(`^(?:[*#-]+\s|h[1-6]\.|bq\.|\|)`)
+
+// wikiBlocks writes the children of sel, separating blocks by a blank line
+// and gathering runs of inline nodes into paragraphs
+func wikiBlocks(sel *goquery.Selection) string {
+	var blocks []string
+	var inline strings.Builder
+	endParagraph := func() {
+		if text := strings.TrimSpace(inline.String()); text != "" {
+			blocks = append(blocks, wikiParagraph(text))
+		}
+		inline.Reset()
+	}
+	sel.Contents().Each(func(_ int, node *goquery.Selection) {
+		name := goquery.NodeName(node)
+		if !wikiBlockElements[name] && !(name == "ac:structured-macro" && isWikiBlockMacro(node)) {
+			inline.WriteString(wikiInline(node))
+			return
+		}
+		endParagraph()
+		if block := strings.TrimSpace(wikiBlock(node)); block != "" {
+			blocks = append(blocks, block)
+		}
+	})
+	endParagraph()
+	return strings.Join(blocks, "\n\n")
+}
+
+// wikiParagraph escapes the start of paragraph text wiki markup would read
+// as another block
+func wikiParagraph(text string) string {
+	if wikiBlockStart.MatchString(text) {
+		return `\` + text
+	}
+	return text
+}
+
+func wikiBlock(node *goquery.Selection) string {
+	name := goquery.NodeName(node)
+	switch name {
+	case "p":
+		return wikiParagraph(wikiInlines(node))
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		return name + ". " + wikiInlines(node)
+	case "ul", "ol":
+		return wikiList(node, "")
+	case "table":
+		return wikiTable(node)
+	case "blockquote":
+		return "{quote}\n" + wikiBlocks(node) + "\n{quote}"
+	case "hr":
+		return "----"
+	case "pre":
+		return "{noformat}\n" + node.Text() + "\n{noformat}"
+	case "ac:task-list":
+		var lines []string
+		node.ChildrenFiltered("ac\\:task").Each(func(_ int, task *goquery.Selection) {
+			box := ""
+			if strings.TrimSpace(task.ChildrenFiltered("ac\\:task-status").Text()) == "complete" {
+				box = "(/) "
+			}
+			lines = append(lines, "* "+box+wikiInlines(task.ChildrenFiltered("ac\\:task-body")))
+		})
+		return strings.Join(lines, "\n")
+	case "ac:structured-macro":
+		return wikiMacro(node)
+	}
+	return wikiBlocks(node)
+}
+
+// wikiMacro writes a macro as `{name:params}`, followed by its body and a
+// closing `{name}` when it has one. Code takes its language as the first,
+// unnamed parameter.
+func wikiMacro(macro *goquery.Selection) string {
+	name := macro.AttrOr("ac:name", "")
+	var params []string
+	macro.ChildrenFiltered("ac\\:parameter").Each(func(_ int, param *goquery.Selection) {
+		key, value := param.AttrOr("ac:name", ""), wikiParamValue(param)
+		switch {
+		case value == "":
+		case name == "code" && key == "language", name == "expand" && key == "title", key == "":
+			params = append([]string{value}, params...)
+		default:
+			params = append(params, key+"="+value)
+		}
+	})
+	open := "{" + name
+	if len(params) > 0 {
+		open += ":" + strings.Join(params, "|")
+	}
+	open += "}"
+
+	if body := macro.ChildrenFiltered("ac\\:plain-text-body"); body.Length() > 0 {
+		return open + "\n" + body.Text() + "\n{" + name + "}"
+	}
+	if body := macro.ChildrenFiltered("ac\\:rich-text-body"); body.Length() > 0 {
+		return open + "\n" + wikiBlocks(body) + "\n{" + name + "}"
+	}
+	return open
+}
+
+// wikiParamValue is the text of a macro parameter, or the page or user it
+// refers to
+func wikiParamValue(param *goquery.Selection) string {
+	if page := param.ChildrenFiltered("ri\\:page"); page.Length() > 0 {
+		title := page.AttrOr("ri:content-title", "")
+		if space := page.AttrOr("ri:space-key", ""); space != "" {
+			return space + ":" + title
+		}
+		return title
+	}
+	if user := param.ChildrenFiltered("ri\\:user"); user.Length() > 0 {
+		return user.AttrOr("ri:account-id", user.AttrOr("ri:username", ""))
+	}
+	return strings.TrimSpace(param.Text())
+}
+
+// wikiList writes a list, prefixing each item's marker with those of the
+// lists it is nested in
+func wikiList(list *goquery.Selection, prefix string) string {
+	marker := "*"
+	if goquery.NodeName(list) == "ol" {
+		marker = "#"
+	}
+	var lines []string
+	list.ChildrenFiltered("li").Each(func(_ int, item *goquery.Selection) {
+		var text strings.Builder
+		var nested []string
+		item.Contents().Each(func(_ int, node *goquery.Selection) {
+			switch goquery.NodeName(node) {
+			case "ul", "ol":
+				nested = append(nested, wikiList(node, prefix+marker))
+			case "p":
+				text.WriteString(" " + wikiInlines(node))
+			default:
+				text.WriteString(wikiInline(node))
+			}
+		})
+		lines = append(lines, prefix+marker+" "+strings.TrimSpace(text.String()))
+		lines = append(lines, nested...)
+	})
+	return strings.Join(lines, "\n")
+}
+
+// wikiTable writes `||heading||` and `|cell|` rows
+func wikiTable(table *goquery.Selection) string {
+	var rows []string
+	table.Find("tr").Each(func(_ int, tr *goquery.Selection) {
+		var row strings.Builder
+		last := "|"
+		tr.ChildrenFiltered("th, td").Each(func(_ int, cell *goquery.Selection) {
+			last = "|"
+			if goquery.NodeName(cell) == "th" {
+				last = "||"
+			}
+			// A cell is a single line, so its paragraphs and lines break with \\
+			text := strings.Join(strings.Fields(lineBreaks.ReplaceAllString(wikiBlocks(cell), ` \\ `)), " ")
+			if text == "" {
+				text = " "
+			}
+			row.WriteString(last + text)
+		})
+		rows = append(rows, row.String()+last)
+	})
+	return strings.Join(rows, "\n")
+}
+
+func wikiInlines(sel *goquery.Selection) string {
+	var b strings.Builder
+	sel.Contents().Each(func(_ int, node *goquery.Selection) {
+		b.WriteString(wikiInline(node))
+	})
+	return strings.TrimSpace(b.String())
+}
+
+var (
+	whitespace = regexp.MustCompile(`\s+`)
+	lineBreaks = regexp.MustCompile(`(?:\s*\\\\)?\n+`)
+)
+
+// wikiEffects are the HTML elements wiki markup writes as text effects
+var wikiEffects = map[string]string{
+	"strong": "*", "b": "*", "em": "_", "i": "_", "del": "-", "s": "-",
+	"u": "+", "sup": "^", "sub": "~", "cite": "??",
+}
+
+func wikiInline(node *goquery.Selection) string {
+	name := goquery.NodeName(node)
+	if name == "#text" {
+		text := whitespace.ReplaceAllString(node.Text(), " ")
+		if prev := node.Nodes[0].PrevSibling; prev != nil && prev.Data == "br" {
+			text = strings.TrimLeft(text, " ")
+		}
+		return escapeWiki(text)
+	}
+	if node.Nodes[0].Type != nethtml.ElementNode {
+		return ""
+	}
+	if marker, ok := wikiEffects[name]; ok {
+		text := wikiInlines(node)
+		if text == "" {
+			return ""
+		}
+		return marker + text + marker
+	}
+	switch name {
+	case "br":
+		return "\\\\\n"
+	case "code":
+		return "{{" + node.Text() + "}}"
+	case "a":
+		return wikiLink(wikiInlines(node), node.AttrOr("href", ""))
+	case "time":
+		return node.AttrOr("datetime", "")
+	case "ac:link":
+		return wikiPageLink(node)
+	case "ac:image":
+		return wikiImage(node)
+	case "ac:structured-macro":
+		return wikiMacro(node)
+	}
+	return wikiInlines(node)
+}
+
+func wikiLink(label, target string) string {
+	if label == "" || label == escapeWiki(target) {
+		return "[" + target + "]"
+	}
+	return "[" + label + "|" + target + "]"
+}
+
+// wikiPageLink writes links to pages, anchors, users and attachments
+func wikiPageLink(link *goquery.Selection) string {
+	label := wikiInlines(link.ChildrenFiltered("ac\\:link-body"))
+	if label == "" {
+		label = escapeWiki(strings.TrimSpace(link.ChildrenFiltered("ac\\:plain-text-link-body").Text()))
+	}
+	if user := link.ChildrenFiltered("ri\\:user"); user.Length() > 0 {
+		if id := user.AttrOr("ri:account-id", ""); id != "" {
+			return "[~accountid:" + id + "]"
+		}
+		return "[~" + user.AttrOr("ri:username", user.AttrOr("ri:userkey", "")) + "]"
+	}
+	if attachment := link.ChildrenFiltered("ri\\:attachment"); attachment.Length() > 0 {
+		return wikiLink(label, "^"+attachment.AttrOr("ri:filename", ""))
+	}
+	target := ""
+	if page := link.ChildrenFiltered("ri\\:page"); page.Length() > 0 {
+		target = page.AttrOr("ri:content-title", "")
+		if space := page.AttrOr("ri:space-key", ""); space != "" {
+			target = space + ":" + target
+		}
+	}
+	if anchor := link.AttrOr("ac:anchor", ""); anchor != "" {
+		target += "#" + anchor
+	}
+	if target == "" {
+		return label
+	}
+	return wikiLink(label, target)
+}
+
+func wikiImage(image *goquery.Selection) string {
+	src := image.Find("ri\\:url").AttrOr("ri:value", "")
+	if filename := image.Find("ri\\:attachment").AttrOr("ri:filename", ""); filename != "" {
+		src = filename
+	}
+	if src == "" {
+		return ""
+	}
+	if alt := image.AttrOr("ac:alt", ""); alt != "" && !strings.ContainsAny(alt, ",|!") {
+		src += "|alt=" + alt
+	}
+	return "!" + src + "!"
+}
+
+// escapeWiki escapes the characters wiki markup would read as markup: the
+// brackets and bars of links, macros and tables always, and text effect
+// markers where they could open or close one
+func escapeWiki(text string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch c {
+		case '\\', '[', ']', '{', '}', '|', '!':
+			b.WriteByte('\\')
+		case '*', '_', '-', '+', '^', '~', '?':
+			before := i == 0 || !isWikiWordByte(text[i-1])
+			after := i+1 == len(text) || !isWikiWordByte(text[i+1])
+			if before != after {
+				b.WriteByte('\\')
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func isWikiWordByte(c byte) bool {
+	return c >= 0x80 || c == '_' || ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestWikiToStorage(t *testing.T) {
+	markup := strings.Join([]string{
+		"h2. Setup",
+		"",
+		"Use *bold*, _em_, -gone-, +under+, {{code}} and a [link|https://example.com].",
+		"Second line\\\\third line",
+		"",
+		"* one",
+		"*# nested",
+		"",
+		"||Name||Port||",
+		"|api|8080|",
+		"",
+		"{code:go}",
+		"x := a[1] * 2",
+		"{code}",
+		"",
+		"{warning:title=Careful}",
+		"Back it *up*.",
+		"{warning}",
+		"",
+		"See [Ops:Runbook#Restart], [~jdoe] and {status:colour=Green|title=Done}.",
+	}, "\n")
+
+	got := ConvertWikiToConfluence(markup)
+	for _, want := range []string{
+		"<h2>Setup</h2>",
+		"<strong>bold</strong>, <em>em</em>, <del>gone</del>, <u>under</u>, <code>code</code>",
+		`<a href="https://example.com">link</a>`,
+		"Second line<br />\nthird line",
+		"<li>one\n<ol>\n<li>nested</li>",
+		"<th>Name</th>",
+		"<td>8080</td>",
+		`<ac:parameter ac:name="language">go</ac:parameter><ac:plain-text-body><![CDATA[x := a[1] * 2]]>`,
+		`<ac:structured-macro ac:name="warning"><ac:parameter ac:name="title">Careful</ac:parameter><ac:rich-text-body>`,
+		`<ac:link ac:anchor="Restart"><ri:page ri:content-title="Runbook" ri:space-key="Ops" /></ac:link>`,
+		`<ri:user ri:username="jdoe" />`,
+		`<ac:parameter ac:name="colour">Green</ac:parameter><ac:parameter ac:name="title">Done</ac:parameter>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("storage lacks %s:\n%s", want, got)
+		}
+	}
+}
+
+func TestWikiRoundTrip(t *testing.T) {
+	for _, markup := range []string{
+		"h1. Title\n\nSome *bold* and _em_ text with {{code}}.",
+		"* one\n** two\n*# three\n* four",
+		"||a||b||\n|1|2|",
+		"{code:python}\nprint(1)\n{code}",
+		"{code:java|title=Main \"app\"|linenumbers=true}\nclass A {}\n{code}",
+		"{code:title=Notes}\nplain\n{code}",
+		"{info:title=Note}\nBe *careful*.\n{info}",
+		"{expand:Details}\nHidden.\n{expand}",
+		"{toc}",
+		"----",
+		"[Docs|https://example.com] and [SPACE:Page#Anchor] and [~jdoe]",
+		"{anchor:top}Text with \\[brackets\\] and a\\\\\nbreak",
+		"Status {status:colour=Red|title=Blocked}",
+		"!diagram.png|alt=Flow!",
+		"\\* not a list",
+	} {
+		if got := ConvertConfluenceToWiki(ConvertWikiToConfluence(markup)); got != markup {
+			t.Errorf("round trip of\n%s\ngave\n%s", markup, got)
+		}
+	}
+}
+
+func TestStorageToWikiKeepsMacros(t *testing.T) {
+	for name, doc := range storageCorpus(t) {
+		got := ConvertConfluenceToWiki(doc)
+		if got == "" || strings.Contains(got, "<ac:") || strings.Contains(got, "scribe-storage") {
+			t.Errorf("%s: wiki markup holds storage:\n%s", name, got)
+		}
+	}
+	got := ConvertConfluenceToWiki(storageCorpus(t)["include-page.xml"])
+	if !strings.Contains(got, "{children}") {
+		t.Errorf("children macro lost:\n%s", got)
+	}
+}
+
+func TestWikiFormatNeedsStorage(t *testing.T) {
+	if err := checkFormat(&ConfluenceV2Client{}, FormatWiki); err == nil {
+		t.Error("wiki markup accepted by an ADF provider")
+	}
+	if err := checkFormat(&ConfluenceClient{}, FormatWiki); err != nil {
+		t.Errorf("wiki markup rejected by a storage provider: %v", err)
+	}
+	if err := checkFormat(&ConfluenceClient{}, "rst"); err == nil {
+		t.Error("unknown format accepted")
+	}
+	if _, err := getPage(context.Background(), &ConfluenceClient{}, GetPageParams{ID: "1", Format: "rst"}, nil); err == nil {
+		t.Error("get accepted an unknown format")
+	}
+}
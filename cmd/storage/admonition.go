@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// AdmonitionMacros maps GitHub alert and MkDocs admonition types to the
+// Confluence macro that renders them. Unknown types become a panel.
+var AdmonitionMacros = map[string]string{
+	"note":      "info",
+	"info":      "info",
+	"abstract":  "info",
+	"summary":   "info",
+	"question":  "info",
+	"tip":       "tip",
+	"hint":      "tip",
+	"success":   "tip",
+	"important": "note",
+	"attention": "note",
+	"example":   "note",
+	"warning":   "warning",
+	"caution":   "warning",
+	"danger":    "warning",
+	"error":     "warning",
+	"failure":   "warning",
+	"bug":       "warning",
+	"panel":     "panel",
+}
+
+// AdmonitionTypes is the reverse of AdmonitionMacros, used when pulling pages
+var AdmonitionTypes = map[string]string{
+	"info":    "note",
+	"tip":     "tip",
+	"note":    "important",
+	"warning": "warning",
+	"panel":   "panel",
+}
+
+// KindAdmonition is the NodeKind of Admonition
+var KindAdmonition = ast.NewNodeKind("Admonition")
+
+// Admonition is a callout block rendered as an info/note/warning/tip/panel macro
+type Admonition struct {
+	ast.BaseBlock
+	Macro string
+	Title string
+}
+
+// Kind implements ast.Node
+func (n *Admonition) Kind() ast.NodeKind {
+	return KindAdmonition
+}
+
+// Dump implements ast.Node
+func (n *Admonition) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Macro": n.Macro, "Title": n.Title}, nil)
+}
+
+func newAdmonition(kind, title string) *Admonition {
+	macro, ok := AdmonitionMacros[strings.ToLower(kind)]
+	if !ok {
+		macro = "panel"
+	}
+	return &Admonition{Macro: macro, Title: title}
+}
+
+// Admonitions turns `> [!NOTE]` alerts and `!!! tip "Title"` blocks into Confluence macros
+var Admonitions goldmark.Extender = &admonitions{}
+
+type admonitions struct{}
+
+func (e *admonitions) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithBlockParsers(util.Prioritized(&mkdocsAdmonitionParser{}, 150)),
+		parser.WithASTTransformers(util.Prioritized(&githubAlertTransformer{}, 100)),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(&admonitionRenderer{}, 100),
+	))
+}
+
+var mkdocsAdmonitionPattern = regexp.MustCompile(`^!!!\s+([A-Za-z][\w-]*)(?:\s+"([^"]*)")?\s*$`)
+
+// mkdocsAdmonitionParser parses `!!! type "Title"` followed by a body indented four spaces
+type mkdocsAdmonitionParser struct{}
+
+func (p *mkdocsAdmonitionParser) Trigger() []byte {
+	return []byte{'!'}
+}
+
+func (p *mkdocsAdmonitionParser) Open(parent ast.Node, reader text.Reader, pc parser.Context) (ast.Node, parser.State) {
+	line, _ := reader.PeekLine()
+	m := mkdocsAdmonitionPattern.FindSubmatch(util.TrimRightSpace(line))
+	if m == nil {
+		return nil, parser.NoChildren
+	}
+	reader.AdvanceToEOL()
+	return newAdmonition(string(m[1]), string(m[2])), parser.NoChildren
+}
+
+func (p *mkdocsAdmonitionParser) Continue(node ast.Node, reader text.Reader, pc parser.Context) parser.State {
+	line, _ := reader.PeekLine()
+	if util.IsBlank(line) {
+		reader.AdvanceToEOL()
+		return parser.Continue | parser.HasChildren
+	}
+	indent, _ := util.IndentWidth(line, reader.LineOffset())
+	if indent < 4 {
+		return parser.Close
+	}
+	pos, padding := util.IndentPosition(line, reader.LineOffset(), 4)
+	reader.AdvanceAndSetPadding(pos, padding)
+	return parser.Continue | parser.HasChildren
+}
+
+func (p *mkdocsAdmonitionParser) Close(node ast.Node, reader text.Reader, pc parser.Context) {}
+
+func (p *mkdocsAdmonitionParser) CanInterruptParagraph() bool {
+	return true
+}
+
+func (p *mkdocsAdmonitionParser) CanAcceptIndentedLine() bool {
+	return false
+}
+
+var githubAlertPattern = regexp.MustCompile(`^\s*\[!([A-Za-z]+)\]\s*$`)
+
+// githubAlertTransformer replaces blockquotes that open with a `[!TYPE]` line
+type githubAlertTransformer struct{}
+
+func (t *githubAlertTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	var quotes []*ast.Blockquote
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if q, ok := n.(*ast.Blockquote); ok && entering {
+			quotes = append(quotes, q)
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, quote := range quotes {
+		para, ok := quote.FirstChild().(*ast.Paragraph)
+		if !ok || para.Lines().Len() == 0 {
+			continue
+		}
+		first := para.Lines().At(0)
+		m := githubAlertPattern.FindSubmatch(first.Value(source))
+		if m == nil {
+			continue
+		}
+
+		// Drop the marker line's inlines; the rest of the paragraph is the body
+		for c := para.FirstChild(); c != nil; {
+			next := c.NextSibling()
+			if t, ok := c.(*ast.Text); ok && t.Segment.Stop <= first.Stop {
+				para.RemoveChild(para, c)
+				c = next
+				continue
+			}
+			break
+		}
+		if para.ChildCount() == 0 {
+			quote.RemoveChild(quote, para)
+		} else {
+			para.Lines().SetSliced(1, para.Lines().Len())
+		}
+
+		admonition := newAdmonition(string(m[1]), "")
+		for c := quote.FirstChild(); c != nil; {
+			next := c.NextSibling()
+			admonition.AppendChild(admonition, c)
+			c = next
+		}
+		quote.Parent().ReplaceChild(quote.Parent(), quote, admonition)
+	}
+}
+
+type admonitionRenderer struct{}
+
+func (r *admonitionRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindAdmonition, r.renderAdmonition)
+}
+
+func (r *admonitionRenderer) renderAdmonition(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	n := node.(*Admonition)
+	if !entering {
+		_, _ = w.WriteString("</ac:rich-text-body></ac:structured-macro>\n")
+		return ast.WalkContinue, nil
+	}
+	_, _ = w.WriteString(`<ac:structured-macro ac:name="`)
+	_, _ = w.WriteString(n.Macro)
+	_, _ = w.WriteString(`">`)
+	if n.Title != "" {
+		writeParameter(w, "title", n.Title)
+	}
+	_, _ = w.WriteString("<ac:rich-text-body>\n")
+	return ast.WalkContinue, nil
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/util"
+)
+
+// CodeLanguages are the brushes the code macro highlights on Data Center.
+// Other language parameters show as plain text, or fail validation.
+var CodeLanguages = map[string]bool{
+	"actionscript3": true, "applescript": true, "bash": true, "c#": true, "coldfusion": true,
+	"cpp": true, "css": true, "delphi": true, "diff": true, "erl": true, "groovy": true,
+	"java": true, "javafx": true, "js": true, "perl": true, "php": true, "powershell": true,
+	"py": true, "ruby": true, "sass": true, "scala": true, "sql": true, "text": true, "vb": true,
+	"xml": true, "yml": true,
+}
+
+// DefaultCodeAliases map common fence languages to the brush the code
+// macro knows them by. Every alias names one of CodeLanguages.
+var DefaultCodeAliases = map[string]string{
+	"sh": "bash", "shell": "bash", "zsh": "bash", "console": "bash", "rb": "ruby", "yaml": "yml",
+	"javascript": "js", "jsx": "js", "ts": "js", "typescript": "js", "tsx": "js", "node": "js", "json": "js",
+	"python": "py", "python3": "py", "html": "xml", "xhtml": "xml", "svg": "xml", "xslt": "xml",
+	"c": "cpp", "c++": "cpp", "cc": "cpp", "h": "cpp", "hpp": "cpp", "csharp": "c#", "cs": "c#",
+	"ps1": "powershell", "pwsh": "powershell", "ps": "powershell", "erlang": "erl", "pl": "perl",
+	"scss": "sass", "as3": "actionscript3", "actionscript": "actionscript3", "cf": "coldfusion",
+	"pascal": "delphi", "patch": "diff", "jfx": "javafx", "vbnet": "vb",
+	"plain": "text", "plaintext": "text", "txt": "text", "none": "text",
+}
+
+// CodeParameters are the code macro parameters a fence info string can
+// set besides the language. Other words are dropped on push.
+var CodeParameters = map[string]bool{
+	"title": true, "linenumbers": true, "firstline": true, "collapse": true, "theme": true,
+}
+
+// ResolveCodeLanguage is the code macro language for a fence language:
+// lower-cased, without a `language-` prefix and mapped through aliases
+func ResolveCodeLanguage(language string, aliases map[string]string) string {
+	language = strings.TrimPrefix(strings.ToLower(language), "language-")
+	if alias, ok := aliases[language]; ok {
+		return alias
+	}
+	return language
+}
+
+// ParseCodeInfo splits a fence info string such as
+// `go title="main.go" linenumbers` into its language and the code macro
+// parameters that follow it. A bare word is a parameter set to true; a
+// first word with `=` is a parameter, leaving the language empty.
+func ParseCodeInfo(info string) (string, []MacroParam) {
+	words := splitInfo(info)
+	if len(words) == 0 {
+		return "", nil
+	}
+	language := words[0]
+	if strings.Contains(language, "=") {
+		// Parameters without a language
+		language, words = "", append([]string{""}, words...)
+	}
+	var params []MacroParam
+	for _, word := range words[1:] {
+		name, value, ok := strings.Cut(word, "=")
+		if !ok {
+			value = "true"
+		}
+		if name != "" {
+			params = append(params, MacroParam{Name: name, Value: value})
+		}
+	}
+	return language, params
+}
+
+// splitInfo splits s on whitespace outside double quotes, dropping the
+// quotes and the backslashes that escape a quote inside them
+func splitInfo(s string) []string {
+	var words []string
+	var word strings.Builder
+	inWord, quoted := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\'):
+			i++
+			word.WriteByte(s[i])
+		case c == '"':
+			quoted, inWord = !quoted, true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// CodeAliases replaces DefaultCodeAliases with aliases when rendering
+// code fences
+func CodeAliases(aliases map[string]string) goldmark.Extender {
+	return &codeAliases{aliases: aliases}
+}
+
+type codeAliases struct {
+	aliases map[string]string
+}
+
+func (e *codeAliases) Extend(m goldmark.Markdown) {
+	// Ahead of the default code renderer the storage extension installs (100)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(&codeRenderer{aliases: e.aliases}, 99),
+	))
+}
+
+// codeRenderer writes fenced and indented code as code macros
+type codeRenderer struct {
+	aliases map[string]string
+}
+
+func (r *codeRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindFencedCodeBlock, r.renderFencedCodeBlock)
+	reg.Register(ast.KindCodeBlock, r.renderCodeBlock)
+}
+
+func (r *codeRenderer) renderFencedCodeBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkSkipChildren, nil
+	}
+	n := node.(*ast.FencedCodeBlock)
+	var info string
+	if n.Info != nil {
+		info = string(n.Info.Segment.Value(source))
+	}
+	if language, params := ParseCodeInfo(info); language == RawLanguage {
+		_, _ = w.WriteString(blockText(n, source))
+		_ = w.WriteByte('\n')
+	} else {
+		writeCodeMacro(w, ResolveCodeLanguage(language, r.aliases), params, blockText(n, source))
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+func (r *codeRenderer) renderCodeBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkSkipChildren, nil
+	}
+	writeCodeMacro(w, "", nil, blockText(node, source))
+	return ast.WalkSkipChildren, nil
+}
+
+func writeCodeMacro(w util.BufWriter, language string, params []MacroParam, code string) {
+	_, _ = w.WriteString(`<ac:structured-macro ac:name="code">`)
+	if language != "" {
+		writeParameter(w, "language", language)
+	}
+	for _, p := range params {
+		if CodeParameters[p.Name] {
+			writeParameter(w, p.Name, p.Value)
+		}
+	}
+	_, _ = w.WriteString(`<ac:plain-text-body>`)
+	_, _ = w.WriteString(CDATA(code))
+	_, _ = w.WriteString(`</ac:plain-text-body></ac:structured-macro>`)
+	_ = w.WriteByte('\n')
+}
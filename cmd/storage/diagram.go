@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// DiagramLanguages are the fence languages rendered to images
+var DiagramLanguages = map[string]bool{"mermaid": true, "plantuml": true}
+
+// DiagramSourceTitle is the title of the collapsed expand macro that keeps a
+// diagram's source under its image, for pull to turn back into the fence
+func DiagramSourceTitle(language string) string {
+	return language + " source"
+}
+
+// DiagramRenderer renders diagram source and returns the file name of the
+// image attachment, or an error to leave the fence as a code macro
+type DiagramRenderer func(language, source string) (filename string, err error)
+
+// KindDiagram is the NodeKind of Diagram
+var KindDiagram = ast.NewNodeKind("Diagram")
+
+// Diagram is a rendered diagram fence
+type Diagram struct {
+	ast.BaseBlock
+	Language string
+	Source   string
+	Filename string
+}
+
+// Kind implements ast.Node
+func (n *Diagram) Kind() ast.NodeKind {
+	return KindDiagram
+}
+
+// Dump implements ast.Node
+func (n *Diagram) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Language": n.Language, "Filename": n.Filename}, nil)
+}
+
+// Diagrams renders mermaid and plantuml fences as image attachments
+func Diagrams(render DiagramRenderer) goldmark.Extender {
+	return &diagrams{render: render}
+}
+
+type diagrams struct {
+	render DiagramRenderer
+}
+
+func (e *diagrams) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(util.Prioritized(&diagramTransformer{render: e.render}, 100)),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(&diagramRenderer{}, 100),
+	))
+}
+
+type diagramTransformer struct {
+	render DiagramRenderer
+}
+
+func (t *diagramTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	var fences []*ast.FencedCodeBlock
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if f, ok := n.(*ast.FencedCodeBlock); ok && entering && DiagramLanguages[string(f.Language(source))] {
+			fences = append(fences, f)
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, fence := range fences {
+		diagram := &Diagram{Language: string(fence.Language(source)), Source: blockText(fence, source)}
+		filename, err := t.render(diagram.Language, diagram.Source)
+		if err != nil {
+			continue
+		}
+		diagram.Filename = filename
+		fence.Parent().ReplaceChild(fence.Parent(), fence, diagram)
+	}
+}
+
+type diagramRenderer struct{}
+
+func (r *diagramRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindDiagram, r.renderDiagram)
+}
+
+// renderDiagram writes the image followed by the source in a collapsed expand
+func (r *diagramRenderer) renderDiagram(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*Diagram)
+	_, _ = fmt.Fprintf(w, `<p><ac:image ac:alt="%s diagram"><ri:attachment ri:filename="%s" /></ac:image></p>`,
+		util.EscapeHTML([]byte(n.Language)), util.EscapeHTML([]byte(n.Filename)))
+	_ = w.WriteByte('\n')
+	_, _ = w.WriteString(`<ac:structured-macro ac:name="expand">`)
+	writeParameter(w, "title", DiagramSourceTitle(n.Language))
+	_, _ = w.WriteString(`<ac:rich-text-body>`)
+	writeCodeMacro(w, n.Language, nil, n.Source)
+	_, _ = w.WriteString(`</ac:rich-text-body></ac:structured-macro>`)
+	_ = w.WriteByte('\n')
+	return ast.WalkSkipChildren, nil
+}
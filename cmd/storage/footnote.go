@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"strconv"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/util"
+)
+
+// FootnoteAnchor is the anchor of footnote n in the numbered list at the
+// end of the page
+func FootnoteAnchor(n int) string {
+	return "fn-" + strconv.Itoa(n)
+}
+
+// FootnoteRefAnchor is the anchor of the ref'th reference (from 0) to footnote n
+func FootnoteRefAnchor(n, ref int) string {
+	anchor := "fnref-" + strconv.Itoa(n)
+	if ref > 0 {
+		anchor += "-" + strconv.Itoa(ref)
+	}
+	return anchor
+}
+
+// Footnotes parses `[^1]` footnotes and renders them with anchor macros: a
+// superscript number linking to a numbered list after a rule, whose entries
+// link back to the reference
+var Footnotes goldmark.Extender = &footnotes{}
+
+type footnotes struct{}
+
+func (e *footnotes) Extend(m goldmark.Markdown) {
+	extension.Footnote.Extend(m)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(&footnoteRenderer{}, 100),
+	))
+}
+
+type footnoteRenderer struct{}
+
+func (r *footnoteRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(east.KindFootnoteLink, r.renderFootnoteLink)
+	reg.Register(east.KindFootnoteBacklink, r.renderFootnoteBacklink)
+	reg.Register(east.KindFootnoteList, r.renderFootnoteList)
+	reg.Register(east.KindFootnote, r.renderFootnote)
+}
+
+func (r *footnoteRenderer) renderFootnoteLink(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*east.FootnoteLink)
+	_, _ = w.WriteString("<sup>")
+	writeAnchor(w, FootnoteRefAnchor(n.Index, n.RefIndex))
+	writeAnchorLink(w, FootnoteAnchor(n.Index), strconv.Itoa(n.Index))
+	_, _ = w.WriteString("</sup>")
+	return ast.WalkContinue, nil
+}
+
+func (r *footnoteRenderer) renderFootnoteBacklink(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*east.FootnoteBacklink)
+	_ = w.WriteByte(' ')
+	writeAnchorLink(w, FootnoteRefAnchor(n.Index, n.RefIndex), "↩")
+	return ast.WalkContinue, nil
+}
+
+func (r *footnoteRenderer) renderFootnoteList(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		_, _ = w.WriteString("<hr />\n<ol>\n")
+	} else {
+		_, _ = w.WriteString("</ol>\n")
+	}
+	return ast.WalkContinue, nil
+}
+
+func (r *footnoteRenderer) renderFootnote(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		_, _ = w.WriteString("</li>\n")
+		return ast.WalkContinue, nil
+	}
+	_, _ = w.WriteString("<li>")
+	writeAnchor(w, FootnoteAnchor(node.(*east.Footnote).Index))
+	_ = w.WriteByte('\n')
+	return ast.WalkContinue, nil
+}
+
+// writeAnchor writes the anchor macro links to name point at
+func writeAnchor(w util.BufWriter, name string) {
+	_, _ = w.WriteString(`<ac:structured-macro ac:name="anchor">`)
+	writeParameter(w, "", name)
+	_, _ = w.WriteString(`</ac:structured-macro>`)
+}
+
+// writeAnchorLink writes a link to an anchor on the same page
+func writeAnchorLink(w util.BufWriter, anchor, text string) {
+	_, _ = w.WriteString(`<ac:link ac:anchor="`)
+	_, _ = w.Write(util.EscapeHTML([]byte(anchor)))
+	_, _ = w.WriteString(`"><ac:plain-text-link-body>`)
+	_, _ = w.WriteString(CDATA(text))
+	_, _ = w.WriteString(`</ac:plain-text-link-body></ac:link>`)
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// HeadingAnchor is the anchor Confluence gives a heading, which ac:link
+// refers to it by: its text without whitespace
+func HeadingAnchor(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// HeadingID is the id Confluence renders an anchor with on the page titled
+// title: PageTitle-Anchor
+func HeadingID(title, anchor string) string {
+	if title == "" {
+		return anchor
+	}
+	return HeadingAnchor(title) + "-" + anchor
+}
+
+// KindAnchor is the NodeKind of Anchor
+var KindAnchor = ast.NewNodeKind("Anchor")
+
+// Anchor is an anchor macro, written for a heading's `{#custom-id}`
+type Anchor struct {
+	ast.BaseInline
+	Name string
+}
+
+// Kind implements ast.Node
+func (n *Anchor) Kind() ast.NodeKind {
+	return KindAnchor
+}
+
+// Dump implements ast.Node
+func (n *Anchor) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Name": n.Name}, nil)
+}
+
+// HeadingAnchors gives headings the ids Confluence does on the page titled
+// title, writes an anchor macro for each `{#custom-id}` and turns
+// `[text](#fragment)` links to a heading into anchor links
+func HeadingAnchors(title string) goldmark.Extender {
+	return &headingAnchors{title: title}
+}
+
+type headingAnchors struct {
+	title string
+}
+
+func (e *headingAnchors) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(util.Prioritized(&headingAnchorTransformer{title: e.title}, 100)),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(&anchorRenderer{}, 100),
+		util.Prioritized(&pageLinkRenderer{}, 100),
+	))
+}
+
+// AnchorsByFragment maps the `#fragment` of each heading in Markdown source
+// to the anchor it has on Confluence
+func AnchorsByFragment(source []byte) map[string]string {
+	pc := parser.NewContext()
+	doc := New().Parser().Parse(text.NewReader(source), parser.WithContext(pc))
+	anchors := map[string]string{}
+	for _, h := range headingAnchorsOf(doc, source, pc.IDs()) {
+		anchors[h.fragment] = h.anchor
+	}
+	return anchors
+}
+
+// headingAnchor is a heading's `#fragment` in Markdown and its anchor on Confluence
+type headingAnchor struct {
+	heading  *ast.Heading
+	fragment string
+	anchor   string
+	custom   bool
+}
+
+// headingAnchorsOf lists the headings under doc. A `{#custom-id}` is both
+// the fragment and the anchor; other headings get a fragment generated from
+// their text, and an anchor that tells repeated headings apart the way
+// Confluence does, with ".1", ".2"…
+func headingAnchorsOf(doc ast.Node, source []byte, ids parser.IDs) []headingAnchor {
+	var headings []headingAnchor
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if heading, ok := n.(*ast.Heading); ok && entering {
+			headings = append(headings, headingAnchor{heading: heading})
+			// Automatic ids are not enabled, so only `{#custom-id}` headings have one
+			if id, ok := heading.AttributeString("id"); ok {
+				if b, ok := id.([]byte); ok {
+					h := &headings[len(headings)-1]
+					h.fragment, h.anchor, h.custom = string(b), string(b), true
+					ids.Put(b)
+				}
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+
+	// Custom ids are taken before any is generated
+	seen := map[string]int{}
+	for i := range headings {
+		h := &headings[i]
+		if h.custom {
+			continue
+		}
+		text := plainText(h.heading, source)
+		anchor := HeadingAnchor(text)
+		if count := seen[anchor]; count > 0 {
+			seen[anchor]++
+			anchor += "." + strconv.Itoa(count)
+		} else {
+			seen[anchor] = 1
+		}
+		h.fragment, h.anchor = string(ids.Generate([]byte(text), ast.KindHeading)), anchor
+	}
+	return headings
+}
+
+type headingAnchorTransformer struct {
+	title string
+}
+
+func (t *headingAnchorTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	anchors := map[string]string{}
+	for _, h := range headingAnchorsOf(doc, reader.Source(), pc.IDs()) {
+		anchors[h.fragment] = h.anchor
+		if h.custom {
+			h.heading.InsertBefore(h.heading, h.heading.FirstChild(), &Anchor{Name: h.anchor})
+		}
+		h.heading.SetAttributeString("id", []byte(HeadingID(t.title, h.anchor)))
+	}
+
+	var links []*ast.Link
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if l, ok := n.(*ast.Link); ok && entering && strings.HasPrefix(string(l.Destination), "#") {
+			links = append(links, l)
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, link := range links {
+		fragment, err := url.PathUnescape(string(link.Destination[1:]))
+		if err != nil || fragment == "" {
+			continue
+		}
+		anchor, ok := anchors[fragment]
+		if !ok {
+			anchor = fragment
+		}
+		pageLink := &PageLink{Page: PageRef{Anchor: anchor}}
+		for c := link.FirstChild(); c != nil; {
+			next := c.NextSibling()
+			pageLink.AppendChild(pageLink, c)
+			c = next
+		}
+		link.Parent().ReplaceChild(link.Parent(), link, pageLink)
+	}
+}
+
+type anchorRenderer struct{}
+
+func (r *anchorRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindAnchor, r.renderAnchor)
+}
+
+func (r *anchorRenderer) renderAnchor(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		writeAnchor(w, node.(*Anchor).Name)
+	}
+	return ast.WalkContinue, nil
+}
@@ -0,0 +1,322 @@
+package storage
+
+import (
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Markdown shorthands for the common macros:
+//
+//	[[toc]] or [[toc maxLevel=3 style="none"]]   table of contents
+//	<details><summary>Title</summary> ... </details>   expand
+//	{status:green|DONE} or {status:red|LATE|subtle}   status lozenge
+//	{date:2024-05-01}   date lozenge
+
+// MacroParam is one ac:parameter, kept in source order
+type MacroParam struct {
+	Name  string
+	Value string
+}
+
+// StatusColours are the lozenge colours Confluence offers, by shorthand name
+var StatusColours = map[string]string{
+	"grey": "Grey", "red": "Red", "yellow": "Yellow", "green": "Green", "blue": "Blue", "purple": "Purple",
+}
+
+// KindTOC is the NodeKind of TOC
+var KindTOC = ast.NewNodeKind("TOC")
+
+// TOC is a `[[toc]]` paragraph, rendered as the toc macro
+type TOC struct {
+	ast.BaseBlock
+	Params []MacroParam
+}
+
+// Kind implements ast.Node
+func (n *TOC) Kind() ast.NodeKind {
+	return KindTOC
+}
+
+// Dump implements ast.Node
+func (n *TOC) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+// KindExpand is the NodeKind of Expand
+var KindExpand = ast.NewNodeKind("Expand")
+
+// Expand is a <details> block, rendered as the expand macro
+type Expand struct {
+	ast.BaseBlock
+	Title string
+}
+
+// Kind implements ast.Node
+func (n *Expand) Kind() ast.NodeKind {
+	return KindExpand
+}
+
+// Dump implements ast.Node
+func (n *Expand) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Title": n.Title}, nil)
+}
+
+// KindStatus is the NodeKind of Status
+var KindStatus = ast.NewNodeKind("Status")
+
+// Status is a `{status:colour|Title}` shortcode, rendered as the status macro
+type Status struct {
+	ast.BaseInline
+	Colour string
+	Title  string
+	Subtle bool
+}
+
+// Kind implements ast.Node
+func (n *Status) Kind() ast.NodeKind {
+	return KindStatus
+}
+
+// Dump implements ast.Node
+func (n *Status) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Colour": n.Colour, "Title": n.Title}, nil)
+}
+
+// KindDate is the NodeKind of Date
+var KindDate = ast.NewNodeKind("Date")
+
+// Date is a `{date:YYYY-MM-DD}` shortcode, rendered as a <time> date lozenge
+type Date struct {
+	ast.BaseInline
+	Date string
+}
+
+// Kind implements ast.Node
+func (n *Date) Kind() ast.NodeKind {
+	return KindDate
+}
+
+// Dump implements ast.Node
+func (n *Date) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Date": n.Date}, nil)
+}
+
+// Macros adds the toc, expand, status and date shorthands
+var Macros goldmark.Extender = &macros{}
+
+type macros struct{}
+
+func (e *macros) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithInlineParsers(
+			util.Prioritized(&statusParser{}, 100),
+			util.Prioritized(&dateParser{}, 100),
+		),
+		parser.WithASTTransformers(
+			util.Prioritized(&tocTransformer{}, 100),
+			util.Prioritized(&expandTransformer{}, 100),
+		),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(&macroRenderer{}, 100),
+	))
+}
+
+var (
+	tocPattern      = regexp.MustCompile(`^\[\[toc((?:\s+[\w-]+=(?:"[^"]*"|[^\s"\]]+))*)\s*\]\]\s*$`)
+	tocParamPattern = regexp.MustCompile(`([\w-]+)=(?:"([^"]*)"|([^\s"\]]+))`)
+)
+
+// tocTransformer replaces paragraphs holding nothing but `[[toc]]`
+type tocTransformer struct{}
+
+func (t *tocTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	var paragraphs []*ast.Paragraph
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if p, ok := n.(*ast.Paragraph); ok && entering && p.Lines().Len() == 1 {
+			paragraphs = append(paragraphs, p)
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, p := range paragraphs {
+		line := p.Lines().At(0)
+		m := tocPattern.FindSubmatch(line.Value(source))
+		if m == nil {
+			continue
+		}
+		toc := &TOC{}
+		for _, param := range tocParamPattern.FindAllSubmatch(m[1], -1) {
+			toc.Params = append(toc.Params, MacroParam{Name: string(param[1]), Value: string(param[2]) + string(param[3])})
+		}
+		p.Parent().ReplaceChild(p.Parent(), p, toc)
+	}
+}
+
+var (
+	detailsOpenPattern  = regexp.MustCompile(`(?i)^\s*<details(?:\s[^>]*)?>\s*(?:<summary(?:\s[^>]*)?>([\s\S]*?)</summary>)?\s*$`)
+	detailsClosePattern = regexp.MustCompile(`(?i)^\s*</details>\s*$`)
+	tagPattern          = regexp.MustCompile(`<[^>]*>`)
+)
+
+// expandTransformer turns the blocks between a `<details>` HTML block and
+// its matching `</details>` into an Expand. The tags have to stand on lines
+// of their own, separated from the body by blank lines, for Markdown inside
+// to be parsed at all.
+type expandTransformer struct{}
+
+func (t *expandTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	var opens []*ast.HTMLBlock
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if b, ok := n.(*ast.HTMLBlock); ok && entering && detailsOpenPattern.Match(b.Lines().Value(source)) {
+			opens = append(opens, b)
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, open := range opens {
+		var close ast.Node
+		depth := 1
+		for c := open.NextSibling(); c != nil && close == nil; c = c.NextSibling() {
+			b, ok := c.(*ast.HTMLBlock)
+			if !ok {
+				continue
+			}
+			switch value := b.Lines().Value(source); {
+			case detailsOpenPattern.Match(value):
+				depth++
+			case detailsClosePattern.Match(value):
+				if depth--; depth == 0 {
+					close = c
+				}
+			}
+		}
+		if close == nil {
+			continue
+		}
+
+		m := detailsOpenPattern.FindSubmatch(open.Lines().Value(source))
+		title := html.UnescapeString(strings.TrimSpace(tagPattern.ReplaceAllString(string(m[1]), "")))
+		expand := &Expand{Title: title}
+		parent := open.Parent()
+		for c := open.NextSibling(); c != close; {
+			next := c.NextSibling()
+			expand.AppendChild(expand, c)
+			c = next
+		}
+		parent.RemoveChild(parent, close)
+		parent.ReplaceChild(parent, open, expand)
+	}
+}
+
+var statusPattern = regexp.MustCompile(`^\{status:([A-Za-z]+)(?:\\?\|([^|}\\\n]*))?(?:\\?\|(subtle))?\}`)
+
+// statusParser reads `{status:colour|Title}`. The pipes may be escaped, as
+// they must be inside a table cell.
+type statusParser struct{}
+
+func (p *statusParser) Trigger() []byte {
+	return []byte{'{'}
+}
+
+func (p *statusParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	m := statusPattern.FindSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	colour, ok := StatusColours[strings.ToLower(string(m[1]))]
+	if !ok {
+		return nil
+	}
+	block.Advance(len(m[0]))
+	return &Status{Colour: colour, Title: strings.TrimSpace(string(m[2])), Subtle: len(m[3]) > 0}
+}
+
+var datePattern = regexp.MustCompile(`^\{date:(\d{4}-\d{2}-\d{2})\}`)
+
+type dateParser struct{}
+
+func (p *dateParser) Trigger() []byte {
+	return []byte{'{'}
+}
+
+func (p *dateParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	m := datePattern.FindSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	block.Advance(len(m[0]))
+	return &Date{Date: string(m[1])}
+}
+
+type macroRenderer struct{}
+
+func (r *macroRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindTOC, r.renderTOC)
+	reg.Register(KindExpand, r.renderExpand)
+	reg.Register(KindStatus, r.renderStatus)
+	reg.Register(KindDate, r.renderDate)
+}
+
+func (r *macroRenderer) renderTOC(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*TOC)
+	_, _ = w.WriteString(`<ac:structured-macro ac:name="toc">`)
+	for _, param := range n.Params {
+		writeParameter(w, param.Name, param.Value)
+	}
+	_, _ = w.WriteString("</ac:structured-macro>\n")
+	return ast.WalkContinue, nil
+}
+
+func (r *macroRenderer) renderExpand(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		_, _ = w.WriteString("</ac:rich-text-body></ac:structured-macro>\n")
+		return ast.WalkContinue, nil
+	}
+	n := node.(*Expand)
+	_, _ = w.WriteString(`<ac:structured-macro ac:name="expand">`)
+	if n.Title != "" {
+		writeParameter(w, "title", n.Title)
+	}
+	_, _ = w.WriteString("<ac:rich-text-body>\n")
+	return ast.WalkContinue, nil
+}
+
+func (r *macroRenderer) renderStatus(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*Status)
+	_, _ = w.WriteString(`<ac:structured-macro ac:name="status">`)
+	writeParameter(w, "colour", n.Colour)
+	if n.Title != "" {
+		writeParameter(w, "title", n.Title)
+	}
+	if n.Subtle {
+		writeParameter(w, "subtle", "true")
+	}
+	_, _ = w.WriteString("</ac:structured-macro>")
+	return ast.WalkContinue, nil
+}
+
+func (r *macroRenderer) renderDate(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		_, _ = w.WriteString(`<time datetime="` + node.(*Date).Date + `" />`)
+	}
+	return ast.WalkContinue, nil
+}
@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// MathMacros name the macros LaTeX math renders as: Inline takes the
+// formula as its body parameter, Block as its plain-text body
+type MathMacros struct {
+	Inline string
+	Block  string
+}
+
+// DefaultMathMacros are the macros of the LaTeX Math app
+var DefaultMathMacros = MathMacros{Inline: "mathinline", Block: "mathblock"}
+
+// MathLanguage is the language formulas are passed to a DiagramRenderer as
+const MathLanguage = "math"
+
+// KindMath is the NodeKind of Math
+var KindMath = ast.NewNodeKind("Math")
+
+// Math is an inline `$...$` formula
+type Math struct {
+	ast.BaseInline
+	Source   string
+	Filename string
+}
+
+// Kind implements ast.Node
+func (n *Math) Kind() ast.NodeKind {
+	return KindMath
+}
+
+// Dump implements ast.Node
+func (n *Math) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Source": n.Source, "Filename": n.Filename}, nil)
+}
+
+// KindMathBlock is the NodeKind of MathBlock
+var KindMathBlock = ast.NewNodeKind("MathBlock")
+
+// MathBlock is a `$$` display formula, on one line or fenced by `$$` lines
+type MathBlock struct {
+	ast.BaseBlock
+	Source   string
+	Filename string
+	lines    []string
+	closed   bool
+}
+
+// Kind implements ast.Node
+func (n *MathBlock) Kind() ast.NodeKind {
+	return KindMathBlock
+}
+
+// Dump implements ast.Node
+func (n *MathBlock) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Source": n.Source, "Filename": n.Filename}, nil)
+}
+
+// IsRaw implements ast.Node
+func (n *MathBlock) IsRaw() bool {
+	return true
+}
+
+// MathFormula returns the Markdown of a formula: `$src$`, or `$$src$$` for
+// display math. Rendered formulas carry it as the alt text of their image.
+func MathFormula(source string, display bool) string {
+	if display {
+		return "$$" + source + "$$"
+	}
+	return "$" + source + "$"
+}
+
+// Maths renders `$...$` and `$$...$$` LaTeX as macros. With render set,
+// formulas are rendered to image attachments instead, falling back to the
+// macros when rendering fails.
+func Maths(macros MathMacros, render DiagramRenderer) goldmark.Extender {
+	return &maths{macros: macros, render: render}
+}
+
+type maths struct {
+	macros MathMacros
+	render DiagramRenderer
+}
+
+func (e *maths) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		// Ahead of the paragraph parser, which a `$$` line may interrupt
+		parser.WithBlockParsers(util.Prioritized(&mathBlockParser{}, 150)),
+		parser.WithInlineParsers(util.Prioritized(&mathParser{}, 100)),
+	)
+	if e.render != nil {
+		m.Parser().AddOptions(parser.WithASTTransformers(util.Prioritized(&mathTransformer{render: e.render}, 100)))
+	}
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(&mathRenderer{macros: e.macros}, 100),
+	))
+}
+
+type mathBlockParser struct{}
+
+func (p *mathBlockParser) Trigger() []byte {
+	return []byte{'$'}
+}
+
+func (p *mathBlockParser) Open(parent ast.Node, reader text.Reader, pc parser.Context) (ast.Node, parser.State) {
+	line, _ := reader.PeekLine()
+	pos := pc.BlockOffset()
+	if pos < 0 || !bytes.HasPrefix(line[pos:], []byte("$$")) {
+		return nil, parser.NoChildren
+	}
+	rest := bytes.TrimSpace(line[pos+2:])
+	node := &MathBlock{}
+	if len(rest) == 0 {
+		return node, parser.NoChildren
+	}
+	// `$$x$$` on a single line; anything after the closing `$$` is not math
+	if !bytes.HasSuffix(rest, []byte("$$")) || len(rest) < 3 {
+		return nil, parser.NoChildren
+	}
+	node.Source = string(bytes.TrimSpace(rest[:len(rest)-2]))
+	node.closed = true
+	return node, parser.NoChildren
+}
+
+func (p *mathBlockParser) Continue(node ast.Node, reader text.Reader, pc parser.Context) parser.State {
+	n := node.(*MathBlock)
+	line, segment := reader.PeekLine()
+	if n.closed || line == nil {
+		return parser.Close
+	}
+	content := bytes.TrimRight(line, "\r\n")
+	trimmed := bytes.TrimSpace(line)
+	closing := bytes.HasSuffix(trimmed, []byte("$$"))
+	if closing {
+		content = bytes.TrimSpace(trimmed[:len(trimmed)-2])
+	}
+	if !closing || len(content) > 0 {
+		n.lines = append(n.lines, string(content))
+	}
+
+	newline := 0
+	if line[len(line)-1] == '\n' {
+		newline = 1
+	}
+	reader.Advance(segment.Stop - segment.Start - newline + segment.Padding)
+	if closing {
+		n.closed = true
+		return parser.Close
+	}
+	return parser.Continue | parser.NoChildren
+}
+
+func (p *mathBlockParser) Close(node ast.Node, reader text.Reader, pc parser.Context) {
+	if n := node.(*MathBlock); n.lines != nil {
+		n.Source = strings.Join(n.lines, "\n")
+	}
+}
+
+func (p *mathBlockParser) CanInterruptParagraph() bool {
+	return true
+}
+
+func (p *mathBlockParser) CanAcceptIndentedLine() bool {
+	return false
+}
+
+// mathParser reads `$...$`. As in pandoc, the opening `$` must be followed
+// by a non-space, and the closing one preceded by a non-space and not
+// followed by a digit, so prices like $5 and $10 stay text.
+type mathParser struct{}
+
+func (p *mathParser) Trigger() []byte {
+	return []byte{'$'}
+}
+
+func (p *mathParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	if len(line) < 3 || line[1] == '$' || util.IsSpace(line[1]) {
+		return nil
+	}
+	for i := 2; i < len(line); i++ {
+		switch {
+		case line[i] == '\\':
+			i++
+		case line[i] == '$':
+			if util.IsSpace(line[i-1]) || (i+1 < len(line) && line[i+1] >= '0' && line[i+1] <= '9') {
+				return nil
+			}
+			block.Advance(i + 1)
+			return &Math{Source: string(line[1:i])}
+		}
+	}
+	return nil
+}
+
+// mathTransformer renders every formula to an image attachment
+type mathTransformer struct {
+	render DiagramRenderer
+}
+
+func (t *mathTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *Math:
+			n.Filename, _ = t.render(MathLanguage, n.Source)
+		case *MathBlock:
+			n.Filename, _ = t.render(MathLanguage, n.Source)
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+type mathRenderer struct {
+	macros MathMacros
+}
+
+func (r *mathRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindMath, r.renderMath)
+	reg.Register(KindMathBlock, r.renderMathBlock)
+}
+
+func (r *mathRenderer) renderMath(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*Math)
+	if n.Filename != "" {
+		writeMathImage(w, MathFormula(n.Source, false), n.Filename)
+		return ast.WalkContinue, nil
+	}
+	_, _ = fmt.Fprintf(w, `<ac:structured-macro ac:name="%s">`, util.EscapeHTML([]byte(r.macros.Inline)))
+	writeParameter(w, "body", n.Source)
+	_, _ = w.WriteString(`</ac:structured-macro>`)
+	return ast.WalkContinue, nil
+}
+
+func (r *mathRenderer) renderMathBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*MathBlock)
+	if n.Filename != "" {
+		_, _ = w.WriteString("<p>")
+		writeMathImage(w, MathFormula(n.Source, true), n.Filename)
+		_, _ = w.WriteString("</p>\n")
+		return ast.WalkContinue, nil
+	}
+	_, _ = fmt.Fprintf(w, `<ac:structured-macro ac:name="%s"><ac:plain-text-body>`, util.EscapeHTML([]byte(r.macros.Block)))
+	_, _ = w.WriteString(CDATA(n.Source))
+	_, _ = w.WriteString("</ac:plain-text-body></ac:structured-macro>\n")
+	return ast.WalkContinue, nil
+}
+
+// writeMathImage writes a rendered formula, keeping its Markdown as the alt text
+func writeMathImage(w util.BufWriter, formula, filename string) {
+	_, _ = fmt.Fprintf(w, `<ac:image ac:alt="%s"><ri:attachment ri:filename="%s" /></ac:image>`,
+		util.EscapeHTML([]byte(formula)), util.EscapeHTML([]byte(filename)))
+}
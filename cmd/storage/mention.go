@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// UserRef identifies a user the way ri:user does: a Cloud account ID, or a
+// Data Center user key or username
+type UserRef struct {
+	AccountID string
+	UserKey   string
+	Username  string
+}
+
+// UserResolver looks up the user an `@name` mention refers to, or returns
+// nil to leave the mention as text
+type UserResolver func(name string) *UserRef
+
+// GuessUser reads a name given as a user, such as a task assignee or a wiki
+// [~user] link: account IDs are recognized by their shape and anything else
+// is taken for a username
+func GuessUser(name string) *UserRef {
+	if accountIDPattern.MatchString(name) {
+		return &UserRef{AccountID: name}
+	}
+	return &UserRef{Username: name}
+}
+
+// UserByAccountID is the resolver used without a user directory. Only
+// account IDs, which no word looks like, become user links; any other
+// `@name` is left as text.
+func UserByAccountID(name string) *UserRef {
+	if accountIDPattern.MatchString(name) {
+		return &UserRef{AccountID: name}
+	}
+	return nil
+}
+
+// UserByID reads the id of an `@[Display Name](id)` mention: an account ID
+// on Cloud, a user key on Data Center
+func UserByID(id string) *UserRef {
+	if accountIDPattern.MatchString(id) {
+		return &UserRef{AccountID: id}
+	}
+	return &UserRef{UserKey: id}
+}
+
+// KindMention is the NodeKind of Mention
+var KindMention = ast.NewNodeKind("Mention")
+
+// Mention is an `@name` or `@[Display Name](id)`, rendered as a user link
+type Mention struct {
+	ast.BaseInline
+	User UserRef
+}
+
+// Kind implements ast.Node
+func (n *Mention) Kind() ast.NodeKind {
+	return KindMention
+}
+
+// Dump implements ast.Node
+func (n *Mention) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"AccountID": n.User.AccountID, "UserKey": n.User.UserKey, "Username": n.User.Username}, nil)
+}
+
+// Mentions turns `@name` and `@[Display Name](id)` in text, and task
+// assignees, into user links. A nil resolve uses UserByAccountID.
+func Mentions(resolve UserResolver) goldmark.Extender {
+	if resolve == nil {
+		resolve = UserByAccountID
+	}
+	return &mentions{resolve: resolve}
+}
+
+type mentions struct {
+	resolve UserResolver
+}
+
+func (e *mentions) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		// After the task list transformer has split out assignees
+		parser.WithASTTransformers(util.Prioritized(&mentionTransformer{resolve: e.resolve}, 200)),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(&mentionRenderer{}, 100),
+	))
+}
+
+type mentionTransformer struct {
+	resolve UserResolver
+}
+
+func (t *mentionTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	var texts []*ast.Text
+	var links []*ast.Link
+	var assignees []*TaskAssignee
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.Link, *ast.AutoLink, *ast.Image, *ast.CodeSpan, *PageLink:
+			if l, ok := n.(*ast.Link); ok && isMentionLink(l, source) {
+				links = append(links, l)
+			}
+			return ast.WalkSkipChildren, nil
+		case *ast.Text:
+			texts = append(texts, n)
+		case *TaskAssignee:
+			assignees = append(assignees, n)
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, link := range links {
+		// Drop the @ that ends the text before the link
+		at := link.PreviousSibling().(*ast.Text)
+		at.Segment = at.Segment.WithStop(at.Segment.Stop - 1)
+		mention := &Mention{User: *UserByID(string(link.Destination))}
+		link.Parent().ReplaceChild(link.Parent(), link, mention)
+	}
+	for _, assignee := range assignees {
+		parent := assignee.Parent()
+		if user := t.resolve(assignee.User); user != nil {
+			parent.ReplaceChild(parent, assignee, &Mention{User: *user})
+		} else {
+			parent.ReplaceChild(parent, assignee, ast.NewString([]byte("@"+assignee.User)))
+		}
+	}
+	for _, node := range texts {
+		t.splitMentions(node, source)
+	}
+}
+
+// isMentionLink reports whether l is the [Display Name](id) of `@[Display Name](id)`
+func isMentionLink(l *ast.Link, source []byte) bool {
+	prev, ok := l.PreviousSibling().(*ast.Text)
+	if !ok || len(l.Title) > 0 {
+		return false
+	}
+	value := prev.Segment.Value(source)
+	if len(value) == 0 || value[len(value)-1] != '@' {
+		return false
+	}
+	return len(value) == 1 || util.IsSpace(value[len(value)-2])
+}
+
+// splitMentions replaces each `@name` in t that resolves with a Mention
+func (t *mentionTransformer) splitMentions(node *ast.Text, source []byte) {
+	parent := node.Parent()
+	if parent == nil {
+		return
+	}
+	value := node.Segment.Value(source)
+	pos := 0
+	for _, m := range taskAssigneePattern.FindAllSubmatchIndex(value, -1) {
+		// A name running into punctuation (`@alice's`) is still a mention, one
+		// running into a path or another name (`@types/node`) is not
+		if m[3] < len(value) && !isMentionEnd(value[m[3]]) {
+			continue
+		}
+		user := t.resolve(string(value[m[2]:m[3]]))
+		if user == nil {
+			continue
+		}
+		at := m[2] - 1
+		if at > pos {
+			parent.InsertBefore(parent, node, ast.NewTextSegment(text.NewSegment(node.Segment.Start+pos, node.Segment.Start+at)))
+		}
+		parent.InsertBefore(parent, node, &Mention{User: *user})
+		pos = m[3]
+	}
+	if pos == 0 {
+		return
+	}
+	rest := ast.NewTextSegment(text.NewSegment(node.Segment.Start+pos, node.Segment.Stop))
+	rest.SetSoftLineBreak(node.SoftLineBreak())
+	rest.SetHardLineBreak(node.HardLineBreak())
+	parent.ReplaceChild(parent, node, rest)
+}
+
+// isMentionEnd reports whether c can follow the name of an `@name` mention
+func isMentionEnd(c byte) bool {
+	return util.IsSpace(c) || strings.IndexByte(".,;:!?'\")]}", c) >= 0
+}
+
+type mentionRenderer struct{}
+
+func (r *mentionRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindMention, r.renderMention)
+}
+
+func (r *mentionRenderer) renderMention(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		writeUserLink(w, node.(*Mention).User)
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+// writeUserLink writes the most stable identifier of user as a user link
+func writeUserLink(w util.BufWriter, user UserRef) {
+	attr, value := "ri:username", user.Username
+	switch {
+	case user.AccountID != "":
+		attr, value = "ri:account-id", user.AccountID
+	case user.UserKey != "":
+		attr, value = "ri:userkey", user.UserKey
+	}
+	_, _ = w.WriteString(`<ac:link><ri:user ` + attr + `="`)
+	_, _ = w.Write(util.EscapeHTML([]byte(value)))
+	_, _ = w.WriteString(`" /></ac:link>`)
+}
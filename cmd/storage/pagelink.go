@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// PageRef identifies a Confluence page the way ri:page does: by title and
+// space. A PageRef without a title is an anchor on the same page.
+type PageRef struct {
+	Title  string
+	Space  string
+	Anchor string
+}
+
+// PageResolver maps a link destination to the page it points at, or returns
+// nil to leave the link as an ordinary <a href>
+type PageResolver func(dest string) *PageRef
+
+// KindPageLink is the NodeKind of PageLink
+var KindPageLink = ast.NewNodeKind("PageLink")
+
+// PageLink is a link to another Confluence page, rendered as ac:link
+type PageLink struct {
+	ast.BaseInline
+	Page PageRef
+}
+
+// Kind implements ast.Node
+func (n *PageLink) Kind() ast.NodeKind {
+	return KindPageLink
+}
+
+// Dump implements ast.Node
+func (n *PageLink) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Title": n.Page.Title, "Space": n.Page.Space, "Anchor": n.Page.Anchor}, nil)
+}
+
+// PageLinks turns links that resolve to Confluence pages into ac:link elements
+func PageLinks(resolve PageResolver) goldmark.Extender {
+	return &pageLinks{resolve: resolve}
+}
+
+type pageLinks struct {
+	resolve PageResolver
+}
+
+func (e *pageLinks) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(util.Prioritized(&pageLinkTransformer{resolve: e.resolve}, 100)),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(&pageLinkRenderer{}, 100),
+	))
+}
+
+type pageLinkTransformer struct {
+	resolve PageResolver
+}
+
+func (t *pageLinkTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	var links []*ast.Link
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if l, ok := n.(*ast.Link); ok && entering {
+			links = append(links, l)
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, link := range links {
+		page := t.resolve(string(link.Destination))
+		if page == nil {
+			continue
+		}
+		pageLink := &PageLink{Page: *page}
+		for c := link.FirstChild(); c != nil; {
+			next := c.NextSibling()
+			pageLink.AppendChild(pageLink, c)
+			c = next
+		}
+		link.Parent().ReplaceChild(link.Parent(), link, pageLink)
+	}
+}
+
+type pageLinkRenderer struct{}
+
+func (r *pageLinkRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindPageLink, r.renderPageLink)
+}
+
+func (r *pageLinkRenderer) renderPageLink(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	n := node.(*PageLink)
+	if !entering {
+		if n.HasChildren() {
+			_, _ = w.WriteString("</ac:link-body>")
+		}
+		_, _ = w.WriteString("</ac:link>")
+		return ast.WalkContinue, nil
+	}
+	_, _ = w.WriteString("<ac:link")
+	if n.Page.Anchor != "" {
+		_, _ = w.WriteString(` ac:anchor="`)
+		_, _ = w.Write(util.EscapeHTML([]byte(n.Page.Anchor)))
+		_ = w.WriteByte('"')
+	}
+	_ = w.WriteByte('>')
+	if n.Page.Title != "" {
+		_, _ = w.WriteString(`<ri:page ri:content-title="`)
+		_, _ = w.Write(util.EscapeHTML([]byte(n.Page.Title)))
+		_ = w.WriteByte('"')
+		if n.Page.Space != "" {
+			_, _ = w.WriteString(` ri:space-key="`)
+			_, _ = w.Write(util.EscapeHTML([]byte(n.Page.Space)))
+			_ = w.WriteByte('"')
+		}
+		_, _ = w.WriteString(" />")
+	}
+	if n.HasChildren() {
+		_, _ = w.WriteString("<ac:link-body>")
+	}
+	return ast.WalkContinue, nil
+}
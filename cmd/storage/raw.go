@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"encoding/base64"
+	"regexp"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// RawLanguage marks a fenced block whose body is storage XHTML to copy into
+// the page verbatim. Pull writes macros it has no Markdown for this way.
+const RawLanguage = "confluence-storage"
+
+// RawComment wraps storage XHTML in an HTML comment, for places a fenced
+// block cannot go (inside a paragraph, list item or table cell)
+func RawComment(raw string) string {
+	return "<!-- " + RawLanguage + ":" + base64.StdEncoding.EncodeToString([]byte(raw)) + " -->"
+}
+
+var (
+	rawCommentPattern = regexp.MustCompile(`<!-- ` + RawLanguage + `:([A-Za-z0-9+/=]*) -->`)
+	// A line opening with placeholders and going on with text
+	rawCommentLinePattern = regexp.MustCompile(`^(?:<!-- ` + RawLanguage + `:[A-Za-z0-9+/=]* -->)+[ \t]*\S`)
+)
+
+// rawCommentParagraphParser reads a line that starts with a preserved inline
+// macro as a paragraph. CommonMark would otherwise read any line opening
+// with "<!--" as an HTML block and leave the rest of the text unrendered.
+type rawCommentParagraphParser struct {
+	parser.BlockParser
+}
+
+func (p *rawCommentParagraphParser) Trigger() []byte {
+	return []byte{'<'}
+}
+
+func (p *rawCommentParagraphParser) Open(parent ast.Node, reader text.Reader, pc parser.Context) (ast.Node, parser.State) {
+	line, _ := reader.PeekLine()
+	if !rawCommentLinePattern.Match(line) {
+		return nil, parser.NoChildren
+	}
+	return p.BlockParser.Open(parent, reader, pc)
+}
+
+// CanInterruptParagraph matches the HTML block parser, which would interrupt
+// a paragraph at such a line
+func (p *rawCommentParagraphParser) CanInterruptParagraph() bool {
+	return true
+}
+
+// expandRawComments replaces RawComment placeholders with the storage they carry
+func expandRawComments(html []byte) []byte {
+	return rawCommentPattern.ReplaceAllFunc(html, func(comment []byte) []byte {
+		m := rawCommentPattern.FindSubmatch(comment)
+		raw, err := base64.StdEncoding.DecodeString(string(m[1]))
+		if err != nil {
+			return comment
+		}
+		return raw
+	})
+}
+
+// renderRawHTML writes inline HTML as-is (scribe always renders unsafe HTML),
+// restoring any preserved storage
+func (r *Renderer) renderRawHTML(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkSkipChildren, nil
+	}
+	n := node.(*ast.RawHTML)
+	for i := 0; i < n.Segments.Len(); i++ {
+		segment := n.Segments.At(i)
+		_, _ = w.Write(expandRawComments(segment.Value(source)))
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+func (r *Renderer) renderHTMLBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	n := node.(*ast.HTMLBlock)
+	if entering {
+		lines := n.Lines()
+		for i := 0; i < lines.Len(); i++ {
+			line := lines.At(i)
+			_, _ = w.Write(expandRawComments(line.Value(source)))
+		}
+	} else if n.HasClosure() {
+		closure := n.ClosureLine
+		_, _ = w.Write(closure.Value(source))
+	}
+	return ast.WalkContinue, nil
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"bytes"
+	"net/url"
+	"path"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/util"
+)
+
+// Renderer writes the Confluence-specific parts of storage format
+type Renderer struct{}
+
+// NewRenderer returns the storage-format NodeRenderer
+func NewRenderer() renderer.NodeRenderer {
+	return &Renderer{}
+}
+
+// RegisterFuncs implements renderer.NodeRenderer
+func (r *Renderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindImage, r.renderImage)
+	reg.Register(ast.KindLink, r.renderLink)
+	reg.Register(ast.KindRawHTML, r.renderRawHTML)
+	reg.Register(ast.KindHTMLBlock, r.renderHTMLBlock)
+}
+
+func writeParameter(w util.BufWriter, name, value string) {
+	_, _ = w.WriteString(`<ac:parameter ac:name="`)
+	_, _ = w.Write(util.EscapeHTML([]byte(name)))
+	_, _ = w.WriteString(`">`)
+	_, _ = w.Write(util.EscapeHTML([]byte(value)))
+	_, _ = w.WriteString(`</ac:parameter>`)
+}
+
+// renderImage emits remote images as ri:url and everything else as an
+// attachment of the page, referenced by file name
+func (r *Renderer) renderImage(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*ast.Image)
+	dest := string(n.Destination)
+
+	_, _ = w.WriteString(`<ac:image`)
+	if alt := plainText(n, source); alt != "" {
+		_, _ = w.WriteString(` ac:alt="`)
+		_, _ = w.Write(util.EscapeHTML([]byte(alt)))
+		_ = w.WriteByte('"')
+	}
+	if n.Title != nil {
+		_, _ = w.WriteString(` ac:title="`)
+		_, _ = w.Write(util.EscapeHTML(n.Title))
+		_ = w.WriteByte('"')
+	}
+	_ = w.WriteByte('>')
+	if isRemote(dest) {
+		_, _ = w.WriteString(`<ri:url ri:value="`)
+		_, _ = w.Write(util.EscapeHTML([]byte(dest)))
+		_, _ = w.WriteString(`" />`)
+	} else {
+		_, _ = w.WriteString(`<ri:attachment ri:filename="`)
+		_, _ = w.Write(util.EscapeHTML([]byte(attachmentName(dest))))
+		_, _ = w.WriteString(`" />`)
+	}
+	_, _ = w.WriteString(`</ac:image>`)
+	return ast.WalkSkipChildren, nil
+}
+
+func (r *Renderer) renderLink(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	n := node.(*ast.Link)
+	if !entering {
+		_, _ = w.WriteString("</a>")
+		return ast.WalkContinue, nil
+	}
+	_, _ = w.WriteString(`<a href="`)
+	_, _ = w.Write(util.EscapeHTML(util.URLEscape(n.Destination, true)))
+	_ = w.WriteByte('"')
+	if n.Title != nil {
+		_, _ = w.WriteString(` title="`)
+		_, _ = w.Write(util.EscapeHTML(n.Title))
+		_ = w.WriteByte('"')
+	}
+	_ = w.WriteByte('>')
+	return ast.WalkContinue, nil
+}
+
+// blockText joins the raw lines of a code block, dropping the final newline
+func blockText(n ast.Node, source []byte) string {
+	var buf bytes.Buffer
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		buf.Write(line.Value(source))
+	}
+	return string(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+// plainText collects the text of n's inline children, e.g. an image's alt text
+func plainText(n ast.Node, source []byte) string {
+	var buf bytes.Buffer
+	_ = ast.Walk(n, func(c ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch t := c.(type) {
+		case *ast.Text:
+			buf.Write(t.Segment.Value(source))
+			if t.SoftLineBreak() || t.HardLineBreak() {
+				buf.WriteByte(' ')
+			}
+		case *ast.String:
+			buf.Write(t.Value)
+		}
+		return ast.WalkContinue, nil
+	})
+	return buf.String()
+}
+
+func isRemote(dest string) bool {
+	u, err := url.Parse(dest)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+// attachmentName maps a local image path to the attachment file name Confluence stores
+func attachmentName(dest string) string {
+	if unescaped, err := url.PathUnescape(dest); err == nil {
+		dest = unescaped
+	}
+	return path.Base(dest)
+}
@@ -0,0 +1,350 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// AllowedHTMLTags are the HTML elements storage format keeps. Confluence
+// strips the rest, and Data Center rejects some of them outright.
+var AllowedHTMLTags = map[string]bool{
+	"a": true, "abbr": true, "b": true, "big": true, "blockquote": true, "br": true, "cite": true,
+	"code": true, "col": true, "colgroup": true, "dd": true, "del": true, "dfn": true, "div": true,
+	"dl": true, "dt": true, "em": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true,
+	"h6": true, "hr": true, "i": true, "img": true, "ins": true, "kbd": true, "li": true, "ol": true,
+	"p": true, "pre": true, "q": true, "s": true, "samp": true, "small": true, "span": true,
+	"strike": true, "strong": true, "sub": true, "sup": true, "table": true, "tbody": true,
+	"td": true, "tfoot": true, "th": true, "thead": true, "time": true, "tr": true, "tt": true,
+	"u": true, "ul": true, "var": true,
+}
+
+// IsStorageElement reports whether name is one of Confluence's own
+// elements (ac:, ri: or at:), which storage format always allows
+func IsStorageElement(name string) bool {
+	prefix, _, ok := strings.Cut(name, ":")
+	return ok && (prefix == "ac" || prefix == "ri" || prefix == "at")
+}
+
+// voidHTMLTags are the allowed elements without content, which XHTML
+// writes self-closed
+var voidHTMLTags = map[string]bool{"br": true, "col": true, "hr": true, "img": true}
+
+// Elements whose content goes with them when they are removed
+var droppedContentTags = map[string]bool{
+	"script": true, "style": true, "iframe": true, "object": true, "embed": true,
+	"noscript": true, "template": true, "textarea": true, "frameset": true,
+}
+
+// Attributes that hold a URL, where a script scheme would run on click or load
+var urlAttributes = map[string]bool{
+	"href": true, "src": true, "action": true, "formaction": true, "background": true,
+	"poster": true, "xlink:href": true, "cite": true,
+}
+
+var (
+	htmlTokenPattern = regexp.MustCompile(`(?s)<!--.*?-->|<!\[CDATA\[.*?\]\]>|` +
+		`<(/?)([A-Za-z][A-Za-z0-9:_.-]*)((?:\s+[^\s"'>/=]+(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'=<>` + "`" + `]+))?)*)\s*(/?)>`)
+	htmlAttributePattern = regexp.MustCompile(`([^\s"'>/=]+)(?:\s*=\s*("[^"]*"|'[^']*'|[^\s"'=<>` + "`" + `]+))?`)
+	htmlEntityPattern    = regexp.MustCompile(`^&(?:[A-Za-z][A-Za-z0-9]*|#[0-9]+|#[xX][0-9a-fA-F]+);`)
+)
+
+// HTMLIssueKind says what the sanitizer did about raw HTML
+type HTMLIssueKind int
+
+const (
+	// HTMLRemovedElement is an element storage format does not allow
+	HTMLRemovedElement HTMLIssueKind = iota
+	// HTMLRemovedAttribute is an event handler or script URL
+	HTMLRemovedAttribute
+	// HTMLInvalid is HTML that is not well-formed XHTML, such as a tag
+	// that is never closed, which Confluence would reject
+	HTMLInvalid
+)
+
+// HTMLIssue is raw HTML in the Markdown that the sanitizer removed, or
+// could not make valid storage format
+type HTMLIssue struct {
+	Offset  int // into the Markdown source
+	Kind    HTMLIssueKind
+	Message string
+}
+
+// SanitizeHTML checks the raw HTML in a document as it is rendered. It
+// removes elements outside AllowedHTMLTags, event handlers and script
+// URLs, quotes attributes and self-closes void elements, and passes each
+// removal and each tag left unbalanced to report.
+func SanitizeHTML(report func(HTMLIssue)) goldmark.Extender {
+	return &sanitizeHTML{report: report}
+}
+
+type sanitizeHTML struct {
+	report func(HTMLIssue)
+}
+
+func (e *sanitizeHTML) Extend(m goldmark.Markdown) {
+	// Ahead of the storage renderer (100), which writes raw HTML as-is
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(&sanitizeRenderer{report: e.report}, 99),
+	))
+}
+
+// openTag is a raw start tag waiting for its end tag
+type openTag struct {
+	name   string
+	offset int
+	parent ast.Node // the block it must close in
+}
+
+type sanitizeRenderer struct {
+	report func(HTMLIssue)
+	open   []openTag
+	drop   string // the element whose content is being removed
+}
+
+func (r *sanitizeRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindDocument, r.renderDocument)
+	reg.Register(ast.KindRawHTML, r.renderRawHTML)
+	reg.Register(ast.KindHTMLBlock, r.renderHTMLBlock)
+}
+
+func (r *sanitizeRenderer) renderDocument(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		r.open, r.drop = nil, ""
+		return ast.WalkContinue, nil
+	}
+	for _, tag := range r.open {
+		r.report(HTMLIssue{Offset: tag.offset, Kind: HTMLInvalid, Message: fmt.Sprintf("<%s> is never closed", tag.name)})
+	}
+	return ast.WalkContinue, nil
+}
+
+func (r *sanitizeRenderer) renderRawHTML(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		n := node.(*ast.RawHTML)
+		_, _ = w.Write(r.sanitize(source, segmentsOf(n.Segments), n.Parent()))
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+func (r *sanitizeRenderer) renderHTMLBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		n := node.(*ast.HTMLBlock)
+		segments := segmentsOf(n.Lines())
+		if n.HasClosure() {
+			segments = append(segments, n.ClosureLine)
+		}
+		_, _ = w.Write(r.sanitize(source, segments, n.Parent()))
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+func segmentsOf(segments *text.Segments) []text.Segment {
+	var all []text.Segment
+	for i := 0; i < segments.Len(); i++ {
+		all = append(all, segments.At(i))
+	}
+	return all
+}
+
+// sanitize returns the raw HTML in segments as storage format. The segments
+// are joined first, since a tag may run across lines.
+func (r *sanitizeRenderer) sanitize(source []byte, segments []text.Segment, parent ast.Node) []byte {
+	var raw []byte
+	var starts []int // where each segment begins in raw
+	for _, segment := range segments {
+		starts = append(starts, len(raw))
+		raw = append(raw, segment.Value(source)...)
+	}
+	offset := func(i int) int {
+		j := len(starts) - 1
+		for j > 0 && starts[j] > i {
+			j--
+		}
+		if j < 0 {
+			return 0
+		}
+		return segments[j].Start + i - starts[j]
+	}
+
+	var out bytes.Buffer
+	pos := 0
+	for _, m := range htmlTokenPattern.FindAllSubmatchIndex(raw, -1) {
+		r.text(&out, raw[pos:m[0]])
+		pos = m[1]
+		if m[4] < 0 {
+			// A comment or CDATA section, which may carry preserved storage
+			if r.drop == "" {
+				out.Write(expandRawComments(raw[m[0]:m[1]]))
+			}
+			continue
+		}
+		r.tag(&out, raw, m, offset(m[0]), parent)
+	}
+	r.text(&out, raw[pos:])
+	return out.Bytes()
+}
+
+// text writes the text between tags, escaping what XML would read as markup
+func (r *sanitizeRenderer) text(out *bytes.Buffer, raw []byte) {
+	if r.drop != "" {
+		return
+	}
+	for i := 0; i < len(raw); i++ {
+		switch c := raw[i]; {
+		case c == '<':
+			out.WriteString("&lt;")
+		case c == '&' && !htmlEntityPattern.Match(raw[i:]):
+			out.WriteString("&amp;")
+		default:
+			out.WriteByte(c)
+		}
+	}
+}
+
+// tag writes the tag matched by m, which starts at offset in the source
+func (r *sanitizeRenderer) tag(out *bytes.Buffer, raw []byte, m []int, offset int, parent ast.Node) {
+	source := raw[m[0]:m[1]]
+	closing, selfClosing := m[3] > m[2], m[9] > m[8]
+	name := string(raw[m[4]:m[5]])
+	if !IsStorageElement(name) {
+		name = strings.ToLower(name)
+	}
+
+	if r.drop != "" {
+		if closing && name == r.drop {
+			r.drop = ""
+		}
+		return
+	}
+	if !AllowedHTMLTags[name] && !IsStorageElement(name) {
+		if !closing {
+			r.report(HTMLIssue{Offset: offset, Kind: HTMLRemovedElement, Message: fmt.Sprintf("removed <%s>, which storage format does not allow", name)})
+			if droppedContentTags[name] && !selfClosing {
+				r.drop = name
+			}
+		}
+		return
+	}
+
+	if closing {
+		if !voidHTMLTags[name] && r.close(name, offset, parent) {
+			out.WriteString("</" + name + ">")
+		}
+		return
+	}
+
+	changed := name != string(raw[m[4]:m[5]])
+	var attrs strings.Builder
+	seen := map[string]bool{}
+	for _, a := range htmlAttributePattern.FindAllSubmatch(raw[m[6]:m[7]], -1) {
+		attr, value := string(a[1]), string(a[2])
+		lower := strings.ToLower(attr)
+		switch {
+		case strings.HasPrefix(lower, "on"):
+			r.report(HTMLIssue{Offset: offset, Kind: HTMLRemovedAttribute, Message: fmt.Sprintf("removed event handler %s from <%s>", attr, name)})
+			changed = true
+			continue
+		case urlAttributes[lower] && isScriptURL(unquote(value)):
+			r.report(HTMLIssue{Offset: offset, Kind: HTMLRemovedAttribute, Message: fmt.Sprintf("removed script URL in %s from <%s>", attr, name)})
+			changed = true
+			continue
+		case seen[attr]:
+			// XML allows an attribute once
+			changed = true
+			continue
+		}
+		seen[attr] = true
+		quoted := value
+		if value == "" {
+			quoted = `"` + attr + `"`
+		} else {
+			quoted = `"` + escapeAttribute(unquote(value)) + `"`
+		}
+		changed = changed || quoted != value
+		attrs.WriteString(" " + attr + "=" + quoted)
+	}
+
+	switch {
+	case voidHTMLTags[name]:
+		changed = changed || !selfClosing
+		selfClosing = true
+	case !selfClosing:
+		r.open = append(r.open, openTag{name: name, offset: offset, parent: parent})
+	}
+	if !changed {
+		out.Write(source)
+		return
+	}
+	out.WriteString("<" + name + attrs.String())
+	if selfClosing {
+		out.WriteString(" /")
+	}
+	out.WriteByte('>')
+}
+
+// close matches an end tag to the innermost open tag of that name,
+// reporting the tags it skips over or a block boundary it crosses. It
+// returns whether there was an open tag to close.
+func (r *sanitizeRenderer) close(name string, offset int, parent ast.Node) bool {
+	i := len(r.open) - 1
+	for i >= 0 && r.open[i].name != name {
+		i--
+	}
+	if i < 0 {
+		r.report(HTMLIssue{Offset: offset, Kind: HTMLInvalid, Message: fmt.Sprintf("</%s> closes no open <%s>", name, name)})
+		return false
+	}
+	for _, tag := range r.open[i+1:] {
+		r.report(HTMLIssue{Offset: tag.offset, Kind: HTMLInvalid, Message: fmt.Sprintf("<%s> is never closed", tag.name)})
+	}
+	if r.open[i].parent != parent {
+		r.report(HTMLIssue{Offset: offset, Kind: HTMLInvalid, Message: fmt.Sprintf("</%s> is in a different block from its <%s>", name, name)})
+	}
+	r.open = r.open[:i]
+	return true
+}
+
+// escapeAttribute escapes what XML does not allow in a double-quoted
+// attribute value, keeping entities
+func escapeAttribute(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '"':
+			b.WriteString("&quot;")
+		case c == '<':
+			b.WriteString("&lt;")
+		case c == '&' && !htmlEntityPattern.MatchString(value[i:]):
+			b.WriteString("&amp;")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// isScriptURL reports whether url runs script when followed
+func isScriptURL(url string) bool {
+	url = strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, url))
+	return strings.HasPrefix(url, "javascript:") || strings.HasPrefix(url, "vbscript:")
+}
@@ -0,0 +1,65 @@
+// Package storage renders Markdown to Confluence storage format.
+//
+// It is a goldmark extension: the stock XHTML renderer handles ordinary
+// blocks and inlines, while the storage NodeRenderer takes over the
+// constructs Confluence represents with its own elements (code macros,
+// attachments and so on).
+//
+//	md := storage.New()
+//	var buf bytes.Buffer
+//	err := md.Convert(source, &buf)
+package storage
+
+import (
+	"io"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/util"
+)
+
+// Extension installs the storage-format NodeRenderer on a goldmark.Markdown
+type Extension struct{}
+
+// Extend implements goldmark.Extender
+func (e *Extension) Extend(m goldmark.Markdown) {
+	// Ahead of the HTML block parser (900)
+	m.Parser().AddOptions(parser.WithBlockParsers(
+		util.Prioritized(&rawCommentParagraphParser{parser.NewParagraphParser()}, 850),
+	))
+	// Lower values win: this overrides both the html renderer (1000) and GFM (500)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(NewRenderer(), 100),
+		util.Prioritized(&codeRenderer{aliases: DefaultCodeAliases}, 100),
+	))
+}
+
+// New returns a goldmark.Markdown that emits Confluence storage format.
+// Extra extenders are applied after the storage extension.
+func New(extenders ...goldmark.Extender) goldmark.Markdown {
+	return goldmark.New(
+		goldmark.WithExtensions(append([]goldmark.Extender{extension.GFM, &Extension{}, Admonitions, TaskLists, Tables, Macros, Footnotes}, extenders...)...),
+		goldmark.WithParserOptions(
+			parser.WithHeadingAttribute(), // `## Title {#custom-id}`; HeadingAnchors gives the rest their ids
+		),
+		goldmark.WithRendererOptions(
+			html.WithXHTML(),  // CRITICAL: Generates <br/>, <hr/>, <img ... /> for Data Center validity
+			html.WithUnsafe(), // Allow raw HTML (in case user manually added macros)
+		),
+	)
+}
+
+// Convert renders Markdown source as storage format into w
+func Convert(source []byte, w io.Writer) error {
+	return New().Convert(source, w)
+}
+
+// CDATA wraps s in a CDATA section. Any "]]>" inside s would end the section
+// early, so it is split across two sections instead.
+func CDATA(s string) string {
+	return "<![CDATA[" + strings.ReplaceAll(s, "]]>", "]]]]><![CDATA[>") + "]]>"
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/yuin/goldmark"
+)
+
+// render converts markdown with New(extenders...)
+func render(t *testing.T, markdown string, extenders ...goldmark.Extender) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := New(extenders...).Convert([]byte(markdown), &buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestConvert(t *testing.T) {
+	for _, tt := range []struct{ markdown, storage string }{
+		{"a  \nb\n\n---", "<p>a<br />\nb</p>\n<hr />\n"},
+		{"![Alt](diagram.png)", `<p><ac:image ac:alt="Alt"><ri:attachment ri:filename="diagram.png" /></ac:image></p>` + "\n"},
+		{`![Remote](https://example.com/a.png "T")`, `<p><ac:image ac:alt="Remote" ac:title="T"><ri:url ri:value="https://example.com/a.png" /></ac:image></p>` + "\n"},
+		{"```python title=\"x y\" linenumbers\nprint(1)\n```", `<ac:structured-macro ac:name="code"><ac:parameter ac:name="language">py</ac:parameter><ac:parameter ac:name="title">x y</ac:parameter><ac:parameter ac:name="linenumbers">true</ac:parameter><ac:plain-text-body><![CDATA[print(1)]]></ac:plain-text-body></ac:structured-macro>` + "\n"},
+		{"    indented", `<ac:structured-macro ac:name="code"><ac:plain-text-body><![CDATA[indented]]></ac:plain-text-body></ac:structured-macro>` + "\n"},
+		{"> [!TIP]\n> Tip.", `<ac:structured-macro ac:name="tip"><ac:rich-text-body>` + "\n<p>Tip.</p>\n</ac:rich-text-body></ac:structured-macro>\n"},
+		{"[[toc]]", `<ac:structured-macro ac:name="toc"></ac:structured-macro>` + "\n"},
+		{"{status:green|OK} {date:2024-05-01}", `<p><ac:structured-macro ac:name="status"><ac:parameter ac:name="colour">Green</ac:parameter><ac:parameter ac:name="title">OK</ac:parameter></ac:structured-macro> <time datetime="2024-05-01" /></p>` + "\n"},
+		{"- [x] Ship due:2024-05-01", "<ac:task-list>\n<ac:task>\n<ac:task-id>1</ac:task-id>\n<ac:task-status>complete</ac:task-status>\n" + `<ac:task-body>Ship <time datetime="2024-05-01" /></ac:task-body>` + "\n</ac:task>\n</ac:task-list>\n"},
+	} {
+		if got := render(t, tt.markdown); got != tt.storage {
+			t.Errorf("%q rendered as\n%s\nwant\n%s", tt.markdown, got, tt.storage)
+		}
+	}
+}
+
+func TestCDATA(t *testing.T) {
+	if got, want := CDATA("a ]]> b"), "<![CDATA[a ]]]]><![CDATA[> b]]>"; got != want {
+		t.Errorf("CDATA gave %s, want %s", got, want)
+	}
+	code := render(t, "```\nplain ]]> here\n```")
+	if !strings.Contains(code, "<![CDATA[plain ]]]]><![CDATA[> here]]>") {
+		t.Errorf("code block did not split the CDATA section:\n%s", code)
+	}
+}
+
+func TestParseCodeInfo(t *testing.T) {
+	for _, tt := range []struct {
+		info     string
+		language string
+		params   []MacroParam
+	}{
+		{"", "", nil},
+		{"go", "go", nil},
+		{`go title="main.go" linenumbers`, "go", []MacroParam{{"title", "main.go"}, {"linenumbers", "true"}}},
+		{`sh title="say \"hi\""`, "sh", []MacroParam{{"title", `say "hi"`}}},
+		{"collapse=true", "", []MacroParam{{"collapse", "true"}}},
+	} {
+		language, params := ParseCodeInfo(tt.info)
+		if language != tt.language || !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("%q parsed as %q %v, want %q %v", tt.info, language, params, tt.language, tt.params)
+		}
+	}
+}
+
+func TestCodeAliases(t *testing.T) {
+	for language, want := range map[string]string{"Python": "py", "language-yaml": "yml", "go": "go"} {
+		if got := ResolveCodeLanguage(language, DefaultCodeAliases); got != want {
+			t.Errorf("%s resolved to %s, want %s", language, got, want)
+		}
+	}
+	for alias, language := range DefaultCodeAliases {
+		if !CodeLanguages[language] {
+			t.Errorf("alias %s names %s, which the code macro does not highlight", alias, language)
+		}
+	}
+
+	got := render(t, "```kotlin\nx\n```", CodeAliases(map[string]string{"kotlin": "java"}))
+	if want := `<ac:parameter ac:name="language">java</ac:parameter>`; !strings.Contains(got, want) {
+		t.Errorf("aliases not applied:\n%s", got)
+	}
+}
+
+func TestHeadingAnchors(t *testing.T) {
+	got := render(t, "## Setup\n\n## Setup\n\n## Notes {#own}\n\n[first](#setup) [second](#setup-1) [own](#own)", HeadingAnchors("My Guide"))
+	for _, want := range []string{
+		`<h2 id="MyGuide-Setup">Setup</h2>`,
+		`<h2 id="MyGuide-Setup.1">Setup</h2>`,
+		`<h2 id="MyGuide-own"><ac:structured-macro ac:name="anchor"><ac:parameter ac:name="">own</ac:parameter></ac:structured-macro>Notes</h2>`,
+		`<ac:link ac:anchor="Setup"><ac:link-body>first</ac:link-body></ac:link>`,
+		`<ac:link ac:anchor="Setup.1"><ac:link-body>second</ac:link-body></ac:link>`,
+		`<ac:link ac:anchor="own"><ac:link-body>own</ac:link-body></ac:link>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("storage lacks %s:\n%s", want, got)
+		}
+	}
+
+	want := map[string]string{"setup": "Setup", "setup-1": "Setup.1", "own": "own"}
+	if anchors := AnchorsByFragment([]byte("## Setup\n\n## Setup\n\n## Notes {#own}")); !reflect.DeepEqual(anchors, want) {
+		t.Errorf("anchors %v, want %v", anchors, want)
+	}
+}
+
+func TestResolvers(t *testing.T) {
+	users := Mentions(func(name string) *UserRef {
+		if name == "alice" {
+			return &UserRef{AccountID: "557058:abc"}
+		}
+		return nil
+	})
+	pages := PageLinks(func(dest string) *PageRef {
+		if dest == "other.md" {
+			return &PageRef{Title: "Other Page", Space: "DOC"}
+		}
+		return nil
+	})
+	got := render(t, "Hi @alice and @bob, see [Other](other.md) and [site](https://example.com).", users, pages)
+	want := `<p>Hi <ac:link><ri:user ri:account-id="557058:abc" /></ac:link> and @bob, see ` +
+		`<ac:link><ri:page ri:content-title="Other Page" ri:space-key="DOC" /><ac:link-body>Other</ac:link-body></ac:link> and ` +
+		`<a href="https://example.com">site</a>.</p>` + "\n"
+	if got != want {
+		t.Errorf("rendered\n%s\nwant\n%s", got, want)
+	}
+}
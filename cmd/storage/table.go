@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"regexp"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// TableSettingsComment carries what a GFM table cannot say (layout, width,
+// column widths, numbered column, sorting...) as the original <table> start
+// tag and <colgroup>. Pull writes it on the line above the table.
+func TableSettingsComment(startTag string) string {
+	return "<!-- confluence-table: " + startTag + " -->"
+}
+
+var tableSettingsPattern = regexp.MustCompile(`^<!-- confluence-table: (<table[\s\S]*) -->\s*$`)
+
+// tableSettingsAttr is where the settings ride on the east.Table node
+const tableSettingsAttr = "data-confluence-table"
+
+// Tables renders GFM tables with Confluence's cell alignment and restores
+// table settings preserved on pull
+var Tables goldmark.Extender = &tables{}
+
+type tables struct{}
+
+func (e *tables) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(util.Prioritized(&tableSettingsTransformer{}, 100)),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(&tableRenderer{}, 100),
+	))
+}
+
+// tableSettingsTransformer moves a settings comment onto the table after it
+type tableSettingsTransformer struct{}
+
+func (t *tableSettingsTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	var blocks []*ast.HTMLBlock
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if b, ok := n.(*ast.HTMLBlock); ok && entering {
+			if _, ok := b.NextSibling().(*east.Table); ok {
+				blocks = append(blocks, b)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, block := range blocks {
+		m := tableSettingsPattern.FindSubmatch(block.Lines().Value(source))
+		if m == nil {
+			continue
+		}
+		block.NextSibling().SetAttributeString(tableSettingsAttr, m[1])
+		block.Parent().RemoveChild(block.Parent(), block)
+	}
+}
+
+type tableRenderer struct{}
+
+func (r *tableRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(east.KindTable, r.renderTable)
+	reg.Register(east.KindTableHeader, r.renderTableHeader)
+	reg.Register(east.KindTableRow, r.renderTableRow)
+	reg.Register(east.KindTableCell, r.renderTableCell)
+}
+
+func (r *tableRenderer) renderTable(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		if hasBodyRows(node) {
+			_, _ = w.WriteString("</tbody>\n")
+		}
+		_, _ = w.WriteString("</table>\n")
+		return ast.WalkContinue, nil
+	}
+	if settings, ok := node.AttributeString(tableSettingsAttr); ok {
+		_, _ = w.Write(settings.([]byte))
+	} else {
+		_, _ = w.WriteString("<table>")
+	}
+	_ = w.WriteByte('\n')
+	return ast.WalkContinue, nil
+}
+
+func hasBodyRows(table ast.Node) bool {
+	for c := table.FirstChild(); c != nil; c = c.NextSibling() {
+		if c.Kind() == east.KindTableRow {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *tableRenderer) renderTableHeader(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		_, _ = w.WriteString("<thead>\n<tr>\n")
+		return ast.WalkContinue, nil
+	}
+	_, _ = w.WriteString("</tr>\n</thead>\n")
+	if hasBodyRows(node.Parent()) {
+		_, _ = w.WriteString("<tbody>\n")
+	}
+	return ast.WalkContinue, nil
+}
+
+func (r *tableRenderer) renderTableRow(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		if node.PreviousSibling() == nil {
+			// A table without a header row
+			_, _ = w.WriteString("<tbody>\n")
+		}
+		_, _ = w.WriteString("<tr>\n")
+	} else {
+		_, _ = w.WriteString("</tr>\n")
+	}
+	return ast.WalkContinue, nil
+}
+
+func (r *tableRenderer) renderTableCell(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	n := node.(*east.TableCell)
+	tag := "td"
+	if node.Parent().Kind() == east.KindTableHeader {
+		tag = "th"
+	}
+	if !entering {
+		_, _ = w.WriteString("</" + tag + ">\n")
+		return ast.WalkContinue, nil
+	}
+	_, _ = w.WriteString("<" + tag)
+	if n.Alignment != east.AlignNone {
+		_, _ = w.WriteString(` style="text-align: ` + n.Alignment.String() + `;"`)
+	}
+	_ = w.WriteByte('>')
+	return ast.WalkContinue, nil
+}
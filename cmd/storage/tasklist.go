@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// KindTaskList is the NodeKind of TaskList
+var KindTaskList = ast.NewNodeKind("TaskList")
+
+// TaskList is a list whose every item is a `[ ]`/`[x]` task, rendered as ac:task-list
+type TaskList struct {
+	ast.BaseBlock
+}
+
+// Kind implements ast.Node
+func (n *TaskList) Kind() ast.NodeKind {
+	return KindTaskList
+}
+
+// Dump implements ast.Node
+func (n *TaskList) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+// KindTask is the NodeKind of Task
+var KindTask = ast.NewNodeKind("Task")
+
+// Task is one ac:task. IDs only need to be unique within the page.
+type Task struct {
+	ast.BaseBlock
+	ID   int
+	Done bool
+}
+
+// Kind implements ast.Node
+func (n *Task) Kind() ast.NodeKind {
+	return KindTask
+}
+
+// Dump implements ast.Node
+func (n *Task) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"ID": strconv.Itoa(n.ID), "Done": strconv.FormatBool(n.Done)}, nil)
+}
+
+// KindTaskAssignee is the NodeKind of TaskAssignee
+var KindTaskAssignee = ast.NewNodeKind("TaskAssignee")
+
+// TaskAssignee is an `@user` inside a task, rendered as a user link
+type TaskAssignee struct {
+	ast.BaseInline
+	User string
+}
+
+// Kind implements ast.Node
+func (n *TaskAssignee) Kind() ast.NodeKind {
+	return KindTaskAssignee
+}
+
+// Dump implements ast.Node
+func (n *TaskAssignee) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"User": n.User}, nil)
+}
+
+// KindTaskDue is the NodeKind of TaskDue
+var KindTaskDue = ast.NewNodeKind("TaskDue")
+
+// TaskDue is a `due:YYYY-MM-DD` (or `📅 YYYY-MM-DD`) inside a task, rendered as a <time>
+type TaskDue struct {
+	ast.BaseInline
+	Date string
+}
+
+// Kind implements ast.Node
+func (n *TaskDue) Kind() ast.NodeKind {
+	return KindTaskDue
+}
+
+// Dump implements ast.Node
+func (n *TaskDue) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Date": n.Date}, nil)
+}
+
+// TaskLists turns GFM task lists into Confluence ac:task-list macros
+var TaskLists goldmark.Extender = &taskLists{}
+
+type taskLists struct{}
+
+func (e *taskLists) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithASTTransformers(util.Prioritized(&taskListTransformer{}, 100)),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(&taskListRenderer{}, 100),
+	))
+}
+
+var (
+	// Assignees are Server usernames or Cloud account IDs
+	taskAssigneePattern = regexp.MustCompile(`(?:^|\s)@([\w.:-]*\w)`)
+	taskDuePattern      = regexp.MustCompile(`(?:due:|📅\s*)(\d{4}-\d{2}-\d{2})`)
+	accountIDPattern    = regexp.MustCompile(`^(?:[0-9a-f]{24}|\d+:[0-9a-f-]{36})$`)
+)
+
+// taskListTransformer replaces lists made only of task items. Lists mixing
+// tasks and plain items stay lists and keep their checkboxes as text.
+type taskListTransformer struct{}
+
+func (t *taskListTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	var lists []*ast.List
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if l, ok := n.(*ast.List); ok && entering && isTaskList(l) {
+			lists = append(lists, l)
+		}
+		return ast.WalkContinue, nil
+	})
+
+	id := 0
+	for _, list := range lists {
+		taskList := &TaskList{}
+		for item := list.FirstChild(); item != nil; {
+			next := item.NextSibling()
+			id++
+			taskList.AppendChild(taskList, newTask(item, id, source))
+			item = next
+		}
+		list.Parent().ReplaceChild(list.Parent(), list, taskList)
+	}
+}
+
+func isTaskList(l *ast.List) bool {
+	if l.ChildCount() == 0 {
+		return false
+	}
+	for item := l.FirstChild(); item != nil; item = item.NextSibling() {
+		if taskCheckBox(item) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func taskCheckBox(item ast.Node) *east.TaskCheckBox {
+	if block := item.FirstChild(); block != nil {
+		box, _ := block.FirstChild().(*east.TaskCheckBox)
+		return box
+	}
+	return nil
+}
+
+// newTask moves item's children into a Task. The body of an ac:task is
+// inline content, so a loose item's leading paragraph loses its <p>.
+func newTask(item ast.Node, id int, source []byte) *Task {
+	box := taskCheckBox(item)
+	task := &Task{ID: id, Done: box.IsChecked}
+	first := item.FirstChild()
+	first.RemoveChild(first, box)
+	if para, ok := first.(*ast.Paragraph); ok {
+		block := ast.NewTextBlock()
+		block.SetLines(para.Lines())
+		for c := para.FirstChild(); c != nil; {
+			next := c.NextSibling()
+			block.AppendChild(block, c)
+			c = next
+		}
+		item.ReplaceChild(item, para, block)
+		first = block
+	}
+	extractTaskMetadata(first, source)
+
+	for c := item.FirstChild(); c != nil; {
+		next := c.NextSibling()
+		task.AppendChild(task, c)
+		c = next
+	}
+	return task
+}
+
+// extractTaskMetadata splits assignees and due dates out of the text of a task
+func extractTaskMetadata(block ast.Node, source []byte) {
+	for c := block.FirstChild(); c != nil; {
+		next := c.NextSibling()
+		if t, ok := c.(*ast.Text); ok {
+			splitTaskText(block, t, source)
+		}
+		c = next
+	}
+}
+
+func splitTaskText(block ast.Node, t *ast.Text, source []byte) {
+	value := t.Segment.Value(source)
+	type match struct {
+		start, stop int
+		node        ast.Node
+	}
+	var matches []match
+	for _, m := range taskAssigneePattern.FindAllSubmatchIndex(value, -1) {
+		// Keep the whitespace before the @ as text
+		matches = append(matches, match{m[2] - 1, m[3], &TaskAssignee{User: string(value[m[2]:m[3]])}})
+	}
+	for _, m := range taskDuePattern.FindAllSubmatchIndex(value, -1) {
+		matches = append(matches, match{m[0], m[1], &TaskDue{Date: string(value[m[2]:m[3]])}})
+	}
+	if len(matches) == 0 {
+		return
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].start < matches[j].start })
+
+	pos := 0
+	for _, m := range matches {
+		if m.start < pos {
+			continue
+		}
+		if m.start > pos {
+			block.InsertBefore(block, t, ast.NewTextSegment(text.NewSegment(t.Segment.Start+pos, t.Segment.Start+m.start)))
+		}
+		block.InsertBefore(block, t, m.node)
+		pos = m.stop
+	}
+	rest := ast.NewTextSegment(text.NewSegment(t.Segment.Start+pos, t.Segment.Stop))
+	rest.SetSoftLineBreak(t.SoftLineBreak())
+	rest.SetHardLineBreak(t.HardLineBreak())
+	block.ReplaceChild(block, t, rest)
+}
+
+type taskListRenderer struct{}
+
+func (r *taskListRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindTaskList, r.renderTaskList)
+	reg.Register(KindTask, r.renderTask)
+	reg.Register(KindTaskAssignee, r.renderTaskAssignee)
+	reg.Register(KindTaskDue, r.renderTaskDue)
+	reg.Register(east.KindTaskCheckBox, r.renderTaskCheckBox)
+}
+
+func (r *taskListRenderer) renderTaskList(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		_, _ = w.WriteString("<ac:task-list>\n")
+	} else {
+		_, _ = w.WriteString("</ac:task-list>\n")
+	}
+	return ast.WalkContinue, nil
+}
+
+func (r *taskListRenderer) renderTask(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	n := node.(*Task)
+	if !entering {
+		_, _ = w.WriteString("</ac:task-body>\n</ac:task>\n")
+		return ast.WalkContinue, nil
+	}
+	status := "incomplete"
+	if n.Done {
+		status = "complete"
+	}
+	_, _ = w.WriteString("<ac:task>\n<ac:task-id>")
+	_, _ = w.WriteString(strconv.Itoa(n.ID))
+	_, _ = w.WriteString("</ac:task-id>\n<ac:task-status>")
+	_, _ = w.WriteString(status)
+	_, _ = w.WriteString("</ac:task-status>\n<ac:task-body>")
+	return ast.WalkContinue, nil
+}
+
+func (r *taskListRenderer) renderTaskAssignee(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	writeUserLink(w, *GuessUser(node.(*TaskAssignee).User))
+	return ast.WalkSkipChildren, nil
+}
+
+func (r *taskListRenderer) renderTaskDue(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		_, _ = w.WriteString(`<time datetime="` + node.(*TaskDue).Date + `" />`)
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+// renderTaskCheckBox keeps the box of a task in a mixed list as text, since
+// Confluence strips <input> elements
+func (r *taskListRenderer) renderTaskCheckBox(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	if node.(*east.TaskCheckBox).IsChecked {
+		_, _ = w.WriteString("[x] ")
+	} else {
+		_, _ = w.WriteString("[ ] ")
+	}
+	return ast.WalkContinue, nil
+}
@@ -0,0 +1,267 @@
+package wiki
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/wmorley/scribe-cli/storage"
+	"github.com/yuin/goldmark/ast"
+	east "github.com/yuin/goldmark/extension/ast"
+)
+
+// spans are the wiki text effects, a marker on either side of a phrase,
+// and the element each becomes
+var spans = map[string]string{"*": "strong", "_": "em", "-": "del", "+": "u", "^": "sup", "~": "sub", "??": "cite"}
+
+var urlPattern = regexp.MustCompile(`^(?:https?|ftp)://[^\s\]|]*[^\s\]|.,;:!?)]`)
+
+// inlines parses the text of a paragraph, heading, list item or cell into parent
+func (p *parser) inlines(parent ast.Node, s string) {
+	var buf strings.Builder
+	flush := func() *ast.Text {
+		if buf.Len() == 0 {
+			return nil
+		}
+		t := p.text(buf.String())
+		parent.AppendChild(parent, t)
+		buf.Reset()
+		return t
+	}
+	// Raw text leaves line breaks to the caller
+	lineBreak := func(hard bool) {
+		flush()
+		if hard {
+			parent.AppendChild(parent, html("<br />\n"))
+		} else {
+			parent.AppendChild(parent, html("\n"))
+		}
+	}
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\n':
+			lineBreak(false)
+			i++
+			continue
+		case strings.HasPrefix(s[i:], `\\`):
+			lineBreak(true)
+			i += 2
+			for i < len(s) && (s[i] == ' ' || s[i] == '\n') {
+				i++
+			}
+			continue
+		case c == '\\' && i+1 < len(s):
+			buf.WriteByte(s[i+1])
+			i += 2
+			continue
+		case strings.HasPrefix(s[i:], "{{"):
+			if end := strings.Index(s[i+2:], "}}"); end > 0 {
+				flush()
+				code := ast.NewCodeSpan()
+				code.AppendChild(code, p.text(s[i+2:i+2+end]))
+				parent.AppendChild(parent, code)
+				i += end + 4
+				continue
+			}
+		case c == '[':
+			if end := strings.IndexByte(s[i:], ']'); end > 1 {
+				if node := p.link(s[i+1 : i+end]); node != nil {
+					flush()
+					parent.AppendChild(parent, node)
+					i += end + 1
+					continue
+				}
+			}
+		case c == '!':
+			if end := strings.IndexByte(s[i+1:], '!'); end > 0 {
+				if node := p.image(s[i+1 : i+1+end]); node != nil {
+					flush()
+					parent.AppendChild(parent, node)
+					i += end + 2
+					continue
+				}
+			}
+		case c == '{':
+			if end := strings.IndexByte(s[i:], '}'); end > 1 {
+				if node, ok := p.inlineMacro(s[i+1 : i+end]); ok {
+					flush()
+					if node != nil {
+						parent.AppendChild(parent, node)
+					}
+					i += end + 1
+					continue
+				}
+			}
+		case (i == 0 || !isWordByte(s[i-1])) && urlPattern.MatchString(s[i:]):
+			url := urlPattern.FindString(s[i:])
+			flush()
+			link := newLink(url)
+			link.AppendChild(link, p.text(url))
+			parent.AppendChild(parent, link)
+			i += len(url)
+			continue
+		}
+		if marker, phrase, ok := span(s, i); ok {
+			flush()
+			p.span(parent, spans[marker], phrase)
+			i += len(phrase) + 2*len(marker)
+			continue
+		}
+		buf.WriteByte(c)
+		i++
+	}
+	flush()
+}
+
+// span finds the phrase of a text effect opening at i. As in Confluence the
+// opening marker follows a non-word character and precedes a non-space, and
+// the closing one is the reverse, on the same line.
+func span(s string, i int) (string, string, bool) {
+	marker := s[i : i+1]
+	if strings.HasPrefix(s[i:], "??") {
+		marker = "??"
+	}
+	if spans[marker] == "" || (i > 0 && isWordByte(s[i-1])) {
+		return "", "", false
+	}
+	start := i + len(marker)
+	if start >= len(s) || s[start] == ' ' || s[start] == '\n' || s[start] == marker[0] {
+		return "", "", false
+	}
+	for j := start + 1; j+len(marker) <= len(s); j++ {
+		if s[j] == '\n' {
+			break
+		}
+		end := j + len(marker)
+		if s[j:end] == marker && s[j-1] != ' ' && (end == len(s) || !isWordByte(s[end])) {
+			return marker, s[start:j], true
+		}
+	}
+	return "", "", false
+}
+
+func isWordByte(c byte) bool {
+	return c >= 0x80 || c == '_' || ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// span appends phrase as the element of a text effect. The storage
+// format shares the HTML of those Markdown has no syntax for.
+func (p *parser) span(parent ast.Node, element, phrase string) {
+	var node ast.Node
+	switch element {
+	case "strong":
+		node = ast.NewEmphasis(2)
+	case "em":
+		node = ast.NewEmphasis(1)
+	case "del":
+		node = east.NewStrikethrough()
+	default:
+		parent.AppendChild(parent, html("<"+element+">"))
+		p.inlines(parent, phrase)
+		parent.AppendChild(parent, html("</"+element+">"))
+		return
+	}
+	p.inlines(node, phrase)
+	parent.AppendChild(parent, node)
+}
+
+func newLink(dest string) *ast.Link {
+	link := ast.NewLink()
+	link.Destination = []byte(dest)
+	return link
+}
+
+// labelledLink is a link to dest showing label, or dest itself
+func (p *parser) labelledLink(dest, label string) *ast.Link {
+	link := newLink(dest)
+	if label == "" {
+		link.AppendChild(link, p.text(dest))
+	} else {
+		p.inlines(link, label)
+	}
+	return link
+}
+
+// link parses the inside of `[label|target]` or `[target]`: a URL, an
+// `#anchor` on the page, a `~username`, a `^attachment` or a
+// `SPACE:Page Title#anchor`
+func (p *parser) link(inner string) ast.Node {
+	label, target, ok := strings.Cut(inner, "|")
+	if !ok {
+		label, target = "", inner
+	}
+	target = strings.TrimSpace(target)
+	if target == "" || strings.Contains(inner, "\n") {
+		return nil
+	}
+	switch {
+	case urlPattern.MatchString(target) || strings.HasPrefix(target, "mailto:"):
+		return p.labelledLink(target, label)
+	case strings.HasPrefix(target, "~"):
+		return &storage.Mention{User: *storage.GuessUser(target[1:])}
+	case strings.HasPrefix(target, "^"):
+		return p.labelledLink(target[1:], label)
+	}
+
+	var page storage.PageRef
+	rest, anchor, _ := strings.Cut(target, "#")
+	page.Anchor = anchor
+	if space, title, ok := strings.Cut(rest, ":"); ok && !strings.Contains(space, " ") {
+		page.Space, page.Title = space, title
+	} else {
+		page.Title = rest
+	}
+	link := &storage.PageLink{Page: page}
+	if label != "" {
+		p.inlines(link, label)
+	}
+	return link
+}
+
+// image parses the inside of `!file.png!` or `!https://host/logo.png|alt=Logo!`
+func (p *parser) image(inner string) ast.Node {
+	src, options, _ := strings.Cut(inner, "|")
+	if src == "" || strings.ContainsAny(src, " \t\n") || !strings.Contains(src, ".") {
+		return nil
+	}
+	image := ast.NewImage(newLink(src))
+	for _, option := range strings.Split(options, ",") {
+		if alt, ok := strings.CutPrefix(strings.TrimSpace(option), "alt="); ok {
+			image.AppendChild(image, p.text(strings.Trim(alt, `"`)))
+		}
+	}
+	return image
+}
+
+// inlineMacro parses `{status:colour=Green|title=Done}` and `{anchor:name}`.
+// Colour tags are dropped, keeping their text.
+func (p *parser) inlineMacro(inner string) (ast.Node, bool) {
+	name, params, _ := strings.Cut(inner, ":")
+	positional, named := macroParams(params)
+	switch name {
+	case "status":
+		status := &storage.Status{Colour: "Grey"}
+		for _, param := range named {
+			switch strings.ToLower(param.Name) {
+			case "colour", "color":
+				if colour, ok := storage.StatusColours[strings.ToLower(param.Value)]; ok {
+					status.Colour = colour
+				}
+			case "title":
+				status.Title = param.Value
+			case "subtle":
+				status.Subtle = param.Value == "true"
+			}
+		}
+		return status, true
+	case "anchor":
+		if positional == "" {
+			return nil, false
+		}
+		return &storage.Anchor{Name: positional}, true
+	case "color":
+		return nil, true
+	}
+	return nil, false
+}
@@ -0,0 +1,383 @@
+// Package wiki reads Confluence wiki markup, the `h1.`, `*bold*`, `{code}`
+// and `||table||` syntax of the old editor, into a goldmark document that
+// the storage renderer writes as storage format:
+//
+//	var buf bytes.Buffer
+//	err := wiki.Convert(source, &buf)
+//
+// Macros it does not know stay as text.
+package wiki
+
+import (
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/wmorley/scribe-cli/storage"
+	"github.com/yuin/goldmark/ast"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+// Convert renders wiki markup source as storage format into w
+func Convert(source []byte, w io.Writer) error {
+	doc, src := Parse(source)
+	// Code languages are already the code macro's own, so none are aliased
+	return storage.New(storage.HeadingAnchors(""), storage.Mentions(nil), storage.CodeAliases(nil)).Renderer().Render(w, src, doc)
+}
+
+// Parse reads wiki markup into a goldmark document. The text of its nodes
+// points into the returned source, which rendering needs alongside it.
+func Parse(source []byte) (ast.Node, []byte) {
+	p := &parser{}
+	doc := ast.NewDocument()
+	p.blocks(doc, strings.Split(strings.ReplaceAll(string(source), "\r\n", "\n"), "\n"))
+	return doc, p.src
+}
+
+type parser struct {
+	src []byte
+}
+
+// text appends s to the source and returns a text node holding it
+func (p *parser) text(s string) *ast.Text {
+	start := len(p.src)
+	p.src = append(p.src, s...)
+	t := ast.NewTextSegment(text.NewSegment(start, len(p.src)))
+	t.SetRaw(true) // wiki escapes were resolved while parsing, and Markdown's do not apply
+	return t
+}
+
+// html returns a node written out as it is
+func html(s string) *ast.String {
+	n := ast.NewString([]byte(s))
+	n.SetCode(true)
+	return n
+}
+
+var (
+	headingPattern = regexp.MustCompile(`^h([1-6])\.\s*(.*)$`)
+	listPattern    = regexp.MustCompile(`^([*#]+|-)\s+(.*)$`)
+	rulePattern    = regexp.MustCompile(`^-{4,}$`)
+	macroPattern   = regexp.MustCompile(`^\{([A-Za-z]+)(?::([^}]*))?\}(.*)$`)
+)
+
+// blockMacros are the macros whose body runs to a closing `{name}`
+var blockMacros = map[string]bool{
+	"code": true, "noformat": true, "quote": true, "expand": true,
+	"info": true, "note": true, "tip": true, "warning": true, "panel": true,
+}
+
+func (p *parser) blocks(parent ast.Node, lines []string) {
+	for i := 0; i < len(lines); {
+		line := strings.TrimSpace(lines[i])
+		if line == "" {
+			i++
+			continue
+		}
+		if next, ok := p.block(parent, lines, i); ok {
+			i = next
+			continue
+		}
+		i = p.paragraph(parent, lines, i)
+	}
+}
+
+// block parses the block starting at line i, other than a paragraph, and
+// returns the line after it
+func (p *parser) block(parent ast.Node, lines []string, i int) (int, bool) {
+	line := strings.TrimSpace(lines[i])
+	if m := headingPattern.FindStringSubmatch(line); m != nil {
+		level, _ := strconv.Atoi(m[1])
+		heading := ast.NewHeading(level)
+		p.inlines(heading, m[2])
+		parent.AppendChild(parent, heading)
+		return i + 1, true
+	}
+	if quote, ok := strings.CutPrefix(line, "bq. "); ok {
+		blockquote := ast.NewBlockquote()
+		paragraph := ast.NewParagraph()
+		p.inlines(paragraph, quote)
+		blockquote.AppendChild(blockquote, paragraph)
+		parent.AppendChild(parent, blockquote)
+		return i + 1, true
+	}
+	if rulePattern.MatchString(line) {
+		parent.AppendChild(parent, ast.NewThematicBreak())
+		return i + 1, true
+	}
+	if listPattern.MatchString(line) {
+		return p.list(parent, lines, i), true
+	}
+	if strings.HasPrefix(line, "|") {
+		return p.table(parent, lines, i), true
+	}
+	if m := macroPattern.FindStringSubmatch(line); m != nil {
+		return p.macro(parent, lines, i, m[1], m[2], m[3])
+	}
+	return i, false
+}
+
+// startsBlock reports whether line begins a block that ends a paragraph
+func (p *parser) startsBlock(line string) bool {
+	if m := macroPattern.FindStringSubmatch(line); m != nil {
+		return blockMacros[m[1]] || m[1] == "toc"
+	}
+	return headingPattern.MatchString(line) || strings.HasPrefix(line, "bq. ") || rulePattern.MatchString(line) ||
+		listPattern.MatchString(line) || strings.HasPrefix(line, "|")
+}
+
+func (p *parser) paragraph(parent ast.Node, lines []string, i int) int {
+	var text []string
+	for ; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || (len(text) > 0 && p.startsBlock(line)) {
+			break
+		}
+		text = append(text, line)
+	}
+	paragraph := ast.NewParagraph()
+	p.inlines(paragraph, strings.Join(text, "\n"))
+	parent.AppendChild(parent, paragraph)
+	return i
+}
+
+// macro parses a `{toc}` line or a macro with a body. Unclosed and unknown
+// macros are left to the paragraph.
+func (p *parser) macro(parent ast.Node, lines []string, i int, name, params, rest string) (int, bool) {
+	positional, named := macroParams(params)
+	if name == "toc" && strings.TrimSpace(rest) == "" {
+		toc := &storage.TOC{Params: named}
+		parent.AppendChild(parent, toc)
+		return i + 1, true
+	}
+	if !blockMacros[name] {
+		return i, false
+	}
+	body, next, ok := macroBody(lines, i, rest, name)
+	if !ok {
+		return i, false
+	}
+
+	var block ast.Node
+	switch name {
+	case "code", "noformat":
+		language := positional
+		if name == "noformat" {
+			language = ""
+		} else if value, ok := paramValue(named, "language"); ok {
+			language = value
+		}
+		parent.AppendChild(parent, p.codeBlock(codeInfo(language, named), strings.Trim(body, "\n")))
+		return next, true
+	case "quote":
+		block = ast.NewBlockquote()
+	case "expand":
+		block = &storage.Expand{Title: positional}
+		if title, ok := paramValue(named, "title"); ok {
+			block.(*storage.Expand).Title = title
+		}
+	default:
+		title, _ := paramValue(named, "title")
+		block = &storage.Admonition{Macro: name, Title: title}
+	}
+	p.blocks(block, strings.Split(body, "\n"))
+	parent.AppendChild(parent, block)
+	return next, true
+}
+
+// macroBody returns the text from after the opening tag on line i, whose
+// remainder is rest, up to the closing `{name}`, and the line after it
+func macroBody(lines []string, i int, rest, name string) (string, int, bool) {
+	closing := "{" + name + "}"
+	var body []string
+	for j := i; j < len(lines); j++ {
+		line := lines[j]
+		if j == i {
+			line = rest
+		}
+		if k := strings.Index(line, closing); k >= 0 {
+			body = append(body, line[:k])
+			return strings.Join(body, "\n"), j + 1, true
+		}
+		body = append(body, line)
+	}
+	return "", i, false
+}
+
+// macroParams splits `java|title=Example` into the positional parameter
+// and the named ones
+func macroParams(params string) (string, []storage.MacroParam) {
+	var positional string
+	var named []storage.MacroParam
+	for _, param := range strings.Split(params, "|") {
+		if param = strings.TrimSpace(param); param == "" {
+			continue
+		}
+		if name, value, ok := strings.Cut(param, "="); ok {
+			named = append(named, storage.MacroParam{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)})
+		} else if positional == "" {
+			positional = param
+		}
+	}
+	return positional, named
+}
+
+func paramValue(params []storage.MacroParam, name string) (string, bool) {
+	for _, param := range params {
+		if strings.EqualFold(param.Name, name) {
+			return param.Value, true
+		}
+	}
+	return "", false
+}
+
+// codeInfo is the fence info string carrying a {code} macro's language and
+// the parameters the code macro takes, such as `java title="Main"`
+func codeInfo(language string, params []storage.MacroParam) string {
+	words := []string{language}
+	for _, param := range params {
+		if name := strings.ToLower(param.Name); storage.CodeParameters[name] {
+			value := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(param.Value)
+			words = append(words, name+`="`+value+`"`)
+		}
+	}
+	return strings.TrimSpace(strings.Join(words, " "))
+}
+
+func (p *parser) codeBlock(info, code string) ast.Node {
+	var infoText *ast.Text
+	if info != "" {
+		infoText = p.text(info)
+	}
+	block := ast.NewFencedCodeBlock(infoText)
+	for _, line := range strings.Split(code, "\n") {
+		start := len(p.src)
+		p.src = append(p.src, line+"\n"...)
+		block.Lines().Append(text.NewSegment(start, len(p.src)))
+	}
+	return block
+}
+
+// list parses consecutive `*`, `#` and `-` items, nested by the length of
+// their marker (`*#` is a numbered list inside a bullet)
+func (p *parser) list(parent ast.Node, lines []string, i int) int {
+	type level struct {
+		list *ast.List
+		item *ast.ListItem
+	}
+	var levels []level
+	for ; i < len(lines); i++ {
+		m := listPattern.FindStringSubmatch(strings.TrimSpace(lines[i]))
+		if m == nil {
+			break
+		}
+		markers := strings.ReplaceAll(m[1], "-", "*")
+		if len(levels) > len(markers) {
+			levels = levels[:len(markers)]
+		}
+		for depth := 0; depth < len(markers); depth++ {
+			if depth < len(levels) && listMarker(markers[depth]) == levels[depth].list.Marker {
+				continue
+			}
+			list := ast.NewList(listMarker(markers[depth]))
+			if list.IsOrdered() {
+				list.Start = 1
+			}
+			if depth == 0 {
+				parent.AppendChild(parent, list)
+			} else {
+				owner := levels[depth-1].item
+				if owner == nil {
+					owner = ast.NewListItem(2)
+					levels[depth-1].list.AppendChild(levels[depth-1].list, owner)
+					levels[depth-1].item = owner
+				}
+				owner.AppendChild(owner, list)
+			}
+			levels = append(levels[:depth], level{list: list})
+		}
+		item := ast.NewListItem(2)
+		textBlock := ast.NewTextBlock()
+		p.inlines(textBlock, m[2])
+		item.AppendChild(item, textBlock)
+		top := &levels[len(levels)-1]
+		top.list.AppendChild(top.list, item)
+		top.item = item
+	}
+	return i
+}
+
+func listMarker(marker byte) byte {
+	if marker == '#' {
+		return '.'
+	}
+	return '*'
+}
+
+// table parses consecutive `|` rows; a first row of `||` cells is the header
+func (p *parser) table(parent ast.Node, lines []string, i int) int {
+	table := east.NewTable()
+	columns := 0
+	for ; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(line, "|") {
+			break
+		}
+		cells := splitCells(line)
+		columns = max(columns, len(cells))
+		row := east.NewTableRow(nil)
+		for _, content := range cells {
+			cell := east.NewTableCell()
+			p.inlines(cell, strings.TrimSpace(content))
+			row.AppendChild(row, cell)
+		}
+		if strings.HasPrefix(line, "||") && table.ChildCount() == 0 {
+			table.AppendChild(table, east.NewTableHeader(row))
+		} else {
+			table.AppendChild(table, row)
+		}
+	}
+	table.Alignments = make([]east.Alignment, columns)
+	for i := range table.Alignments {
+		table.Alignments[i] = east.AlignNone
+	}
+	parent.AppendChild(parent, table)
+	return i
+}
+
+// splitCells splits a row on `|` and `||`, except inside links, macros and
+// monospace, dropping the empty cell after the closing bar
+func splitCells(row string) []string {
+	var cells []string
+	var cell strings.Builder
+	depth := 0
+	for i := 0; i < len(row); i++ {
+		c := row[i]
+		switch {
+		case c == '\\' && i+1 < len(row):
+			cell.WriteString(row[i : i+2])
+			i++
+			continue
+		case c == '[' || c == '{':
+			depth++
+		case (c == ']' || c == '}') && depth > 0:
+			depth--
+		case c == '|' && depth == 0:
+			if i > 0 {
+				cells = append(cells, cell.String())
+			}
+			cell.Reset()
+			for i+1 < len(row) && row[i+1] == '|' {
+				i++
+			}
+			continue
+		}
+		cell.WriteByte(c)
+	}
+	if strings.TrimSpace(cell.String()) != "" {
+		cells = append(cells, cell.String())
+	}
+	return cells
+}
@@ -0,0 +1,42 @@
+package wiki
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	for _, tt := range []struct{ markup, storage string }{
+		{"h1. Title", "<h1>Title</h1>\n"},
+		{"Some *bold*, _em_, -strike-, +under+ and {{mono}}.", "<p>Some <strong>bold</strong>, <em>em</em>, <del>strike</del>, <u>under</u> and <code>mono</code>.</p>\n"},
+		{"a < b & c", "<p>a &lt; b &amp; c</p>\n"},
+		{"line\\\\break", "<p>line<br />\nbreak</p>\n"},
+		{"----", "<hr />\n"},
+		{"* one\n** nested\n* two", "<ul>\n<li>one\n<ul>\n<li>nested</li>\n</ul>\n</li>\n<li>two</li>\n</ul>\n"},
+		{"# first\n# second", "<ol>\n<li>first</li>\n<li>second</li>\n</ol>\n"},
+		{"||a||b||\n|1|2|", "<table>\n<thead>\n<tr>\n<th>a</th>\n<th>b</th>\n</tr>\n</thead>\n<tbody>\n<tr>\n<td>1</td>\n<td>2</td>\n</tr>\n</tbody>\n</table>\n"},
+		{"[Example|https://example.com] and [~jsmith]", `<p><a href="https://example.com">Example</a> and <ac:link><ri:user ri:username="jsmith" /></ac:link></p>` + "\n"},
+		{"!diagram.png!", `<p><ac:image><ri:attachment ri:filename="diagram.png" /></ac:image></p>` + "\n"},
+		{"{code:language=java|title=Main}\nclass A {}\n{code}", `<ac:structured-macro ac:name="code"><ac:parameter ac:name="language">java</ac:parameter><ac:parameter ac:name="title">Main</ac:parameter><ac:plain-text-body><![CDATA[class A {}]]></ac:plain-text-body></ac:structured-macro>` + "\n"},
+		// Languages are the code macro's own and are not aliased
+		{"{code:yaml}\na: 1\n{code}", `<ac:structured-macro ac:name="code"><ac:parameter ac:name="language">yaml</ac:parameter><ac:plain-text-body><![CDATA[a: 1]]></ac:plain-text-body></ac:structured-macro>` + "\n"},
+		{"{noformat}\nraw *text*\n{noformat}", `<ac:structured-macro ac:name="code"><ac:plain-text-body><![CDATA[raw *text*]]></ac:plain-text-body></ac:structured-macro>` + "\n"},
+		{"{quote}\nQuoted.\n{quote}", "<blockquote>\n<p>Quoted.</p>\n</blockquote>\n"},
+		{"{info:title=Heads up}\nBody.\n{info}", `<ac:structured-macro ac:name="info"><ac:parameter ac:name="title">Heads up</ac:parameter><ac:rich-text-body>` + "\n<p>Body.</p>\n</ac:rich-text-body></ac:structured-macro>\n"},
+		{"{expand:More}\nHidden.\n{expand}", `<ac:structured-macro ac:name="expand"><ac:parameter ac:name="title">More</ac:parameter><ac:rich-text-body>` + "\n<p>Hidden.</p>\n</ac:rich-text-body></ac:structured-macro>\n"},
+		{"{toc}", `<ac:structured-macro ac:name="toc"></ac:structured-macro>` + "\n"},
+		{"{status:colour=Green|title=DONE}", `<p><ac:structured-macro ac:name="status"><ac:parameter ac:name="colour">Green</ac:parameter><ac:parameter ac:name="title">DONE</ac:parameter></ac:structured-macro></p>` + "\n"},
+		{"{anchor:here}", `<p><ac:structured-macro ac:name="anchor"><ac:parameter ac:name="">here</ac:parameter></ac:structured-macro></p>` + "\n"},
+		// Unknown and unclosed macros stay text
+		{"{unknown:x=1}", "<p>{unknown:x=1}</p>\n"},
+		{"{info}\nNever closed.", "<p>{info}\nNever closed.</p>\n"},
+	} {
+		var buf bytes.Buffer
+		if err := Convert([]byte(tt.markup), &buf); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tt.storage {
+			t.Errorf("%q converted to\n%s\nwant\n%s", tt.markup, got, tt.storage)
+		}
+	}
+}
@@ -70,6 +70,12 @@ M.config = {
 	template_path = nil, -- Path to custom template file (optional)
 	-- Set to true for Chalk / backends where page URLs should not use /wiki prefix
 	scribe_no_wiki = false,
+	-- Route CLI calls through one long-lived `scribe-cli serve --stdio` process
+	use_server = true,
+	-- Serve space/page listings from scribe-cli's cache only (toggle with :ScribeOffline)
+	offline = false,
+	-- Config profile naming the instance to use (switch with :ScribeProfile); nil uses default_profile
+	profile = vim.env.SCRIBE_PROFILE,
 }
 
 function M.setup(opts)
@@ -107,22 +113,33 @@ function M.setup(opts)
 	-- Set environment variables for the CLI
 	vim.env.SCRIBE_URL = M.config.scribe_url
 	vim.env.SCRIBE_USERNAME = M.config.scribe_username
-	vim.env.SCRIBE_API_TOKEN = M.config.scribe_api_token
+	-- Tokens stored with `scribe-cli auth login` are found by the CLI itself
+	if M.config.scribe_api_token ~= "" then
+		vim.env.SCRIBE_API_TOKEN = M.config.scribe_api_token
+	end
 	if M.config.scribe_no_wiki then
 		vim.env.SCRIBE_PROVIDER = "chalk"
 	end
 
 	-- Validate configuration
-	if M.config.scribe_url == "" or M.config.scribe_api_token == "" then
+	if not M.config.profile and M.config.scribe_url == "" then
 		vim.notify(
-			"Confluence credentials not configured. Please set:\n"
-				.. "- scribe_url\n"
-				.. "- scribe_api_token\n"
-				.. "Or pass them in setup()",
+			"Confluence instance not configured. Please set:\n"
+				.. "- scribe_url (SCRIBE_URL)\n"
+				.. "Or pass it in setup(), or set a profile.\n"
+				.. "Store the API token with `scribe-cli auth login`",
 			vim.log.levels.WARN
 		)
 	end
 
+	if M.config.use_server then
+		vim.api.nvim_create_autocmd("VimLeavePre", {
+			callback = function()
+				require("scribe.rpc").stop()
+			end,
+		})
+	end
+
 	-- Create user commands
 	vim.api.nvim_create_user_command("ScribePush", function()
 		require("scribe.push").push_current_file()
@@ -152,6 +169,74 @@ function M.setup(opts)
 		require("scribe.new").create_new_doc_with_template()
 	end, { desc = "Create new document and select template" })
 
+	vim.api.nvim_create_user_command("ScribeOutboxFlush", function()
+		require("scribe.utils").execute_cli({ "outbox", "flush" }, function(result, err)
+			if err then
+				vim.notify("Outbox flush incomplete: " .. err, vim.log.levels.WARN)
+				return
+			end
+			vim.notify(string.format("Sent %d queued operation(s)", #(result or {})), vim.log.levels.INFO)
+		end)
+	end, { desc = "Send page updates queued while offline" })
+
+	vim.api.nvim_create_user_command("ScribeLint", function()
+		require("scribe.lint").lint_current_file()
+	end, { desc = "Check the current file for constructs Confluence will not keep" })
+
+	vim.api.nvim_create_user_command("ScribePreview", function()
+		require("scribe.preview").preview_current_file()
+	end, { desc = "Preview the current file in the browser, reloading on save" })
+
+	vim.api.nvim_create_user_command("ScribePreviewStop", function()
+		require("scribe.preview").stop()
+	end, { desc = "Stop the preview server" })
+
+	vim.api.nvim_create_autocmd("VimLeavePre", {
+		callback = function()
+			require("scribe.preview").stop()
+		end,
+	})
+
+	vim.api.nvim_create_user_command("ScribeOffline", function()
+		M.config.offline = not M.config.offline
+		-- The server picks up --offline when it is next spawned
+		require("scribe.rpc").stop()
+		vim.notify("Scribe offline mode " .. (M.config.offline and "on" or "off"), vim.log.levels.INFO)
+	end, { desc = "Toggle serving listings from the local cache only" })
+
+	vim.api.nvim_create_user_command("ScribeProfile", function(cmd)
+		local function use(name)
+			M.config.profile = name
+			-- The server picks up --profile when it is next spawned
+			require("scribe.rpc").stop()
+			vim.notify("Scribe profile " .. name, vim.log.levels.INFO)
+		end
+		if cmd.args ~= "" then
+			use(cmd.args)
+			return
+		end
+		vim.fn.jobstart({ M.config.scribe_cli_path, "profile", "list" }, {
+			stdout_buffered = true,
+			on_stdout = function(_, data)
+				local ok, profiles = pcall(vim.json.decode, table.concat(data, "\n"))
+				if not ok or type(profiles) ~= "table" or #profiles == 0 then
+					vim.notify("No profiles configured", vim.log.levels.WARN)
+					return
+				end
+				vim.ui.select(profiles, {
+					prompt = "Scribe profile",
+					format_item = function(p)
+						return p.name .. "  " .. p.url .. (p.current and "  (current)" or "")
+					end,
+				}, function(choice)
+					if choice then
+						use(choice.name)
+					end
+				end)
+			end,
+		})
+	end, { nargs = "?", desc = "Switch the configured instance Scribe talks to" })
+
 	vim.notify("scribe.nvim loaded successfully!", vim.log.levels.INFO)
 end
 
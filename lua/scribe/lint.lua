@@ -0,0 +1,52 @@
+local M = {}
+
+-- Lint the current file and load the issues into the quickfix list
+function M.lint_current_file()
+	local file = require("scribe.utils").get_current_file()
+	if file == "" then
+		vim.notify("No file in the current buffer", vim.log.levels.ERROR)
+		return
+	end
+
+	local function show(issues)
+		local items = {}
+		for _, issue in ipairs(issues) do
+			table.insert(items, {
+				filename = issue.file,
+				lnum = issue.line,
+				col = issue.column,
+				text = issue.message .. " [" .. issue.rule .. "]",
+				type = "W",
+			})
+		end
+		vim.fn.setqflist({}, " ", { title = "Scribe lint", items = items })
+		if #items == 0 then
+			vim.notify("No lint issues", vim.log.levels.INFO)
+		else
+			vim.cmd("copen")
+		end
+	end
+
+	local config = require("scribe").config
+	if config.use_server then
+		-- The server lints the buffer as it is, saved or not
+		local content = table.concat(vim.api.nvim_buf_get_lines(0, 0, -1, false), "\n") .. "\n"
+		require("scribe.rpc").request("lint", { file = file, content = content }, function(issues)
+			if type(issues) == "table" then
+				show(issues)
+			end
+		end)
+		return
+	end
+	vim.fn.jobstart({ config.scribe_cli_path, "lint", "--file", file, "--json" }, {
+		stdout_buffered = true,
+		on_stdout = function(_, data)
+			local ok, issues = pcall(vim.json.decode, table.concat(data, "\n"))
+			if ok and type(issues) == "table" then
+				show(issues)
+			end
+		end,
+	})
+end
+
+return M
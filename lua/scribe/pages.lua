@@ -99,7 +99,7 @@ function M.show_pages_picker(space_key, on_page_select)
 		:find()
 end
 
--- Prompt for query (Enter = blank = all pages), then show paginated list.
+-- Prompt for query (Enter = blank = all pages), then show every matching page.
 function M.prompt_then_show_pages(space_key, on_page_select)
 	local query = vim.fn.input("Query (Enter = all pages): ")
 	if query == nil then
@@ -112,16 +112,15 @@ end
 function M.show_pages_for_space(space_key, offset, query, on_page_select)
 	offset = offset or 0
 	query = query or ""
-	local limit = 100
 
 	local args = {
 		"page", "search", "--space", space_key,
 		"--query", query,
-		"--limit", tostring(limit),
 		"--offset", tostring(offset),
+		"--all",
 	}
 
-	vim.notify(string.format("Fetching pages %d-%d...", offset + 1, offset + limit), vim.log.levels.INFO)
+	vim.notify("Fetching pages...", vim.log.levels.INFO)
 	utils.execute_cli(args, function(result, err)
 		if err then
 			vim.notify("Failed to list pages: " .. err, vim.log.levels.ERROR)
@@ -132,26 +131,13 @@ function M.show_pages_for_space(space_key, offset, query, on_page_select)
 			return
 		end
 
-		local pages = (result.results and type(result.results) == "table" and result.results) or (type(result) == "table" and result) or {}
-		if type(pages) ~= "table" then
-			pages = {}
-		end
+		local pages = type(result) == "table" and result or {}
 		if #pages == 0 then
 			vim.notify("No pages found in space", vim.log.levels.INFO)
 			return
 		end
-		if #pages >= limit then
-			table.insert(pages, {
-				name = "➡️  Next Page...",
-				action = "next_page",
-				type = "system",
-			})
-		end
 
-		local current_offset = offset
-		local current_limit = limit
 		local current_space_key = space_key
-		local current_query = query
 		local current_on_select = on_page_select
 
 		pickers
@@ -163,13 +149,6 @@ function M.show_pages_for_space(space_key, offset, query, on_page_select)
 						if not entry or type(entry) ~= "table" then
 							return { value = {}, display = "?", ordinal = "?" }
 						end
-						if entry.action == "next_page" then
-							return {
-								value = entry,
-								display = entry.name or "➡️  Next Page...",
-								ordinal = "zzzz",
-							}
-						end
 						local version = (entry.version and type(entry.version) == "table" and entry.version.number) or 0
 						return {
 							value = entry,
@@ -186,9 +165,7 @@ function M.show_pages_for_space(space_key, offset, query, on_page_select)
 						if not selection or not selection.value then
 							return
 						end
-						if selection.value.action == "next_page" then
-							M.show_pages_for_space(current_space_key, current_offset + current_limit, current_query, current_on_select)
-						elseif selection.value.id or selection.value.title then
+						if selection.value.id or selection.value.title then
 							utils.save_favorites({ key = current_space_key })
 							utils.save_recent_page(selection.value, current_space_key)
 							if current_on_select then
@@ -214,7 +191,7 @@ function M.show_pages_for_space(space_key, offset, query, on_page_select)
 				end,
 			})
 			:find()
-	end)
+	end, { ndjson = true })
 end
 
 -- Open a page in the browser. page_obj can have _links.webui or id (and optionally title).
@@ -0,0 +1,73 @@
+local M = {}
+
+-- The running `scribe-cli preview` job and the file it serves
+local job = nil
+local job_file = nil
+
+function M.stop()
+	if job then
+		vim.fn.jobstop(job)
+		job = nil
+		job_file = nil
+	end
+end
+
+local function open_browser(url)
+	local open_cmd = vim.fn.has("mac") == 1 and "open" or "xdg-open"
+	vim.fn.jobstart({ open_cmd, url }, { detach = true })
+end
+
+-- Start a preview server for the current file and open it in the browser.
+-- The page reloads whenever the buffer is written.
+function M.preview_current_file()
+	local utils = require("scribe.utils")
+	local file = utils.get_current_file()
+	if file == "" then
+		vim.notify("No file in the current buffer", vim.log.levels.ERROR)
+		return
+	end
+	if job and job_file == file then
+		vim.notify("Preview already running for " .. vim.fn.fnamemodify(file, ":t"), vim.log.levels.INFO)
+		return
+	end
+	M.stop()
+
+	local config = require("scribe").config
+	local output = {}
+	local opened = false
+	job = vim.fn.jobstart({ config.scribe_cli_path, "preview", "--file", file }, {
+		on_stdout = function(_, data)
+			if opened then
+				return
+			end
+			vim.list_extend(output, data)
+			-- The server prints {"url": ...} once it is listening
+			local ok, result = pcall(vim.json.decode, table.concat(output, "\n"))
+			if ok and type(result) == "table" and result.url then
+				opened = true
+				open_browser(result.url)
+				vim.notify("Previewing at " .. result.url, vim.log.levels.INFO)
+			end
+		end,
+		on_stderr = function(_, data)
+			local message = table.concat(data, "\n")
+			if vim.trim(message) ~= "" then
+				vim.notify("Preview: " .. message, vim.log.levels.WARN)
+			end
+		end,
+		on_exit = function(id)
+			if job == id then
+				job = nil
+				job_file = nil
+			end
+		end,
+	})
+	if job <= 0 then
+		vim.notify("Failed to start scribe-cli preview", vim.log.levels.ERROR)
+		job = nil
+		return
+	end
+	job_file = file
+end
+
+return M
@@ -8,7 +8,7 @@ function M.pull_page()
 		if not space or not space.key then
 			return
 		end
-		-- Reuse pages picker: favorites first, then Search… with query + paginated list
+		-- Reuse pages picker: favorites first, then Search… with query + full result list
 		pages.show_pages_picker(space.key, function(page)
 			if not page or not page.id then
 				return
@@ -21,18 +21,27 @@ end
 function M.do_pull(space, page)
 	vim.notify("Fetching page content...", vim.log.levels.INFO)
 
+	local target_dir = vim.fn.expand("%:p:h")
+	if target_dir == "" or target_dir == "." then
+		target_dir = vim.fn.getcwd()
+	end
+
+	-- --dir lets links to pages already pulled alongside become relative file links
 	utils.execute_cli({
 		"page",
 		"get",
 		"--id",
 		page.id,
+		"--dir",
+		target_dir,
+		"--json",
 	}, function(result, err)
 		if err then
 			vim.notify("Failed to fetch page: " .. err, vim.log.levels.ERROR)
 			return
 		end
 
-		-- page get returns raw markdown on stdout (result may be string)
+		-- page get --json returns the markdown with the version it was converted at
 		local content = result
 		if type(content) ~= "string" then
 			content = type(result) == "table" and (result.content or result.body or "") or tostring(result or "")
@@ -44,10 +53,6 @@ function M.do_pull(space, page)
 			filename = "page-" .. page.id .. ".md"
 		end
 
-		local target_dir = vim.fn.expand("%:p:h")
-		if target_dir == "" or target_dir == "." then
-			target_dir = vim.fn.getcwd()
-		end
 		local filepath = target_dir .. "/" .. filename
 
 		local frontmatter = {
@@ -55,9 +60,19 @@ function M.do_pull(space, page)
 			string.format("confluence_page_id: %s", page.id),
 			string.format("confluence_space: %s", space.key),
 			string.format("confluence_title: %s", title),
-			"---",
-			"",
 		}
+		-- Recorded so updates go to the instance the page came from, as named by the CLI
+		local profile = type(result) == "table" and result.profile
+		if profile and profile ~= "" then
+			table.insert(frontmatter, string.format("confluence_profile: %s", profile))
+		end
+		-- Recorded so queued updates can detect that the page changed underneath them.
+		-- Taken from the fetch itself: the picker's listing may come from the cache.
+		local version = type(result) == "table" and result.version
+		if version and version ~= 0 then
+			table.insert(frontmatter, string.format("confluence_version: %s", version))
+		end
+		vim.list_extend(frontmatter, { "---", "" })
 		local content_lines = vim.split(content, "\n")
 		local all_lines = vim.list_extend(frontmatter, content_lines)
 
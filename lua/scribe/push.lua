@@ -71,6 +71,8 @@ function M.push_current_file()
 					confluence_page_id = result.id,
 					confluence_space = space.key,
 					confluence_title = title,
+					confluence_profile = result.profile ~= "" and result.profile or nil,
+					confluence_version = type(result.version) == "table" and result.version.number or nil,
 				})
 
 				-- Open in browser
@@ -0,0 +1,189 @@
+-- Client for `scribe-cli serve --stdio`: one long-lived process speaking
+-- JSON-RPC 2.0, one JSON document per line, shared by every picker and push.
+local M = {}
+
+local state = {
+	handle = nil,
+	stdin = nil,
+	next_id = 0,
+	pending = {},
+	buffer = "",
+}
+
+-- Flags that take no value on the command line
+local bool_flags = { all = true, queue = true, force = true, json = true }
+-- Flags whose values are numbers in the RPC params
+local number_flags = { limit = true, offset = true, base_version = true }
+
+local function fail_pending(message)
+	local pending = state.pending
+	state.pending = {}
+	for _, callback in pairs(pending) do
+		callback(nil, message)
+	end
+end
+
+local function handle_message(line)
+	local ok, msg = pcall(vim.json.decode, line)
+	if not ok or type(msg) ~= "table" then
+		return
+	end
+
+	if msg.method == "$/progress" and type(msg.params) == "table" then
+		vim.notify(msg.params.message or "", vim.log.levels.INFO)
+		return
+	end
+
+	local callback = msg.id and state.pending[msg.id]
+	if not callback then
+		return
+	end
+	state.pending[msg.id] = nil
+
+	if type(msg.error) == "table" then
+		-- -32001: queued in the outbox, to be sent by :ScribeOutboxFlush
+		local level = msg.error.code == -32001 and vim.log.levels.WARN or vim.log.levels.ERROR
+		vim.notify("Scribe CLI error: " .. (msg.error.message or "unknown error"), level)
+		callback(nil, msg.error.message or "unknown error")
+	else
+		callback(msg.result, nil)
+	end
+end
+
+local function start()
+	if state.handle then
+		return true
+	end
+
+	local config = require("scribe").config
+	local stdin = vim.loop.new_pipe(false)
+	local stdout = vim.loop.new_pipe(false)
+	local stderr = vim.loop.new_pipe(false)
+
+	local handle
+	local args = { "serve", "--stdio" }
+	if config.offline then
+		table.insert(args, "--offline")
+	end
+	if config.profile then
+		vim.list_extend(args, { "--profile", config.profile })
+	end
+
+	handle = vim.loop.spawn(config.scribe_cli_path, {
+		args = args,
+		stdio = { stdin, stdout, stderr },
+	}, function(code)
+		stdin:close()
+		stdout:close()
+		stderr:close()
+		handle:close()
+		vim.schedule(function()
+			state.handle = nil
+			state.stdin = nil
+			state.buffer = ""
+			fail_pending("scribe-cli server exited with code " .. tostring(code))
+		end)
+	end)
+
+	if not handle then
+		vim.notify("Failed to spawn scribe-cli server", vim.log.levels.ERROR)
+		return false
+	end
+	state.handle = handle
+	state.stdin = stdin
+
+	stdout:read_start(function(err, data)
+		if err then
+			vim.schedule(function()
+				vim.notify("Error reading scribe-cli server: " .. err, vim.log.levels.ERROR)
+			end)
+		end
+		if not data then
+			return
+		end
+		vim.schedule(function()
+			state.buffer = state.buffer .. data
+			while true do
+				local nl = state.buffer:find("\n", 1, true)
+				if not nl then
+					break
+				end
+				local line = state.buffer:sub(1, nl - 1)
+				state.buffer = state.buffer:sub(nl + 1)
+				handle_message(line)
+			end
+		end)
+	end)
+
+	stderr:read_start(function(_, data)
+		if data then
+			vim.schedule(function()
+				vim.notify("scribe-cli server: " .. data, vim.log.levels.WARN)
+			end)
+		end
+	end)
+
+	return true
+end
+
+-- Send a request; callback(result, err) runs on the main loop. Returns the request id.
+function M.request(method, params, callback)
+	if not start() then
+		callback(nil, "Failed to spawn process")
+		return nil
+	end
+	state.next_id = state.next_id + 1
+	local id = state.next_id
+	state.pending[id] = callback
+	state.stdin:write(vim.json.encode({
+		jsonrpc = "2.0",
+		id = id,
+		method = method,
+		params = next(params) and params or vim.empty_dict(),
+	}) .. "\n")
+	return id
+end
+
+-- Ask the server to abandon an in-flight request
+function M.cancel(id)
+	if not state.handle or not id then
+		return
+	end
+	state.stdin:write(vim.json.encode({
+		jsonrpc = "2.0",
+		method = "$/cancelRequest",
+		params = { id = id },
+	}) .. "\n")
+end
+
+-- Translate CLI-style args ({ "page", "get", "--id", "1" }) into an RPC call.
+-- Flag names become params with dashes turned into underscores.
+function M.execute(args, callback)
+	local method = args[1] .. "/" .. args[2]
+	local params = {}
+	local i = 3
+	while i <= #args do
+		local name = args[i]:gsub("^%-%-", ""):gsub("%-", "_")
+		if bool_flags[name] then
+			params[name] = true
+			i = i + 1
+		else
+			local value = args[i + 1]
+			if number_flags[name] then
+				value = tonumber(value)
+			end
+			params[name] = value
+			i = i + 2
+		end
+	end
+	return M.request(method, params, callback)
+end
+
+function M.stop()
+	if state.handle then
+		state.stdin:write(vim.json.encode({ jsonrpc = "2.0", id = 0, method = "shutdown" }) .. "\n")
+		state.stdin:shutdown()
+	end
+end
+
+return M
@@ -127,15 +127,15 @@ function M.list_spaces()
 	end)
 end
 
--- offset: optional, for pagination. on_select: optional; when user picks a space, call on_select(space). If nil, default is show_pages_for_space.
+-- offset: optional, first result to fetch (the CLI streams everything after it with --all).
+-- on_select: optional; when user picks a space, call on_select(space). If nil, default is show_pages_for_space.
 function M.search_all_spaces(offset, query, on_select)
 	offset = offset or 0
 	query = query or ""
-	local limit = 100
 
-	vim.notify(string.format("Fetching spaces %d-%d...", offset, offset + limit), vim.log.levels.INFO)
+	vim.notify("Fetching spaces...", vim.log.levels.INFO)
 
-	local args = { "spaces", "list", "--limit", tostring(limit), "--offset", tostring(offset) }
+	local args = { "spaces", "list", "--all", "--offset", tostring(offset) }
 	if query ~= "" then
 		table.insert(args, "--query")
 		table.insert(args, query)
@@ -147,7 +147,7 @@ function M.search_all_spaces(offset, query, on_select)
 			return
 		end
 
-		local entries = result.results or result
+		local entries = result
 		if type(entries) ~= "table" then
 			entries = {}
 		end
@@ -156,17 +156,6 @@ function M.search_all_spaces(offset, query, on_select)
 			return
 		end
 
-		if #entries >= limit then
-			table.insert(entries, {
-				name = "➡️  Next Page...",
-				action = "next_page",
-				type = "system",
-				ordinal = "zzzz",
-			})
-		end
-		local current_offset = offset
-		local current_query = query
-
 		pickers
 			.new({}, {
 				prompt_title = query == " " and "All Spaces" or ("Spaces matching: " .. query),
@@ -176,13 +165,6 @@ function M.search_all_spaces(offset, query, on_select)
 						if not entry or type(entry) ~= "table" then
 							return { value = {}, display = "?", ordinal = "?" }
 						end
-						if entry.action == "next_page" then
-							return {
-								value = entry,
-								display = entry.name or "➡️  Next Page...",
-								ordinal = "zzzz",
-							}
-						end
 						local name = entry.name or "?"
 						local key = entry.key or "?"
 						local type_label = entry.type == "personal" and " (Personal)" or ""
@@ -201,9 +183,7 @@ function M.search_all_spaces(offset, query, on_select)
 						if not selection or not selection.value then
 							return
 						end
-						if selection.value.action == "next_page" then
-							M.search_all_spaces(current_offset + limit, current_query, on_select)
-						elseif selection.value.key then
+						if selection.value.key then
 							utils.save_favorites(selection.value)
 							if on_select then
 								on_select(selection.value)
@@ -225,7 +205,7 @@ function M.search_all_spaces(offset, query, on_select)
 				end,
 			})
 			:find()
-	end)
+	end, { ndjson = true })
 end
 
 return M
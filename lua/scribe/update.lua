@@ -40,6 +40,11 @@ function M.update_current_file()
 
 		vim.notify("Page updated successfully!", vim.log.levels.INFO)
 
+		if type(result.version) == "table" and result.version.number then
+			frontmatter.confluence_version = result.version.number
+			utils.update_frontmatter(frontmatter)
+		end
+
 		-- Open in browser
 		local open_cmd = vim.fn.has("mac") == 1 and "open" or "xdg-open"
 		local webui = (result._links and result._links.webui) or (result._link and result._link.webui) or ""
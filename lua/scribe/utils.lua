@@ -164,11 +164,35 @@ function M.add_page_favorite(page_obj, space_key)
 	write_favorites(data)
 end
 
--- Execute confluence-cli command and return parsed JSON
-function M.execute_cli(args, callback)
+-- Decode newline-delimited JSON (one document per line, as written by --all) into a list
+local function decode_ndjson(data)
+	local items = {}
+	for line in data:gmatch("[^\n]+") do
+		local ok, item = pcall(vim.json.decode, line)
+		if not ok then
+			return nil
+		end
+		table.insert(items, item)
+	end
+	return items
+end
+
+-- Execute confluence-cli command and return parsed JSON.
+-- opts.ndjson: decode stdout as newline-delimited JSON and return a list
+-- With config.use_server the call goes to the shared `scribe-cli serve` process instead.
+function M.execute_cli(args, callback, opts)
+	opts = opts or {}
 	local config = require("scribe").config
+	if config.use_server then
+		require("scribe.rpc").execute(args, callback)
+		return
+	end
 	local cmd = config.scribe_cli_path
-	local full_args = vim.list_extend({}, args)
+	local full_args = config.offline and { "--offline" } or {}
+	if config.profile then
+		vim.list_extend(full_args, { "--profile", config.profile })
+	end
+	vim.list_extend(full_args, args)
 
 	local stdout = vim.loop.new_pipe(false)
 	local stderr = vim.loop.new_pipe(false)
@@ -194,6 +218,21 @@ function M.execute_cli(args, callback)
 				return
 			end
 
+			-- Warnings (e.g. unresolvable links) come on stderr of a successful run
+			if stderr_data ~= "" then
+				vim.notify(stderr_data, vim.log.levels.WARN)
+			end
+
+			if opts.ndjson then
+				local items = decode_ndjson(stdout_data)
+				if items then
+					callback(items, nil)
+				else
+					callback(nil, "Invalid NDJSON output from scribe-cli")
+				end
+				return
+			end
+
 			local success, result = pcall(vim.json.decode, stdout_data)
 			if success then
 				callback(result, nil)